@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+)
+
+// acceptResponse checks that a message received for the query is its response: the QR bit is set,
+// the ID matches and the question section echoes the query's. With matchCase the names must match
+// byte for byte, as 0x20 encoding relies on; otherwise their case is ignored. A FORMERR without a
+// question section is accepted, since servers can't echo questions they failed to parse.
+func acceptResponse(query, res *DnsPacket, matchCase bool) error {
+	if !res.Header.Response {
+		return fmt.Errorf("%w: QR bit not set", ErrMismatchedResponse)
+	}
+	if res.Header.ID != query.Header.ID {
+		return fmt.Errorf("%w: ID %d, expected %d", ErrMismatchedResponse, res.Header.ID, query.Header.ID)
+	}
+	if len(res.Questions) == 0 && res.Header.ResCode == FORMERR {
+		return nil
+	}
+	if len(res.Questions) != len(query.Questions) {
+		return fmt.Errorf("%w: %d questions, expected %d", ErrMismatchedResponse, len(res.Questions), len(query.Questions))
+	}
+	for i, q := range query.Questions {
+		r := res.Questions[i]
+		if r.Qtype != q.Qtype || r.Qclass != q.Qclass || !sameQuestionName(r.Name, q.Name, matchCase) {
+			return fmt.Errorf("%w: question %s %s, expected %s %s", ErrMismatchedResponse, r.Name, QueryType(r.Qtype), q.Name, QueryType(q.Qtype))
+		}
+	}
+	return nil
+}
+
+// sameQuestionName compares two names in presentation format, optionally including letter case
+func sameQuestionName(a, b string, matchCase bool) bool {
+	an, bn := parseNameLoose(a), parseNameLoose(b)
+	if matchCase {
+		return string(an.Wire()) == string(bn.Wire())
+	}
+	return an.Equal(bn)
+}
+
+// sameAddr reports whether a datagram came from the address the query was sent to
+func sameAddr(from, to net.Addr) bool {
+	f, ok1 := from.(*net.UDPAddr)
+	t, ok2 := to.(*net.UDPAddr)
+	if !ok1 || !ok2 {
+		return from.String() == to.String()
+	}
+	return f.Port == t.Port && f.IP.Equal(t.IP)
+}
+
+// randomizeCase returns a copy of the query whose question names have randomly mixed letter case
+// (draft-vixie-dnsext-dns0x20), adding bits a spoofed response has to guess. The query itself and
+// its questions are left unchanged.
+func randomizeCase(query *DnsPacket) *DnsPacket {
+	wire := *query
+	wire.Questions = make([]*DnsQuestion, len(query.Questions))
+	for i, q := range query.Questions {
+		mixed := *q
+		name := []byte(q.Name)
+		bits := make([]byte, len(name))
+		rand.Read(bits)
+		for j, c := range name {
+			if lower := c | 0x20; lower >= 'a' && lower <= 'z' {
+				name[j] = lower &^ (bits[j] & 1 << 5)
+			}
+		}
+		mixed.Name = string(name)
+		wire.Questions[i] = &mixed
+	}
+	return &wire
+}
+
+// restoreCase puts the query's names back into a response to its randomizeCase copy, in the
+// question section and on records owned by a mixed case name
+func restoreCase(res, wire, query *DnsPacket) {
+	names := make(map[string]string)
+	for i, q := range wire.Questions {
+		names[q.Name] = query.Questions[i].Name
+	}
+	for _, q := range res.Questions {
+		if name, ok := names[q.Name]; ok {
+			q.Name = name
+		}
+	}
+	for _, section := range [][]*DnsRecord{res.Answers, res.Authorities, res.Resources} {
+		for _, rec := range section {
+			if name, ok := names[rec.Name]; ok {
+				rec.Name = name
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Roles that can be granted to clients
+const (
+	RoleRecurse  = "recurse"  // May send queries with recursion desired
+	RoleTransfer = "transfer" // May request zone transfers
+)
+
+// ACL maps client certificate identities to the roles they hold
+type ACL struct {
+	Identities map[string][]string // Roles per identity: a subject CN, DNS name, email or URI SAN
+	Default    []string            // Roles of clients without a matching identity, including plain UDP and TCP
+}
+
+// LoadACL reads an ACL file holding one "identity role[,role...]" entry per line. The identity "*"
+// sets the default roles; lines starting with # are comments.
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	acl := &ACL{Identities: make(map[string][]string)}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected identity and roles", path, line)
+		}
+		roles := strings.Split(fields[1], ",")
+		for _, role := range roles {
+			if role != RoleRecurse && role != RoleTransfer {
+				return nil, fmt.Errorf("%s:%d: unknown role %q", path, line, role)
+			}
+		}
+		if fields[0] == "*" {
+			acl.Default = append(acl.Default, roles...)
+		} else {
+			acl.Identities[fields[0]] = append(acl.Identities[fields[0]], roles...)
+		}
+	}
+	return acl, scanner.Err()
+}
+
+// Roles returns the roles held by the client that sent req
+func (a *ACL) Roles(req *Request) map[string]bool {
+	roles := make(map[string]bool)
+	for _, role := range a.Default {
+		roles[role] = true
+	}
+	for _, id := range ClientIdentities(req.TLS) {
+		for _, role := range a.Identities[id] {
+			roles[role] = true
+		}
+	}
+	return roles
+}
+
+// ClientIdentities lists the identities in a verified client certificate, or nothing if the client
+// didn't authenticate
+func ClientIdentities(state *tls.ConnectionState) []string {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+	var ids []string
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		ids = append(ids, uri.String())
+	}
+	return ids
+}
+
+// ACLHandler refuses queries the client's roles don't allow before passing them to the next handler
+type ACLHandler struct {
+	Next Handler
+	ACL  *ACL
+}
+
+// ServeDNS answers REFUSED to recursive queries without the recurse role and zone transfers without
+// the transfer role
+func (h *ACLHandler) ServeDNS(req *Request) *DnsPacket {
+	roles := h.ACL.Roles(req)
+	for _, q := range req.Packet.Questions {
+		qtype := QueryType(q.Qtype)
+		if (qtype == QTYPE_AXFR || qtype == QTYPE_IXFR) && !roles[RoleTransfer] {
+			return NewErrorResponse(req.Packet, REFUSED)
+		}
+	}
+	if req.Packet.Header.RecursionDesired && !roles[RoleRecurse] {
+		return NewErrorResponse(req.Packet, REFUSED)
+	}
+	return h.Next.ServeDNS(req)
+}
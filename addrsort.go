@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// AddrPreference chooses how LookupIP orders the addresses it returns
+type AddrPreference int
+
+const (
+	PreferRFC6724 AddrPreference = iota // Destination address selection rules of RFC 6724
+	PreferIPv4                          // IPv4 addresses first, each family in RFC 6724 order
+	PreferIPv6                          // IPv6 addresses first, each family in RFC 6724 order
+)
+
+// LookupIP resolves host to its IPv4 and IPv6 addresses using the system resolver
+func LookupIP(host string) ([]net.IP, error) {
+	return NewClient().LookupIP(host, SystemResolver())
+}
+
+// LookupIP queries the server for the A and AAAA records of host in parallel and returns the
+// addresses sorted by the client's AddrPreference, so the first is the one to dial first. It only
+// fails when neither lookup succeeds.
+func (c *Client) LookupIP(host, server string) ([]net.IP, error) {
+	type result struct {
+		addrs []net.IP
+		err   error
+	}
+	qtypes := []QueryType{QTYPE_A, QTYPE_AAAA}
+	results := make([]chan result, len(qtypes))
+	for i, qtype := range qtypes {
+		results[i] = make(chan result, 1)
+		go func(qtype QueryType, out chan<- result) {
+			res, err := c.Lookup(host, qtype, server)
+			if err == nil {
+				err = checkRcode(res)
+			}
+			if err != nil {
+				out <- result{err: err}
+				return
+			}
+			var addrs []net.IP
+			for _, rec := range res.Answers {
+				if addr := addrOf(rec.Data); addr != nil && rec.Qtype == qtype {
+					addrs = append(addrs, addr)
+				}
+			}
+			out <- result{addrs: addrs}
+		}(qtype, results[i])
+	}
+
+	var addrs []net.IP
+	var errs []error
+	for _, ch := range results {
+		r := <-ch
+		addrs = append(addrs, r.addrs...)
+		if r.err != nil {
+			errs = append(errs, r.err)
+		}
+	}
+	if len(errs) == len(qtypes) {
+		return nil, errs[0]
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s: no addresses", host)
+	}
+	SortAddrs(addrs, c.AddrPreference)
+	return addrs, nil
+}
+
+// SortAddrs orders destination addresses by the rules of RFC 6724 section 6 that apply without
+// knowledge of the host's address states, using the source address the routing table would pick for
+// each. With PreferIPv4 or PreferIPv6 the chosen family comes first regardless of the other rules.
+func SortAddrs(addrs []net.IP, pref AddrPreference) {
+	sources := make([]net.IP, len(addrs))
+	for i, dst := range addrs {
+		sources[i] = sourceAddr(dst)
+	}
+	dests := make([]destination, len(addrs))
+	for i := range addrs {
+		dests[i] = destination{addrs[i], sources[i]}
+	}
+	sort.SliceStable(dests, func(i, j int) bool {
+		return dests[i].before(dests[j], pref)
+	})
+	for i, d := range dests {
+		addrs[i] = d.addr
+	}
+}
+
+// destination is an address to sort with the source address that would be used to reach it
+type destination struct {
+	addr   net.IP
+	source net.IP // nil if the destination is unreachable
+}
+
+// before reports whether d should be tried before o
+func (d destination) before(o destination, pref AddrPreference) bool {
+	if pref != PreferRFC6724 {
+		d4, o4 := d.addr.To4() != nil, o.addr.To4() != nil
+		if d4 != o4 {
+			return d4 == (pref == PreferIPv4)
+		}
+	}
+	// Rule 1: avoid unusable destinations
+	if (d.source == nil) != (o.source == nil) {
+		return d.source != nil
+	}
+	if d.source == nil {
+		return false
+	}
+	// Rule 2: prefer matching scope
+	dScope, oScope := addrScope(d.addr), addrScope(o.addr)
+	dMatch, oMatch := dScope == addrScope(d.source), oScope == addrScope(o.source)
+	if dMatch != oMatch {
+		return dMatch
+	}
+	// Rule 5: prefer matching label
+	dPolicy, oPolicy := classify(d.addr), classify(o.addr)
+	dLabel, oLabel := dPolicy.label == classify(d.source).label, oPolicy.label == classify(o.source).label
+	if dLabel != oLabel {
+		return dLabel
+	}
+	// Rule 6: prefer higher precedence
+	if dPolicy.precedence != oPolicy.precedence {
+		return dPolicy.precedence > oPolicy.precedence
+	}
+	// Rule 8: prefer smaller scope
+	if dScope != oScope {
+		return dScope < oScope
+	}
+	// Rule 9: use longest matching prefix, for IPv6 only as IPv4 prefixes say little about topology
+	if d.addr.To4() == nil && o.addr.To4() == nil {
+		return commonPrefixLen(d.source, d.addr) > commonPrefixLen(o.source, o.addr)
+	}
+	// Rule 10: otherwise leave the order unchanged
+	return false
+}
+
+// sourceAddr returns the local address the system would use to reach dst, or nil if there is no
+// route. Connecting a UDP socket only consults the routing table; nothing is sent.
+func sourceAddr(dst net.IP) net.IP {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dst, Port: 9})
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// Address scopes of RFC 4291 section 2.7, with IPv4 mapped as in RFC 6724 section 3.2
+const (
+	scopeInterfaceLocal = 0x1
+	scopeLinkLocal      = 0x2
+	scopeSiteLocal      = 0x5
+	scopeGlobal         = 0xe
+)
+
+// addrScope returns the scope of an address
+func addrScope(ip net.IP) int {
+	if ip4 := ip.To4(); ip4 != nil {
+		if ip4.IsLoopback() || ip4.IsLinkLocalUnicast() {
+			return scopeLinkLocal
+		}
+		return scopeGlobal
+	}
+	switch {
+	case ip.IsMulticast():
+		return int(ip[1] & 0x0f)
+	case ip.IsLoopback(), ip.IsLinkLocalUnicast():
+		return scopeLinkLocal
+	case ip[0] == 0xfe && ip[1]&0xc0 == 0xc0:
+		return scopeSiteLocal
+	}
+	return scopeGlobal
+}
+
+// policy is an entry of the RFC 6724 default policy table
+type policy struct {
+	prefix     *net.IPNet
+	precedence int
+	label      int
+}
+
+// policyTable is the default policy table of RFC 6724 section 2.1, longest prefixes first
+var policyTable = func() []policy {
+	entries := []struct {
+		cidr              string
+		precedence, label int
+	}{
+		{"::1/128", 50, 0},
+		{"::ffff:0:0/96", 35, 4},
+		{"::/96", 1, 3},
+		{"2001::/32", 5, 5},
+		{"2002::/16", 30, 2},
+		{"3ffe::/16", 1, 12},
+		{"fec0::/10", 1, 11},
+		{"fc00::/7", 3, 13},
+		{"::/0", 40, 1},
+	}
+	table := make([]policy, len(entries))
+	for i, e := range entries {
+		_, prefix, _ := net.ParseCIDR(e.cidr)
+		table[i] = policy{prefix, e.precedence, e.label}
+	}
+	return table
+}()
+
+// classify returns the policy table entry matching an address, IPv4 addresses as IPv4-mapped IPv6
+func classify(ip net.IP) policy {
+	ip16 := ip.To16()
+	for _, p := range policyTable {
+		if p.prefix.Contains(ip16) {
+			return p
+		}
+	}
+	return policyTable[len(policyTable)-1]
+}
+
+// commonPrefixLen returns the number of leading bits two IPv6 addresses share, up to the 64 bit
+// prefix length RFC 6724 section 2.2 limits the comparison to
+func commonPrefixLen(a, b net.IP) int {
+	a, b = a.To16(), b.To16()
+	n := 0
+	for i := 0; i < 8; i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	return n
+}
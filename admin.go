@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Pausable is a handler whose blocking can be turned off and back on
+type Pausable interface {
+	SetPaused(paused bool)
+	Paused() bool
+}
+
+// AdminAPI is an HTTP JSON API for editing the zones in a zone store. Edits are applied to the
+// served zones as soon as they are stored.
+type AdminAPI struct {
+	Store     *SQLiteZoneStore // Zone store edited through the API; nil leaves out the zone routes
+	Authority *Authority
+	Stats     *QueryStats       // Query counts served under /stats and in the web UI; nil leaves them out
+	History   *StatsDB          // Query history served under /history; nil leaves out the route
+	Caching   *CachingHandler   // Cache reported and flushed under /cache; nil leaves out the routes
+	Blocking  []Pausable        // Blocklists and policies paused and resumed under /blocking; none leaves out the routes
+	Upstreams *OutstandingTable // Queries outstanding to upstreams, served under /upstreams; nil leaves out the route
+	Debug     bool              // Also serve /debug/pprof/ profiles and /debug/vars
+}
+
+// Handler returns the API's routes:
+//
+//	GET    /zones                          list zones
+//	POST   /zones                          create a zone from {"origin": "..."}
+//	DELETE /zones/{origin}                 delete a zone
+//	GET    /zones/{origin}/records         list a zone's records
+//	POST   /zones/{origin}/records         add a record from {"name", "type", "ttl", "data"}
+//	DELETE /zones/{origin}/records/{id}    delete a record
+//	GET    /zones/{origin}/zone            a served zone as a master file
+//	GET    /zones/{origin}/journal         a journaled zone's changes, oldest first
+//	POST   /zones/{origin}/rollback        return a journaled zone to an earlier version from {"serial": n}
+//	GET    /                               web UI with query graphs, recent queries and controls
+//	GET    /stats?window=1h&top=10         query totals, top clients and names, timeline and latest queries
+//	GET    /history?days=30&by=day         queries and blocked queries per day or hour
+//	GET    /cache                          cache entries, hits and misses
+//	POST   /cache/flush                    empty the cache
+//	GET    /blocking                       whether blocklists and policies apply, as {"enabled": true}
+//	PUT    /blocking                       pause or resume blocklists and policies from {"enabled": false}
+//	GET    /upstreams                      queries in flight and queued per upstream
+//	GET    /debug/pprof/                   runtime profiles, with Debug
+//	GET    /debug/vars                     goroutines, heap, cache and zone sizes as JSON, with Debug
+//
+// POST requests must be sent as application/json, even /cache/flush which takes no body. Browsers
+// only send that content type cross-origin after a preflight, which the API never answers, so other
+// sites can't make a visitor's browser edit zones or flush the cache.
+func (a *AdminAPI) Handler() http.Handler {
+	mux := http.NewServeMux()
+	if a.Store != nil {
+		mux.HandleFunc("GET /zones", a.listZones)
+		mux.HandleFunc("POST /zones", requireJSON(a.createZone))
+		mux.HandleFunc("DELETE /zones/{origin}", a.deleteZone)
+		mux.HandleFunc("GET /zones/{origin}/records", a.listRecords)
+		mux.HandleFunc("POST /zones/{origin}/records", requireJSON(a.addRecord))
+		mux.HandleFunc("DELETE /zones/{origin}/records/{id}", a.deleteRecord)
+		mux.HandleFunc("POST /zones/{origin}/rollback", requireJSON(a.rollback))
+	}
+	if a.Authority != nil {
+		mux.HandleFunc("GET /zones/{origin}/zone", a.zoneFile)
+		mux.HandleFunc("GET /zones/{origin}/journal", a.journal)
+	}
+	if a.Stats != nil {
+		mux.HandleFunc("GET /{$}", serveUI)
+		mux.HandleFunc("GET /stats", a.stats)
+	}
+	if a.History != nil {
+		mux.HandleFunc("GET /history", a.history)
+	}
+	if a.Caching != nil {
+		mux.HandleFunc("GET /cache", a.cacheInfo)
+		mux.HandleFunc("POST /cache/flush", requireJSON(a.flushCache))
+	}
+	if len(a.Blocking) > 0 {
+		mux.HandleFunc("GET /blocking", a.blocking)
+		mux.HandleFunc("PUT /blocking", a.setBlocking)
+	}
+	if a.Upstreams != nil {
+		mux.HandleFunc("GET /upstreams", a.upstreams)
+	}
+	if a.Debug {
+		handleDebug(mux)
+	}
+	return mux
+}
+
+// ListenAndServe serves the API on addr
+func (a *AdminAPI) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, a.Handler())
+}
+
+// requireJSON rejects requests whose body isn't declared as JSON before passing them to h
+func requireJSON(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			http.Error(w, "expected Content-Type: application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (a *AdminAPI) listZones(w http.ResponseWriter, r *http.Request) {
+	origins, err := a.Store.Zones()
+	a.reply(w, http.StatusOK, origins, err)
+}
+
+func (a *AdminAPI) createZone(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Origin string `json:"origin"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Origin == "" {
+		http.Error(w, "expected {\"origin\": \"...\"}", http.StatusBadRequest)
+		return
+	}
+	a.reply(w, http.StatusCreated, body, a.apply(a.Store.CreateZone(body.Origin)))
+}
+
+func (a *AdminAPI) deleteZone(w http.ResponseWriter, r *http.Request) {
+	a.reply(w, http.StatusNoContent, nil, a.apply(a.Store.DeleteZone(r.PathValue("origin"))))
+}
+
+func (a *AdminAPI) listRecords(w http.ResponseWriter, r *http.Request) {
+	records, err := a.Store.Records(r.PathValue("origin"))
+	a.reply(w, http.StatusOK, records, err)
+}
+
+func (a *AdminAPI) addRecord(w http.ResponseWriter, r *http.Request) {
+	rec := &StoredRecord{TTL: 3600}
+	if err := json.NewDecoder(r.Body).Decode(rec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err := a.Store.AddRecord(r.PathValue("origin"), rec)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.reply(w, http.StatusCreated, rec, a.apply(err))
+}
+
+func (a *AdminAPI) deleteRecord(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid record ID", http.StatusBadRequest)
+		return
+	}
+	a.reply(w, http.StatusNoContent, nil, a.apply(a.Store.DeleteRecord(r.PathValue("origin"), id)))
+}
+
+func (a *AdminAPI) stats(w http.ResponseWriter, r *http.Request) {
+	window, top := statsHistory*statsInterval, 10
+	if s := r.URL.Query().Get("window"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < statsInterval || d > statsHistory*statsInterval {
+			http.Error(w, "window must be a duration between 1m and 1h", http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+	if s := r.URL.Query().Get("top"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "top must be a positive number", http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+	a.reply(w, http.StatusOK, a.Stats.Summary(window, top, time.Now()), nil)
+}
+
+func (a *AdminAPI) history(w http.ResponseWriter, r *http.Request) {
+	days, period := 30, 24*time.Hour
+	if s := r.URL.Query().Get("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "days must be a positive number", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	switch r.URL.Query().Get("by") {
+	case "", "day":
+	case "hour":
+		period = time.Hour
+	default:
+		http.Error(w, "by must be day or hour", http.StatusBadRequest)
+		return
+	}
+	since := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-days)
+	history, err := a.History.History(since, period)
+	a.reply(w, http.StatusOK, history, err)
+}
+
+func (a *AdminAPI) cacheInfo(w http.ResponseWriter, r *http.Request) {
+	var info struct {
+		Entries *int  `json:"entries"` // Null for caches kept outside the process
+		Hits    int64 `json:"hits"`
+		Misses  int64 `json:"misses"`
+	}
+	info.Hits, info.Misses = a.Caching.Counts()
+	if c, ok := a.Caching.Cache.(*MemoryCache); ok {
+		n := c.Len()
+		info.Entries = &n
+	}
+	a.reply(w, http.StatusOK, info, nil)
+}
+
+func (a *AdminAPI) flushCache(w http.ResponseWriter, r *http.Request) {
+	c, ok := a.Caching.Cache.(*MemoryCache)
+	if !ok {
+		http.Error(w, "only the in-memory cache can be flushed", http.StatusNotImplemented)
+		return
+	}
+	c.Flush()
+	log.Print("admin: cache flushed")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *AdminAPI) upstreams(w http.ResponseWriter, r *http.Request) {
+	a.reply(w, http.StatusOK, a.Upstreams.Loads(), nil)
+}
+
+// blockingState is the body of the /blocking routes
+type blockingState struct {
+	Enabled bool `json:"enabled"`
+}
+
+func (a *AdminAPI) blocking(w http.ResponseWriter, r *http.Request) {
+	a.reply(w, http.StatusOK, blockingState{!a.Blocking[0].Paused()}, nil)
+}
+
+func (a *AdminAPI) setBlocking(w http.ResponseWriter, r *http.Request) {
+	var body blockingState
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "expected {\"enabled\": true or false}", http.StatusBadRequest)
+		return
+	}
+	for _, b := range a.Blocking {
+		b.SetPaused(!body.Enabled)
+	}
+	log.Printf("admin: blocking enabled: %t", body.Enabled)
+	a.reply(w, http.StatusOK, body, nil)
+}
+
+// apply syncs the served zones after a successful edit, passing through the edit's error
+func (a *AdminAPI) zoneFile(w http.ResponseWriter, r *http.Request) {
+	zone := a.Authority.Zone(r.PathValue("origin"))
+	if zone == nil {
+		http.Error(w, "zone not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/dns")
+	zone.WriteTo(w)
+}
+
+// journalEntry is a zone change as listed by the API
+type journalEntry struct {
+	Time    time.Time `json:"time"`
+	From    uint32    `json:"from"`
+	To      uint32    `json:"to"`
+	Deleted []string  `json:"deleted"`
+	Added   []string  `json:"added"`
+}
+
+func (a *AdminAPI) journal(w http.ResponseWriter, r *http.Request) {
+	j, err := a.zoneJournal(r.PathValue("origin"))
+	if err != nil {
+		a.reply(w, http.StatusOK, nil, err)
+		return
+	}
+	entries := []*journalEntry{}
+	for _, c := range j.Changes() {
+		e := &journalEntry{Time: c.Time, From: c.From(), To: c.To()}
+		for _, rec := range c.Deleted {
+			e.Deleted = append(e.Deleted, rec.String())
+		}
+		for _, rec := range c.Added {
+			e.Added = append(e.Added, rec.String())
+		}
+		entries = append(entries, e)
+	}
+	a.reply(w, http.StatusOK, entries, nil)
+}
+
+func (a *AdminAPI) rollback(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Serial *uint32 `json:"serial"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Serial == nil {
+		http.Error(w, "expected {\"serial\": n}", http.StatusBadRequest)
+		return
+	}
+	origin := r.PathValue("origin")
+	j, err := a.zoneJournal(origin)
+	if err != nil {
+		a.reply(w, http.StatusOK, nil, err)
+		return
+	}
+	records, err := j.Revert(a.Authority.Zone(origin).Records(), *req.Serial)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	err = a.apply(a.Store.ReplaceRecords(origin, records))
+	if err != nil {
+		a.reply(w, http.StatusOK, nil, err)
+		return
+	}
+	serial := uint32(0)
+	if soa := a.Authority.Zone(origin).soa(); soa != nil {
+		serial = serialOf(soa.Data)
+	}
+	a.reply(w, http.StatusOK, map[string]uint32{"serial": serial}, nil)
+}
+
+// zoneJournal returns the journal of a served zone
+func (a *AdminAPI) zoneJournal(origin string) (*ZoneJournal, error) {
+	zone := a.Authority.Zone(origin)
+	if zone == nil || zone.Journal() == nil {
+		return nil, fmt.Errorf("zone %s: %w", origin, ErrNotFound)
+	}
+	return zone.Journal(), nil
+}
+
+func (a *AdminAPI) apply(err error) error {
+	if err != nil {
+		return err
+	}
+	if err := a.Store.Sync(a.Authority); err != nil {
+		log.Printf("admin: zone sync: %v", err)
+	}
+	return nil
+}
+
+// reply writes v as JSON with the given status, or the error if there was one
+func (a *AdminAPI) reply(w http.ResponseWriter, status int, v any, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	case v == nil:
+		w.WriteHeader(status)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// testList parses blocklist rules, failing the test on errors
+func testList(t *testing.T, rules ...string) *Blocklist {
+	t.Helper()
+	l, err := ParseBlocklist(strings.NewReader(strings.Join(rules, "\n")), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// testSource serves a fixed list as a BlocklistSource
+func testSource(l *Blocklist) *BlocklistSource {
+	s := &BlocklistSource{}
+	s.list.Store(l)
+	return s
+}
+
+// testPolicy builds a policy from rule lines of action, clients, suffix and qtype
+func testPolicy(t *testing.T, lines ...string) *Policy {
+	t.Helper()
+	p := &Policy{}
+	for _, line := range lines {
+		rule, err := parsePolicyRule(strings.Fields(line), map[string]*ClientSet{"*": {Any: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Rules = append(p.Rules, rule)
+	}
+	return p
+}
+
+// TestAllowlistPrecedence checks that allowlists, the server's and the client group's, win over
+// blocklists, which win over policy rules, when their names overlap
+func TestAllowlistPrecedence(t *testing.T) {
+	kids := &ClientGroup{
+		Name:      "kids",
+		Clients:   parseClientSet("10.0.0.0/24"),
+		Allowlist: testList(t, "ads.example", "x.a.example", "chess.games.example"),
+		Policy:    testPolicy(t, "refuse * games.example *"),
+	}
+	var handler Handler = HandlerFunc(func(req *Request) *DnsPacket { return NewResponse(req.Packet) })
+	handler = &PolicyHandler{Next: handler, Policy: testPolicy(t, "refuse * a.example *", "refuse * safe.example *")}
+	handler = &BlocklistHandler{
+		Next:     handler,
+		Lists:    []*BlocklistSource{testSource(testList(t, "*.a.example", "||safe.example^", "ads.example"))},
+		Response: &BlockResponse{Mode: BlockNXDomain},
+	}
+	handler = &AllowlistHandler{Next: handler, Lists: []*BlocklistSource{testSource(testList(t, "b.a.example", "||safe.example^"))}}
+	handler = &GroupHandler{Next: handler, Groups: &ClientGroups{Groups: []*ClientGroup{kids}}}
+
+	const other, child = "192.0.2.1", "10.0.0.5"
+	tests := []struct {
+		name   string
+		client string
+		want   ResultCode // NXDOMAIN from the blocklist, REFUSED from a policy, NOERROR when answered
+	}{
+		{"x.a.example", other, NXDOMAIN},        // Blocked below a.example, before the policy refusing a.example
+		{"b.a.example", other, NOERROR},         // Allowed exactly, over the wildcard block and the policy
+		{"c.b.a.example", other, NXDOMAIN},      // The allowed name doesn't cover names below it
+		{"a.example", other, REFUSED},           // The wildcard block leaves out a.example itself
+		{"safe.example", other, NOERROR},        // Allowed and blocked with the same rule: allowing wins
+		{"www.safe.example", other, NOERROR},    // Also below it, over the policy too
+		{"ads.example", other, NXDOMAIN},        // Blocked for everyone else
+		{"ads.example", child, NOERROR},         // Allowed by the group
+		{"x.a.example", child, NOERROR},         // Allowed by the group over the server's block and policy
+		{"y.a.example", child, NXDOMAIN},        // The group's allowlist is exact
+		{"games.example", child, REFUSED},       // The group's policy
+		{"games.example", other, NOERROR},       // Other clients don't get the group's policy
+		{"chess.games.example", child, NOERROR}, // Allowed by the group over its own policy
+		{"go.games.example", child, REFUSED},
+		{"B.A.Example.", other, NOERROR}, // Case and the final dot don't matter
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+tt.client, func(t *testing.T) {
+			query := NewDnsPacket()
+			query.Questions = append(query.Questions, NewDnsQuestion(tt.name, QTYPE_A))
+			req := &Request{Packet: query, RemoteAddr: &net.UDPAddr{IP: net.ParseIP(tt.client), Port: 53}, Transport: "udp"}
+			res := handler.ServeDNS(req)
+			if res.Header.ResCode != tt.want {
+				t.Errorf("rcode %v, want %v", res.Header.ResCode, tt.want)
+			}
+			if blocked := tt.want != NOERROR; req.Blocked != blocked {
+				t.Errorf("Blocked = %t, want %t", req.Blocked, blocked)
+			}
+		})
+	}
+}
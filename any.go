@@ -0,0 +1,86 @@
+package main
+
+import "fmt"
+
+// Ways of answering ANY queries, set with ANYHandler.Mode
+const (
+	ANYMinimal = "hinfo"  // Synthesize a single HINFO record (RFC 8482 section 4.2)
+	ANYSubset  = "subset" // Answer with one of the RRsets at the name (RFC 8482 section 4.1)
+	ANYFull    = "full"   // Pass the query on and return every RRset, as before RFC 8482
+)
+
+// anyHINFOTTL is the TTL of synthesized HINFO answers, long enough that caches hold on to them
+const anyHINFOTTL = 3600
+
+// ANYHandler answers queries for type ANY without dumping every RRset at the name, which makes
+// such queries useless for amplification, and passes all other queries on to Next
+type ANYHandler struct {
+	Next Handler
+	Mode string // ANYMinimal, ANYSubset or ANYFull; empty means ANYMinimal
+}
+
+// ParseANYMode checks the name of a way of answering ANY queries
+func ParseANYMode(mode string) (string, error) {
+	switch mode {
+	case ANYMinimal, ANYSubset, ANYFull:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown ANY mode %q, expected %s, %s or %s", mode, ANYMinimal, ANYSubset, ANYFull)
+}
+
+// ServeDNS answers ANY queries according to the handler's mode
+func (h *ANYHandler) ServeDNS(req *Request) *DnsPacket {
+	query := req.Packet
+	if len(query.Questions) != 1 || QueryType(query.Questions[0].Qtype) != QTYPE_ANY {
+		return h.Next.ServeDNS(req)
+	}
+	switch h.Mode {
+	case ANYFull:
+		return h.Next.ServeDNS(req)
+	case ANYSubset:
+		res := h.Next.ServeDNS(req)
+		if res != nil {
+			res.Answers = firstRRset(res.Answers)
+		}
+		return res
+	}
+
+	q := query.Questions[0]
+	res := NewResponse(query)
+	res.Answers = []*DnsRecord{{
+		Name:  q.Name,
+		Qtype: QTYPE_HINFO,
+		Class: q.Qclass,
+		TTL:   anyHINFOTTL,
+		Data:  &HINFO{CPU: "RFC8482"},
+	}}
+	return res
+}
+
+// firstRRset keeps the CNAME records leading to the final name and the first other RRset in answers
+func firstRRset(answers []*DnsRecord) []*DnsRecord {
+	var kept []*DnsRecord
+	var first *DnsRecord
+	for _, rec := range answers {
+		switch {
+		case rec.Qtype == QTYPE_CNAME:
+			kept = append(kept, rec)
+		case first == nil:
+			first = rec
+			kept = append(kept, rec)
+		case rec.Qtype == first.Qtype && rec.Class == first.Class && parseNameLoose(rec.Name).Equal(parseNameLoose(first.Name)):
+			kept = append(kept, rec)
+		}
+	}
+	return kept
+}
+
+// IsMinimalANY reports whether a response to an ANY query is the synthesized HINFO record servers
+// following RFC 8482 return instead of the records at the name
+func IsMinimalANY(res *DnsPacket) bool {
+	if len(res.Answers) != 1 {
+		return false
+	}
+	h := res.Answers[0].HINFO()
+	return h != nil && h.CPU == "RFC8482"
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxCNAMEChain bounds how many in-zone CNAMEs are followed while answering
+const maxCNAMEChain = 8
+
+// AuthZone is a zone served authoritatively, indexed by owner name and safe for concurrent updates
+type AuthZone struct {
+	Origin Name
+
+	records map[string][]*DnsRecord // Records by lowercase owner name
+	names   map[string]int          // Owner names and empty non-terminals, with the number of records at or below them
+	bytes   int64                   // Approximate memory held by the records
+	journal *ZoneJournal            // Where changes are recorded, nil if they aren't
+	mu      sync.RWMutex
+}
+
+// NewAuthZone indexes the records of a parsed zone, ignoring any outside its origin
+func NewAuthZone(zone *Zone) *AuthZone {
+	z := &AuthZone{
+		Origin:  parseNameLoose(zone.Origin),
+		records: make(map[string][]*DnsRecord),
+		names:   make(map[string]int),
+	}
+	for _, rec := range zone.Records {
+		z.Add(rec)
+	}
+	return z
+}
+
+// Add inserts a record, returning false if it is outside the zone or already present
+func (z *AuthZone) Add(rec *DnsRecord) bool {
+	name := parseNameLoose(rec.Name)
+	if !name.IsSubdomainOf(z.Origin) {
+		return false
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	key := name.Key()
+	for _, existing := range z.records[key] {
+		if sameRecord(existing, rec) {
+			return false
+		}
+	}
+	z.records[key] = append(z.records[key], rec)
+	z.bytes += recordSize(rec)
+	for n := name; ; n = n.Parent() {
+		z.names[n.Key()]++
+		if n.Equal(z.Origin) {
+			break
+		}
+	}
+	return true
+}
+
+// Remove deletes the record with the same owner, type, class and data, returning false if none matched.
+// As a zone has a single SOA, removing an SOA that doesn't match removes the zone's, whose serial
+// may have been increased by Commit.
+func (z *AuthZone) Remove(rec *DnsRecord) bool {
+	name := parseNameLoose(rec.Name)
+	if !name.IsSubdomainOf(z.Origin) {
+		return false
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	key := name.Key()
+	match := -1
+	for i, existing := range z.records[key] {
+		if sameRecord(existing, rec) {
+			match = i
+			break
+		}
+		if rec.Qtype == QTYPE_SOA && existing.Qtype == QTYPE_SOA && match < 0 {
+			match = i
+		}
+	}
+	if i := match; i >= 0 {
+		existing := z.records[key][i]
+		z.records[key] = append(z.records[key][:i:i], z.records[key][i+1:]...)
+		z.bytes -= recordSize(existing)
+		if len(z.records[key]) == 0 {
+			delete(z.records, key)
+		}
+		for n := name; ; n = n.Parent() {
+			if z.names[n.Key()]--; z.names[n.Key()] == 0 {
+				delete(z.names, n.Key())
+			}
+			if n.Equal(z.Origin) {
+				break
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Records returns a copy of all records in the zone
+func (z *AuthZone) Records() []*DnsRecord {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	var records []*DnsRecord
+	for _, set := range z.records {
+		records = append(records, set...)
+	}
+	return records
+}
+
+// sameRecord reports whether two records have the same owner, type, class and canonical data
+func sameRecord(a, b *DnsRecord) bool {
+	if a.Qtype != b.Qtype || a.Class != b.Class || !parseNameLoose(a.Name).Equal(parseNameLoose(b.Name)) {
+		return false
+	}
+	ra, errA := CanonicalRdata(a)
+	rb, errB := CanonicalRdata(b)
+	return errA == nil && errB == nil && string(ra) == string(rb)
+}
+
+// lookup returns the records of the given type at name; qtype 255 (ANY) matches every type
+func (z *AuthZone) lookup(name Name, qtype QueryType) []*DnsRecord {
+	var matched []*DnsRecord
+	for _, rec := range z.records[name.Key()] {
+		if rec.Qtype == qtype || qtype == QTYPE_ANY {
+			matched = append(matched, rec)
+		}
+	}
+	return matched
+}
+
+// soa returns the zone's SOA record, or nil if it has none
+func (z *AuthZone) soa() *DnsRecord {
+	if soa := z.lookup(z.Origin, QTYPE_SOA); len(soa) > 0 {
+		return soa[0]
+	}
+	return nil
+}
+
+// servesClass reports whether the zone answers questions of a class: its SOA's class, IN if it has
+// no SOA, or ANY
+func (z *AuthZone) servesClass(class Class) bool {
+	if class == CLASS_ANY {
+		return true
+	}
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	if soa := z.soa(); soa != nil {
+		return soa.Class == class
+	}
+	return class == CLASS_IN
+}
+
+// Answer fills in the response to a question for a name inside the zone (RFC 1034 section 4.3.2)
+func (z *AuthZone) Answer(q *DnsQuestion, res *DnsPacket) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	qname := parseNameLoose(q.Name)
+	qtype := QueryType(q.Qtype)
+	res.Header.AuthoritativeAnswer = true
+	for chain := 0; chain < maxCNAMEChain; chain++ {
+		if ns := z.delegation(qname); ns != nil {
+			// Below a zone cut: refer the client to the child zone's servers
+			res.Header.AuthoritativeAnswer = len(res.Answers) > 0
+			res.Authorities = append(res.Authorities, ns...)
+			res.Resources = append(res.Resources, z.glue(ns)...)
+			return
+		}
+
+		records, exists := z.records[qname.Key()], z.names[qname.Key()] > 0
+		owner := qname
+		if !exists {
+			if wildcard, ok := z.wildcard(qname); ok {
+				records, exists = z.records[wildcard.Key()], true
+				owner = wildcard
+			}
+		}
+		if !exists {
+			if len(res.Answers) == 0 {
+				res.Header.ResCode = NXDOMAIN
+			}
+			z.addSOA(res)
+			return
+		}
+
+		var target string
+		var answers []*DnsRecord
+		for _, rec := range records {
+			switch {
+			case rec.Qtype == qtype || qtype == QTYPE_ANY:
+				answers = append(answers, synthesize(rec, owner, qname))
+			case rec.Qtype == QTYPE_CNAME:
+				answers = append(answers, synthesize(rec, owner, qname))
+				target, _ = targetName(rec.Data)
+			}
+		}
+		res.Answers = append(res.Answers, answers...)
+		if len(answers) == 0 {
+			z.addSOA(res)
+			return
+		}
+		if target == "" || qtype == QTYPE_CNAME || qtype == QTYPE_ANY {
+			res.Resources = append(res.Resources, z.additional(answers)...)
+			return
+		}
+		// Follow the CNAME while it stays inside the zone
+		next := parseNameLoose(target)
+		if !next.IsSubdomainOf(z.Origin) {
+			return
+		}
+		qname = next
+	}
+}
+
+// delegation returns the NS records of the zone cut at or above name, if any, below the apex
+func (z *AuthZone) delegation(name Name) []*DnsRecord {
+	var cut []*DnsRecord
+	for n := name; !n.Equal(z.Origin) && n.CountLabels() > z.Origin.CountLabels(); n = n.Parent() {
+		if ns := z.lookup(n, QTYPE_NS); len(ns) > 0 {
+			cut = ns
+		}
+	}
+	return cut
+}
+
+// wildcard returns the wildcard owner that covers a name which doesn't exist (RFC 4592)
+func (z *AuthZone) wildcard(name Name) (Name, bool) {
+	// Find the closest encloser, the longest existing ancestor
+	encloser := name.Parent()
+	for !encloser.Equal(z.Origin) && z.names[encloser.Key()] == 0 {
+		encloser = encloser.Parent()
+	}
+	wildcard, err := encloser.Child("*")
+	if err != nil || len(z.records[wildcard.Key()]) == 0 {
+		return Name{}, false
+	}
+	return wildcard, true
+}
+
+// synthesize returns rec, renamed to qname when it was matched through a wildcard owner
+func synthesize(rec *DnsRecord, owner, qname Name) *DnsRecord {
+	if owner.Equal(qname) {
+		return rec
+	}
+	copied := *rec
+	copied.Name = qname.String()
+	return &copied
+}
+
+// addSOA adds the zone's SOA to the authority section of a negative response (RFC 2308)
+func (z *AuthZone) addSOA(res *DnsPacket) {
+	if soa := z.soa(); soa != nil {
+		res.Authorities = append(res.Authorities, soa)
+	}
+}
+
+// glue returns in-zone addresses of the name servers in a referral
+func (z *AuthZone) glue(ns []*DnsRecord) []*DnsRecord {
+	var glue []*DnsRecord
+	for _, rec := range ns {
+		name, _ := targetName(rec.Data)
+		if host := parseNameLoose(name); host.IsSubdomainOf(z.Origin) {
+			glue = append(glue, z.lookup(host, QTYPE_A)...)
+			glue = append(glue, z.lookup(host, QTYPE_AAAA)...)
+		}
+	}
+	return glue
+}
+
+// additional returns in-zone addresses of the hosts named by NS, MX and SRV answers
+func (z *AuthZone) additional(answers []*DnsRecord) []*DnsRecord {
+	var extra []*DnsRecord
+	for _, rec := range answers {
+		switch rec.Data.(type) {
+		case *NS, *MX, *SRV:
+			name, _ := targetName(rec.Data)
+			if host := parseNameLoose(name); host.IsSubdomainOf(z.Origin) && z.delegation(host) == nil {
+				extra = append(extra, z.lookup(host, QTYPE_A)...)
+				extra = append(extra, z.lookup(host, QTYPE_AAAA)...)
+			}
+		}
+	}
+	return extra
+}
+
+// Authority is a Handler serving authoritative zones, passing queries for other names to Next
+type Authority struct {
+	Next Handler // Handler for names outside every zone; REFUSED is answered when nil
+
+	zones map[string]*AuthZone
+	mu    sync.RWMutex
+}
+
+// NewAuthority initializes an Authority with no zones
+func NewAuthority(next Handler) *Authority {
+	return &Authority{Next: next, zones: make(map[string]*AuthZone)}
+}
+
+// SetZone installs or replaces a zone. A replacement takes over the journal of the zone it replaces,
+// recording the differences between them.
+func (a *Authority) SetZone(zone *AuthZone) {
+	if old := a.Zone(zone.Origin.String()); old != nil && old.Journal() != nil && zone.Journal() == nil {
+		zone.SetJournal(old.Journal())
+		if _, err := zone.Commit(old.Records()); err != nil {
+			log.Printf("zone %s: journal: %v", zone.Origin.FQDN(), err)
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.zones[zone.Origin.Key()] = zone
+}
+
+// RemoveZone stops serving the zone with the given origin
+func (a *Authority) RemoveZone(origin string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.zones, parseNameLoose(origin).Key())
+}
+
+// Zone returns the zone with the given origin, or nil
+func (a *Authority) Zone(origin string) *AuthZone {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.zones[parseNameLoose(origin).Key()]
+}
+
+// Zones returns the served zones
+func (a *Authority) Zones() []*AuthZone {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	zones := make([]*AuthZone, 0, len(a.zones))
+	for _, zone := range a.zones {
+		zones = append(zones, zone)
+	}
+	return zones
+}
+
+// FindZone returns the most specific zone containing name, or nil
+func (a *Authority) FindZone(name string) *AuthZone {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for n := parseNameLoose(name); ; n = n.Parent() {
+		if zone, ok := a.zones[n.Key()]; ok {
+			return zone
+		}
+		if n.IsRoot() {
+			return nil
+		}
+	}
+}
+
+// WatchZoneFile reloads a zone from its master file whenever the file changes, checking every
+// interval until the process exits. A version that fails to load is logged and the zone kept as it was.
+func (a *Authority) WatchZoneFile(path, origin string, interval time.Duration) {
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+	for range time.Tick(interval) {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = info.ModTime()
+		zone, err := LoadZoneFile(path, origin)
+		if err != nil {
+			log.Printf("zone %s: %v", origin, err)
+			continue
+		}
+		a.SetZone(NewAuthZone(zone))
+		log.Printf("zone %s: reloaded %s", origin, path)
+	}
+}
+
+// ServeDNS answers queries for names in the served zones
+func (a *Authority) ServeDNS(req *Request) *DnsPacket {
+	query := req.Packet
+	if len(query.Questions) != 1 {
+		return NewErrorResponse(query, FORMERR)
+	}
+	zone := a.FindZone(query.Questions[0].Name)
+	if zone != nil && !zone.servesClass(query.Questions[0].Qclass) {
+		zone = nil
+	}
+	if zone == nil {
+		if a.Next != nil {
+			return a.Next.ServeDNS(req)
+		}
+		return NewErrorResponse(query, REFUSED)
+	}
+	span := req.Span.Child("zone.answer", SpanInternal)
+	span.SetAttr("dns.zone", zone.Origin.String())
+	res := NewResponse(query)
+	if q := query.Questions[0]; QueryType(q.Qtype) == QTYPE_IXFR {
+		if !parseNameLoose(q.Name).Equal(zone.Origin) {
+			return NewErrorResponse(query, REFUSED)
+		}
+		zone.transfer(query, res)
+		span.Finish()
+		return res
+	}
+	zone.Answer(query.Questions[0], res)
+	a.followCNAME(zone, query.Questions[0], res)
+	span.Finish()
+	return res
+}
+
+// followCNAME continues a CNAME chain that leaves zone into the other zones served, such as the
+// CNAMEs of a classless reverse delegation (RFC 2317) leading into a child zone served here too
+func (a *Authority) followCNAME(zone *AuthZone, q *DnsQuestion, res *DnsPacket) {
+	qtype := QueryType(q.Qtype)
+	if qtype == QTYPE_CNAME || qtype == QTYPE_ANY {
+		return
+	}
+	for chain := 0; chain < maxCNAMEChain && len(res.Answers) > 0; chain++ {
+		cname, ok := res.Answers[len(res.Answers)-1].Data.(*CNAME)
+		if !ok {
+			return
+		}
+		next := a.FindZone(cname.Target)
+		if next == nil || next == zone || !next.servesClass(q.Qclass) {
+			return
+		}
+		part := NewDnsPacket()
+		next.Answer(&DnsQuestion{Name: cname.Target, Qtype: q.Qtype, Qclass: q.Qclass}, part)
+		res.Answers = append(res.Answers, part.Answers...)
+		res.Authorities = part.Authorities
+		res.Resources = part.Resources
+		res.Header.ResCode = part.Header.ResCode
+		res.Header.AuthoritativeAnswer = part.Header.AuthoritativeAnswer
+		zone = next
+	}
+}
+
+// Len returns the number of records in the zone
+func (z *AuthZone) Len() int {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	n := 0
+	for _, set := range z.records {
+		n += len(set)
+	}
+	return n
+}
+
+// Size returns the approximate memory held by the zone's records, in bytes
+func (z *AuthZone) Size() int64 {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.bytes
+}
+
+// String describes the zone for logging
+func (z *AuthZone) String() string {
+	return fmt.Sprintf("%s (%d records)", z.Origin.FQDN(), z.Len())
+}
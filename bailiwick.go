@@ -0,0 +1,182 @@
+package main
+
+import "expvar"
+
+// bailiwickScrubbed counts records removed from responses for being outside the bailiwick
+var bailiwickScrubbed = expvar.NewInt("bailiwick_scrubbed_records")
+
+// maxChainLength bounds the CNAME chain followed through an answer section
+const maxChainLength = 16
+
+// ScrubBailiwick removes the records of a response that a server could use to poison a cache with
+// names it wasn't asked about, and returns how many it removed:
+//
+//   - answers not owned by the queried name or a name its CNAME chain leads to
+//   - NS and SOA authority records not owned by one of those names or a parent of one, and other
+//     authority records not below a kept NS or SOA owner
+//   - additional addresses that no kept NS, MX, SRV or SVCB record refers to, or that are outside
+//     the zone of the record referring to them: below the NS owner for glue, and for answers below
+//     the closest zone in the authority section, or else the registered domain of the answer's name
+func ScrubBailiwick(res *DnsPacket) int {
+	if len(res.Questions) != 1 {
+		return 0
+	}
+	qname, err := ParseName(res.Questions[0].Name)
+	if err != nil {
+		return 0
+	}
+	removed := 0
+
+	// The names the answer section may be about
+	chain := []Name{qname}
+	for i := 0; i < maxChainLength; i++ {
+		next, ok := chainTarget(res.Answers, chain[len(chain)-1])
+		if !ok || containsName(chain, next) {
+			break
+		}
+		chain = append(chain, next)
+	}
+	answers := res.Answers[:0]
+	for _, rec := range res.Answers {
+		if name, err := ParseName(rec.Name); err == nil && containsName(chain, name) {
+			answers = append(answers, rec)
+		} else {
+			removed++
+		}
+	}
+	res.Answers = answers
+
+	// Zone cuts: NS and SOA owners at or above a name in the chain
+	var zones []Name
+	authorities := make([]*DnsRecord, 0, len(res.Authorities))
+	for _, rec := range res.Authorities {
+		name, err := ParseName(rec.Name)
+		if err == nil && (rec.Qtype == QTYPE_NS || rec.Qtype == QTYPE_SOA) && enclosesAny(name, chain) {
+			zones = append(zones, name)
+			authorities = append(authorities, rec)
+		}
+	}
+	for _, rec := range res.Authorities {
+		if rec.Qtype == QTYPE_NS || rec.Qtype == QTYPE_SOA {
+			continue
+		}
+		if name, err := ParseName(rec.Name); err == nil && belowAny(name, zones) {
+			authorities = append(authorities, rec)
+		}
+	}
+	removed += len(res.Authorities) - len(authorities)
+	res.Authorities = authorities
+
+	// Hosts that additional addresses may be given for, each with the zone it must be in
+	targets := map[string]Name{}
+	for _, rec := range res.Authorities {
+		if ns, ok := rec.Data.(*NS); ok {
+			if host, err := ParseName(ns.Host); err == nil {
+				targets[host.Key()] = parseNameLoose(rec.Name)
+			}
+		}
+	}
+	for _, rec := range res.Answers {
+		switch rec.Data.(type) {
+		case *NS, *MX, *SRV, *SVCB, *HTTPS:
+		default:
+			continue
+		}
+		name, _ := targetName(rec.Data)
+		host, err := ParseName(name)
+		if err != nil {
+			continue
+		}
+		owner := parseNameLoose(rec.Name)
+		if _, ok := rec.Data.(*NS); ok {
+			targets[host.Key()] = owner
+		} else if _, ok := targets[host.Key()]; !ok {
+			targets[host.Key()] = answerZone(owner, zones)
+		}
+	}
+	resources := res.Resources[:0]
+	for _, rec := range res.Resources {
+		if rec.Qtype == QTYPE_OPT {
+			resources = append(resources, rec)
+			continue
+		}
+		name, err := ParseName(rec.Name)
+		if err != nil || rec.Qtype != QTYPE_A && rec.Qtype != QTYPE_AAAA {
+			removed++
+			continue
+		}
+		if zone, ok := targets[name.Key()]; ok && name.IsSubdomainOf(zone) {
+			resources = append(resources, rec)
+		} else {
+			removed++
+		}
+	}
+	res.Resources = resources
+
+	bailiwickScrubbed.Add(int64(removed))
+	return removed
+}
+
+// chainTarget returns the target of a CNAME owned by name among the records
+func chainTarget(records []*DnsRecord, name Name) (Name, bool) {
+	for _, rec := range records {
+		cname, ok := rec.Data.(*CNAME)
+		if !ok {
+			continue
+		}
+		if owner, err := ParseName(rec.Name); err == nil && owner.Equal(name) {
+			target, err := ParseName(cname.Target)
+			return target, err == nil
+		}
+	}
+	return Name{}, false
+}
+
+// containsName reports whether a name is among names
+func containsName(names []Name, name Name) bool {
+	for _, n := range names {
+		if n.Equal(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// enclosesAny reports whether zone is one of names or a parent of one
+func enclosesAny(zone Name, names []Name) bool {
+	for _, n := range names {
+		if n.IsSubdomainOf(zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// belowAny reports whether name is one of zones or below one
+func belowAny(name Name, zones []Name) bool {
+	for _, zone := range zones {
+		if name.IsSubdomainOf(zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// answerZone returns the zone an answer owned by name comes from: the closest enclosing zone cut in
+// the authority section, or else the registered domain of the name
+func answerZone(name Name, zones []Name) Name {
+	var closest Name
+	found := false
+	for _, zone := range zones {
+		if name.IsSubdomainOf(zone) && (!found || zone.CountLabels() > closest.CountLabels()) {
+			closest, found = zone, true
+		}
+	}
+	if found {
+		return closest
+	}
+	if domain, err := ParseName(RegisteredDomain(name.Key())); err == nil && !domain.IsRoot() {
+		return domain
+	}
+	return name
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Ways of answering blocked queries
+const (
+	BlockNXDomain = "nxdomain" // Pretend the name doesn't exist
+	BlockNoData   = "nodata"   // Pretend the name has no records of the type
+	BlockRefused  = "refused"  // Refuse the query
+	BlockNull     = "null"     // Answer A queries with 0.0.0.0 and AAAA queries with ::
+)
+
+// blockTTL is the TTL of addresses synthesized for blocked names
+const blockTTL = 60
+
+// BlockResponse describes the answer to a blocked query: one of the Block modes, or the addresses
+// of a landing page
+type BlockResponse struct {
+	Mode string // One of the Block constants; empty when the addresses are answered
+	IPv4 net.IP // Answered to A queries, NODATA if nil
+	IPv6 net.IP // Answered to AAAA queries, NODATA if nil
+}
+
+// ParseBlockResponse parses a block mode or a comma-separated IPv4 and/or IPv6 landing page address
+func ParseBlockResponse(s string) (*BlockResponse, error) {
+	switch s {
+	case BlockNXDomain, BlockNoData, BlockRefused:
+		return &BlockResponse{Mode: s}, nil
+	case BlockNull:
+		return &BlockResponse{IPv4: net.IPv4zero.To4(), IPv6: net.IPv6zero}, nil
+	}
+	b := &BlockResponse{}
+	for _, item := range strings.Split(s, ",") {
+		ip := net.ParseIP(strings.TrimSpace(item))
+		switch {
+		case ip == nil:
+			return nil, fmt.Errorf("invalid block response %q, expected %s, %s, %s, %s or landing page addresses", s, BlockNXDomain, BlockNoData, BlockRefused, BlockNull)
+		case ip.To4() != nil:
+			b.IPv4 = ip.To4()
+		default:
+			b.IPv6 = ip
+		}
+	}
+	return b, nil
+}
+
+// Answer builds the response to a blocked query
+func (b *BlockResponse) Answer(query *DnsPacket) *DnsPacket {
+	switch b.Mode {
+	case BlockNXDomain:
+		return NewErrorResponse(query, NXDOMAIN)
+	case BlockRefused:
+		return NewErrorResponse(query, REFUSED)
+	}
+	res := NewResponse(query)
+	res.Header.RecursionAvailable = true
+	if b.Mode == BlockNoData || len(query.Questions) == 0 {
+		return res
+	}
+	q := query.Questions[0]
+	switch QueryType(q.Qtype) {
+	case QTYPE_A:
+		if b.IPv4 != nil {
+			res.Answers = append(res.Answers, &DnsRecord{Name: q.Name, Qtype: QTYPE_A, Class: q.Qclass, TTL: blockTTL, Data: &A{Addr: b.IPv4}})
+		}
+	case QTYPE_AAAA:
+		if b.IPv6 != nil {
+			res.Answers = append(res.Answers, &DnsRecord{Name: q.Name, Qtype: QTYPE_AAAA, Class: q.Qclass, TTL: blockTTL, Data: &AAAA{Addr: b.IPv6}})
+		}
+	}
+	return res
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// How a name in a Blocklist is blocked
+const (
+	blockExact    = 1 << iota // The name itself
+	blockWildcard             // Names below it
+)
+
+// Blocklist is a set of blocked names: exact names and whole subtrees kept in a compact hash set
+// looked up once per label of a queried name, and regular expressions combined into one, so lookups
+// stay fast and memory small for lists of millions of names
+type Blocklist struct {
+	names   nameSet
+	regexps []string       // Sources of the regular expression rules
+	regexp  *regexp.Regexp // The rules combined, nil if there are none
+	rules   int
+}
+
+// ParseBlocklist reads a blocklist with one rule per line:
+//
+//	ads.example             the name only
+//	0.0.0.0 ads.example     the same, in hosts file format, which may list several names
+//	*.tracker.example       names below tracker.example, but not tracker.example itself
+//	||tracker.example^      tracker.example and the names below it, in Adblock syntax
+//	/^ad[0-9]+\.example$/   names matching a regular expression, without the final dot
+//
+// Lines starting with # or ! are comments. Rules with Adblock modifiers or exceptions are skipped.
+// The name is used in error messages.
+func ParseBlocklist(r io.Reader, name string) (*Blocklist, error) {
+	l := &Blocklist{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' || text[0] == '!' {
+			continue
+		}
+		if err := l.addRule(text); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(l.regexps) > 0 {
+		l.regexp = regexp.MustCompile("(?:" + strings.Join(l.regexps, ")|(?:") + ")")
+	}
+	return l, nil
+}
+
+// LoadBlocklist reads a blocklist file as ParseBlocklist does
+func LoadBlocklist(path string) (*Blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseBlocklist(f, path)
+}
+
+// addRule adds one line's rule
+func (l *Blocklist) addRule(text string) error {
+	if len(text) > 1 && text[0] == '/' && text[len(text)-1] == '/' {
+		source := text[1 : len(text)-1]
+		if _, err := regexp.Compile(source); err != nil {
+			return err
+		}
+		l.regexps = append(l.regexps, source)
+		l.rules++
+		return nil
+	}
+	if strings.HasPrefix(text, "@@") || strings.Contains(text, "$") {
+		// Adblock exceptions and modifiers have no DNS equivalent here
+		return nil
+	}
+	if body, ok := strings.CutPrefix(text, "||"); ok {
+		body = strings.TrimSuffix(body, "^")
+		if !validBlockName(body) {
+			return fmt.Errorf("invalid rule %q", text)
+		}
+		l.add(body, blockExact|blockWildcard)
+		return nil
+	}
+	if body, ok := strings.CutPrefix(text, "*."); ok {
+		if !validBlockName(body) {
+			return fmt.Errorf("invalid rule %q", text)
+		}
+		l.add(body, blockWildcard)
+		return nil
+	}
+	text, _, _ = strings.Cut(text, "#")
+	fields := strings.Fields(text)
+	if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+		// A hosts file line: the address, then names
+		for _, name := range fields[1:] {
+			if validBlockName(name) && net.ParseIP(name) == nil && name != "localhost" && name != "localhost.localdomain" {
+				l.add(name, blockExact)
+			}
+		}
+		return nil
+	}
+	if len(fields) != 1 || !validBlockName(fields[0]) {
+		return fmt.Errorf("invalid rule %q", text)
+	}
+	l.add(fields[0], blockExact)
+	return nil
+}
+
+// add blocks a name as the flags say
+func (l *Blocklist) add(name string, flags uint8) {
+	l.names.add(strings.ToLower(strings.TrimSuffix(name, ".")), flags)
+	l.rules++
+}
+
+// validBlockName reports whether s looks like a domain name a rule can block
+func validBlockName(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Len returns the number of rules
+func (l *Blocklist) Len() int {
+	return l.rules
+}
+
+// Contains reports whether a name is blocked
+func (l *Blocklist) Contains(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return false
+	}
+	// Hash the name from its end, checking each parent domain as its first label is completed
+	h := uint32(fnvOffset)
+	for i := len(name) - 1; i >= 0; i-- {
+		if name[i] == '.' {
+			if l.names.get(name[i+1:], h)&blockWildcard != 0 {
+				return true
+			}
+		}
+		h = (h ^ uint32(name[i])) * fnvPrime
+	}
+	if l.names.get(name, h)&blockExact != 0 {
+		return true
+	}
+	return l.regexp != nil && l.regexp.MatchString(name)
+}
+
+// FNV-1a parameters
+const (
+	fnvOffset = 2166136261
+	fnvPrime  = 16777619
+)
+
+// suffixHash hashes a name from its last byte to its first, so the hashes of its parent domains
+// are steps on the way
+func suffixHash[T string | []byte](name T) uint32 {
+	h := uint32(fnvOffset)
+	for i := len(name) - 1; i >= 0; i-- {
+		h = (h ^ uint32(name[i])) * fnvPrime
+	}
+	return h
+}
+
+// nameSet is an open addressing hash set of names with flags. The names are packed into one byte
+// slice as flags, length and name, and the table holds their offsets, which takes a fraction of the
+// memory of a map of strings.
+type nameSet struct {
+	arena []byte
+	slots []uint32 // Offset of an entry in arena plus one, 0 for free slots
+	n     int
+}
+
+// add inserts a name or adds flags to it
+func (s *nameSet) add(name string, flags uint8) {
+	if len(name) > 255 {
+		return
+	}
+	if 4*(s.n+1) > 3*len(s.slots) {
+		s.grow()
+	}
+	h := suffixHash(name)
+	mask := uint32(len(s.slots) - 1)
+	for i := h & mask; ; i = (i + 1) & mask {
+		off := s.slots[i]
+		if off == 0 {
+			s.slots[i] = uint32(len(s.arena)) + 1
+			s.arena = append(s.arena, flags, byte(len(name)))
+			s.arena = append(s.arena, name...)
+			s.n++
+			return
+		}
+		if s.matches(off, name) {
+			s.arena[off-1] |= flags
+			return
+		}
+	}
+}
+
+// get returns the flags of a name whose suffixHash is h, 0 if it isn't in the set
+func (s *nameSet) get(name string, h uint32) uint8 {
+	if s.n == 0 {
+		return 0
+	}
+	mask := uint32(len(s.slots) - 1)
+	for i := h & mask; ; i = (i + 1) & mask {
+		off := s.slots[i]
+		if off == 0 {
+			return 0
+		}
+		if s.matches(off, name) {
+			return s.arena[off-1]
+		}
+	}
+}
+
+// matches reports whether the entry at slot value off holds name
+func (s *nameSet) matches(off uint32, name string) bool {
+	n := uint32(s.arena[off])
+	return n == uint32(len(name)) && string(s.arena[off+1:off+1+n]) == name
+}
+
+// grow doubles the table and reinserts the entries
+func (s *nameSet) grow() {
+	size := max(1024, 2*len(s.slots))
+	s.slots = make([]uint32, size)
+	mask := uint32(size - 1)
+	for off := uint32(0); off < uint32(len(s.arena)); off += 2 + uint32(s.arena[off+1]) {
+		i := suffixHash(s.arena[off+2:off+2+uint32(s.arena[off+1])]) & mask
+		for s.slots[i] != 0 {
+			i = (i + 1) & mask
+		}
+		s.slots[i] = off + 1
+	}
+}
+
+// BlocklistHandler blocks queries for names on any of its lists and passes the others on to Next
+type BlocklistHandler struct {
+	Next     Handler
+	Lists    []*BlocklistSource
+	Response *BlockResponse // Answer to blocked queries
+
+	paused atomic.Bool
+}
+
+// SetPaused turns blocking off or back on
+func (h *BlocklistHandler) SetPaused(paused bool) {
+	h.paused.Store(paused)
+}
+
+// Paused reports whether blocking is turned off
+func (h *BlocklistHandler) Paused() bool {
+	return h.paused.Load()
+}
+
+// ServeDNS blocks the query if its name is listed
+func (h *BlocklistHandler) ServeDNS(req *Request) *DnsPacket {
+	if len(req.Packet.Questions) == 0 || h.paused.Load() || req.Allowed {
+		return h.Next.ServeDNS(req)
+	}
+	name := req.Packet.Questions[0].Name
+	for _, source := range h.Lists {
+		if source.List().Contains(name) {
+			req.Blocked = true
+			return h.Response.Answer(req.Packet)
+		}
+	}
+	return h.Next.ServeDNS(req)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+// BenchmarkBlocklistContains measures lookups in a list the size of the large public blocklists,
+// reporting the heap the list takes alongside the time per lookup
+func BenchmarkBlocklistContains(b *testing.B) {
+	const size = 1_000_000
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	l := &Blocklist{}
+	for i := 0; i < size; i++ {
+		name := "ads" + strconv.Itoa(i) + ".tracker" + strconv.Itoa(i%1000) + ".example"
+		if i%10 == 0 {
+			l.add(name, blockExact|blockWildcard)
+		} else {
+			l.add(name, blockExact)
+		}
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	if l.Len() != size {
+		b.Fatalf("list holds %d rules, want %d", l.Len(), size)
+	}
+
+	// Half the lookups are listed names or names below wildcard rules, half miss
+	queries := make([]string, 4096)
+	for i := range queries {
+		n := i * 241 % size
+		switch i % 4 {
+		case 0:
+			queries[i] = "ads" + strconv.Itoa(n) + ".tracker" + strconv.Itoa(n%1000) + ".example."
+		case 1:
+			n -= n % 10
+			queries[i] = "img.cdn.ads" + strconv.Itoa(n) + ".tracker" + strconv.Itoa(n%1000) + ".example."
+		case 2:
+			queries[i] = "www" + strconv.Itoa(n) + ".example.com."
+		default:
+			queries[i] = "a.b.c.d.ads" + strconv.Itoa(n) + ".example.net."
+		}
+	}
+	for i, q := range queries {
+		if want := i%4 < 2; l.Contains(q) != want {
+			b.Fatalf("Contains(%q) = %t, want %t", q, !want, want)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.Contains(queries[i%len(queries)])
+	}
+	b.StopTimer()
+	heap := float64(after.HeapAlloc - before.HeapAlloc)
+	b.ReportMetric(heap/(1<<20), "heap-MB")
+	b.ReportMetric(heap/size, "heap-B/name")
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// blocklistFileCheck is how often local list files are checked for changes
+const blocklistFileCheck = 10 * time.Second
+
+// maxBlocklistSize bounds the size of a downloaded list
+const maxBlocklistSize = 256 << 20
+
+// errBlocklistUnchanged reports that a list hasn't changed since it was last loaded
+var errBlocklistUnchanged = errors.New("unchanged")
+
+// BlocklistSource keeps a Blocklist loaded from a file or an http(s) URL up to date. Downloads are
+// conditional on the ETag and Last-Modified of the previous one, so unchanged lists aren't fetched
+// again, and a new version only replaces the current list once it has parsed completely.
+type BlocklistSource struct {
+	Location string // File path or URL
+	Client   *http.Client
+
+	list         atomic.Pointer[Blocklist]
+	etag         string
+	lastModified string
+	modTime      time.Time // Of the file
+}
+
+// NewBlocklistSource loads the list at location, a file path or an http:// or https:// URL
+func NewBlocklistSource(location string) (*BlocklistSource, error) {
+	s := &BlocklistSource{Location: location, Client: &http.Client{Timeout: time.Minute}}
+	if err := s.Update(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// List returns the current list
+func (s *BlocklistSource) List() *Blocklist {
+	return s.list.Load()
+}
+
+// remote reports whether the list is downloaded
+func (s *BlocklistSource) remote() bool {
+	return strings.HasPrefix(s.Location, "http://") || strings.HasPrefix(s.Location, "https://")
+}
+
+// Update loads the list again if it changed, keeping the current one if the new version fails to
+// load, doesn't parse or is empty while the current one isn't
+func (s *BlocklistSource) Update() error {
+	var data []byte
+	var err error
+	if s.remote() {
+		data, err = s.download()
+	} else {
+		data, err = s.read()
+	}
+	if err != nil {
+		return err
+	}
+	list, err := ParseBlocklist(bytes.NewReader(data), s.Location)
+	if err != nil {
+		return err
+	}
+	if current := s.List(); current != nil && current.Len() > 0 && list.Len() == 0 {
+		return fmt.Errorf("%s: new version has no rules, keeping the current one", s.Location)
+	}
+	s.list.Store(list)
+	return nil
+}
+
+// read returns the file's contents if it was modified since it was last read
+func (s *BlocklistSource) read() ([]byte, error) {
+	info, err := os.Stat(s.Location)
+	if err != nil {
+		return nil, err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil, errBlocklistUnchanged
+	}
+	data, err := os.ReadFile(s.Location)
+	if err != nil {
+		return nil, err
+	}
+	s.modTime = info.ModTime()
+	return data, nil
+}
+
+// download fetches the list unless the server says it is unchanged
+func (s *BlocklistSource) download() ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, s.Location, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	if s.lastModified != "" {
+		req.Header.Set("If-Modified-Since", s.lastModified)
+	}
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotModified:
+		return nil, errBlocklistUnchanged
+	case res.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%s: %s", s.Location, res.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxBlocklistSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", s.Location, err)
+	}
+	if len(data) > maxBlocklistSize {
+		return nil, fmt.Errorf("%s: larger than %d bytes", s.Location, maxBlocklistSize)
+	}
+	s.etag, s.lastModified = res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+	return data, nil
+}
+
+// Run updates the list until the process exits: every interval for URLs, and whenever the file
+// changes for files
+func (s *BlocklistSource) Run(interval time.Duration) {
+	if !s.remote() {
+		interval = blocklistFileCheck
+	}
+	for range time.Tick(interval) {
+		switch err := s.Update(); {
+		case err == nil:
+			log.Printf("blocklist: loaded %d rules from %s", s.List().Len(), s.Location)
+		case !errors.Is(err, errBlocklistUnchanged):
+			log.Printf("blocklist: %v", err)
+		}
+	}
+}
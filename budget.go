@@ -0,0 +1,117 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Counters of memory budget enforcement, published at /debug/vars
+var (
+	budgetPressure = expvar.NewInt("memory_budget_pressure") // Times usage was found over the budget
+	budgetEvicted  = expvar.NewInt("memory_budget_evicted")  // Cache entries evicted to get back under it
+)
+
+// recordOverhead approximates the bytes a zone record takes besides its variable length fields
+const recordOverhead = 256
+
+// MemoryBudget bounds the approximate memory held by the response cache and the served zones.
+// Zone data can't be dropped, so when the total goes over the limit the cache is shrunk to make
+// room, down to a low-water mark so the next few inserts don't trip the limit again.
+type MemoryBudget struct {
+	Limit     int64         // Bytes the cache and zones may hold together
+	Cache     *MemoryCache  // Cache evicted from under pressure; may be nil
+	Authority *Authority    // Served zones counted against the budget; may be nil
+	Interval  time.Duration // How often usage is checked
+
+	over bool // Whether the last check found usage over the limit
+}
+
+// NewMemoryBudget initializes a MemoryBudget checking usage every second
+func NewMemoryBudget(limit int64, cache *MemoryCache, auth *Authority) *MemoryBudget {
+	return &MemoryBudget{Limit: limit, Cache: cache, Authority: auth, Interval: time.Second}
+}
+
+// Usage returns the approximate bytes held by the cache and by the zones
+func (b *MemoryBudget) Usage() (cache, zones int64) {
+	if b.Cache != nil {
+		cache = b.Cache.Size()
+	}
+	if b.Authority != nil {
+		for _, zone := range b.Authority.Zones() {
+			zones += zone.Size()
+		}
+	}
+	return cache, zones
+}
+
+// Enforce evicts cache entries when usage is over the limit until it is at 80% of it, and returns
+// the number of entries evicted
+func (b *MemoryBudget) Enforce() int {
+	cache, zones := b.Usage()
+	wasOver := b.over
+	if b.over = cache+zones > b.Limit; !b.over {
+		return 0
+	}
+	budgetPressure.Add(1)
+	evicted := 0
+	if b.Cache != nil {
+		evicted = b.Cache.Shrink(max(b.Limit*8/10-zones, 0))
+		budgetEvicted.Add(int64(evicted))
+	}
+	// Zones alone over the limit keep usage there; only report it once rather than every check
+	if evicted > 0 || !wasOver {
+		log.Printf("memory budget: cache %d and zones %d bytes over the limit of %d, evicted %d cache entries", cache, zones, b.Limit, evicted)
+	}
+	return evicted
+}
+
+// Run enforces the budget every Interval until the process exits
+func (b *MemoryBudget) Run() {
+	for range time.Tick(b.Interval) {
+		b.Enforce()
+	}
+}
+
+// recordSize approximates the memory taken by a zone record
+func recordSize(rec *DnsRecord) int64 {
+	n := recordOverhead + len(rec.Name)
+	if data, err := packRdata(rec); err == nil {
+		n += len(data)
+	}
+	// Plus the headers of the slices and strings the data is split into
+	switch data := rec.Data.(type) {
+	case *TXT:
+		n += 16 * len(data.Txt)
+	case *SVCB:
+		n += 32 * len(data.Params)
+	case *HTTPS:
+		n += 32 * len(data.Params)
+	}
+	return int64(n)
+}
+
+// byteSize is a flag holding a size in bytes, given with an optional K, M or G suffix (powers of 1024)
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	s := strings.TrimSuffix(strings.ToUpper(value), "B")
+	shift := 0
+	if i := strings.IndexAny(s, "KMG"); i >= 0 && i == len(s)-1 {
+		shift = 10 * (strings.IndexByte("KMG", s[i]) + 1)
+		s = s[:i]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > 1<<(62-shift) {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*b = byteSize(n << shift)
+	return nil
+}
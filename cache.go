@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache stores wire-format responses under string keys until their TTL runs out. Implementations
+// must be safe for concurrent use; they may live in process or in a store shared by many servers.
+type Cache interface {
+	Get(key string) ([]byte, time.Duration, bool) // Returns the value and its remaining TTL
+	Set(key string, value []byte, ttl time.Duration)
+	Delete(key string)
+}
+
+// memoryEntry is a cached value and the time it expires
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// memoryShards is the number of independently locked parts of a MemoryCache
+const memoryShards = 64
+
+// MemoryCache is the default in-process Cache. Keys are spread by hash over shards with their own
+// locks, so concurrent lookups of different names rarely contend.
+type MemoryCache struct {
+	shards [memoryShards]memoryShard
+}
+
+// memoryShard is one locked part of a MemoryCache
+type memoryShard struct {
+	entries    map[string]memoryEntry
+	maxEntries int
+	bytes      int64 // Approximate memory held by the entries
+	mu         sync.Mutex
+}
+
+// memoryEntryOverhead approximates the bytes a cache entry takes besides its key and value
+const memoryEntryOverhead = 96
+
+// NewMemoryCache initializes an empty MemoryCache holding about maxEntries values, 0 for no limit
+func NewMemoryCache(maxEntries int) *MemoryCache {
+	c := &MemoryCache{}
+	for i := range c.shards {
+		c.shards[i].entries = make(map[string]memoryEntry)
+		if maxEntries > 0 {
+			c.shards[i].maxEntries = (maxEntries + memoryShards - 1) / memoryShards
+		}
+	}
+	return c
+}
+
+// shard returns the shard responsible for key, chosen by its FNV-1a hash
+func (c *MemoryCache) shard(key string) *memoryShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &c.shards[h%memoryShards]
+}
+
+// Get returns the value stored under key if it hasn't expired
+func (c *MemoryCache) Get(key string) ([]byte, time.Duration, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, 0, false
+	}
+	remaining := time.Until(entry.expires)
+	if remaining <= 0 {
+		s.remove(key)
+		return nil, 0, false
+	}
+	return entry.value, remaining, true
+}
+
+// Set stores value under key for ttl, evicting expired and then arbitrary entries when the shard is full
+func (c *MemoryCache) Set(key string, value []byte, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.entries[key]; !exists && s.maxEntries > 0 && len(s.entries) >= s.maxEntries {
+		s.evict()
+	}
+	s.remove(key)
+	s.entries[key] = memoryEntry{value: value, expires: time.Now().Add(ttl)}
+	s.bytes += entrySize(key, value)
+}
+
+// Delete removes the value stored under key
+func (c *MemoryCache) Delete(key string) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+}
+
+// Len returns the number of entries held, including expired ones not yet dropped
+func (c *MemoryCache) Len() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		n += len(s.entries)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Flush drops every entry
+func (c *MemoryCache) Flush() {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		s.entries = make(map[string]memoryEntry)
+		s.bytes = 0
+		s.mu.Unlock()
+	}
+}
+
+// evict drops expired entries, or a random tenth of the shard if none have expired
+func (s *memoryShard) evict() {
+	s.shrink(func() bool { return len(s.entries) < s.maxEntries-s.maxEntries/10 })
+}
+
+// shrink drops expired entries, then arbitrary ones until enough reports true, and returns the
+// number of entries dropped
+func (s *memoryShard) shrink(enough func() bool) int {
+	n := len(s.entries)
+	now := time.Now()
+	for key, entry := range s.entries {
+		if now.After(entry.expires) {
+			s.remove(key)
+		}
+	}
+	for key := range s.entries {
+		if enough() {
+			break
+		}
+		s.remove(key)
+	}
+	return n - len(s.entries)
+}
+
+// remove deletes the entry under key, keeping the shard's byte count in step
+func (s *memoryShard) remove(key string) {
+	if entry, ok := s.entries[key]; ok {
+		s.bytes -= entrySize(key, entry.value)
+		delete(s.entries, key)
+	}
+}
+
+// entrySize approximates the memory taken by a cache entry
+func entrySize(key string, value []byte) int64 {
+	return int64(len(key) + len(value) + memoryEntryOverhead)
+}
+
+// Size returns the approximate memory held by the cached entries, in bytes
+func (c *MemoryCache) Size() int64 {
+	var n int64
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		n += s.bytes
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Shrink evicts expired entries and then arbitrary ones until the cache holds at most about target
+// bytes, and returns the number of entries evicted
+func (c *MemoryCache) Shrink(target int64) int {
+	perShard := target / memoryShards
+	evicted := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		evicted += s.shrink(func() bool { return s.bytes <= perShard })
+		s.mu.Unlock()
+	}
+	return evicted
+}
+
+// CachingHandler answers repeated queries from a Cache, passing misses on to the next handler
+type CachingHandler struct {
+	Next  Handler
+	Cache Cache
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// NewCachingHandler wraps next with cache
+func NewCachingHandler(next Handler, cache Cache) *CachingHandler {
+	return &CachingHandler{Next: next, Cache: cache}
+}
+
+// ServeDNS answers from the cache when possible, otherwise asks the next handler and caches its answer
+func (h *CachingHandler) ServeDNS(req *Request) *DnsPacket {
+	query := req.Packet
+	if len(query.Questions) != 1 {
+		return h.Next.ServeDNS(req)
+	}
+	key := cacheKey(query.Questions[0])
+	if req.Group != nil && len(req.Group.Upstreams) > 0 {
+		// Groups with their own upstreams get their own answers, e.g. from a filtering resolver
+		key = req.Group.Name + "/" + key
+	}
+	if query.Header.CheckingDisabled {
+		// Answers to CD queries skip validation, so they are kept apart from validated ones
+		key += "/cd"
+	}
+
+	span := req.Span.Child("cache.lookup", SpanInternal)
+	value, remaining, ok := h.Cache.Get(key)
+	span.SetAttr("cache.hit", ok)
+	span.Finish()
+	if ok {
+		if res, err := DnsPacketFromBuffer(&BytePacketBuffer{buf: value}); err == nil {
+			h.hits.Add(1)
+			// Age every record by the time spent in the cache
+			elapsed := uint32(0)
+			if left := uint32((remaining + time.Second - 1) / time.Second); left < responseTTL(res) {
+				elapsed = responseTTL(res) - left
+			}
+			for _, section := range [][]*DnsRecord{res.Answers, res.Authorities, res.Resources} {
+				for _, rec := range section {
+					if rec.TTL > elapsed {
+						rec.TTL -= elapsed
+					} else {
+						rec.TTL = 0
+					}
+				}
+			}
+			res.Header.ID = query.Header.ID
+			res.Questions = query.Questions
+			return res
+		}
+		h.Cache.Delete(key)
+	}
+
+	h.misses.Add(1)
+	res := h.Next.ServeDNS(req)
+	h.store(key, res)
+	return res
+}
+
+// Counts returns how many queries were answered from the cache and how many missed it
+func (h *CachingHandler) Counts() (hits, misses int64) {
+	return h.hits.Load(), h.misses.Load()
+}
+
+// Prefetch resolves the question through the next handler and caches the answer, replacing any
+// cached one. It returns how long the answer will be cached, zero if it couldn't be.
+func (h *CachingHandler) Prefetch(q *DnsQuestion) time.Duration {
+	query := NewDnsPacket()
+	query.Header.RecursionDesired = true
+	query.Questions = append(query.Questions, q)
+	// Asked as if over TCP, so a truncated answer is retried in full rather than left uncached
+	res := h.Next.ServeDNS(&Request{Packet: query, RemoteAddr: &net.TCPAddr{IP: net.IPv6loopback}, Transport: "tcp"})
+	return h.store(cacheKey(q), res)
+}
+
+// store caches a cacheable response under key and returns its TTL. Records outside the bailiwick
+// of the question are removed from the response first, so they are neither cached nor passed on.
+func (h *CachingHandler) store(key string, res *DnsPacket) time.Duration {
+	if res == nil || !cacheable(res) {
+		return 0
+	}
+	ScrubBailiwick(res)
+	ttl := time.Duration(responseTTL(res)) * time.Second
+	stored := *res
+	stored.RemoveEDNS()
+	value, err := stored.Pack()
+	if err != nil {
+		return 0
+	}
+	h.Cache.Set(key, value, ttl)
+	return ttl
+}
+
+// cacheKey identifies a question independently of the case of its name
+func cacheKey(q *DnsQuestion) string {
+	return fmt.Sprintf("%s/%d/%d", parseNameLoose(q.Name).Key(), q.Qtype, q.Qclass)
+}
+
+// cacheable reports whether a response may be stored: complete answers and negative responses only
+func cacheable(res *DnsPacket) bool {
+	if res.Header.TruncatedMessage {
+		return false
+	}
+	return res.Header.ResCode == NOERROR || res.Header.ResCode == NXDOMAIN
+}
+
+// responseTTL returns how long a response stays valid: the lowest record TTL, or for negative
+// answers the SOA TTL capped at its minimum field (RFC 2308)
+func responseTTL(res *DnsPacket) uint32 {
+	if len(res.Answers) == 0 {
+		for _, rec := range res.Authorities {
+			if soa, ok := rec.Data.(*SOA); ok {
+				if soa.Minimum < rec.TTL {
+					return soa.Minimum
+				}
+				return rec.TTL
+			}
+		}
+		return 0
+	}
+	ttl := ^uint32(0)
+	for _, section := range [][]*DnsRecord{res.Answers, res.Authorities, res.Resources} {
+		for _, rec := range section {
+			if rec.Qtype != QTYPE_OPT && rec.TTL < ttl {
+				ttl = rec.TTL
+			}
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkMemoryCacheParallel measures the sharded cache under concurrent lookups of many names,
+// with one Set for every nine Gets as a resolver with a warm cache sees
+func BenchmarkMemoryCacheParallel(b *testing.B) {
+	const keys = 10000
+	cache := NewMemoryCache(keys)
+	names := make([]string, keys)
+	value := make([]byte, 128)
+	for i := range names {
+		names[i] = "host" + strconv.Itoa(i) + ".example.com.:1:1"
+		cache.Set(names[i], value, time.Hour)
+	}
+	var seed atomic.Uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// Each goroutine walks the names from its own offset so they don't move in lockstep
+		i := int(seed.Add(7919))
+		for pb.Next() {
+			i++
+			key := names[i%keys]
+			if i%10 == 0 {
+				cache.Set(key, value, time.Hour)
+			} else {
+				cache.Get(key)
+			}
+		}
+	})
+}
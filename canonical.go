@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// canonicalizer is implemented by RData types with embedded names that are lowercased in canonical
+// form: those listed in RFC 4034 section 6.2 as amended by RFC 6840 section 5.1
+type canonicalizer interface {
+	canonical() RData // Returns a copy of the data with its names lowercased
+}
+
+// CanonicalRdata returns the record's RDATA in canonical wire form: uncompressed, with embedded
+// names lowercased for the types listed in RFC 4034 section 6.2 as amended by RFC 6840 section 5.1
+func CanonicalRdata(rec *DnsRecord) ([]byte, error) {
+	c := *rec
+	if data, ok := rec.Data.(canonicalizer); ok {
+		c.Data = data.canonical()
+	}
+	return packRdata(&c)
+}
+
+// SignatureLabels returns the label count an RRSIG over records owned by name carries: the labels
+// of the name not counting the root or a leading wildcard label (RFC 4034 section 3.1.3)
+func SignatureLabels(name Name) int {
+	labels := name.CountLabels()
+	if labels > 0 && name.labels[0] == "*" {
+		labels--
+	}
+	return labels
+}
+
+// CanonicalOwner returns the owner name a signature with the given label count covers, lowercased:
+// the name itself, or for records synthesized from a wildcard the wildcard name they came from
+// (RFC 4035 section 5.3.2)
+func CanonicalOwner(name Name, labels int) (Name, error) {
+	count := name.CountLabels()
+	if labels > count {
+		return Name{}, fmt.Errorf("signature covers %d labels but %s has %d", labels, name, count)
+	}
+	owner := name.Canonical()
+	if labels < count {
+		owner = Name{labels: append([]string{"*"}, owner.labels[count-labels:]...)}
+	}
+	return owner, nil
+}
+
+// CanonicalRecord returns a record in the canonical form signatures are computed over: owner name
+// and embedded names lowercased and uncompressed, and the TTL replaced with the signature's
+// original TTL (RFC 4034 section 6.2)
+func CanonicalRecord(rec *DnsRecord, ttl uint32) ([]byte, error) {
+	rdata, err := CanonicalRdata(rec)
+	if err != nil {
+		return nil, err
+	}
+	return canonicalRecord(parseNameLoose(rec.Name).Canonical(), rec, ttl, rdata)
+}
+
+// canonicalRecord encodes a record with the given owner and canonical RDATA
+func canonicalRecord(owner Name, rec *DnsRecord, ttl uint32, rdata []byte) ([]byte, error) {
+	if len(rdata) > 0xffff {
+		return nil, fmt.Errorf("%s %s data of %d bytes", rec.Name, rec.Qtype, len(rdata))
+	}
+	w := rdataWriter{buf: owner.Wire()}
+	w.u16(uint16(rec.Qtype))
+	w.u16(uint16(rec.Class))
+	w.u32(ttl)
+	w.u16(uint16(len(rdata)))
+	w.buf = append(w.buf, rdata...)
+	return w.bytes()
+}
+
+// CanonicalWire returns the RRset in the form a signature with the given original TTL and label
+// count covers: its records in canonical form and canonical order (RFC 4034 section 6.3), without
+// changing the order of s.Records
+func (s *RRSet) CanonicalWire(ttl uint32, labels int) ([]byte, error) {
+	owner, err := CanonicalOwner(parseNameLoose(s.Name), labels)
+	if err != nil {
+		return nil, err
+	}
+	order := make([]int, len(s.Records))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return canonicalOrder{s}.Less(order[i], order[j])
+	})
+	var wire []byte
+	for _, i := range order {
+		rec, err := canonicalRecord(owner, s.Records[i], ttl, s.rdata[i])
+		if err != nil {
+			return nil, err
+		}
+		wire = append(wire, rec...)
+	}
+	return wire, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testRecord parses one master file line in the example.com zone, failing the test on errors
+func testRecord(t *testing.T, line string) *DnsRecord {
+	t.Helper()
+	zone, err := ParseZone(strings.NewReader("$TTL 3600\n"+line+"\n"), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zone.Records) != 1 {
+		t.Fatalf("%q: got %d records", line, len(zone.Records))
+	}
+	return zone.Records[0]
+}
+
+// testHex decodes hex written with spaces between the fields
+func testHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestCanonicalRdata checks the canonical RDATA of the types RFC 4034 section 6.2 lowercases the
+// names of, and that those RFC 6840 section 5.1 removed from the list keep their case
+func TestCanonicalRdata(t *testing.T) {
+	const exampleCom = "07 6578616d706c65 03 636f6d 00" // example.com
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"@ NS NS1.Example.COM.", "03 6e7331" + exampleCom},
+		{"www CNAME Web.EXAMPLE.com.", "03 776562" + exampleCom},
+		{"1 PTR Host.Example.Com.", "04 686f7374" + exampleCom},
+		{"@ MX 10 Mail.Example.COM.", "000a 04 6d61696c" + exampleCom},
+		{"_sip._udp SRV 1 2 5060 SIP.example.com.", "0001 0002 13c4 03 736970" + exampleCom},
+		{"@ SOA NS1.Example.com. HostMaster.EXAMPLE.com. 1 2 3 4 5",
+			"03 6e7331" + exampleCom + "0a 686f73746d6173746572" + exampleCom +
+				"00000001 00000002 00000003 00000004 00000005"},
+		{"@ RP Admin.Example.COM. Info.Example.COM.", "05 61646d696e" + exampleCom + "04 696e666f" + exampleCom},
+		{`@ NAPTR 100 10 "S" "SIP+D2U" "" _SIP._udp.Example.com.`,
+			"0064 000a 01 53 07 5349502b443255 00 04 5f736970 04 5f756470" + exampleCom},
+		// The example of RFC 4034 section 3.3 with a mixed-case signer and a shorter signature
+		{"host RRSIG A 5 3 86400 20030322173103 20030220173103 2642 Example.COM. AAEC",
+			"0001 05 03 00015180 3e7c9dd7 3e5510d7 0a52" + exampleCom + "000102"},
+		// The example of RFC 4034 section 4.3 with a mixed-case next name, which RFC 6840 leaves as is
+		{"alfa NSEC Host.Example.com. A MX RRSIG NSEC TYPE1234",
+			"04 486f7374 07 4578616d706c65 03 636f6d 00 00 06 40 01 00 00 00 03 04 1b" +
+				strings.Repeat(" 00", 26) + " 20"},
+		{`@ TXT "Hello World"`, "0b 48656c6c6f20576f726c64"},
+	}
+	for _, tt := range tests {
+		rdata, err := CanonicalRdata(testRecord(t, tt.line))
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if want := testHex(t, tt.want); !bytes.Equal(rdata, want) {
+			t.Errorf("%q:\n got %x\nwant %x", tt.line, rdata, want)
+		}
+	}
+}
+
+// TestCanonicalRecord checks that the owner name is lowercased, the TTL replaced and the RDATA in
+// canonical form
+func TestCanonicalRecord(t *testing.T) {
+	rec := testRecord(t, "WWW.Example.COM. 300 IN CNAME Web.Example.COM.")
+	wire, err := CanonicalRecord(rec, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testHex(t, "03 777777 07 6578616d706c65 03 636f6d 00 0005 0001 00000e10 0011"+
+		"03 776562 07 6578616d706c65 03 636f6d 00")
+	if !bytes.Equal(wire, want) {
+		t.Errorf("got %x\nwant %x", wire, want)
+	}
+}
+
+// TestCanonicalNameOrder sorts the names of the example in RFC 4034 section 6.1
+func TestCanonicalNameOrder(t *testing.T) {
+	want := []string{
+		`example`,
+		`a.example`,
+		`yljkjljk.a.example`,
+		`Z.a.example`,
+		`zABC.a.EXAMPLE`,
+		`z.example`,
+		`\001.z.example`,
+		`*.z.example`,
+		`\200.z.example`,
+	}
+	names := make([]Name, len(want))
+	for i, s := range want {
+		name, err := ParseName(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names[len(names)-1-i] = name
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].Compare(names[j]) < 0 })
+	for i, name := range names {
+		if got := name.String(); got != want[i] {
+			t.Errorf("position %d: got %s, want %s", i, got, want[i])
+		}
+	}
+}
+
+// TestDSDigest checks the DS example of RFC 4034 section 5.4, whose digest covers the owner name in
+// canonical form, also when the owner is written in mixed case
+func TestDSDigest(t *testing.T) {
+	key := testRecord(t, "dskey.example.com. 86400 IN DNSKEY 256 3 5 "+
+		"AQOeiiR0GOMYkDshWoSKz9XzfwJr1AYtsmx3TGkJaNXVbfi/2pHm822aJ5iI9BMzNXxeYCmZDRD99WYwYqUSdjMm"+
+		"mAphXdvxegXd/M5+X7OrzKBaMbCVdFLUUh6DhweJBjEVv5f2wwjM9XzcnOf+EPbtG9DMBmADjFDc2w/rljwvFw==").DNSKEY()
+	if tag := key.KeyTag(); tag != 60485 {
+		t.Errorf("key tag %d, want 60485", tag)
+	}
+	ds := testRecord(t, "dskey.example.com. 86400 IN DS 60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118").DS()
+	for _, owner := range []string{"dskey.example.com", "DSKEY.Example.COM"} {
+		if !ds.Matches(owner, key) {
+			t.Errorf("DS doesn't match the key owned by %s", owner)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chaos injects faults into the messages a Server or Client sends, to exercise the code that copes
+// with lossy networks and misbehaving peers: retries, ID matching, TCP fallback and timeouts. Rates
+// are the fractions of messages affected, from 0 to 1. A nil Chaos injects nothing.
+type Chaos struct {
+	Drop      float64       // Messages never sent
+	Duplicate float64       // Messages sent twice
+	Corrupt   float64       // Messages with a random byte changed
+	WrongID   float64       // Messages sent with another message ID
+	Truncate  float64       // UDP responses cut to their question with TC set, forcing a retry over TCP
+	Delay     time.Duration // Messages are held back for a random time up to this long
+}
+
+// chaosFaults counts the faults injected by Chaos
+var chaosFaults = expvar.NewInt("chaos_faults")
+
+// chaosRate is one of the rates of a Chaos, with the name ParseChaos knows it by
+type chaosRate struct {
+	name string
+	rate *float64
+}
+
+// rates returns the fault rates of c
+func (c *Chaos) rates() []chaosRate {
+	return []chaosRate{
+		{"drop", &c.Drop},
+		{"dup", &c.Duplicate},
+		{"corrupt", &c.Corrupt},
+		{"wrong-id", &c.WrongID},
+		{"tc", &c.Truncate},
+	}
+}
+
+// ParseChaos parses a comma-separated list of faults and their rates, as percentages or fractions,
+// and the delay, such as "drop=5%,dup=1%,corrupt=0.5%,wrong-id=1%,tc=10%,delay=200ms"
+func ParseChaos(s string) (*Chaos, error) {
+	c := &Chaos{}
+	for _, field := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, fmt.Errorf("chaos fault %q has no rate", field)
+		}
+		name = strings.ToLower(name)
+		if name == "delay" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid chaos delay %q", value)
+			}
+			c.Delay = d
+			continue
+		}
+		found := false
+		for _, r := range c.rates() {
+			if r.name != name {
+				continue
+			}
+			rate, err := parseRate(value)
+			if err != nil {
+				return nil, err
+			}
+			*r.rate, found = rate, true
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown chaos fault %q, expected drop, dup, corrupt, wrong-id, tc or delay", name)
+		}
+	}
+	return c, nil
+}
+
+// parseRate parses a percentage such as 5% or a fraction such as 0.05
+func parseRate(s string) (float64, error) {
+	percent := strings.HasSuffix(s, "%")
+	rate, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if percent {
+		rate /= 100
+	}
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("invalid rate %q, expected a percentage or a fraction from 0 to 1", s)
+	}
+	return rate, nil
+}
+
+// String formats the faults as ParseChaos accepts them
+func (c *Chaos) String() string {
+	var fields []string
+	for _, r := range c.rates() {
+		if *r.rate > 0 {
+			fields = append(fields, fmt.Sprintf("%s=%g%%", r.name, *r.rate*100))
+		}
+	}
+	if c.Delay > 0 {
+		fields = append(fields, "delay="+c.Delay.String())
+	}
+	return strings.Join(fields, ",")
+}
+
+// hit decides at random whether a fault with the rate strikes, counting it if so
+func (c *Chaos) hit(rate float64) bool {
+	if rate <= 0 || rand.Float64() >= rate {
+		return false
+	}
+	chaosFaults.Add(1)
+	return true
+}
+
+// truncate decides whether a UDP response is replaced with a truncated one
+func (c *Chaos) truncate() bool {
+	return c != nil && c.hit(c.Truncate)
+}
+
+// Inject waits out the delay and returns the messages to send in place of msg: none if it is
+// dropped, two if it is duplicated, each possibly corrupted or given another ID
+func (c *Chaos) Inject(msg []byte) [][]byte {
+	if c == nil {
+		return [][]byte{msg}
+	}
+	if c.Delay > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(c.Delay) + 1)))
+	}
+	if c.hit(c.Drop) {
+		return nil
+	}
+	out := [][]byte{msg}
+	if c.hit(c.Duplicate) {
+		out = append(out, msg)
+	}
+	for i, m := range out {
+		wrongID, corrupt := len(m) >= 2 && c.hit(c.WrongID), len(m) > 0 && c.hit(c.Corrupt)
+		if !wrongID && !corrupt {
+			continue
+		}
+		m = append([]byte(nil), m...)
+		if wrongID {
+			// Any ID but the right one
+			id := (uint16(m[0])<<8 | uint16(m[1])) + uint16(1+rand.Intn(0xffff))
+			m[0], m[1] = byte(id>>8), byte(id)
+		}
+		if corrupt {
+			m[rand.Intn(len(m))] ^= byte(1 + rand.Intn(0xff))
+		}
+		out[i] = m
+	}
+	return out
+}
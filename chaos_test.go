@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// chaosServer serves an A record for every name from a Server injecting the faults of c, and
+// returns its address and the count of queries it answered
+func chaosServer(t *testing.T, c *Chaos) (string, *atomic.Int32) {
+	t.Helper()
+	var queries atomic.Int32
+	handler := HandlerFunc(func(req *Request) *DnsPacket {
+		queries.Add(1)
+		res := NewResponse(req.Packet)
+		res.Header.RecursionAvailable = true
+		res.Answers = append(res.Answers, NewRecord(req.Packet.Questions[0].Name, 300, &A{Addr: net.IPv4(192, 0, 2, 1)}))
+		return res
+	})
+	s := NewServer("", handler)
+	s.Chaos = c
+	return testServe(t, s), &queries
+}
+
+// chaosClient returns a Client giving up on each exchange after timeout
+func chaosClient(timeout time.Duration) *Client {
+	client := NewClient()
+	client.Timeout = timeout
+	return client
+}
+
+// chaosQuery returns a query for example.com IN A
+func chaosQuery() *DnsPacket {
+	query := NewDnsPacket()
+	query.Header.RecursionDesired = true
+	query.Questions = append(query.Questions, NewDnsQuestion("example.com", QTYPE_A))
+	return query
+}
+
+// isTimeout reports whether err is a network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// checkAnswer fails the test unless res answers chaosQuery with the server's address
+func checkAnswer(t *testing.T, res *DnsPacket) {
+	t.Helper()
+	if len(res.Answers) != 1 || res.Answers[0].String() != "example.com.\t300\tIN\tA\t192.0.2.1" {
+		t.Errorf("got answers %v, want example.com A 192.0.2.1", res.Answers)
+	}
+}
+
+// TestChaosWrongID checks that the client drops responses with another ID and waits for the right
+// one until its timeout rather than taking them
+func TestChaosWrongID(t *testing.T) {
+	addr, queries := chaosServer(t, &Chaos{WrongID: 1})
+	const timeout = 300 * time.Millisecond
+	start := time.Now()
+	res, err := chaosClient(timeout).Exchange(chaosQuery(), addr)
+	if !isTimeout(err) {
+		t.Fatalf("got %v, %v, want a timeout", res, err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("gave up after %s, before the timeout of %s", elapsed, timeout)
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("server answered %d queries, want 1", n)
+	}
+}
+
+// TestChaosTruncate checks that the client retries over TCP when the server sets TC over UDP
+func TestChaosTruncate(t *testing.T) {
+	addr, queries := chaosServer(t, &Chaos{Truncate: 1})
+	client := chaosClient(time.Second)
+	res, err := client.Exchange(chaosQuery(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Header.TruncatedMessage || len(res.Answers) != 0 {
+		t.Errorf("UDP response has TC %t and %d answers, want a truncated one", res.Header.TruncatedMessage, len(res.Answers))
+	}
+
+	res, err = client.Lookup("example.com", QTYPE_A, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Header.TruncatedMessage {
+		t.Error("Lookup returned the truncated UDP response")
+	}
+	checkAnswer(t, res)
+	// The Exchange, and Lookup over UDP and then TCP
+	if n := queries.Load(); n != 3 {
+		t.Errorf("server answered %d queries, want 3", n)
+	}
+}
+
+// TestChaosDrop checks that the client times out when responses are dropped, and that Lookup
+// retries once without EDNS before giving up
+func TestChaosDrop(t *testing.T) {
+	addr, queries := chaosServer(t, &Chaos{Drop: 1})
+	client := chaosClient(200 * time.Millisecond)
+	if res, err := client.Exchange(chaosQuery(), addr); !isTimeout(err) {
+		t.Fatalf("Exchange returned %v, %v, want a timeout", res, err)
+	}
+	if res, err := client.Lookup("example.com", QTYPE_A, addr); !isTimeout(err) {
+		t.Fatalf("Lookup returned %v, %v, want a timeout", res, err)
+	}
+	if n := queries.Load(); n != 3 {
+		t.Errorf("server answered %d queries, want 3", n)
+	}
+}
+
+// TestChaosDuplicate checks that the client takes the first of duplicated responses, and that the
+// second doesn't disturb the next exchange
+func TestChaosDuplicate(t *testing.T) {
+	addr, queries := chaosServer(t, &Chaos{Duplicate: 1})
+	client := chaosClient(time.Second)
+	for i := 0; i < 3; i++ {
+		query := chaosQuery()
+		res, err := client.Exchange(query, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Header.ID != query.Header.ID {
+			t.Errorf("response ID %d, want %d", res.Header.ID, query.Header.ID)
+		}
+		checkAnswer(t, res)
+	}
+	if n := queries.Load(); n != 3 {
+		t.Errorf("server answered %d queries, want 3", n)
+	}
+}
+
+// TestChaosCorrupt checks that a corrupted response is either dropped, leaving the client to time
+// out, or still matches the query it answers
+func TestChaosCorrupt(t *testing.T) {
+	addr, _ := chaosServer(t, &Chaos{Corrupt: 1})
+	client := chaosClient(200 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		query := chaosQuery()
+		res, err := client.Exchange(query, addr)
+		if err != nil {
+			if !isTimeout(err) {
+				t.Errorf("got %v, want a response or a timeout", err)
+			}
+			continue
+		}
+		if err := acceptResponse(query, res, false); err != nil {
+			t.Errorf("took a response that doesn't match the query: %v", err)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// ZoneProblem is a single issue found while checking a zone
+type ZoneProblem struct {
+	Warning bool   // Warnings don't prevent the zone from being served
+	Name    string // The owner name the problem applies to
+	Message string // Human readable description
+}
+
+// String formats the problem like a compiler diagnostic
+func (p ZoneProblem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+	return fmt.Sprintf("%s: %s: %s", level, p.Name, p.Message)
+}
+
+// CheckZone validates a parsed zone for common errors before it is served
+func CheckZone(zone *Zone) []ZoneProblem {
+	var problems []ZoneProblem
+	fail := func(name, format string, args ...interface{}) {
+		problems = append(problems, ZoneProblem{Name: name + ".", Message: fmt.Sprintf(format, args...)})
+	}
+	warn := func(name, format string, args ...interface{}) {
+		problems = append(problems, ZoneProblem{Warning: true, Name: name + ".", Message: fmt.Sprintf(format, args...)})
+	}
+
+	origin := parseNameLoose(zone.Origin).Key()
+	byName := make(map[string]map[QueryType][]*DnsRecord)
+	for _, rec := range zone.Records {
+		name := parseNameLoose(rec.Name).Key()
+		if !isSubdomain(name, origin) {
+			fail(rec.Name, "%s record is out of zone %s.", rec.Qtype, zone.Origin)
+			continue
+		}
+		if byName[name] == nil {
+			byName[name] = make(map[QueryType][]*DnsRecord)
+		}
+		byName[name][rec.Qtype] = append(byName[name][rec.Qtype], rec)
+	}
+
+	// The apex must carry exactly one SOA and at least one NS
+	apex := byName[origin]
+	switch soas := apex[QTYPE_SOA]; len(soas) {
+	case 0:
+		fail(zone.Origin, "no SOA record at zone apex")
+	case 1:
+		checkSerial(soas[0], warn)
+	default:
+		fail(zone.Origin, "multiple SOA records at zone apex")
+	}
+	if len(apex[QTYPE_NS]) == 0 {
+		fail(zone.Origin, "no NS records at zone apex")
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Delegation points are names below the apex that carry NS records
+	var cuts []string
+	for _, name := range names {
+		if name != origin && len(byName[name][QTYPE_NS]) > 0 {
+			cuts = append(cuts, name)
+		}
+	}
+	underCut := func(name string) string {
+		for _, cut := range cuts {
+			if isSubdomain(name, cut) {
+				return cut
+			}
+		}
+		return ""
+	}
+
+	// Classless reverse zones (RFC 2317) only hold the addresses of their range
+	network, classless := ParseClasslessReverseZone(zone.Origin)
+
+	for _, name := range names {
+		types := byName[name]
+		if classless && len(types[QTYPE_PTR]) > 0 && name != origin {
+			if ip, ok := classlessAddr(parseNameLoose(name), parseNameLoose(origin), network); !ok || !network.Contains(ip) {
+				warn(name, "PTR record outside the range %s of the classless reverse zone", network)
+			}
+		}
+		if name != origin {
+			if len(types[QTYPE_SOA]) > 0 {
+				fail(name, "SOA record not at zone apex")
+			}
+		}
+
+		if cnames := types[QTYPE_CNAME]; len(cnames) > 0 {
+			if len(cnames) > 1 {
+				fail(name, "multiple CNAME records")
+			}
+			for qtype := range types {
+				if qtype != QTYPE_CNAME {
+					fail(name, "CNAME and other data (%s)", qtype)
+				}
+			}
+		}
+
+		if cut := underCut(name); cut != "" && name != cut {
+			for qtype := range types {
+				if qtype != QTYPE_A && qtype != QTYPE_AAAA {
+					warn(name, "%s data below delegation point %s. is occluded", qtype, cut)
+				}
+			}
+		}
+
+		for _, qtype := range []QueryType{QTYPE_NS, QTYPE_MX, QTYPE_SRV} {
+			for _, rec := range types[qtype] {
+				host, _ := targetName(rec.Data)
+				target := parseNameLoose(host).Key()
+				if !isSubdomain(target, origin) {
+					continue
+				}
+				if len(byName[target][QTYPE_CNAME]) > 0 {
+					fail(name, "%s target %s. is an alias (CNAME)", qtype, host)
+					continue
+				}
+				hasAddr := len(byName[target][QTYPE_A]) > 0 || len(byName[target][QTYPE_AAAA]) > 0
+				if hasAddr {
+					continue
+				}
+				// In-zone NS targets below a delegation need glue to be reachable at all
+				if qtype == QTYPE_NS && underCut(target) != "" {
+					fail(name, "missing glue A/AAAA record for %s.", host)
+				} else if underCut(target) == "" {
+					fail(name, "%s target %s. has no address records", qtype, host)
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+// checkSerial flags SOA serials that look date-based (YYYYMMDDnn) but aren't valid dates
+func checkSerial(soa *DnsRecord, warn func(name, format string, args ...interface{})) {
+	data, ok := soa.Data.(*SOA)
+	if !ok {
+		return
+	}
+	if data.Serial == 0 {
+		warn(soa.Name, "SOA serial is 0")
+		return
+	}
+	serial := fmt.Sprintf("%d", data.Serial)
+	if len(serial) != 10 || (serial[:2] != "19" && serial[:2] != "20") {
+		return
+	}
+	date, err := time.Parse("20060102", serial[:8])
+	if err != nil {
+		warn(soa.Name, "SOA serial %s looks like YYYYMMDDnn but %s is not a valid date", serial, serial[:8])
+		return
+	}
+	if date.After(time.Now().AddDate(0, 0, 1)) {
+		warn(soa.Name, "SOA serial %s is dated in the future", serial)
+	}
+}
+
+// isSubdomain reports whether name equals or is below parent, comparing label by label
+func isSubdomain(name, parent string) bool {
+	return parseNameLoose(name).IsSubdomainOf(parseNameLoose(parent))
+}
+
+// runCheckZone implements the "checkzone" subcommand
+func runCheckZone(args []string) int {
+	fs := flag.NewFlagSet("checkzone", flag.ExitOnError)
+	origin := fs.String("origin", "", "zone origin, when the file has no $ORIGIN directive")
+	output := fs.String("o", "", "write the zone in canonical form, sorted and with relative owner names, to this file")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gdns checkzone [-origin example.com] [-o canonical.db] zone.db\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	zone, err := LoadZoneFile(fs.Arg(0), *origin)
+	if err != nil {
+		fmt.Printf("%s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+	if zone.Origin == "" {
+		fmt.Printf("%s: zone origin unknown, use -origin or $ORIGIN\n", fs.Arg(0))
+		return 1
+	}
+
+	failures := 0
+	for _, problem := range CheckZone(zone) {
+		fmt.Println(problem)
+		if !problem.Warning {
+			failures++
+		}
+	}
+	if failures > 0 {
+		fmt.Printf("zone %s/IN: %d errors, not loaded\n", zone.Origin, failures)
+		return 1
+	}
+
+	var serial uint32
+	for _, rec := range zone.Records {
+		if soa, ok := rec.Data.(*SOA); ok {
+			serial = soa.Serial
+		}
+	}
+	fmt.Printf("zone %s/IN: loaded serial %d (%d records)\n", zone.Origin, serial, len(zone.Records))
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err == nil {
+			err = WriteZone(f, zone.Origin, zone.Records)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			fmt.Printf("%s: %v\n", *output, err)
+			return 1
+		}
+	}
+	return 0
+}
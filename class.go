@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Class is the class of a question or record. Nearly everything is IN; CH carries the queries for
+// a server's own identity such as version.bind.
+type Class uint16
+
+const (
+	CLASS_IN   Class = 1   // Internet
+	CLASS_CS   Class = 2   // CSNET, obsolete
+	CLASS_CH   Class = 3   // Chaos
+	CLASS_HS   Class = 4   // Hesiod
+	CLASS_NONE Class = 254 // Deletions and prerequisites in dynamic updates (RFC 2136)
+	CLASS_ANY  Class = 255 // Any class, in questions only
+)
+
+// classNames maps classes to their mnemonics
+var classNames = map[Class]string{
+	CLASS_IN:   "IN",
+	CLASS_CS:   "CS",
+	CLASS_CH:   "CH",
+	CLASS_HS:   "HS",
+	CLASS_NONE: "NONE",
+	CLASS_ANY:  "ANY",
+}
+
+// String returns the class mnemonic, or CLASSnnn for classes without one (RFC 3597)
+func (c Class) String() string {
+	if name, ok := classNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("CLASS%d", uint16(c))
+}
+
+// ClassFromString parses a class mnemonic or CLASSnnn notation
+func ClassFromString(s string) (Class, error) {
+	s = strings.ToUpper(s)
+	for c, name := range classNames {
+		if name == s {
+			return c, nil
+		}
+	}
+	if strings.HasPrefix(s, "CLASS") {
+		if n, err := strconv.ParseUint(s[5:], 10, 16); err == nil {
+			return Class(n), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown class %q", s)
+}
+
+// servedClass reports whether the server answers queries of the class: IN, CH and HS, or ANY
+func servedClass(c Class) bool {
+	switch c {
+	case CLASS_IN, CLASS_CH, CLASS_HS, CLASS_ANY:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ParseClasslessReverseZone recognizes the origin of a classless in-addr.arpa zone, named after the
+// first address of the range it covers and the prefix length, as in RFC 2317 (0/25.113.0.203.in-addr.arpa)
+// or RFC 4183 (0-25.113.0.203.in-addr.arpa), and returns that range
+func ParseClasslessReverseZone(origin string) (*net.IPNet, bool) {
+	labels := parseNameLoose(origin).Canonical().Labels()
+	n := len(labels)
+	if n < 4 || n > 6 || labels[n-2] != "in-addr" || labels[n-1] != "arpa" {
+		return nil, false
+	}
+	first, length, ok := strings.Cut(labels[0], "/")
+	if !ok {
+		first, length, ok = strings.Cut(labels[0], "-")
+	}
+	if !ok {
+		return nil, false
+	}
+	// The octets above the range, most significant last, then the range's first value
+	octets := n - 3
+	ip := make(net.IP, 4)
+	for i := 0; i < octets; i++ {
+		v, err := strconv.ParseUint(labels[n-3-i], 10, 8)
+		if err != nil {
+			return nil, false
+		}
+		ip[i] = byte(v)
+	}
+	v, err := strconv.ParseUint(first, 10, 8)
+	bits, lerr := strconv.Atoi(length)
+	if err != nil || lerr != nil || bits <= 8*octets || bits > 8*octets+8 {
+		return nil, false
+	}
+	ip[octets] = byte(v)
+	mask := net.CIDRMask(bits, 32)
+	if !ip.Mask(mask).Equal(ip) {
+		return nil, false
+	}
+	return &net.IPNet{IP: ip, Mask: mask}, true
+}
+
+// classlessAddr returns the address a name directly below a classless zone's origin stands for, as
+// RFC 2317 names it after the last octet of the address
+func classlessAddr(name Name, origin Name, network *net.IPNet) (net.IP, bool) {
+	if name.CountLabels() != origin.CountLabels()+1 || !name.IsSubdomainOf(origin) {
+		return nil, false
+	}
+	v, err := strconv.ParseUint(name.Labels()[0], 10, 8)
+	if err != nil {
+		return nil, false
+	}
+	ones, _ := network.Mask.Size()
+	ip := append(net.IP(nil), network.IP.To4()...)
+	ip[(ones-1)/8] = byte(v)
+	return ip, true
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client sends DNS queries to upstream servers over UDP
+type Client struct {
+	Timeout   time.Duration // Time to wait for each response
+	UDPSize   uint16        // EDNS payload size advertised by Lookup, 0 to send plain DNS queries
+	TLSConfig *tls.Config   // Settings for DoT and DoH connections, nil for the defaults
+
+	// AddrPreference orders the addresses LookupIP returns, by RFC 6724 rules unless a family is preferred
+	AddrPreference AddrPreference
+
+	// CaseRandomization sends names over UDP in randomly mixed letter case (0x20 encoding) and
+	// drops responses that don't echo it exactly. Some servers don't preserve case and never answer.
+	CaseRandomization bool
+
+	// Outstanding caps the queries in flight to each server, nil for no cap
+	Outstanding *OutstandingTable
+
+	// Chaos injects faults into queries sent over UDP, nil for none
+	Chaos *Chaos
+
+	noEDNS   map[string]bool   // Servers found not to handle EDNS queries
+	upgrades map[string]string // Servers mapped to the encrypted resolvers they designated
+	pinned   map[string]string // Encrypted resolver addresses mapped to the IPs learned from DDR
+	doh      *http.Client
+	ids      *IDAllocator         // Message IDs in flight, per server
+	idle     map[string]*idleConn // TCP and TLS connections kept open between queries, per server
+	mu       sync.Mutex
+}
+
+// NewClient initializes and returns a new Client with default settings
+func NewClient() *Client {
+	return &Client{
+		Timeout: 5 * time.Second,
+		UDPSize: DefaultEDNSSize,
+	}
+}
+
+// Exchange sends a query packet to the server and returns the parsed response. The server is a
+// plain DNS address sent queries over UDP, a tls://host[:port] DoT server or an https:// DoH URL.
+// The query is given a fresh message ID that no other query in flight to the server uses, and
+// waits its turn when the server already has as many queries outstanding as Outstanding allows.
+func (c *Client) Exchange(query *DnsPacket, server string) (*DnsPacket, error) {
+	if upgraded := c.upgraded(server); upgraded != "" {
+		server = upgraded
+	}
+	done, err := c.admit(server)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if strings.HasPrefix(server, "https://") {
+		return c.ExchangeHTTPS(query, server)
+	}
+	release, err := c.assignID(query, server)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if strings.HasPrefix(server, "tls://") {
+		return c.ExchangeTLS(query, strings.TrimPrefix(server, "tls://"))
+	}
+
+	conn, err := net.Dial("udp", serverAddr(server))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	wire := query
+	if c.CaseRandomization {
+		wire = randomizeCase(query)
+	}
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+	msg, err := wire.Pack()
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range c.Chaos.Inject(msg) {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	// Drop anything that isn't the response to this query, be it a stray datagram, a late answer to
+	// an earlier query or a spoofing attempt, and keep waiting for the real one until the deadline
+	udp := conn.(*net.UDPConn)
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, from, err := udp.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		if !sameAddr(from, conn.RemoteAddr()) {
+			continue
+		}
+		packet, err := DnsPacketFromBuffer(&BytePacketBuffer{buf: buf[:n]})
+		if err != nil || acceptResponse(wire, packet, c.CaseRandomization) != nil {
+			continue
+		}
+		if wire != query {
+			restoreCase(packet, wire, query)
+		}
+		return packet, nil
+	}
+}
+
+// Lookup queries the server for a single name and record type with recursion desired. ANY queries
+// to plain DNS servers are sent over TCP; use IsMinimalANY to spot RFC 8482 minimal answers.
+func (c *Client) Lookup(qname string, qtype QueryType, server string) (*DnsPacket, error) {
+	return c.LookupClass(qname, qtype, CLASS_IN, server)
+}
+
+// LookupClass is Lookup for a question of another class than IN, such as CH
+func (c *Client) LookupClass(qname string, qtype QueryType, qclass Class, server string) (*DnsPacket, error) {
+	query := NewDnsPacket()
+	query.Header.RecursionDesired = true
+	question := NewDnsQuestion(qname, qtype)
+	question.Qclass = qclass
+	query.Questions = append(query.Questions, question)
+	if c.UDPSize > 0 && c.supportsEDNS(server) {
+		query.SetEDNS(c.UDPSize)
+	}
+
+	if qtype == QTYPE_ANY && !strings.Contains(server, "://") && c.upgraded(server) == "" {
+		// Servers cut ANY answers short over UDP to deter amplification; TCP gets the fullest answer
+		// they are willing to give, which may still be a single RRset or a synthesized HINFO record
+		res, err := c.ExchangeTCP(query, server)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", server, err)
+		}
+		return res, nil
+	}
+	res, err := c.Exchange(query, server)
+	if query.OPT() != nil && ednsRejected(res, err) {
+		// Legacy servers and middleboxes answer FORMERR or drop EDNS queries; retry without OPT
+		query.RemoveEDNS()
+		if res, err = c.Exchange(query, server); err == nil && !ednsRejected(res, nil) {
+			c.disableEDNS(server)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", server, err)
+	}
+	if res.Header.TruncatedMessage {
+		res, err = c.ExchangeTCP(query, server)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w: TCP retry failed: %v", server, ErrTruncated, err)
+		}
+	}
+	return res, nil
+}
+
+// ednsRejected reports whether an EDNS query failed in a way that suggests the server doesn't understand OPT
+func ednsRejected(res *DnsPacket, err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return err == nil && res.Header.ResCode == FORMERR && res.OPT() == nil
+}
+
+// supportsEDNS reports whether EDNS queries should still be sent to the server
+func (c *Client) supportsEDNS(server string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.noEDNS[serverAddr(server)]
+}
+
+// disableEDNS remembers that the server only answers queries without OPT
+func (c *Client) disableEDNS(server string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.noEDNS == nil {
+		c.noEDNS = make(map[string]bool)
+	}
+	c.noEDNS[serverAddr(server)] = true
+}
+
+// ExchangeTCP sends a query packet to the server over TCP and returns the parsed response. Like
+// Exchange, it gives the query a message ID not in flight to the server. EDNS queries reuse the
+// connection of an earlier one while the server's edns-tcp-keepalive timeout allows.
+func (c *Client) ExchangeTCP(query *DnsPacket, server string) (*DnsPacket, error) {
+	done, err := c.admit(server)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	release, err := c.assignID(query, server)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	addr := serverAddr(server)
+	return c.exchangeStream(addr, query, func() (net.Conn, error) {
+		return c.dial(context.Background(), "tcp", addr)
+	})
+}
+
+// Transfer fetches all records of a zone from the server using AXFR
+func (c *Client) Transfer(zone, server string) ([]*DnsRecord, error) {
+	conn, err := net.DialTimeout("tcp", serverAddr(server), c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	query := NewDnsPacket()
+	release, err := c.assignID(query, server)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	query.Questions = append(query.Questions, NewDnsQuestion(zone, QTYPE_AXFR))
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+	if _, err := query.WriteTo(conn); err != nil {
+		return nil, err
+	}
+
+	// The transfer is complete once the closing SOA record arrives
+	var records []*DnsRecord
+	soas := 0
+	for soas < 2 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+		packet, err := ReadMessage(conn)
+		if err != nil {
+			return nil, fmt.Errorf("%s: transfer of %s: %w", server, zone, err)
+		}
+		if err := checkRcode(packet); err != nil {
+			return nil, fmt.Errorf("%s: transfer refused: %w", server, err)
+		}
+		if len(packet.Answers) == 0 {
+			return nil, fmt.Errorf("%s: transfer of %s returned no records", server, zone)
+		}
+		for _, rec := range packet.Answers {
+			if rec.Qtype == QTYPE_SOA {
+				soas++
+				if soas == 2 {
+					break
+				}
+			}
+			records = append(records, rec)
+		}
+	}
+	if merged, err := MergeRRSets(records); err == nil {
+		records = merged
+	}
+	return records, nil
+}
+
+// readTCPMessage reads one length-prefixed message from a TCP stream
+func readTCPMessage(r io.Reader) (*BytePacketBuffer, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	length := int(prefix[0])<<8 | int(prefix[1])
+	buffer := NewBytePacketBufferSize(length)
+	if _, err := io.ReadFull(r, buffer.buf); err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+// assignID sets the query's ID to one reserved for the server and returns the function freeing it
+func (c *Client) assignID(query *DnsPacket, server string) (func(), error) {
+	c.mu.Lock()
+	if c.ids == nil {
+		c.ids = NewIDAllocator()
+	}
+	ids := c.ids
+	c.mu.Unlock()
+
+	addr := server
+	if !strings.Contains(server, "://") {
+		addr = serverAddr(server)
+	}
+	id, err := ids.Acquire(addr)
+	if err != nil {
+		return nil, err
+	}
+	query.Header.ID = id
+	return func() { ids.Release(addr, id) }, nil
+}
+
+// serverAddr appends the default DNS port to a server address when missing
+func serverAddr(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, "53")
+}
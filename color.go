@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// ANSI SGR codes used by Palette
+const (
+	ansiBold   = "1"
+	ansiDim    = "2"
+	ansiRed    = "31"
+	ansiGreen  = "32"
+	ansiYellow = "33"
+	ansiCyan   = "36"
+)
+
+// Palette colors CLI output with ANSI escapes when enabled and passes text through unchanged otherwise
+type Palette struct {
+	Enabled bool
+}
+
+// NewPalette picks colors for output written to f. The mode is "always", "never" or "auto", which
+// colors only terminals and honors the NO_COLOR convention (https://no-color.org) and TERM=dumb.
+func NewPalette(mode string, f *os.File) (*Palette, error) {
+	switch mode {
+	case "always":
+		return &Palette{Enabled: true}, nil
+	case "never":
+		return &Palette{}, nil
+	case "auto":
+		if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+			return &Palette{}, nil
+		}
+		return &Palette{Enabled: isTerminal(f)}, nil
+	}
+	return nil, fmt.Errorf("unknown color mode %q, expected auto, always or never", mode)
+}
+
+// isTerminal reports whether f is a character device such as a terminal rather than a pipe or file
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// paint wraps s in the escape sequence for code
+func (p *Palette) paint(code, s string) string {
+	if p == nil || !p.Enabled {
+		return s
+	}
+	return "\x1b[" + code + "m" + s + "\x1b[0m"
+}
+
+// Name formats a domain name
+func (p *Palette) Name(s string) string {
+	return p.paint(ansiBold, s)
+}
+
+// Type formats a record type
+func (p *Palette) Type(qtype QueryType) string {
+	return p.paint(ansiCyan, qtype.String())
+}
+
+// TTL formats a TTL
+func (p *Palette) TTL(ttl uint32) string {
+	return p.paint(ansiDim, strconv.FormatUint(uint64(ttl), 10))
+}
+
+// Rcode formats a result code: green for success, yellow for NXDOMAIN and red for failures
+func (p *Palette) Rcode(rc ResultCode) string {
+	switch rc {
+	case NOERROR:
+		return p.paint(ansiGreen, rc.String())
+	case NXDOMAIN:
+		return p.paint(ansiYellow, rc.String())
+	}
+	return p.paint(ansiRed, rc.String())
+}
+
+// Added formats a line describing something added
+func (p *Palette) Added(s string) string {
+	return p.paint(ansiGreen, s)
+}
+
+// Removed formats a line describing something removed
+func (p *Palette) Removed(s string) string {
+	return p.paint(ansiRed, s)
+}
+
+// Comment formats secondary information such as section headings
+func (p *Palette) Comment(s string) string {
+	return p.paint(ansiDim, s)
+}
+
+// Record formats a record in zone file presentation format, like DnsRecord.String
+func (p *Palette) Record(rec *DnsRecord) string {
+	return fmt.Sprintf("%s.\t%s\t%s\t%s\t%s", p.Name(rec.Name), p.TTL(rec.TTL), className(rec.Class), p.Type(rec.Qtype), rec.RdataString())
+}
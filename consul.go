@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// consulWait is how long a Consul blocking query may wait for a change
+const consulWait = 5 * time.Minute
+
+// ConsulWatcher keeps a KVSource in step with a key prefix in Consul's KV store using blocking queries
+type ConsulWatcher struct {
+	Addr   string // Base URL of the Consul agent, e.g. http://127.0.0.1:8500
+	Prefix string
+	Token  string // ACL token, if the agent requires one
+	Source *KVSource
+	Client *http.Client
+}
+
+// Run polls the prefix, waking as soon as Consul reports a change, and retries after errors
+func (w *ConsulWatcher) Run() {
+	var index uint64
+	for {
+		next, err := w.poll(index)
+		if err != nil {
+			log.Printf("consul %s: %v", w.Addr, err)
+			index = 0
+			time.Sleep(kvRetryDelay)
+			continue
+		}
+		// The index can go backwards after a Consul restore; start over from a full read
+		if next < index {
+			next = 0
+		}
+		index = next
+	}
+}
+
+// poll waits until the prefix changes after index, applies its contents and returns the new index
+func (w *ConsulWatcher) poll(index uint64) (uint64, error) {
+	query := url.Values{"recurse": {"true"}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", consulWait.String())
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(w.Addr, "/")+"/v1/kv/"+strings.TrimPrefix(w.Prefix, "/")+"?"+query.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	if w.Token != "" {
+		req.Header.Set("X-Consul-Token", w.Token)
+	}
+	client := w.Client
+	if client == nil {
+		// Consul adds up to wait/16 of jitter to blocking queries
+		client = &http.Client{Timeout: consulWait + consulWait/16 + 10*time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// A missing prefix is reported as 404 but is simply empty
+	var pairs []struct {
+		Key   string
+		Value *string // Base64, null for keys without a value
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+			return 0, err
+		}
+	case http.StatusNotFound:
+	default:
+		return 0, fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid X-Consul-Index: %w", err)
+	}
+	if next == index {
+		// The wait timed out without a change
+		return index, nil
+	}
+
+	snapshot := make(map[string]string)
+	for _, pair := range pairs {
+		if pair.Value == nil {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(*pair.Value)
+		if err != nil {
+			return 0, err
+		}
+		snapshot[pair.Key] = string(value)
+	}
+	w.Source.Replace(snapshot)
+	return next, nil
+}
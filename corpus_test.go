@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// update rewrites the golden files of the corpus from the current decoding: go test -run Corpus -update
+var update = flag.Bool("update", false, "write the golden files of testdata/corpus instead of checking them")
+
+// TestCorpus checks that each message of the corpus of responses in testdata/corpus still decodes to
+// the golden description next to it, locking in parser behavior
+func TestCorpus(t *testing.T) {
+	entries, err := corpusEntries(filepath.Join("testdata", "corpus"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Run(e.name, func(t *testing.T) {
+			msg, err := readCorpusHex(e.hex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeCorpusMessage(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *update {
+				if err := os.WriteFile(e.golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(e.golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line, w, g := firstDifference(string(want), got); line > 0 {
+				t.Errorf("line %d differs\n\twant: %s\n\tgot:  %s", line, w, g)
+			}
+		})
+	}
+}
+
+// corpusEntry is one message of a golden corpus: a hex dump, whose # lines describe it, and the
+// golden file holding what it decodes to
+type corpusEntry struct {
+	name   string
+	hex    string
+	golden string
+}
+
+// corpusEntries lists the messages of the corpus in dir, by name
+func corpusEntries(dir string) ([]corpusEntry, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.hex"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%s: no .hex messages", dir)
+	}
+	sort.Strings(paths)
+	entries := make([]corpusEntry, len(paths))
+	for i, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".hex")
+		entries[i] = corpusEntry{name: name, hex: path, golden: filepath.Join(dir, name+".golden")}
+	}
+	return entries, nil
+}
+
+// readCorpusHex reads a hex dump, ignoring whitespace and # comment lines
+func readCorpusHex(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var digits strings.Builder
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			digits.WriteString(strings.Join(strings.Fields(line), ""))
+		}
+	}
+	msg, err := hex.DecodeString(digits.String())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return msg, nil
+}
+
+// describeMessage renders everything a decoded message holds, as decode prints it followed by its
+// EDNS version, flags, payload size and options, which decode leaves out
+func describeMessage(packet *DnsPacket) string {
+	var b bytes.Buffer
+	PrintResponse(&b, packet, &Palette{})
+	if opt := packet.OPT(); opt != nil {
+		flags := "none"
+		if opt.TTL&ednsDO != 0 {
+			flags = "do"
+		}
+		fmt.Fprintf(&b, ";; EDNS: version %d, flags: %s, extended rcode %d, udp %d\n", opt.TTL>>16&0xff, flags, opt.TTL>>24, uint16(opt.Class))
+		options, err := ParseEDNSOptions(opt.ednsOptions())
+		if err != nil {
+			fmt.Fprintf(&b, ";; EDNS options: %v\n", err)
+		}
+		for _, option := range options {
+			fmt.Fprintf(&b, ";; EDNS option %d: %x\n", option.Code, option.Data)
+		}
+	}
+	return b.String()
+}
+
+// decodeCorpusMessage decodes a corpus message and checks that encoding it again gives a message
+// that decodes the same way
+func decodeCorpusMessage(msg []byte) (string, error) {
+	packet, err := DnsPacketFromBuffer(&BytePacketBuffer{buf: msg})
+	if err != nil {
+		return "", err
+	}
+	got := describeMessage(packet)
+	packed, err := packet.Pack()
+	if err != nil {
+		return "", fmt.Errorf("encoding again: %v", err)
+	}
+	again, err := DnsPacketFromBuffer(&BytePacketBuffer{buf: packed})
+	if err != nil {
+		return "", fmt.Errorf("decoding the message encoded again: %v", err)
+	}
+	if describeMessage(again) != got {
+		return "", fmt.Errorf("encoding again changes the message:\n%s", describeMessage(again))
+	}
+	return got, nil
+}
+
+// firstDifference returns the first line where two texts differ, numbered from 1
+func firstDifference(want, got string) (int, string, string) {
+	wantLines, gotLines := strings.Split(want, "\n"), strings.Split(got, "\n")
+	for i := 0; i < max(len(wantLines), len(gotLines)); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w != g {
+			return i + 1, w, g
+		}
+	}
+	return 0, "", ""
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ddrName is the special-use name queried to discover designated resolvers (RFC 9462)
+const ddrName = "_dns.resolver.arpa"
+
+// DesignatedResolver is an encrypted resolver advertised by an unencrypted one
+type DesignatedResolver struct {
+	Priority uint16   // SvcPriority of the SVCB record, lower is preferred
+	Target   string   // Name the resolver's certificate is issued for
+	URL      string   // tls://target:port for DoT, https://target:port/path for DoH
+	Addrs    []net.IP // Addresses to reach the resolver on
+}
+
+// DiscoverResolvers asks server for its designated encrypted resolvers, in order of preference
+func (c *Client) DiscoverResolvers(server string) ([]*DesignatedResolver, error) {
+	res, err := c.Lookup(ddrName, QTYPE_SVCB, server)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRcode(res); err != nil {
+		return nil, err
+	}
+
+	var resolvers []*DesignatedResolver
+	for _, rec := range res.Answers {
+		// Alias mode records (priority 0) aren't used for DDR
+		svcb, ok := rec.Data.(*SVCB)
+		if !ok || svcb.Priority == 0 {
+			continue
+		}
+		target := parseNameLoose(svcb.Target).String()
+		if target == "" {
+			target = parseNameLoose(rec.Name).String()
+		}
+		port := ""
+		if value, ok := svcb.ServiceParam(SVCB_PORT); ok && len(value) == 2 {
+			port = strconv.Itoa(int(value[0])<<8 | int(value[1]))
+		}
+		addrs := svcb.AddressHints()
+		if len(addrs) == 0 {
+			addrs = c.resolveTarget(target, server)
+		}
+
+		for _, alpn := range svcb.ALPN() {
+			d := &DesignatedResolver{Priority: svcb.Priority, Target: target, Addrs: addrs}
+			switch alpn {
+			case "dot":
+				d.URL = "tls://" + net.JoinHostPort(target, defaultString(port, "853"))
+			case "h2", "h3":
+				path, ok := svcb.ServiceParam(SVCB_DOHPATH)
+				if !ok {
+					continue
+				}
+				// The path is a URI template; POST requests don't use the {?dns} variable
+				template := string(path)
+				if i := strings.Index(template, "{"); i >= 0 {
+					template = template[:i]
+				}
+				d.URL = "https://" + net.JoinHostPort(target, defaultString(port, "443")) + template
+			default:
+				continue
+			}
+			if !containsResolver(resolvers, d.URL) {
+				resolvers = append(resolvers, d)
+			}
+		}
+	}
+	sort.SliceStable(resolvers, func(i, j int) bool { return resolvers[i].Priority < resolvers[j].Priority })
+	return resolvers, nil
+}
+
+// Upgrade discovers the encrypted resolvers designated by server and verifies them (RFC 9462 section 4.2).
+// The first one whose certificate also covers the server's own IP address is used for all later
+// queries to server.
+func (c *Client) Upgrade(server string) (*DesignatedResolver, error) {
+	host, _, err := net.SplitHostPort(serverAddr(server))
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("%s: verified discovery needs the resolver's IP address", server)
+	}
+	resolvers, err := c.DiscoverResolvers(server)
+	if err != nil {
+		return nil, err
+	}
+	if len(resolvers) == 0 {
+		return nil, fmt.Errorf("%s: no designated resolvers", server)
+	}
+
+	var failures []error
+	for _, d := range resolvers {
+		for _, addr := range d.Addrs {
+			dialAddr, err := c.verifyDesignated(d, addr, ip)
+			if err != nil {
+				failures = append(failures, fmt.Errorf("%s via %s: %w", d.URL, addr, err))
+				continue
+			}
+			c.mu.Lock()
+			if c.upgrades == nil {
+				c.upgrades = make(map[string]string)
+				c.pinned = make(map[string]string)
+			}
+			c.upgrades[serverAddr(server)] = d.URL
+			c.pinned[d.hostPort()] = dialAddr
+			c.mu.Unlock()
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: no designated resolver could be verified: %w", server, errors.Join(failures...))
+}
+
+// verifyDesignated connects to a designated resolver and checks that its certificate, besides being
+// valid for the target name, lists the IP address of the unencrypted resolver. It returns the
+// address it connected to.
+func (c *Client) verifyDesignated(d *DesignatedResolver, addr, resolverIP net.IP) (string, error) {
+	_, port, _ := net.SplitHostPort(d.hostPort())
+	dialAddr := net.JoinHostPort(addr.String(), port)
+	protos := []string{"dot"}
+	if strings.HasPrefix(d.URL, "https://") {
+		protos = []string{"h2", "http/1.1"}
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: c.Timeout}, "tcp", dialAddr, c.tlsConfig(d.Target, protos...))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	for _, certIP := range conn.ConnectionState().PeerCertificates[0].IPAddresses {
+		if certIP.Equal(resolverIP) {
+			return dialAddr, nil
+		}
+	}
+	return "", fmt.Errorf("certificate for %s does not cover %s", d.Target, resolverIP)
+}
+
+// resolveTarget looks up the addresses of a designated resolver through the unencrypted one
+func (c *Client) resolveTarget(target, server string) []net.IP {
+	addrs, _ := c.LookupIP(target, server)
+	return addrs
+}
+
+// upgraded returns the encrypted resolver URL that replaces server, if any
+func (c *Client) upgraded(server string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.upgrades[serverAddr(server)]
+}
+
+// hostPort returns the host:port part of the resolver URL
+func (d *DesignatedResolver) hostPort() string {
+	rest := d.URL[strings.Index(d.URL, "://")+3:]
+	if i := strings.Index(rest, "/"); i >= 0 {
+		rest = rest[:i]
+	}
+	return rest
+}
+
+// containsResolver reports whether a resolver with the given URL is already listed
+func containsResolver(resolvers []*DesignatedResolver, url string) bool {
+	for _, d := range resolvers {
+		if d.URL == url {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultString returns s, or def if s is empty
+func defaultString(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
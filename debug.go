@@ -0,0 +1,53 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+)
+
+// publishOnce guards the process-wide expvar registry against publishing the same names twice
+var publishOnce sync.Once
+
+// publishDebugVars publishes runtime and server state at /debug/vars, next to expvar's own cmdline
+// and memstats. Either argument may be nil.
+func publishDebugVars(cache Cache, auth *Authority) {
+	publishOnce.Do(func() {
+		expvar.Publish("goroutines", expvar.Func(func() any {
+			return runtime.NumGoroutine()
+		}))
+		expvar.Publish("heap", expvar.Func(func() any {
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			return map[string]uint64{"alloc": m.HeapAlloc, "inuse": m.HeapInuse, "objects": m.HeapObjects, "sys": m.HeapSys}
+		}))
+		expvar.Publish("cache_entries", expvar.Func(func() any {
+			if c, ok := cache.(*MemoryCache); ok {
+				return c.Len()
+			}
+			return nil
+		}))
+		expvar.Publish("zone_records", expvar.Func(func() any {
+			counts := make(map[string]int)
+			if auth != nil {
+				for _, zone := range auth.Zones() {
+					counts[zone.Origin.FQDN()] = zone.Len()
+				}
+			}
+			return counts
+		}))
+	})
+}
+
+// handleDebug adds the net/http/pprof profiles and the expvar variables to mux
+func handleDebug(mux *http.ServeMux) {
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// runDecode implements the "decode" subcommand, which prints a DNS message read from a file
+func runDecode(args []string) int {
+	fs := flag.NewFlagSet("decode", flag.ContinueOnError)
+	isHex := fs.Bool("hex", false, "the input is a hex dump rather than raw bytes; whitespace is ignored")
+	lenient := fs.Bool("lenient", false, "print whatever decodes and list the entries that don't, instead of failing")
+	strict := fs.String("strict", "", "reject the message if it fails these checks: all, or a comma-separated list of counts, class, z and rdlength")
+	color := fs.String("color", "auto", "color output: auto (terminals only, unless NO_COLOR is set), always or never")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gdns decode [-hex] [-lenient | -strict checks] file|-\n")
+		fmt.Fprintf(fs.Output(), "Exit status: 0 success, 1 unreadable or undecodable message, 4 usage error.\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return ExitOK
+	} else if err != nil {
+		return ExitUsage
+	}
+	if fs.NArg() != 1 || (*lenient && *strict != "") {
+		fs.Usage()
+		return ExitUsage
+	}
+	var checks StrictCheck
+	if *strict != "" {
+		var err error
+		if checks, err = ParseStrictChecks(*strict); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitUsage
+		}
+	}
+	palette, err := NewPalette(*color, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+
+	var data []byte
+	if fs.Arg(0) == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(fs.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *isHex {
+		if data, err = hex.DecodeString(strings.Join(strings.Fields(string(data)), "")); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(0), err)
+			return 1
+		}
+	}
+	if len(data) > maxMessageSize {
+		fmt.Fprintf(os.Stderr, "%s: %d bytes is larger than a DNS message can be\n", fs.Arg(0), len(data))
+		return 1
+	}
+
+	if *lenient {
+		packet, errs := ParseMessageLenient(data)
+		PrintResponse(os.Stdout, packet, palette)
+		for _, e := range errs {
+			fmt.Println(palette.Removed(";; error: " + e.Error()))
+		}
+		if len(errs) > 0 {
+			return 1
+		}
+		return 0
+	}
+	var packet *DnsPacket
+	if checks != 0 {
+		packet, err = DnsPacketFromBufferStrict(&BytePacketBuffer{buf: data}, checks)
+	} else {
+		packet, err = DnsPacketFromBuffer(&BytePacketBuffer{buf: data})
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+	PrintResponse(os.Stdout, packet, palette)
+	return 0
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rrsetKey identifies an RRset within a response
+type rrsetKey struct {
+	Name  string
+	Qtype QueryType
+}
+
+// rrsetSummary holds the comparable contents of an RRset
+type rrsetSummary struct {
+	Rdata []string // Sorted record data in presentation format
+	TTL   uint32   // Lowest TTL seen in the RRset
+
+	members *RRSet // Used to drop duplicate records
+}
+
+// resolverAnswer is the outcome of one query against one resolver
+type resolverAnswer struct {
+	Server string
+	Err    error
+	Rcode  ResultCode
+	RRsets map[rrsetKey]*rrsetSummary
+}
+
+// groupRRsets summarizes records as RRsets keyed by owner name and type, ignoring duplicates
+func groupRRsets(records []*DnsRecord) map[rrsetKey]*rrsetSummary {
+	sets := make(map[rrsetKey]*rrsetSummary)
+	for _, rec := range records {
+		key := rrsetKey{Name: parseNameLoose(rec.Name).Key(), Qtype: rec.Qtype}
+		set, ok := sets[key]
+		if !ok {
+			set = &rrsetSummary{TTL: rec.TTL, members: NewRRSet(rec)}
+			sets[key] = set
+		}
+		if added, err := set.members.Add(rec); err == nil && !added {
+			continue
+		}
+		set.Rdata = append(set.Rdata, rec.RdataString())
+		if rec.TTL < set.TTL {
+			set.TTL = rec.TTL
+		}
+	}
+	for _, set := range sets {
+		sort.Strings(set.Rdata)
+	}
+	return sets
+}
+
+// sortedRRsetKeys returns the union of the keys of all given RRset maps in name and type order
+func sortedRRsetKeys(sets ...map[rrsetKey]*rrsetSummary) []rrsetKey {
+	keys := make(map[rrsetKey]bool)
+	for _, set := range sets {
+		for key := range set {
+			keys[key] = true
+		}
+	}
+	sorted := make([]rrsetKey, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		return sorted[i].Qtype < sorted[j].Qtype
+	})
+	return sorted
+}
+
+// compareAnswers reports how each answer differs from the first one
+func compareAnswers(answers []resolverAnswer, ttlThreshold uint32) []string {
+	var diffs []string
+	base := answers[0]
+	for _, other := range answers[1:] {
+		prefix := fmt.Sprintf("%s vs %s:", base.Server, other.Server)
+		if base.Err != nil || other.Err != nil {
+			if (base.Err == nil) != (other.Err == nil) {
+				diffs = append(diffs, fmt.Sprintf("%s error mismatch: %v / %v", prefix, base.Err, other.Err))
+			}
+			continue
+		}
+		if base.Rcode != other.Rcode {
+			diffs = append(diffs, fmt.Sprintf("%s rcode %s / %s", prefix, base.Rcode, other.Rcode))
+		}
+
+		for _, key := range sortedRRsetKeys(base.RRsets, other.RRsets) {
+			a, b := base.RRsets[key], other.RRsets[key]
+			switch {
+			case b == nil:
+				diffs = append(diffs, fmt.Sprintf("%s %s %s only in %s", prefix, key.Name, key.Qtype, base.Server))
+			case a == nil:
+				diffs = append(diffs, fmt.Sprintf("%s %s %s only in %s", prefix, key.Name, key.Qtype, other.Server))
+			case strings.Join(a.Rdata, " ") != strings.Join(b.Rdata, " "):
+				diffs = append(diffs, fmt.Sprintf("%s %s %s [%s] / [%s]", prefix, key.Name, key.Qtype,
+					strings.Join(a.Rdata, ", "), strings.Join(b.Rdata, ", ")))
+			default:
+				delta := int64(a.TTL) - int64(b.TTL)
+				if delta < 0 {
+					delta = -delta
+				}
+				if delta > int64(ttlThreshold) {
+					diffs = append(diffs, fmt.Sprintf("%s %s %s TTL %d / %d (delta %ds)", prefix, key.Name, key.Qtype,
+						a.TTL, b.TTL, delta))
+				}
+			}
+		}
+	}
+	return diffs
+}
+
+// runDiff implements the "diff" subcommand, comparing answers across resolvers
+func runDiff(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	servers := fs.String("servers", "", "comma-separated list of resolvers to compare (at least two)")
+	qtypeName := fs.String("type", "A", "record type to query; ANY is sent over TCP, and servers may answer it minimally (RFC 8482)")
+	ttlThreshold := fs.Duration("ttl-delta", 0, "only report TTL differences larger than this")
+	timeout := fs.Duration("timeout", 5*time.Second, "time to wait for each response")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gdns diff -servers a,b[,c...] [-type A] name...\n")
+		fmt.Fprintf(fs.Output(), "Exit status: 0 identical answers, 1 differences, 4 usage error.\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return ExitOK
+	} else if err != nil {
+		return ExitUsage
+	}
+
+	serverList := strings.Split(*servers, ",")
+	if *servers == "" || len(serverList) < 2 || fs.NArg() == 0 {
+		fs.Usage()
+		return ExitUsage
+	}
+	qtype, err := QueryTypeFromString(*qtypeName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+
+	client := NewClient()
+	client.Timeout = *timeout
+
+	differences := 0
+	for _, name := range fs.Args() {
+		answers := make([]resolverAnswer, len(serverList))
+		var wg sync.WaitGroup
+		for i, server := range serverList {
+			wg.Add(1)
+			go func(i int, server string) {
+				defer wg.Done()
+				answers[i].Server = server
+				res, err := client.Lookup(name, qtype, server)
+				if err != nil {
+					answers[i].Err = err
+					return
+				}
+				answers[i].Rcode = res.Header.ResCode
+				answers[i].RRsets = groupRRsets(res.Answers)
+			}(i, strings.TrimSpace(server))
+		}
+		wg.Wait()
+
+		for _, answer := range answers {
+			if answer.Err != nil {
+				fmt.Printf("%s %s: %s error: %v\n", name, qtype, answer.Server, answer.Err)
+			}
+		}
+		diffs := compareAnswers(answers, uint32(ttlThreshold.Seconds()))
+		if len(diffs) == 0 {
+			fmt.Printf("%s %s: identical\n", name, qtype)
+			continue
+		}
+		differences++
+		for _, d := range diffs {
+			fmt.Printf("%s %s: %s\n", name, qtype, d)
+		}
+	}
+
+	if differences > 0 {
+		return 1
+	}
+	return 0
+}
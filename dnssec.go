@@ -0,0 +1,534 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNSSEC signing algorithms (RFC 8624 section 3.1)
+const (
+	DNSSEC_RSASHA256       = 8
+	DNSSEC_ECDSAP256SHA256 = 13
+	DNSSEC_ECDSAP384SHA384 = 14
+	DNSSEC_ED25519         = 15
+)
+
+// dnssecAlgorithmNames maps the supported algorithms to their mnemonics
+var dnssecAlgorithmNames = map[uint8]string{
+	DNSSEC_RSASHA256:       "RSASHA256",
+	DNSSEC_ECDSAP256SHA256: "ECDSAP256SHA256",
+	DNSSEC_ECDSAP384SHA384: "ECDSAP384SHA384",
+	DNSSEC_ED25519:         "ED25519",
+}
+
+// DNSKEY flags
+const (
+	DNSKEY_ZONE = 0x0100 // The key signs the zone's records
+	DNSKEY_SEP  = 0x0001 // Secure entry point, set on key signing keys
+)
+
+// dnskeyProtocol is the only valid value of a DNSKEY's protocol field (RFC 4034 section 2.1.2)
+const dnskeyProtocol = 3
+
+// DNSSEC validation errors
+var (
+	ErrBogus         = errors.New("DNSSEC validation failed")          // A signature or proof that should verify doesn't
+	ErrInsecureProof = errors.New("DNSSEC proof leaves data unsigned") // A proof through an opt-out or weak NSEC3 chain
+)
+
+// DNSSECAlgorithmFromString parses an algorithm mnemonic or number
+func DNSSECAlgorithmFromString(s string) (uint8, error) {
+	for algorithm, name := range dnssecAlgorithmNames {
+		if strings.EqualFold(s, name) {
+			return algorithm, nil
+		}
+	}
+	if n, err := strconv.ParseUint(s, 10, 8); err == nil && dnssecAlgorithmNames[uint8(n)] != "" {
+		return uint8(n), nil
+	}
+	return 0, fmt.Errorf("unsupported DNSSEC algorithm %q", s)
+}
+
+// DNSKEY is the data of a DNSSEC public key record (RFC 4034)
+type DNSKEY struct {
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte // In the algorithm's DNSSEC encoding
+}
+
+// RRType returns QTYPE_DNSKEY
+func (k *DNSKEY) RRType() QueryType {
+	return QTYPE_DNSKEY
+}
+
+// Pack encodes the data in wire format
+func (k *DNSKEY) Pack() ([]byte, error) {
+	var w rdataWriter
+	w.u16(k.Flags)
+	w.u8(k.Protocol)
+	w.u8(k.Algorithm)
+	w.buf = append(w.buf, k.PublicKey...)
+	return w.bytes()
+}
+
+// String formats the data in presentation format
+func (k *DNSKEY) String() string {
+	return fmt.Sprintf("%d %d %d %s", k.Flags, k.Protocol, k.Algorithm, base64.StdEncoding.EncodeToString(k.PublicKey))
+}
+
+// decodeDNSKEY parses wire format DNSKEY data
+func decodeDNSKEY(data []byte) (RData, error) {
+	r := rdataReader{data: data}
+	k := &DNSKEY{Flags: r.u16(), Protocol: r.u8(), Algorithm: r.u8()}
+	k.PublicKey = append([]byte(nil), r.rest()...)
+	return k, r.done()
+}
+
+// parseDNSKEY parses presentation format DNSKEY data; the base64 key may be split into several fields
+func parseDNSKEY(fields, names []string) (RData, error) {
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("expects flags, protocol, algorithm and key")
+	}
+	flags, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid flags %q", fields[0])
+	}
+	protocol, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid protocol %q", fields[1])
+	}
+	algorithm, err := strconv.ParseUint(fields[2], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid algorithm %q", fields[2])
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.Join(fields[3:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %v", err)
+	}
+	return &DNSKEY{Flags: uint16(flags), Protocol: uint8(protocol), Algorithm: uint8(algorithm), PublicKey: key}, nil
+}
+
+// DNSKEY returns the record's DNSKEY data, or nil if it isn't a DNSKEY record
+func (r *DnsRecord) DNSKEY() *DNSKEY {
+	k, _ := r.Data.(*DNSKEY)
+	return k
+}
+
+// KeyTag computes the tag RRSIG and DS records use to refer to the key (RFC 4034 appendix B)
+func (k *DNSKEY) KeyTag() uint16 {
+	data, _ := k.Pack()
+	var ac uint32
+	for i, b := range data {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xffff
+	return uint16(ac)
+}
+
+// NewDNSKEY encodes a public key as the data of a DNSKEY record with the given flags
+func NewDNSKEY(flags uint16, algorithm uint8, pub crypto.PublicKey) (*DNSKEY, error) {
+	k := &DNSKEY{Flags: flags, Protocol: dnskeyProtocol, Algorithm: algorithm}
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if algorithm != DNSSEC_RSASHA256 {
+			break
+		}
+		// Exponent length, exponent and modulus (RFC 3110 section 2)
+		exponent := big.NewInt(int64(pub.E)).Bytes()
+		if len(exponent) > 255 {
+			k.PublicKey = []byte{0, byte(len(exponent) >> 8), byte(len(exponent))}
+		} else {
+			k.PublicKey = []byte{byte(len(exponent))}
+		}
+		k.PublicKey = append(append(k.PublicKey, exponent...), pub.N.Bytes()...)
+		return k, nil
+	case *ecdsa.PublicKey:
+		size := ecdsaSize(algorithm)
+		if size == 0 || pub.Curve != ecdsaCurve(algorithm) {
+			break
+		}
+		// The point's coordinates, without the uncompressed point prefix (RFC 6605 section 4)
+		k.PublicKey = append(pub.X.FillBytes(make([]byte, size)), pub.Y.FillBytes(make([]byte, size))...)
+		return k, nil
+	case ed25519.PublicKey:
+		if algorithm != DNSSEC_ED25519 {
+			break
+		}
+		k.PublicKey = append([]byte(nil), pub...)
+		return k, nil
+	}
+	return nil, fmt.Errorf("%T is not a key for DNSSEC algorithm %d", pub, algorithm)
+}
+
+// CryptoKey decodes the public key
+func (k *DNSKEY) CryptoKey() (crypto.PublicKey, error) {
+	switch k.Algorithm {
+	case DNSSEC_RSASHA256:
+		key := k.PublicKey
+		if len(key) < 1 {
+			return nil, fmt.Errorf("empty RSA key")
+		}
+		n, key := int(key[0]), key[1:]
+		if n == 0 && len(key) >= 2 {
+			n, key = int(key[0])<<8|int(key[1]), key[2:]
+		}
+		if n == 0 || n > 4 || len(key) <= n {
+			return nil, fmt.Errorf("unsupported RSA key encoding")
+		}
+		e := int(new(big.Int).SetBytes(key[:n]).Int64())
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(key[n:]), E: e}, nil
+	case DNSSEC_ECDSAP256SHA256, DNSSEC_ECDSAP384SHA384:
+		size := ecdsaSize(k.Algorithm)
+		if len(k.PublicKey) != 2*size {
+			return nil, fmt.Errorf("ECDSA key is %d bytes, expected %d", len(k.PublicKey), 2*size)
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: ecdsaCurve(k.Algorithm),
+			X:     new(big.Int).SetBytes(k.PublicKey[:size]),
+			Y:     new(big.Int).SetBytes(k.PublicKey[size:]),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("ECDSA key is not on the curve")
+		}
+		return pub, nil
+	case DNSSEC_ED25519:
+		if len(k.PublicKey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Ed25519 key is %d bytes, expected %d", len(k.PublicKey), ed25519.PublicKeySize)
+		}
+		return ed25519.PublicKey(k.PublicKey), nil
+	}
+	return nil, fmt.Errorf("unsupported DNSSEC algorithm %d", k.Algorithm)
+}
+
+// ecdsaCurve returns the curve of an ECDSA algorithm, or nil
+func ecdsaCurve(algorithm uint8) elliptic.Curve {
+	switch algorithm {
+	case DNSSEC_ECDSAP256SHA256:
+		return elliptic.P256()
+	case DNSSEC_ECDSAP384SHA384:
+		return elliptic.P384()
+	}
+	return nil
+}
+
+// ecdsaSize returns the size of a coordinate, and of each signature half, of an ECDSA algorithm
+func ecdsaSize(algorithm uint8) int {
+	switch algorithm {
+	case DNSSEC_ECDSAP256SHA256:
+		return 32
+	case DNSSEC_ECDSAP384SHA384:
+		return 48
+	}
+	return 0
+}
+
+// dnssecDigest hashes signed data as the algorithm says; Ed25519 signs the data itself
+func dnssecDigest(algorithm uint8, data []byte) (crypto.Hash, []byte) {
+	switch algorithm {
+	case DNSSEC_RSASHA256, DNSSEC_ECDSAP256SHA256:
+		sum := sha256.Sum256(data)
+		return crypto.SHA256, sum[:]
+	case DNSSEC_ECDSAP384SHA384:
+		sum := sha512.Sum384(data)
+		return crypto.SHA384, sum[:]
+	}
+	return 0, data
+}
+
+// RRSIG is the data of a DNSSEC signature record (RFC 4034)
+type RRSIG struct {
+	TypeCovered QueryType
+	Algorithm   uint8
+	Labels      uint8  // Labels of the owner name, not counting a leading wildcard
+	OriginalTTL uint32 // TTL of the covered RRset as the signer published it
+	Expiration  uint32 // Seconds since the epoch, in serial number arithmetic
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  string // Owner of the DNSKEY, the zone the records are in
+	Signature   []byte
+}
+
+// RRType returns QTYPE_RRSIG
+func (s *RRSIG) RRType() QueryType {
+	return QTYPE_RRSIG
+}
+
+// Pack encodes the data in wire format
+func (s *RRSIG) Pack() ([]byte, error) {
+	w := s.packHeader()
+	w.buf = append(w.buf, s.Signature...)
+	return w.bytes()
+}
+
+// packHeader encodes the fields before the signature, which are also signed
+func (s *RRSIG) packHeader() rdataWriter {
+	var w rdataWriter
+	w.u16(uint16(s.TypeCovered))
+	w.u8(s.Algorithm)
+	w.u8(s.Labels)
+	w.u32(s.OriginalTTL)
+	w.u32(s.Expiration)
+	w.u32(s.Inception)
+	w.u16(s.KeyTag)
+	w.name(s.SignerName)
+	return w
+}
+
+// String formats the data in presentation format
+func (s *RRSIG) String() string {
+	return fmt.Sprintf("%s %d %d %d %s %s %d %s %s", s.TypeCovered, s.Algorithm, s.Labels, s.OriginalTTL,
+		formatSigTime(s.Expiration), formatSigTime(s.Inception), s.KeyTag, parseNameLoose(s.SignerName).FQDN(),
+		base64.StdEncoding.EncodeToString(s.Signature))
+}
+
+// canonical returns a copy with the signer name lowercased
+func (s *RRSIG) canonical() RData {
+	c := *s
+	c.SignerName = parseNameLoose(s.SignerName).Canonical().String()
+	return &c
+}
+
+// decodeRRSIG parses wire format RRSIG data
+func decodeRRSIG(data []byte) (RData, error) {
+	r := rdataReader{data: data}
+	s := &RRSIG{TypeCovered: QueryType(r.u16()), Algorithm: r.u8(), Labels: r.u8(), OriginalTTL: r.u32(),
+		Expiration: r.u32(), Inception: r.u32(), KeyTag: r.u16()}
+	s.SignerName = r.name()
+	s.Signature = append([]byte(nil), r.rest()...)
+	return s, r.done()
+}
+
+// parseRRSIG parses presentation format RRSIG data; the base64 signature may be split into several fields
+func parseRRSIG(fields, names []string) (RData, error) {
+	if len(fields) < 9 {
+		return nil, fmt.Errorf("expects type, algorithm, labels, TTL, expiration, inception, key tag, signer and signature")
+	}
+	s := &RRSIG{SignerName: names[7]}
+	var err error
+	if s.TypeCovered, err = QueryTypeFromString(fields[0]); err != nil {
+		return nil, err
+	}
+	var nums [3]uint64
+	for i, bits := range []int{8, 8, 32} {
+		if nums[i], err = strconv.ParseUint(fields[1+i], 10, bits); err != nil {
+			return nil, fmt.Errorf("invalid number %q", fields[1+i])
+		}
+	}
+	s.Algorithm, s.Labels, s.OriginalTTL = uint8(nums[0]), uint8(nums[1]), uint32(nums[2])
+	if s.Expiration, err = parseSigTime(fields[4]); err != nil {
+		return nil, err
+	}
+	if s.Inception, err = parseSigTime(fields[5]); err != nil {
+		return nil, err
+	}
+	tag, err := strconv.ParseUint(fields[6], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key tag %q", fields[6])
+	}
+	s.KeyTag = uint16(tag)
+	if s.Signature, err = base64.StdEncoding.DecodeString(strings.Join(fields[8:], "")); err != nil {
+		return nil, fmt.Errorf("invalid signature: %v", err)
+	}
+	return s, nil
+}
+
+// RRSIG returns the record's RRSIG data, or nil if it isn't an RRSIG record
+func (r *DnsRecord) RRSIG() *RRSIG {
+	s, _ := r.Data.(*RRSIG)
+	return s
+}
+
+// sigTimeLayout is the YYYYMMDDHHmmSS presentation format of signature times
+const sigTimeLayout = "20060102150405"
+
+// formatSigTime formats a signature time in UTC
+func formatSigTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format(sigTimeLayout)
+}
+
+// parseSigTime parses a signature time given as YYYYMMDDHHmmSS or as seconds since the epoch
+func parseSigTime(s string) (uint32, error) {
+	if len(s) == len(sigTimeLayout) {
+		t, err := time.Parse(sigTimeLayout, s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid signature time %q", s)
+		}
+		return uint32(t.Unix()), nil
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid signature time %q", s)
+	}
+	return uint32(n), nil
+}
+
+// sigTime returns the time a 32-bit signature timestamp refers to, taking it to be within 68 years
+// of now (RFC 4034 section 3.1.5)
+func sigTime(t uint32, now time.Time) time.Time {
+	return now.Add(time.Duration(int32(t-uint32(now.Unix()))) * time.Second)
+}
+
+// signedData returns what a signature covers: its own data up to the signature, then the RRset in
+// canonical form (RFC 4034 section 3.1.8.1)
+func (s *RRSIG) signedData(set *RRSet) ([]byte, error) {
+	header := s.canonical().(*RRSIG).packHeader()
+	data, err := header.bytes()
+	if err != nil {
+		return nil, err
+	}
+	records, err := set.CanonicalWire(s.OriginalTTL, int(s.Labels))
+	if err != nil {
+		return nil, err
+	}
+	return append(data, records...), nil
+}
+
+// VerifyRRSIG checks that a signature covers the RRset, was made by the key, is valid at now and
+// verifies (RFC 4035 section 5.3). The key must be owned by the signer name; callers establish that
+// and whether the key is trusted.
+func VerifyRRSIG(set *RRSet, sig *RRSIG, key *DNSKEY, now time.Time) error {
+	switch {
+	case sig.TypeCovered != set.Qtype:
+		return fmt.Errorf("%w: signature covers %s, not %s", ErrBogus, sig.TypeCovered, set.Qtype)
+	case !parseNameLoose(set.Name).IsSubdomainOf(parseNameLoose(sig.SignerName)):
+		return fmt.Errorf("%w: %s signed by %s, outside its zone", ErrBogus, set.Name, sig.SignerName)
+	case key.Protocol != dnskeyProtocol || key.Flags&DNSKEY_ZONE == 0:
+		return fmt.Errorf("%w: key %d is not a zone key", ErrBogus, key.KeyTag())
+	case sig.Algorithm != key.Algorithm || sig.KeyTag != key.KeyTag():
+		return fmt.Errorf("%w: signature by key %d/%d, not %d/%d", ErrBogus, sig.KeyTag, sig.Algorithm, key.KeyTag(), key.Algorithm)
+	case int(sig.Labels) > SignatureLabels(parseNameLoose(set.Name)):
+		return fmt.Errorf("%w: signature covers %d labels, more than %s has", ErrBogus, sig.Labels, set.Name)
+	}
+	if expiration := sigTime(sig.Expiration, now); now.After(expiration) {
+		return fmt.Errorf("%w: signature expired at %s", ErrBogus, expiration.UTC().Format(time.RFC3339))
+	}
+	if inception := sigTime(sig.Inception, now); now.Before(inception) {
+		return fmt.Errorf("%w: signature not valid before %s", ErrBogus, inception.UTC().Format(time.RFC3339))
+	}
+
+	pub, err := key.CryptoKey()
+	if err != nil {
+		return fmt.Errorf("%w: key %d: %v", ErrBogus, key.KeyTag(), err)
+	}
+	data, err := sig.signedData(set)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBogus, err)
+	}
+	hash, digest := dnssecDigest(sig.Algorithm, data)
+	ok := false
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(pub, hash, digest, sig.Signature) == nil
+	case *ecdsa.PublicKey:
+		size := ecdsaSize(sig.Algorithm)
+		if len(sig.Signature) == 2*size {
+			r := new(big.Int).SetBytes(sig.Signature[:size])
+			s := new(big.Int).SetBytes(sig.Signature[size:])
+			ok = ecdsa.Verify(pub, digest, r, s)
+		}
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pub, digest, sig.Signature)
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s %s signature by key %d does not verify", ErrBogus, set.Name, set.Qtype, sig.KeyTag)
+	}
+	return nil
+}
+
+// SigningKey is a zone's DNSKEY together with its private key
+type SigningKey struct {
+	Owner   string // The zone the key signs
+	DNSKEY  *DNSKEY
+	Private crypto.Signer // An *rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey
+}
+
+// GenerateSigningKey creates a new key for the zone with the given algorithm and DNSKEY flags.
+// RSA keys are 2048 bits.
+func GenerateSigningKey(owner string, algorithm uint8, flags uint16) (*SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch algorithm {
+	case DNSSEC_RSASHA256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case DNSSEC_ECDSAP256SHA256, DNSSEC_ECDSAP384SHA384:
+		private, err = ecdsa.GenerateKey(ecdsaCurve(algorithm), rand.Reader)
+	case DNSSEC_ED25519:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported DNSSEC algorithm %d", algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := NewDNSKEY(flags, algorithm, private.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{Owner: owner, DNSKEY: key, Private: private}, nil
+}
+
+// Record returns the key's DNSKEY record
+func (k *SigningKey) Record(ttl uint32) *DnsRecord {
+	return NewRecord(k.Owner, ttl, k.DNSKEY)
+}
+
+// Sign signs an RRset of the key's zone, returning the RRSIG record valid from inception to expiration
+func (k *SigningKey) Sign(set *RRSet, inception, expiration time.Time) (*DnsRecord, error) {
+	owner := parseNameLoose(set.Name)
+	if !owner.IsSubdomainOf(parseNameLoose(k.Owner)) {
+		return nil, fmt.Errorf("%s is outside zone %s", set.Name, k.Owner)
+	}
+	sig := &RRSIG{
+		TypeCovered: set.Qtype,
+		Algorithm:   k.DNSKEY.Algorithm,
+		Labels:      uint8(SignatureLabels(owner)),
+		OriginalTTL: set.TTL,
+		Expiration:  uint32(expiration.Unix()),
+		Inception:   uint32(inception.Unix()),
+		KeyTag:      k.DNSKEY.KeyTag(),
+		SignerName:  k.Owner,
+	}
+	data, err := sig.signedData(set)
+	if err != nil {
+		return nil, err
+	}
+	hash, digest := dnssecDigest(sig.Algorithm, data)
+	switch private := k.Private.(type) {
+	case *rsa.PrivateKey:
+		sig.Signature, err = rsa.SignPKCS1v15(rand.Reader, private, hash, digest)
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, private, digest); err == nil {
+			size := ecdsaSize(sig.Algorithm)
+			sig.Signature = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+		}
+	case ed25519.PrivateKey:
+		sig.Signature = ed25519.Sign(private, digest)
+	default:
+		err = fmt.Errorf("unsupported private key %T", k.Private)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec := NewRecord(set.Name, set.TTL, sig)
+	rec.Class = set.Class
+	return rec, nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dockerTTL is the TTL of records for containers, which come and go often
+const dockerTTL = 5
+
+// DockerWatcher answers for running containers: A and AAAA queries for <name>.<domain> and
+// <alias>.<domain> through its KVSource, and PTR queries for their addresses as a Handler that
+// passes every other query on to Next.
+type DockerWatcher struct {
+	Next   Handler
+	Source *KVSource
+	Client *http.Client // Talks to the Docker Engine API; requests go to http://docker/...
+
+	ptr   map[string][]string // Container names by reverse lookup name, lowercase
+	ips   map[string][]string // Reverse lookup names by container ID
+	names map[string]string   // Container name by ID
+	mu    sync.RWMutex
+}
+
+// dockerContainer is the part of a container inspection the watcher uses
+type dockerContainer struct {
+	ID    string `json:"Id"`
+	Name  string `json:"Name"`
+	State struct {
+		Running bool `json:"Running"`
+	} `json:"State"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string   `json:"IPAddress"`
+			GlobalIPv6Address string   `json:"GlobalIPv6Address"`
+			Aliases           []string `json:"Aliases"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// NewDockerWatcher creates a watcher for the Docker daemon at host, a unix:// socket or tcp:// address
+func NewDockerWatcher(host string, source *KVSource, next Handler) (*DockerWatcher, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	var network, addr string
+	switch u.Scheme {
+	case "unix":
+		network, addr = "unix", u.Path
+	case "tcp":
+		network, addr = "tcp", u.Host
+	default:
+		return nil, fmt.Errorf("%s: Docker host must be unix:// or tcp://", host)
+	}
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	return &DockerWatcher{
+		Next:   next,
+		Source: source,
+		Client: &http.Client{Transport: &http.Transport{DialContext: dial}},
+		ptr:    make(map[string][]string),
+		ips:    make(map[string][]string),
+		names:  make(map[string]string),
+	}, nil
+}
+
+// Run loads the running containers and follows container and network events, reconnecting after
+// errors, until the process exits
+func (w *DockerWatcher) Run() {
+	for {
+		err := w.follow()
+		log.Printf("docker: %v", err)
+		time.Sleep(kvRetryDelay)
+	}
+}
+
+// follow subscribes to events, then lists the running containers so nothing started in between is
+// missed, and applies events until the stream breaks
+func (w *DockerWatcher) follow() error {
+	filters := `{"type":["container","network"]}`
+	resp, err := w.get("/events?filters=" + url.QueryEscape(filters))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := w.load(); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string `json:"Type"`
+			Action string `json:"Action"`
+			Actor  struct {
+				ID         string            `json:"ID"`
+				Attributes map[string]string `json:"Attributes"`
+			} `json:"Actor"`
+		}
+		if err := dec.Decode(&event); err != nil {
+			return err
+		}
+		id := event.Actor.ID
+		if event.Type == "network" {
+			// Connecting a network adds addresses and aliases to the container named in the event
+			id = event.Actor.Attributes["container"]
+		}
+		switch {
+		case id == "":
+		case event.Type == "container" && (event.Action == "die" || event.Action == "destroy"):
+			w.remove(id)
+		case event.Type == "network" || event.Action == "start" || event.Action == "rename":
+			w.refresh(id)
+		}
+	}
+}
+
+// load replaces everything known with the currently running containers
+func (w *DockerWatcher) load() error {
+	resp, err := w.get("/containers/json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var list []struct {
+		ID string `json:"Id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return err
+	}
+	running := make(map[string]bool)
+	for _, c := range list {
+		running[c.ID] = true
+		w.refresh(c.ID)
+	}
+	w.mu.RLock()
+	var gone []string
+	for id := range w.ips {
+		if !running[id] {
+			gone = append(gone, id)
+		}
+	}
+	w.mu.RUnlock()
+	for _, id := range gone {
+		w.remove(id)
+	}
+	return nil
+}
+
+// refresh inspects a container and publishes its current names and addresses
+func (w *DockerWatcher) refresh(id string) {
+	resp, err := w.get("/containers/" + url.PathEscape(id) + "/json")
+	if err != nil {
+		log.Printf("docker: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	var c dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		log.Printf("docker: container %.12s: %v", id, err)
+		return
+	}
+	if !c.State.Running {
+		w.remove(id)
+		return
+	}
+
+	name := strings.TrimPrefix(c.Name, "/")
+	names := []string{name}
+	var addrs []string
+	for _, network := range c.NetworkSettings.Networks {
+		for _, alias := range network.Aliases {
+			// Compose and the daemon list the short container ID as an alias; it isn't useful as a name
+			if !strings.HasPrefix(c.ID, alias) {
+				names = append(names, alias)
+			}
+		}
+		for _, ip := range []string{network.IPAddress, network.GlobalIPv6Address} {
+			if ip != "" {
+				addrs = append(addrs, ip)
+			}
+		}
+	}
+	names, addrs = uniqueStrings(names), uniqueStrings(addrs)
+
+	var lines, reverse []string
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		qtype := "AAAA"
+		if ip.To4() != nil {
+			qtype = "A"
+		}
+		for _, n := range names {
+			lines = append(lines, fmt.Sprintf("%s %d %s %s", n, dockerTTL, qtype, addr))
+		}
+		reverse = append(reverse, lowerASCII(reverseName(ip)))
+	}
+
+	w.removeReverse(id)
+	w.mu.Lock()
+	w.ips[id] = reverse
+	w.names[id] = name
+	for _, r := range reverse {
+		w.ptr[r] = append(w.ptr[r], name)
+	}
+	w.mu.Unlock()
+	w.Source.Put(id, strings.Join(lines, "\n"))
+}
+
+// remove withdraws a container's records
+func (w *DockerWatcher) remove(id string) {
+	w.removeReverse(id)
+	w.Source.Delete(id)
+}
+
+// removeReverse forgets the reverse names of a container
+func (w *DockerWatcher) removeReverse(id string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, r := range w.ips[id] {
+		// Another container may hold the same address, e.g. after a restart; keep its name
+		var names []string
+		for _, n := range w.ptr[r] {
+			if n != w.names[id] {
+				names = append(names, n)
+			}
+		}
+		if len(names) == 0 {
+			delete(w.ptr, r)
+		} else {
+			w.ptr[r] = names
+		}
+	}
+	delete(w.ips, id)
+	delete(w.names, id)
+}
+
+// ServeDNS answers PTR queries for container addresses and passes everything else on
+func (w *DockerWatcher) ServeDNS(req *Request) *DnsPacket {
+	query := req.Packet
+	if len(query.Questions) == 1 && QueryType(query.Questions[0].Qtype) == QTYPE_PTR {
+		q := query.Questions[0]
+		w.mu.RLock()
+		names := w.ptr[lowerASCII(strings.TrimSuffix(q.Name, "."))]
+		w.mu.RUnlock()
+		if len(names) > 0 {
+			res := NewResponse(query)
+			res.Header.AuthoritativeAnswer = true
+			for _, n := range names {
+				res.Answers = append(res.Answers, &DnsRecord{
+					Name:  q.Name,
+					Qtype: QTYPE_PTR,
+					Class: CLASS_IN,
+					TTL:   dockerTTL,
+					Data:  &PTR{Host: n + "." + w.Source.Zone.Origin.String()},
+				})
+			}
+			return res
+		}
+	}
+	if w.Next == nil {
+		return NewErrorResponse(query, REFUSED)
+	}
+	return w.Next.ServeDNS(req)
+}
+
+// get sends a GET request to the Docker Engine API
+func (w *DockerWatcher) get(path string) (*http.Response, error) {
+	resp, err := w.Client.Get("http://docker" + path)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: HTTP status %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+// uniqueStrings returns the distinct strings of s in sorted order
+func uniqueStrings(s []string) []string {
+	sort.Strings(s)
+	out := s[:0]
+	for i, v := range s {
+		if i == 0 || v != s[i-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
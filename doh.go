@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// dohPath is the URL path DNS over HTTPS queries are accepted on
+const dohPath = "/dns-query"
+
+// ServeHTTPS answers DNS over HTTPS (RFC 8484) requests on the TLS listener l
+func (s *Server) ServeHTTPS(l net.Listener) error {
+	s.mu.Lock()
+	s.tcpListeners = append(s.tcpListeners, l)
+	s.mu.Unlock()
+
+	srv := &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: s.TCPTimeout,
+		IdleTimeout:       s.TCPTimeout,
+		ErrorLog:          log.Default(),
+	}
+	err := srv.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// ServeHTTP implements http.Handler, answering DNS messages sent to /dns-query, either POSTed or
+// with GET as the base64url "dns" query parameter. Answers of either method carry a Cache-Control
+// max-age so HTTP caches can serve them, unless they depend on the client: then they are private.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != dohPath {
+		http.NotFound(w, r)
+		return
+	}
+	if !acceptsDNSMessage(r.Header.Get("Accept")) {
+		http.Error(w, "only "+dohContentType+" responses are available", http.StatusNotAcceptable)
+		return
+	}
+	var msg []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		// RFC 8484 drops the padding, but some clients send it anyway
+		msg, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		msg, err = io.ReadAll(io.LimitReader(r.Body, maxMessageSize+1))
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(msg) > maxMessageSize {
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+
+	_, res := s.handle(msg, Request{RemoteAddr: s.clientAddr(r), Transport: "https", TLS: r.TLS})
+	if res == nil {
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+	out, err := res.Pack()
+	if err != nil {
+		log.Printf("https %s: %v", s.clientAddr(r), err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohContentType)
+	switch {
+	case !cacheable(res):
+		w.Header().Set("Cache-Control", "no-store")
+	case s.ClientAnswers || tailored(res):
+		// A shared cache would hand one client's answer to others (RFC 8484 section 5.1)
+		w.Header().Set("Cache-Control", "private")
+	default:
+		// The freshness lifetime is the smallest TTL in the answer (RFC 8484 section 5.1)
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", responseTTL(res)))
+	}
+	w.Write(out)
+}
+
+// tailored reports whether a response is scoped to the client subnet of its query (RFC 7871)
+func tailored(res *DnsPacket) bool {
+	option, ok := findEDNSOption(res, EDNSClientSubnet)
+	if !ok {
+		return false
+	}
+	ecs, err := ParseClientSubnet(option.Data)
+	return err != nil || ecs.ScopePrefix > 0
+}
+
+// acceptsDNSMessage reports whether an Accept header allows application/dns-message responses.
+// The most specific matching media range decides, and a quality of 0 refuses the type; clients
+// sending no Accept header take anything.
+func acceptsDNSMessage(accept string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+	specificity := map[string]int{"*/*": 0, "application/*": 1, dohContentType: 2}
+	best, bestQ := -1, 0.0
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(item, ";")
+		spec, ok := specificity[strings.ToLower(strings.TrimSpace(mediaType))]
+		if !ok || spec <= best {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if key, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.EqualFold(key, "q") {
+				if v, err := strconv.ParseFloat(value, 64); err == nil {
+					q = v
+				}
+			}
+		}
+		best, bestQ = spec, q
+	}
+	return bestQ > 0
+}
+
+// httpsConfig returns the TLS configuration for the DoH listener, offering HTTP/2
+func (s *Server) httpsConfig() *tls.Config {
+	config := s.TLSConfig.Clone()
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return config
+}
+
+// httpRemoteAddr converts the client address of an HTTP request into a net.Addr
+func httpRemoteAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+// clientAddr returns the address of the client behind a DoH request. Requests relayed by a trusted
+// proxy are attributed to the address the proxies recorded in Forwarded (RFC 7239) or, failing
+// that, X-Forwarded-For: the chain is walked back from the nearest hop, skipping trusted proxies,
+// so a client can't pass itself off as someone else by sending the header itself.
+func (s *Server) clientAddr(r *http.Request) net.Addr {
+	peer := httpRemoteAddr(r).(*net.TCPAddr)
+	if !s.trustedProxy(peer.IP) {
+		return peer
+	}
+	hops := forwardedFor(r.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(value, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	}
+	addr := peer
+	for i := len(hops) - 1; i >= 0 && s.trustedProxy(addr.IP); i-- {
+		hop := parseForwardedNode(hops[i])
+		if hop == nil {
+			// An obfuscated or unknown node ends what can be known about the client
+			break
+		}
+		addr = hop
+	}
+	return addr
+}
+
+// trustedProxy reports whether ip belongs to one of the server's TrustedProxies
+func (s *Server) trustedProxy(ip net.IP) bool {
+	for _, network := range s.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the for= parameters of Forwarded header values, nearest hop last
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				if key, node, ok := strings.Cut(strings.TrimSpace(pair), "="); ok && strings.EqualFold(key, "for") {
+					hops = append(hops, strings.Trim(node, "\""))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseForwardedNode parses a node address as it appears in Forwarded and X-Forwarded-For:
+// an IP, an IP with a port, or a bracketed IPv6 address with an optional port
+func parseForwardedNode(node string) *net.TCPAddr {
+	if ip := net.ParseIP(node); ip != nil {
+		return &net.TCPAddr{IP: ip}
+	}
+	host, port, err := net.SplitHostPort(node)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: ip, Port: p}
+}
+
+// ParseNetworks parses a comma-separated list of IP addresses and CIDR networks
+func ParseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// LoadServerTLSConfig loads a certificate and key for the encrypted listeners. When clientCA is set,
+// clients must present a certificate issued by one of the CAs in that file.
+func LoadServerTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCA != "" {
+		pool, err := loadCertPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// loadCertPool reads PEM certificates from a file into a pool
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return pool, nil
+}
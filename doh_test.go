@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestDoHCacheControl checks that DoH answers are cacheable by shared HTTP caches over GET and POST
+// unless they depend on the client, through the server's handlers or a client subnet scope
+func TestDoHCacheControl(t *testing.T) {
+	answer := func(scope uint8) Handler {
+		return HandlerFunc(func(req *Request) *DnsPacket {
+			res := NewResponse(req.Packet)
+			res.Answers = append(res.Answers, NewRecord("example.com", 300, &A{Addr: net.IPv4(192, 0, 2, 1)}))
+			res.Answers = append(res.Answers, NewRecord("example.com", 60, &A{Addr: net.IPv4(192, 0, 2, 2)}))
+			if scope > 0 {
+				opt := res.SetEDNS(DefaultEDNSSize)
+				ecs := &ClientSubnet{Family: 1, SourcePrefix: 24, ScopePrefix: scope, Address: net.IPv4(198, 51, 100, 0).To4()}
+				setEDNSOption(opt, EDNSClientSubnet, &EDNSOption{Code: EDNSClientSubnet, Data: ecs.Pack()})
+			}
+			return res
+		})
+	}
+	refuse := HandlerFunc(func(req *Request) *DnsPacket { return NewErrorResponse(req.Packet, REFUSED) })
+	tests := []struct {
+		name          string
+		handler       Handler
+		clientAnswers bool
+		want          string
+	}{
+		{"shared answer", answer(0), false, "max-age=60"},
+		{"client-dependent handlers", answer(0), true, "private"},
+		{"answer scoped to a client subnet", answer(24), false, "private"},
+		{"refused", refuse, true, "no-store"},
+	}
+	query := chaosQuery()
+	query.SetEDNS(DefaultEDNSSize)
+	msg, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		s := NewServer("", tt.handler)
+		s.ClientAnswers = tt.clientAnswers
+		requests := []*http.Request{
+			httptest.NewRequest(http.MethodGet, dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(msg), nil),
+			httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader(msg)),
+		}
+		requests[1].Header.Set("Content-Type", dohContentType)
+		for _, r := range requests {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Errorf("%s over %s: status %d", tt.name, r.Method, w.Code)
+				continue
+			}
+			if got := w.Header().Get("Cache-Control"); got != tt.want {
+				t.Errorf("%s over %s: Cache-Control %q, want %q", tt.name, r.Method, got, tt.want)
+			}
+		}
+	}
+}
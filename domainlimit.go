@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What DomainLimiter does with queries under a domain it limits
+const (
+	DomainLimitNXDomain = "nxdomain" // Answer NXDOMAIN itself, except for names known to exist
+	DomainLimitRefuse   = "refuse"   // Forward up to the rate each second and refuse the rest
+)
+
+// domainLimitHold is how long a domain stays limited after its flood of NXDOMAIN answers stops
+const domainLimitHold = time.Minute
+
+// maxLimitedDomains bounds the registered domains tracked at once
+const maxLimitedDomains = 100000
+
+// maxKnownNames bounds the existing names remembered per domain
+const maxKnownNames = 1000
+
+// ParseDomainLimitMode checks the name of a domain limiter mode
+func ParseDomainLimitMode(mode string) (string, error) {
+	switch mode {
+	case DomainLimitNXDomain, DomainLimitRefuse:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown domain limit mode %q, expected %s or %s", mode, DomainLimitNXDomain, DomainLimitRefuse)
+}
+
+// domainState is what DomainLimiter knows about one registered domain
+type domainState struct {
+	second       int64 // Unix second the counts are for
+	misses       int   // NXDOMAIN answers, upstream or synthesized, and refused queries in the second
+	forwarded    int   // Queries forwarded in the second while limited
+	limitedUntil time.Time
+	known        map[string]struct{} // Names recently answered NOERROR, with records or without (NODATA)
+	soa          *DnsRecord          // From the latest NXDOMAIN answer, for synthesized ones
+}
+
+// DomainLimiter defends against random subdomain attacks, floods of queries for nonexistent names
+// under one registered domain meant to overwhelm its authoritative servers and the resolvers in
+// between. When the NXDOMAIN answers for a domain exceed Threshold a second, the domain is limited
+// for a minute after the flood stops: queries for names not known to exist are answered NXDOMAIN
+// without asking Next, or forwarded only up to Rate a second and refused beyond it.
+type DomainLimiter struct {
+	Next      Handler
+	Mode      string // DomainLimitNXDomain or DomainLimitRefuse
+	Threshold int    // NXDOMAIN answers a second for one domain that start limiting it
+	Rate      int    // Queries a second still forwarded for a limited domain in DomainLimitRefuse mode
+
+	domains map[string]*domainState
+	mu      sync.Mutex
+}
+
+// NewDomainLimiter initializes a DomainLimiter with default thresholds
+func NewDomainLimiter(next Handler, mode string) *DomainLimiter {
+	return &DomainLimiter{Next: next, Mode: mode, Threshold: 100, Rate: 10, domains: make(map[string]*domainState)}
+}
+
+// ServeDNS answers queries under limited domains as the mode says and forwards the others
+func (h *DomainLimiter) ServeDNS(req *Request) *DnsPacket {
+	if len(req.Packet.Questions) == 0 {
+		return h.Next.ServeDNS(req)
+	}
+	name := strings.ToLower(strings.TrimSuffix(req.Packet.Questions[0].Name, "."))
+	domain := RegisteredDomain(name)
+	if domain == "" {
+		return h.Next.ServeDNS(req)
+	}
+	now := time.Now()
+
+	h.mu.Lock()
+	st := h.state(domain, now)
+	_, known := st.known[name]
+	if now.Before(st.limitedUntil) && !known {
+		switch {
+		case h.Mode == DomainLimitNXDomain:
+			h.miss(st, domain, now)
+			soa := st.soa
+			h.mu.Unlock()
+			res := NewErrorResponse(req.Packet, NXDOMAIN)
+			res.Header.RecursionAvailable = true
+			if soa != nil {
+				res.Authorities = append(res.Authorities, soa)
+			}
+			return res
+		case st.forwarded >= h.Rate:
+			h.miss(st, domain, now)
+			h.mu.Unlock()
+			return NewErrorResponse(req.Packet, REFUSED)
+		}
+		st.forwarded++
+	}
+	h.mu.Unlock()
+
+	res := h.Next.ServeDNS(req)
+	if res == nil {
+		return res
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st = h.state(domain, now)
+	switch {
+	case res.Header.ResCode == NXDOMAIN:
+		for _, rec := range res.Authorities {
+			if rec.Qtype == QTYPE_SOA {
+				soa := *rec
+				st.soa = &soa
+			}
+		}
+		h.miss(st, domain, now)
+	case res.Header.ResCode == NOERROR:
+		// A NODATA answer also means the name exists; a synthesized NXDOMAIN for it would deny its
+		// whole subtree to resolvers following RFC 8020
+		if len(st.known) >= maxKnownNames {
+			st.known = make(map[string]struct{})
+		}
+		st.known[name] = struct{}{}
+	}
+	return res
+}
+
+// state returns the state of a domain with its counts for the current second
+func (h *DomainLimiter) state(domain string, now time.Time) *domainState {
+	st := h.domains[domain]
+	if st == nil {
+		if len(h.domains) >= maxLimitedDomains {
+			// Keep only the domains being limited
+			for d, s := range h.domains {
+				if now.After(s.limitedUntil) {
+					delete(h.domains, d)
+				}
+			}
+		}
+		st = &domainState{known: make(map[string]struct{})}
+		h.domains[domain] = st
+	}
+	if sec := now.Unix(); st.second != sec {
+		st.second, st.misses, st.forwarded = sec, 0, 0
+	}
+	return st
+}
+
+// miss counts an NXDOMAIN answer for a domain, limiting the domain or extending its limit when
+// there are too many
+func (h *DomainLimiter) miss(st *domainState, domain string, now time.Time) {
+	st.misses++
+	if st.misses <= h.Threshold {
+		return
+	}
+	if now.After(st.limitedUntil) {
+		log.Printf("domain limit: more than %d NXDOMAIN answers a second under %s, limiting it", h.Threshold, domain)
+	}
+	st.limitedUntil = now.Add(domainLimitHold)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DS digest types (RFC 4509, RFC 6605). SHA-1 is only checked, never produced (RFC 8624 section 3.3).
+const (
+	DS_SHA1   = 1
+	DS_SHA256 = 2
+	DS_SHA384 = 4
+)
+
+// dsDigestNames maps the supported digest types to their names
+var dsDigestNames = map[uint8]string{
+	DS_SHA1:   "SHA-1",
+	DS_SHA256: "SHA-256",
+	DS_SHA384: "SHA-384",
+}
+
+// DS is the data of a delegation signer record, with which a parent zone vouches for a child's key
+// (RFC 4034)
+type DS struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+// RRType returns QTYPE_DS
+func (d *DS) RRType() QueryType {
+	return QTYPE_DS
+}
+
+// Pack encodes the data in wire format
+func (d *DS) Pack() ([]byte, error) {
+	var w rdataWriter
+	w.u16(d.KeyTag)
+	w.u8(d.Algorithm)
+	w.u8(d.DigestType)
+	w.buf = append(w.buf, d.Digest...)
+	return w.bytes()
+}
+
+// String formats the data in presentation format
+func (d *DS) String() string {
+	return fmt.Sprintf("%d %d %d %X", d.KeyTag, d.Algorithm, d.DigestType, d.Digest)
+}
+
+// decodeDS parses wire format DS data
+func decodeDS(data []byte) (RData, error) {
+	r := rdataReader{data: data}
+	d := &DS{KeyTag: r.u16(), Algorithm: r.u8(), DigestType: r.u8()}
+	d.Digest = append([]byte(nil), r.rest()...)
+	return d, r.done()
+}
+
+// parseDS parses presentation format DS data; the digest may be split into several fields
+func parseDS(fields, names []string) (RData, error) {
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("expects key tag, algorithm, digest type and digest")
+	}
+	tag, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key tag %q", fields[0])
+	}
+	var nums [2]uint8
+	for i := range nums {
+		n, err := strconv.ParseUint(fields[1+i], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", fields[1+i])
+		}
+		nums[i] = uint8(n)
+	}
+	digest, err := hex.DecodeString(strings.Join(fields[3:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest: %v", err)
+	}
+	return &DS{KeyTag: uint16(tag), Algorithm: nums[0], DigestType: nums[1], Digest: digest}, nil
+}
+
+// DS returns the record's DS data, or nil if it isn't a DS record
+func (r *DnsRecord) DS() *DS {
+	d, _ := r.Data.(*DS)
+	return d
+}
+
+// ParseDSDigestType parses a digest type name such as sha256 or its number
+func ParseDSDigestType(s string) (uint8, error) {
+	for digestType, name := range dsDigestNames {
+		if strings.EqualFold(s, name) || strings.EqualFold(s, strings.ReplaceAll(name, "-", "")) {
+			return digestType, nil
+		}
+	}
+	if n, err := strconv.ParseUint(s, 10, 8); err == nil && dsDigestNames[uint8(n)] != "" {
+		return uint8(n), nil
+	}
+	return 0, fmt.Errorf("unsupported DS digest type %q", s)
+}
+
+// dsDigest hashes a key's owner name and data as a DS record of the digest type commits to them
+func dsDigest(owner string, key *DNSKEY, digestType uint8) ([]byte, error) {
+	rdata, err := key.Pack()
+	if err != nil {
+		return nil, err
+	}
+	data := append(parseNameLoose(owner).CanonicalWire(), rdata...)
+	switch digestType {
+	case DS_SHA1:
+		sum := sha1.Sum(data)
+		return sum[:], nil
+	case DS_SHA256:
+		sum := sha256.Sum256(data)
+		return sum[:], nil
+	case DS_SHA384:
+		sum := sha512.Sum384(data)
+		return sum[:], nil
+	}
+	return nil, fmt.Errorf("unsupported DS digest type %d", digestType)
+}
+
+// NewDS computes the DS data for the key owned by owner, as submitted to the parent zone
+func NewDS(owner string, key *DNSKEY, digestType uint8) (*DS, error) {
+	if digestType == DS_SHA1 {
+		return nil, fmt.Errorf("SHA-1 DS records must not be created")
+	}
+	digest, err := dsDigest(owner, key, digestType)
+	if err != nil {
+		return nil, err
+	}
+	return &DS{KeyTag: key.KeyTag(), Algorithm: key.Algorithm, DigestType: digestType, Digest: digest}, nil
+}
+
+// Matches reports whether the DS record refers to the key owned by owner
+func (d *DS) Matches(owner string, key *DNSKEY) bool {
+	if d.KeyTag != key.KeyTag() || d.Algorithm != key.Algorithm {
+		return false
+	}
+	digest, err := dsDigest(owner, key, d.DigestType)
+	return err == nil && bytes.Equal(digest, d.Digest)
+}
+
+// runDS implements the ds subcommand
+func runDS(args []string) int {
+	fs := flag.NewFlagSet("ds", flag.ExitOnError)
+	resolver := fs.String("server", "1.1.1.1", "resolver or authoritative server to fetch the DNSKEY records from")
+	zoneFile := fs.String("f", "", "read the DNSKEY records from this zone file instead of querying")
+	digests := fs.String("digest", "sha256", "comma-separated digest types: sha256, sha384")
+	all := fs.Bool("all", false, "include zone signing keys, not just those with the SEP flag")
+	timeout := fs.Duration("timeout", 5*time.Second, "time to wait for each response")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gdns ds [-server 1.1.1.1 | -f zone.db] [-digest sha256,sha384] [-all] zone\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	var digestTypes []uint8
+	for _, s := range strings.Split(*digests, ",") {
+		digestType, err := ParseDSDigestType(strings.TrimSpace(s))
+		if err == nil && digestType == DS_SHA1 {
+			err = fmt.Errorf("SHA-1 DS records must not be created")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-digest: %v\n", err)
+			return 2
+		}
+		digestTypes = append(digestTypes, digestType)
+	}
+	zone := parseNameLoose(fs.Arg(0))
+
+	var records []*DnsRecord
+	if *zoneFile != "" {
+		z, err := LoadZoneFile(*zoneFile, zone.String())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		records = z.Records
+	} else {
+		client := NewClient()
+		client.Timeout = *timeout
+		res, err := client.Lookup(zone.String(), QTYPE_DNSKEY, *resolver)
+		if err == nil {
+			err = checkRcode(res)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		records = res.Answers
+	}
+
+	found := false
+	for _, rec := range records {
+		key := rec.DNSKEY()
+		if key == nil || !parseNameLoose(rec.Name).Equal(zone) || !*all && key.Flags&DNSKEY_SEP == 0 {
+			continue
+		}
+		for _, digestType := range digestTypes {
+			ds, err := NewDS(zone.String(), key, digestType)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			fmt.Printf("%s IN DS %s\n", zone.FQDN(), ds)
+			found = true
+		}
+	}
+	if !found {
+		fmt.Fprintf(os.Stderr, "%s: no DNSKEY records to make DS records from\n", zone.FQDN())
+		return 1
+	}
+	return 0
+}
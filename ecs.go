@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// EDNSClientSubnet is the option code of EDNS Client Subnet (RFC 7871)
+const EDNSClientSubnet = 8
+
+// Prefix lengths anonymized client subnets are cut to, as RFC 7871 section 11.1 recommends
+const (
+	ecsAnonymousIPv4 = 24
+	ecsAnonymousIPv6 = 56
+)
+
+// Ways of treating the client subnet a query carries when it is forwarded, set with Forwarder.ECS
+const (
+	ECSForward   = "forward"   // Pass it upstream unchanged
+	ECSStrip     = "strip"     // Remove it, so upstreams see only this server's address
+	ECSAnonymize = "anonymize" // Cut it to a /24 or /56 network, enough for geolocation
+	ECSZero      = "zero"      // Replace it with a zero length prefix, telling upstreams not to tailor answers
+)
+
+// ParseECSMode checks the name of a client subnet policy
+func ParseECSMode(mode string) (string, error) {
+	switch mode {
+	case ECSForward, ECSStrip, ECSAnonymize, ECSZero:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown ECS mode %q, expected %s, %s, %s or %s", mode, ECSForward, ECSStrip, ECSAnonymize, ECSZero)
+}
+
+// ClientSubnet is the payload of an EDNS Client Subnet option
+type ClientSubnet struct {
+	Family       uint16 // 1 for IPv4, 2 for IPv6
+	SourcePrefix uint8  // Leading bits of Address that are significant
+	ScopePrefix  uint8  // Leading bits the answer applies to, set by servers
+	Address      net.IP // The client network, zero beyond SourcePrefix
+}
+
+// ParseClientSubnet decodes the payload of an EDNS Client Subnet option
+func ParseClientSubnet(data []byte) (*ClientSubnet, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("client subnet option of %d bytes is too short", len(data))
+	}
+	ecs := &ClientSubnet{Family: uint16(data[0])<<8 | uint16(data[1]), SourcePrefix: data[2], ScopePrefix: data[3]}
+	size := net.IPv4len
+	if ecs.Family == 2 {
+		size = net.IPv6len
+	} else if ecs.Family != 1 {
+		return nil, fmt.Errorf("unknown client subnet family %d", ecs.Family)
+	}
+	addr := data[4:]
+	if int(ecs.SourcePrefix) > 8*size || len(addr) != (int(ecs.SourcePrefix)+7)/8 {
+		return nil, fmt.Errorf("client subnet address of %d bytes does not match prefix length %d", len(addr), ecs.SourcePrefix)
+	}
+	ecs.Address = make(net.IP, size)
+	copy(ecs.Address, addr)
+	return ecs, nil
+}
+
+// Pack encodes the option payload, with the address cut to SourcePrefix bits
+func (e *ClientSubnet) Pack() []byte {
+	addr := e.Address.To4()
+	if e.Family == 2 {
+		addr = e.Address.To16()
+	}
+	bits := 8 * len(addr)
+	masked := addr.Mask(net.CIDRMask(int(e.SourcePrefix), bits))
+	data := []byte{byte(e.Family >> 8), byte(e.Family), e.SourcePrefix, e.ScopePrefix}
+	return append(data, masked[:(int(e.SourcePrefix)+7)/8]...)
+}
+
+// applyECSMode rewrites the client subnet among the options of an OPT record's data according to
+// mode. Outside ECSForward a malformed client subnet is dropped; other options are kept as they are.
+func applyECSMode(data []byte, mode string) []byte {
+	if mode == "" || mode == ECSForward || len(data) == 0 {
+		return data
+	}
+	options, err := ParseEDNSOptions(data)
+	if err != nil {
+		return data
+	}
+	var kept []EDNSOption
+	for _, option := range options {
+		if option.Code != EDNSClientSubnet {
+			kept = append(kept, option)
+			continue
+		}
+		ecs, err := ParseClientSubnet(option.Data)
+		switch {
+		case mode == ECSStrip || err != nil:
+			continue
+		case mode == ECSZero:
+			ecs.SourcePrefix = 0
+		case mode == ECSAnonymize:
+			limit := uint8(ecsAnonymousIPv4)
+			if ecs.Family == 2 {
+				limit = ecsAnonymousIPv6
+			}
+			ecs.SourcePrefix = min(ecs.SourcePrefix, limit)
+		}
+		ecs.ScopePrefix = 0
+		kept = append(kept, EDNSOption{Code: EDNSClientSubnet, Data: ecs.Pack()})
+	}
+	return PackEDNSOptions(kept)
+}
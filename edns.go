@@ -0,0 +1,153 @@
+package main
+
+import "fmt"
+
+// DefaultEDNSSize is the UDP payload size advertised by default. It avoids IP fragmentation on
+// practically all paths, leaving larger answers to TCP (DNS Flag Day 2020).
+const DefaultEDNSSize = 1232
+
+// EDNSOption is a single option carried in the RDATA of an OPT record (RFC 6891)
+type EDNSOption struct {
+	Code uint16 // The option code
+	Data []byte // The option payload
+}
+
+// NewOPTRecord builds the OPT pseudo-record advertising the given UDP payload size
+func NewOPTRecord(udpSize uint16) *DnsRecord {
+	return &DnsRecord{
+		Name:  "",
+		Qtype: QTYPE_OPT,
+		Class: Class(udpSize),
+		Data:  &OPT{},
+	}
+}
+
+// ednsOptions returns the options of an OPT record in wire format
+func (r *DnsRecord) ednsOptions() []byte {
+	if opt, ok := r.Data.(*OPT); ok {
+		return opt.Options
+	}
+	return nil
+}
+
+// OPT returns the packet's OPT pseudo-record, or nil if the packet doesn't use EDNS
+func (p *DnsPacket) OPT() *DnsRecord {
+	for _, rec := range p.Resources {
+		if rec.Qtype == QTYPE_OPT {
+			return rec
+		}
+	}
+	return nil
+}
+
+// ednsDO is the DNSSEC OK flag in the TTL field of OPT records (RFC 3225)
+const ednsDO = 1 << 15
+
+// DNSSECOK reports whether the packet's OPT record has the DO flag set, asking for DNSSEC records
+func (p *DnsPacket) DNSSECOK() bool {
+	opt := p.OPT()
+	return opt != nil && opt.TTL&ednsDO != 0
+}
+
+// udpPayloadLimit returns the largest UDP response the sender of a query accepts: the payload size
+// its OPT record advertises, capped at limit, or 512 bytes for plain DNS queries and advertised
+// sizes below 512 (RFC 6891 section 6.2.5)
+func udpPayloadLimit(query *DnsPacket, limit uint16) int {
+	size := uint16(512)
+	if opt := query.OPT(); opt != nil && uint16(opt.Class) > size {
+		size = uint16(opt.Class)
+	}
+	if limit >= 512 && size > limit {
+		size = limit
+	}
+	return int(size)
+}
+
+// SetEDNS adds an OPT record advertising udpSize, replacing any existing one
+func (p *DnsPacket) SetEDNS(udpSize uint16) *DnsRecord {
+	p.RemoveEDNS()
+	opt := NewOPTRecord(udpSize)
+	p.Resources = append(p.Resources, opt)
+	return opt
+}
+
+// RemoveEDNS drops the packet's OPT record, if any
+func (p *DnsPacket) RemoveEDNS() {
+	resources := p.Resources[:0:0]
+	for _, rec := range p.Resources {
+		if rec.Qtype != QTYPE_OPT {
+			resources = append(resources, rec)
+		}
+	}
+	p.Resources = resources
+}
+
+// ParseEDNSOptions splits the RDATA of an OPT record into its options
+func ParseEDNSOptions(data []byte) ([]EDNSOption, error) {
+	var options []EDNSOption
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated EDNS option header")
+		}
+		code := uint16(data[0])<<8 | uint16(data[1])
+		length := int(data[2])<<8 | int(data[3])
+		if len(data) < 4+length {
+			return nil, fmt.Errorf("EDNS option %d is %d bytes but only %d remain", code, length, len(data)-4)
+		}
+		options = append(options, EDNSOption{Code: code, Data: append([]byte(nil), data[4:4+length]...)})
+		data = data[4+length:]
+	}
+	return options, nil
+}
+
+// PackEDNSOptions encodes options as the RDATA of an OPT record
+func PackEDNSOptions(options []EDNSOption) []byte {
+	var data []byte
+	for _, option := range options {
+		data = append(data, byte(option.Code>>8), byte(option.Code), byte(len(option.Data)>>8), byte(len(option.Data)))
+		data = append(data, option.Data...)
+	}
+	return data
+}
+
+// checkOPT verifies that a message has at most one OPT record, and only in the additional section
+// (RFC 6891 section 6.1.1)
+func checkOPT(p *DnsPacket) error {
+	for _, section := range [][]*DnsRecord{p.Answers, p.Authorities} {
+		for _, rec := range section {
+			if rec.Qtype == QTYPE_OPT {
+				return fmt.Errorf("%w: OPT record outside the additional section", ErrBadOPT)
+			}
+		}
+	}
+	n := 0
+	for _, rec := range p.Resources {
+		if rec.Qtype == QTYPE_OPT {
+			n++
+		}
+	}
+	if n > 1 {
+		return fmt.Errorf("%w: %d OPT records", ErrBadOPT, n)
+	}
+	return nil
+}
+
+// optLast returns the records with any OPT record moved to the end, where RFC 6891 expects it
+func optLast(records []*DnsRecord) []*DnsRecord {
+	misplaced := false
+	for i, rec := range records {
+		misplaced = misplaced || (rec.Qtype == QTYPE_OPT && i < len(records)-1)
+	}
+	if !misplaced {
+		return records
+	}
+	var ordered, opts []*DnsRecord
+	for _, rec := range records {
+		if rec.Qtype == QTYPE_OPT {
+			opts = append(opts, rec)
+		} else {
+			ordered = append(ordered, rec)
+		}
+	}
+	return append(ordered, opts...)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// TestCheckOPT checks the placement and number of OPT records RFC 6891 allows, both on decoded
+// packets and through DnsPacketFromBuffer
+func TestCheckOPT(t *testing.T) {
+	opt := func() *DnsRecord {
+		rec := NewRecord("", 0, &OPT{})
+		rec.Class = 4096
+		return rec
+	}
+	a := func() *DnsRecord {
+		return NewRecord("example.com", 3600, &A{Addr: net.IPv4(192, 0, 2, 1)})
+	}
+	tests := []struct {
+		name                      string
+		answers, auth, additional []*DnsRecord
+		msg                       string // The same message on the wire
+		bad                       bool
+	}{
+		{"no OPT", []*DnsRecord{a()}, nil, nil,
+			"1234 8180 0001 0001 0000 0000" + testQuestion + testA, false},
+		{"one OPT", []*DnsRecord{a()}, nil, []*DnsRecord{opt()},
+			"1234 8180 0001 0001 0000 0001" + testQuestion + testA + testOPT, false},
+		{"OPT before other additional records", nil, nil, []*DnsRecord{opt(), a()},
+			"1234 8180 0001 0000 0000 0002" + testQuestion + testOPT + testA, false},
+		{"two OPT records", nil, nil, []*DnsRecord{opt(), a(), opt()},
+			"1234 8180 0001 0000 0000 0003" + testQuestion + testOPT + testA + testOPT, true},
+		{"OPT in the answers", []*DnsRecord{a(), opt()}, nil, nil,
+			"1234 8180 0001 0002 0000 0000" + testQuestion + testA + testOPT, true},
+		{"OPT in the authority section", nil, []*DnsRecord{opt()}, []*DnsRecord{opt()},
+			"1234 8180 0001 0000 0001 0001" + testQuestion + testOPT + testOPT, true},
+	}
+	for _, tt := range tests {
+		p := NewDnsPacket()
+		p.Answers, p.Authorities, p.Resources = tt.answers, tt.auth, tt.additional
+		if err := checkOPT(p); tt.bad != errors.Is(err, ErrBadOPT) || !tt.bad && err != nil {
+			t.Errorf("%s: checkOPT returned %v", tt.name, err)
+		}
+		packet, err := DnsPacketFromBuffer(&BytePacketBuffer{buf: testHex(t, tt.msg)})
+		if tt.bad != errors.Is(err, ErrBadOPT) || !tt.bad && err != nil {
+			t.Errorf("%s: DnsPacketFromBuffer returned %v", tt.name, err)
+		}
+		if tt.bad && packet != nil {
+			t.Errorf("%s: got a packet along with %v", tt.name, err)
+		}
+	}
+}
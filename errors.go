@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned while encoding and decoding DNS messages
+var (
+	ErrBufferOverrun      = errors.New("end of buffer")                   // Read or write past the end of the packet buffer
+	ErrTooManyJumps       = errors.New("too many name compression jumps") // Compression pointers loop or nest too deeply
+	ErrTruncated          = errors.New("response truncated")              // The answer didn't fit and couldn't be retried over TCP
+	ErrMismatchedResponse = errors.New("response does not match query")   // Wrong ID, question or QR bit on a stream transport
+	ErrBadOPT             = errors.New("invalid OPT record")              // More than one OPT record, or one outside the additional section
+)
+
+// RcodeError reports a response that came back with a failure result code
+type RcodeError struct {
+	Name  string     // The name that was queried
+	Qtype QueryType  // The type that was queried
+	Rcode ResultCode // The result code returned by the server
+}
+
+// Error implements the error interface
+func (e *RcodeError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Name, e.Qtype, e.Rcode)
+}
+
+// checkRcode returns an *RcodeError when the response carries anything other than NOERROR
+func checkRcode(res *DnsPacket) error {
+	if res.Header.ResCode == NOERROR {
+		return nil
+	}
+	err := &RcodeError{Rcode: res.Header.ResCode}
+	if len(res.Questions) > 0 {
+		err.Name = res.Questions[0].Name
+		err.Qtype = QueryType(res.Questions[0].Qtype)
+	}
+	return err
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EtcdWatcher keeps a KVSource in step with a key prefix in etcd, using the v3 JSON gateway
+type EtcdWatcher struct {
+	Endpoint string // Base URL of an etcd member, e.g. http://127.0.0.1:2379
+	Prefix   string
+	Source   *KVSource
+	Client   *http.Client
+}
+
+// etcdKV is a key-value pair as returned by the JSON gateway, with base64 key and value
+type etcdKV struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Run loads the prefix and then applies changes as etcd reports them, reconnecting after errors
+func (w *EtcdWatcher) Run() {
+	for {
+		rev, err := w.load()
+		if err == nil {
+			err = w.watch(rev + 1)
+		}
+		log.Printf("etcd %s: %v", w.Endpoint, err)
+		time.Sleep(kvRetryDelay)
+	}
+}
+
+// load reads every key under the prefix into the source and returns the store revision read at
+func (w *EtcdWatcher) load() (int64, error) {
+	var res struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		Kvs []etcdKV `json:"kvs"`
+	}
+	if err := w.post("/v3/kv/range", w.rangeRequest(nil), &res); err != nil {
+		return 0, err
+	}
+	snapshot := make(map[string]string)
+	for _, kv := range res.Kvs {
+		key, value, err := kv.decode()
+		if err != nil {
+			return 0, err
+		}
+		snapshot[key] = value
+	}
+	w.Source.Replace(snapshot)
+	return strconv.ParseInt(res.Header.Revision, 10, 64)
+}
+
+// watch streams changes to the prefix from revision rev onwards until the connection fails
+func (w *EtcdWatcher) watch(rev int64) error {
+	body := map[string]any{"create_request": w.rangeRequest(map[string]any{"start_revision": rev})}
+	payload, _ := json.Marshal(body)
+	resp, err := w.client().Post(strings.TrimSuffix(w.Endpoint, "/")+"/v3/watch", "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("watch: HTTP status %s", resp.Status)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Canceled     bool   `json:"canceled"`
+				CancelReason string `json:"cancel_reason"`
+				Events       []struct {
+					Type string `json:"type"` // Omitted for PUT, "DELETE" for deletions
+					KV   etcdKV `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("watch: %s", msg.Error.Message)
+		}
+		if msg.Result.Canceled {
+			return fmt.Errorf("watch canceled: %s", msg.Result.CancelReason)
+		}
+		for _, ev := range msg.Result.Events {
+			key, value, err := ev.KV.decode()
+			if err != nil {
+				return err
+			}
+			if ev.Type == "DELETE" {
+				w.Source.Delete(key)
+			} else {
+				w.Source.Put(key, value)
+			}
+		}
+	}
+}
+
+// rangeRequest returns a request body covering every key under the prefix, plus extra fields
+func (w *EtcdWatcher) rangeRequest(extra map[string]any) map[string]any {
+	req := map[string]any{
+		"key":       base64.StdEncoding.EncodeToString([]byte(w.Prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(prefixEnd(w.Prefix)),
+	}
+	for k, v := range extra {
+		req[k] = v
+	}
+	return req
+}
+
+// post sends a JSON request to the gateway and decodes the response into v
+func (w *EtcdWatcher) post(path string, body, v any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client().Post(strings.TrimSuffix(w.Endpoint, "/")+path, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: HTTP status %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// client returns the HTTP client to use; watches are long-lived so there is no overall timeout
+func (w *EtcdWatcher) client() *http.Client {
+	if w.Client != nil {
+		return w.Client
+	}
+	return http.DefaultClient
+}
+
+// decode returns the key and value of a gateway key-value pair
+func (kv etcdKV) decode() (string, string, error) {
+	key, err := base64.StdEncoding.DecodeString(kv.Key)
+	if err != nil {
+		return "", "", err
+	}
+	value, err := base64.StdEncoding.DecodeString(kv.Value)
+	if err != nil {
+		return "", "", err
+	}
+	return string(key), string(value), nil
+}
+
+// prefixEnd returns the smallest key greater than every key starting with prefix
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// Every byte is 0xff: the range runs to the end of the keyspace
+	return []byte{0}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// FailoverSet pairs the primary records of a name and type with backups answered in their place while
+// the primary's health check fails
+type FailoverSet struct {
+	Primary []*DnsRecord
+	Backup  []*DnsRecord
+	Check   *HealthCheck
+}
+
+// Active returns the records to answer with: the primaries while they are healthy, else the backups
+func (s *FailoverSet) Active() []*DnsRecord {
+	if s.Check.Healthy() || len(s.Backup) == 0 {
+		return s.Primary
+	}
+	return s.Backup
+}
+
+// FailoverRecords holds the failover sets of names
+type FailoverRecords struct {
+	sets map[poolKey]*FailoverSet
+}
+
+// LoadFailoverRecords reads a failover file holding "primary check record" and "backup record" entries,
+// one per line, where check is the tcp://, http:// or https:// health check of the primary and record
+// is a master file entry with an absolute owner name, e.g.
+//
+//	primary http://192.0.2.1/healthz www.example.com. 60 IN A 192.0.2.1
+//	backup                           www.example.com. 60 IN A 198.51.100.1
+//
+// Primaries of the same name and type share one check. Lines starting with # are comments.
+func LoadFailoverRecords(path string) (*FailoverRecords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := &FailoverRecords{sets: make(map[poolKey]*FailoverSet)}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		var check string
+		switch {
+		case len(fields) >= 3 && fields[0] == "primary":
+			check, fields = fields[1], fields[2:]
+		case len(fields) >= 2 && fields[0] == "backup":
+			fields = fields[1:]
+		default:
+			return nil, fmt.Errorf("%s:%d: expected \"primary check record\" or \"backup record\"", path, line)
+		}
+		zone, err := ParseZone(strings.NewReader(strings.Join(fields, " ")), "")
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if len(zone.Records) != 1 {
+			return nil, fmt.Errorf("%s:%d: expected one record", path, line)
+		}
+		rec := zone.Records[0]
+		key := poolKey{parseNameLoose(rec.Name).Key(), rec.Qtype}
+		set := r.sets[key]
+		if set == nil {
+			set = &FailoverSet{}
+			r.sets[key] = set
+		}
+		if check == "" {
+			set.Backup = append(set.Backup, rec)
+			continue
+		}
+		if set.Check == nil {
+			if set.Check, err = NewHealthCheck(check); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+		} else if set.Check.URL.String() != check {
+			return nil, fmt.Errorf("%s:%d: primaries of %s %s have different checks", path, line, rec.Name, rec.Qtype)
+		}
+		set.Primary = append(set.Primary, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, set := range r.sets {
+		if len(set.Primary) == 0 {
+			rec := set.Backup[0]
+			return nil, fmt.Errorf("%s: backup of %s %s has no primary", path, rec.Name, rec.Qtype)
+		}
+	}
+	return r, nil
+}
+
+// StartChecks runs the health check of every primary in the background, as HealthCheck.Start
+func (r *FailoverRecords) StartChecks(interval time.Duration, rise, fall int) {
+	for _, set := range r.sets {
+		set.Check.Start(interval, rise, fall)
+	}
+}
+
+// Lookup returns the failover set of a name and type, or nil
+func (r *FailoverRecords) Lookup(name string, qtype QueryType) *FailoverSet {
+	n, err := ParseName(name)
+	if err != nil {
+		return nil
+	}
+	return r.sets[poolKey{n.Key(), qtype}]
+}
+
+// FailoverHandler answers queries for names with failover sets from the primary records while their
+// health check passes and from the backups otherwise, overriding whatever Next would answer, and
+// passes all other queries on to Next
+type FailoverHandler struct {
+	Next    Handler
+	Records *FailoverRecords
+}
+
+// ServeDNS answers from the active records of the queried name and type
+func (h *FailoverHandler) ServeDNS(req *Request) *DnsPacket {
+	query := req.Packet
+	if len(query.Questions) != 1 {
+		return h.Next.ServeDNS(req)
+	}
+	q := query.Questions[0]
+	set := h.Records.Lookup(q.Name, QueryType(q.Qtype))
+	if set == nil {
+		return h.Next.ServeDNS(req)
+	}
+	res := NewResponse(query)
+	res.Header.AuthoritativeAnswer = true
+	for _, rec := range set.Active() {
+		answer := *rec
+		answer.Name = q.Name
+		res.Answers = append(res.Answers, &answer)
+	}
+	return res
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// How FingerprintHandler orders the records of responses
+const (
+	FingerprintNormalize = "normalize" // Canonical order within each RRset, whatever order the source gave
+	FingerprintRandomize = "randomize" // Random order within each RRset, different for every response
+)
+
+// identityNames are the CHAOS TXT names servers answer with their software, version or host name
+var identityNames = map[string]bool{
+	"version.bind":   true,
+	"version.server": true,
+	"authors.bind":   true,
+	"hostname.bind":  true,
+	"id.server":      true,
+}
+
+// ParseFingerprintMode checks the name of a record ordering
+func ParseFingerprintMode(mode string) (string, error) {
+	switch mode {
+	case FingerprintNormalize, FingerprintRandomize:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown fingerprint mode %q, expected %s or %s", mode, FingerprintNormalize, FingerprintRandomize)
+}
+
+// FingerprintHandler hides what software answers queries, and what software upstream answered
+// them, from scanners that tell servers apart by their responses. CHAOS identity queries such as
+// version.bind are refused or answered with a chosen version instead of being passed on. In either
+// mode, responses echo the query's ID, opcode, RD and CD flags and question exactly as asked, with
+// Z clear, however upstream echoed them, and the records of each RRset are put in an order that
+// doesn't depend on where they came from.
+type FingerprintHandler struct {
+	Next    Handler
+	Mode    string // FingerprintNormalize or FingerprintRandomize; empty leaves the order as it is
+	Version string // Answered to version.bind and version.server; empty refuses them like the other identity names
+}
+
+// ServeDNS answers identity queries itself and reorders the records of other responses
+func (h *FingerprintHandler) ServeDNS(req *Request) *DnsPacket {
+	query := req.Packet
+	if len(query.Questions) == 1 && query.Questions[0].Qclass == CLASS_CH {
+		q := query.Questions[0]
+		name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+		if identityNames[name] {
+			qtype := QueryType(q.Qtype)
+			if h.Version == "" || !strings.HasPrefix(name, "version.") || qtype != QTYPE_TXT && qtype != QTYPE_ANY {
+				return NewErrorResponse(query, REFUSED)
+			}
+			res := NewResponse(query)
+			res.Header.AuthoritativeAnswer = true
+			version := NewRecord(q.Name, 0, &TXT{Txt: []string{h.Version}})
+			version.Class = CLASS_CH
+			res.Answers = []*DnsRecord{version}
+			return res
+		}
+	}
+
+	res := h.Next.ServeDNS(req)
+	if res == nil || h.Mode == "" {
+		return res
+	}
+	echo(query, res)
+	res.Answers = h.reorder(res.Answers)
+	res.Authorities = h.reorder(res.Authorities)
+	var opt []*DnsRecord
+	if rec := res.OPT(); rec != nil {
+		opt = []*DnsRecord{rec}
+		res.RemoveEDNS()
+	}
+	res.Resources = append(h.reorder(res.Resources), opt...)
+	return res
+}
+
+// echo makes a response echo the query's header fields and questions the way NewResponse does
+func echo(query, res *DnsPacket) {
+	res.Header.ID = query.Header.ID
+	res.Header.Opcode = query.Header.Opcode
+	res.Header.RecursionDesired = query.Header.RecursionDesired
+	res.Header.CheckingDisabled = query.Header.CheckingDisabled
+	res.Header.Z = false
+	if len(res.Questions) == len(query.Questions) {
+		res.Questions = query.Questions
+	}
+}
+
+// reorder orders the records of each RRset as the mode says, keeping the RRsets in the order they
+// first appear so CNAME chains still read from the queried name on
+func (h *FingerprintHandler) reorder(records []*DnsRecord) []*DnsRecord {
+	sets, err := GroupRRSets(records)
+	if err != nil {
+		return records
+	}
+	reordered := make([]*DnsRecord, 0, len(records))
+	for _, set := range sets {
+		if h.Mode == FingerprintRandomize {
+			rand.Shuffle(len(set.Records), func(i, j int) {
+				set.Records[i], set.Records[j] = set.Records[j], set.Records[i]
+			})
+		} else {
+			set.Sort()
+		}
+		reordered = append(reordered, set.Records...)
+	}
+	return reordered
+}
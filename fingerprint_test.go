@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestFingerprintEcho checks that responses echo the query's header fields and question as asked,
+// whatever the next handler echoed
+func TestFingerprintEcho(t *testing.T) {
+	upstream := HandlerFunc(func(req *Request) *DnsPacket {
+		res := NewDnsPacket()
+		res.Header.ID = 1
+		res.Header.Response = true
+		res.Header.Z = true
+		res.Questions = []*DnsQuestion{NewDnsQuestion("EXAMPLE.com", QTYPE_A)}
+		return res
+	})
+	query := NewDnsPacket()
+	query.Header.ID = 4321
+	query.Header.RecursionDesired = true
+	query.Header.CheckingDisabled = true
+	query.Questions = []*DnsQuestion{NewDnsQuestion("eXaMpLe.CoM", QTYPE_A)}
+
+	for _, mode := range []string{FingerprintNormalize, FingerprintRandomize} {
+		h := &FingerprintHandler{Next: upstream, Mode: mode}
+		res := h.ServeDNS(&Request{Packet: query})
+		header := res.Header
+		if header.ID != 4321 || !header.RecursionDesired || !header.CheckingDisabled || header.Z {
+			t.Errorf("%s: header ID %d, RD %t, CD %t, Z %t, want the query's with Z clear", mode, header.ID,
+				header.RecursionDesired, header.CheckingDisabled, header.Z)
+		}
+		if len(res.Questions) != 1 || res.Questions[0].Name != "eXaMpLe.CoM" {
+			t.Errorf("%s: question %v, want eXaMpLe.CoM as asked", mode, res.Questions)
+		}
+	}
+
+	// Without a mode the response is left as the next handler made it
+	res := (&FingerprintHandler{Next: upstream, Version: "1.0"}).ServeDNS(&Request{Packet: query})
+	if res.Header.ID != 1 || !res.Header.Z {
+		t.Errorf("without a mode: header ID %d, Z %t, want them unchanged", res.Header.ID, res.Header.Z)
+	}
+}
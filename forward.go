@@ -0,0 +1,789 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamFailureHold is how long an upstream that failed to answer or answered SERVFAIL is tried
+// only after the others
+const upstreamFailureHold = 30 * time.Second
+
+// Forwarder is a Handler that relays queries to upstream resolvers, trying each in turn until one
+// answers with something other than SERVFAIL
+type Forwarder struct {
+	Client    *Client
+	Upstreams []string // Resolver addresses, port 53 if none is given
+	ECS       string   // What to do with client subnets in queries: ECSForward (the default), ECSStrip, ECSAnonymize or ECSZero
+	Selection string   // Order upstreams are tried in: UpstreamOrdered (the default) or UpstreamFastest
+
+	srtt     SRTT                 // Round-trip times of the upstreams
+	failures map[string]time.Time // Upstreams mapped to when they last failed
+	mu       sync.Mutex
+}
+
+// NewForwarder initializes a Forwarder relaying to the given upstreams
+func NewForwarder(upstreams []string) *Forwarder {
+	return &Forwarder{Client: NewClient(), Upstreams: upstreams}
+}
+
+// ServeDNS forwards the query and relays the first upstream answer other than SERVFAIL, or SERVFAIL
+// if no upstream gives one
+func (f *Forwarder) ServeDNS(req *Request) *DnsPacket {
+	// Copy the header, as the client assigns the upstream query its own ID
+	query := *req.Packet
+	header := *query.Header
+	query.Header = &header
+	if query.OPT() != nil && f.Client.UDPSize > 0 {
+		// Ask upstream for what we can take without fragmentation, not what the client advertised
+		old := query.OPT()
+		opt := query.SetEDNS(f.Client.UDPSize)
+		opt.TTL, opt.Data = old.TTL, &OPT{Options: applyECSMode(old.ednsOptions(), f.ECS)}
+	}
+
+	upstreams := f.Upstreams
+	if req.Group != nil && len(req.Group.Upstreams) > 0 {
+		upstreams = req.Group.Upstreams
+	}
+	var servfail *DnsPacket
+	for _, upstream := range f.order(upstreams) {
+		span := req.Span.Child("dns.upstream", SpanClient)
+		span.SetAttr("server.address", upstream)
+		start := time.Now()
+		res, err := f.Client.Exchange(&query, upstream)
+		if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			f.srtt.Observe(upstream, time.Since(start))
+		}
+		if err == nil && res.Header.TruncatedMessage && req.Transport == "tcp" {
+			span.SetAttr("dns.tcp_retry", true)
+			res, err = f.Client.ExchangeTCP(&query, upstream)
+		}
+		span.SetError(err)
+		if err == nil {
+			span.SetAttr("dns.response.rcode", res.Header.ResCode.String())
+		}
+		span.Finish()
+		if err != nil {
+			log.Printf("forward %s to %s: %v", req.RemoteAddr, upstream, err)
+			f.failed(upstream)
+			continue
+		}
+		res.Header.ID = req.Packet.Header.ID
+		if res.Header.ResCode == SERVFAIL {
+			// Another upstream may still get an answer, but if none does relay the failure as given
+			f.failed(upstream)
+			servfail = res
+			continue
+		}
+		f.succeeded(upstream)
+		res.MergeRRSets()
+		return res
+	}
+	if servfail != nil {
+		return servfail
+	}
+	return NewErrorResponse(req.Packet, SERVFAIL)
+}
+
+// order returns upstreams in the order to try them: as given or fastest first as Selection says,
+// but those that failed within upstreamFailureHold last
+func (f *Forwarder) order(upstreams []string) []string {
+	if f.Selection == UpstreamFastest {
+		upstreams = f.srtt.Sort(upstreams)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.failures) == 0 {
+		return upstreams
+	}
+	now := time.Now()
+	ordered := make([]string, 0, len(upstreams))
+	var failing []string
+	for _, upstream := range upstreams {
+		if at, ok := f.failures[upstream]; ok && now.Sub(at) < upstreamFailureHold {
+			failing = append(failing, upstream)
+		} else {
+			ordered = append(ordered, upstream)
+		}
+	}
+	return append(ordered, failing...)
+}
+
+// failed remembers that an upstream failed to answer
+func (f *Forwarder) failed(upstream string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures == nil {
+		f.failures = make(map[string]time.Time)
+	}
+	f.failures[upstream] = time.Now()
+}
+
+// succeeded forgets an upstream's failures once it answers again
+func (f *Forwarder) succeeded(upstream string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.failures, upstream)
+}
+
+// runServe implements the "serve" subcommand, a forwarding DNS server
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":53", "address to listen on for UDP and TCP")
+	upstreams := fs.String("upstream", "", "comma-separated list of resolvers to forward to")
+	batch := fs.Int("batch", 64, "datagrams per recvmmsg/sendmmsg call (Linux only)")
+	udpSize := fs.Uint("udp-size", DefaultEDNSSize, "EDNS UDP payload size used towards clients and upstreams")
+	cacheSize := fs.Int("cache-size", 100000, "responses kept in the in-memory cache, 0 to disable caching")
+	var memoryBudget byteSize
+	fs.Var(&memoryBudget, "memory-budget", "evict cached answers when the cache and zones hold more than this, e.g. 512M (0 for no limit)")
+	preload := fs.String("preload", "", "resolve the \"name [type]\" lines of this file at startup and keep their answers cached")
+	redisAddr := fs.String("redis", "", "share the cache through the Redis server at this address instead of keeping it in memory")
+	redisPassword := fs.String("redis-password", "", "password for the Redis server")
+	ddr := fs.Bool("ddr", false, "upgrade upstreams to the encrypted resolvers they designate (RFC 9462)")
+	tlsListen := fs.String("tls-listen", "", "address to serve DNS over TLS on, e.g. :853")
+	httpsListen := fs.String("https-listen", "", "address to serve DNS over HTTPS on, e.g. :443")
+	trustedProxies := fs.String("trusted-proxies", "", "comma-separated addresses or networks of reverse proxies in front of -https-listen whose X-Forwarded-For or Forwarded headers identify clients")
+	certFile := fs.String("cert", "", "certificate for the TLS and HTTPS listeners")
+	keyFile := fs.String("key", "", "private key for the TLS and HTTPS listeners")
+	clientCA := fs.String("client-ca", "", "require TLS and HTTPS clients to present a certificate issued by these CAs")
+	aclFile := fs.String("acl", "", "file mapping client certificate identities to roles (recurse, transfer)")
+	reusePort := fs.Bool("reuseport", false, "open one UDP socket per CPU with SO_REUSEPORT")
+	timeout := fs.Duration("timeout", 5*time.Second, "time to wait for each upstream response")
+	otlpEndpoint := fs.String("otlp-endpoint", "", "export traces of queries to this OTLP/HTTP collector URL, e.g. http://localhost:4318/v1/traces")
+	traceSample := fs.Float64("trace-sample", 1, "fraction of queries traced with -otlp-endpoint")
+	upstreamSelect := fs.String("upstream-select", UpstreamOrdered, "order upstreams are tried in: ordered (as given, later ones only as backups) or fastest (lowest smoothed round-trip time first)")
+	maxOutstanding := fs.Int("max-outstanding", 200, "queries in flight to one upstream at once, 0 for no limit; more wait for a slot up to -timeout")
+	maxQueued := fs.Int("max-queued", 1000, "queries waiting for a slot at one upstream over -max-outstanding before more fail at once")
+	caseRandomization := fs.Bool("0x20", false, "send names upstream over UDP in random letter case and drop answers that don't echo it")
+	var zoneFiles zoneFlags
+	fs.Var(&zoneFiles, "zone", "serve a zone authoritatively from a master file, as origin=path (repeatable)")
+	geoPools := fs.String("geo-pools", "", "file of location-tagged record pools answered from the pool nearest the client")
+	weightedPools := fs.String("weighted-pools", "", "file of weighted, health-checked A and AAAA targets answered instead of other data for their names")
+	weightedAnswers := fs.Int("weighted-answers", 1, "number of addresses sampled by weight into each answer from -weighted-pools")
+	failover := fs.String("failover", "", "file of primary records with health checks and the backups answered while they fail")
+	healthInterval := fs.Duration("health-interval", 10*time.Second, "time between health checks of -weighted-pools targets and -failover primaries")
+	healthRise := fs.Int("health-rise", 2, "passing health checks in a row that bring a target back up")
+	healthFall := fs.Int("health-fall", 3, "failing health checks in a row that take a target down")
+	geoIP := fs.String("geoip", "", "MaxMind DB file (e.g. GeoLite2-City.mmdb) locating clients for -geo-pools")
+	zoneDB := fs.String("zone-db", "", "serve the zones stored in this SQLite database authoritatively (needs a build with -tags sqlite)")
+	adminListen := fs.String("admin-listen", "", "address for the HTTP API serving query statistics and editing the zones in -zone-db")
+	debug := fs.Bool("debug", false, "serve pprof profiles and expvar variables under /debug/ on -admin-listen")
+	syncInterval := fs.Duration("zone-sync", 5*time.Second, "how often to pick up changes to -zone files and changes made to -zone-db by other writers")
+	journalDir := fs.String("journal-dir", "", "directory of journals recording the changes to -zone and -zone-db zones, for IXFR and the admin API")
+	etcdURL := fs.String("etcd", "", "serve records kept in etcd, given as the URL of a member, e.g. http://127.0.0.1:2379")
+	consulURL := fs.String("consul", "", "serve records kept in Consul's KV store, given as the agent URL, e.g. http://127.0.0.1:8500")
+	consulToken := fs.String("consul-token", "", "ACL token for Consul")
+	kvPrefix := fs.String("kv-prefix", "/gdns/", "key prefix holding the records in etcd or Consul")
+	kvZone := fs.String("kv-zone", "", "zone the records in etcd or Consul are served in")
+	kubeZone := fs.String("kubernetes", "", "answer for Kubernetes services in this cluster domain, e.g. cluster.local")
+	kubeAPI := fs.String("kube-api", "", "Kubernetes API server URL (default: the in-cluster service account)")
+	kubeToken := fs.String("kube-token", "", "file holding the bearer token for -kube-api")
+	kubeCA := fs.String("kube-ca", "", "CA certificates for -kube-api")
+	dockerHost := fs.String("docker", "", "answer for running containers of the Docker daemon at this address, e.g. unix:///var/run/docker.sock")
+	dockerDomain := fs.String("docker-domain", "docker", "domain suffix container names are answered under")
+	strict := fs.String("strict", "", "answer FORMERR to queries failing these checks: all, or a comma-separated list of counts, class, z and rdlength")
+	chaosSpec := fs.String("chaos", "", "inject faults into responses to test clients in staging, e.g. drop=5%,dup=1%,corrupt=1%,wrong-id=1%,tc=10%,delay=200ms")
+	multiQuestion := fs.String("multi-question", MultiQuestionFormErr, "how to answer queries with several questions: formerr (RFC 9619) or first (answer only the first)")
+	ecsMode := fs.String("ecs", ECSForward, "client subnets in forwarded queries: forward, strip, anonymize (cut to /24 or /56) or zero (ask for untailored answers)")
+	safeSearch := fs.String("safe-search", "", "force safe search on Google, Bing, DuckDuckGo and YouTube: strict or moderate (YouTube's lighter restriction)")
+	groupsFile := fs.String("groups", "", "file of client groups with their own upstreams, policies and query log levels")
+	leasesFile := fs.String("dhcp-leases", "", "dnsmasq or ISC dhcpd lease file for -dhcp-domain names and the hardware addresses in -groups")
+	leaseDomain := fs.String("dhcp-domain", "", "answer A, AAAA and PTR queries for the hostnames in -dhcp-leases under this domain, e.g. lan")
+	queryLog := fs.String("query-log", QueryLogNone, "log queries: none, errors (answers other than NOERROR and NXDOMAIN) or all")
+	blockResponse := fs.String("block-response", BlockNXDomain, "answer to queries for -blocklist names, newly observed domains under -nod block and block rules of -policy files without a response line: nxdomain, nodata, refused, null (0.0.0.0 and ::) or landing page addresses")
+	logClients := fs.String("log-clients", LogClientsFull, "client addresses in the query log: full, hash (a keyed hash) or truncate (the /24 or /48 network)")
+	logMinClients := fs.Int("log-min-clients", 0, "log names as - until this many distinct clients asked for them within an hour")
+	logAggregate := fs.Duration("log-aggregate", 0, "log only query totals per rcode and type, this often, instead of each query")
+	logShip := fs.String("log-ship", "", "also send log output, and the query log instead, to syslog://host[:port], syslog+tcp://host[:port], json+udp://host:port, json+tcp://host:port or kafka://broker[:port]/topic")
+	logBuffer := fs.Int("log-buffer", 10000, "log records held for -log-ship while the collector is slow or down; more are dropped")
+	tunnelMode := fs.String("tunnel-detect", "", "watch for clients tunneling data through long, random looking or never repeated names: alert (log them) or throttle (also refuse their queries under the domain for 10 minutes)")
+	tunnelUnique := fs.Int("tunnel-max-unique", 100, "distinct names a client may ask for under one domain each minute before -tunnel-detect flags it")
+	nodMode := fs.String("nod", "", "act on domains first seen within -nod-window: log, delay (also answer SERVFAIL for -nod-delay) or block (also answer as -block-response)")
+	nodFile := fs.String("nod-file", "", "file keeping when domains were first seen for -nod across restarts")
+	nodWindow := fs.Duration("nod-window", 24*time.Hour, "how long a domain counts as newly observed, and how long -nod learns before acting")
+	nodDelay := fs.Duration("nod-delay", time.Minute, "how long -nod delay answers SERVFAIL for newly observed domains")
+	pslFile := fs.String("psl", "", "Public Suffix List file to use instead of the built-in copy, for registered domains in -nod, -tunnel-detect and statistics")
+	var blocklists listFlags
+	fs.Var(&blocklists, "blocklist", "block the names in this file or http(s) URL of hostnames, hosts file lines, *.wildcards, ||adblock^ rules and /regexps/ (repeatable)")
+	blocklistUpdate := fs.Duration("blocklist-update", 24*time.Hour, "how often -blocklist and -allowlist URLs are checked for a new version; files are reloaded when they change")
+	var allowlists listFlags
+	fs.Var(&allowlists, "allowlist", "exempt the names in this file or URL, written as for -blocklist, from -blocklist, -policy and -nod blocking (repeatable)")
+	statsDB := fs.String("stats-db", "", "SQLite database recording every query for the history served under /history on -admin-listen (needs a build with -tags sqlite)")
+	statsRetention := fs.Duration("stats-retention", 30*24*time.Hour, "how long -stats-db keeps queries")
+	domainLimit := fs.String("domain-limit", "", "limit registered domains flooded with queries for random nonexistent names: nxdomain (answer NXDOMAIN for names not known to exist) or refuse (forward only -domain-limit-rate a second)")
+	domainLimitThreshold := fs.Int("domain-limit-threshold", 100, "NXDOMAIN answers a second under one registered domain that start -domain-limit")
+	domainLimitRate := fs.Int("domain-limit-rate", 10, "queries a second still forwarded for a domain limited in -domain-limit refuse mode")
+	policyFile := fs.String("policy", "", "file of rules refusing or answering NXDOMAIN to queries by client, name suffix and type")
+	minimal := fs.Bool("minimal-responses", false, "leave authority and additional records out of responses, except the SOA of negative answers, referrals and OPT")
+	fingerprint := fs.String("fingerprint", "", "order the records of each RRset to hide which software answered: normalize (canonical order) or randomize; also echoes query header fields the same way for every answer and refuses CHAOS identity queries such as version.bind")
+	versionString := fs.String("version", "", "answer CHAOS version.bind and version.server queries with this text instead of refusing them under -fingerprint")
+	dnssec := fs.Bool("dnssec", false, "validate forwarded answers as a DNSSEC validating stub: ask upstreams for signatures, answer SERVFAIL to bogus answers and set AD on secure ones; clients setting CD get unvalidated answers")
+	trustAnchors := fs.String("trust-anchors", "", "master file of DS or DNSKEY records trusted by -dnssec instead of the root zone's keys")
+	anyMode := fs.String("any", ANYMinimal, "how to answer ANY queries: hinfo (a synthesized HINFO record), subset (one RRset) or full (every RRset)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gdns serve [-upstream a[,b...]] [-zone origin=path] [-zone-db path] [-listen :53]\n")
+		fmt.Fprintf(fs.Output(), "Upstreams are IP[:port], tls://host[:port] or https:// URLs.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if (*upstreams == "" && len(zoneFiles) == 0 && *zoneDB == "" && *kvZone == "" && *kubeZone == "" && *dockerHost == "" && *leaseDomain == "") || fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	if *udpSize < 512 || *udpSize > maxMessageSize {
+		fmt.Fprintf(os.Stderr, "-udp-size must be between 512 and %d\n", maxMessageSize)
+		return 2
+	}
+	var strictChecks StrictCheck
+	if *strict != "" {
+		var err error
+		if strictChecks, err = ParseStrictChecks(*strict); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	var chaos *Chaos
+	if *chaosSpec != "" {
+		var err error
+		if chaos, err = ParseChaos(*chaosSpec); err != nil {
+			fmt.Fprintf(os.Stderr, "-chaos: %v\n", err)
+			return 2
+		}
+	}
+	if *multiQuestion != MultiQuestionFormErr && *multiQuestion != MultiQuestionFirst {
+		fmt.Fprintf(os.Stderr, "unknown -multi-question mode %q\n", *multiQuestion)
+		return 2
+	}
+	if _, err := ParseECSMode(*ecsMode); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *fingerprint != "" {
+		if _, err := ParseFingerprintMode(*fingerprint); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	if _, err := ParseANYMode(*anyMode); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *debug && *adminListen == "" {
+		fmt.Fprintln(os.Stderr, "-debug needs -admin-listen")
+		return 2
+	}
+	if *weightedAnswers < 1 || *healthInterval <= 0 || *healthRise < 1 || *healthFall < 1 {
+		fmt.Fprintln(os.Stderr, "-weighted-answers, -health-interval, -health-rise and -health-fall must be positive")
+		return 2
+	}
+	blocked, err := ParseBlockResponse(*blockResponse)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if _, err := ParseQueryLogLevel(*queryLog); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if _, err := ParseLogClientsMode(*logClients); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	var shipper *LogShipper
+	if *logShip != "" {
+		if *logBuffer < 1 {
+			fmt.Fprintln(os.Stderr, "-log-buffer must be positive")
+			return 2
+		}
+		if shipper, err = NewLogShipper(*logShip, *logBuffer); err != nil {
+			fmt.Fprintf(os.Stderr, "-log-ship: %v\n", err)
+			return 2
+		}
+		log.SetOutput(io.MultiWriter(os.Stderr, shipper))
+	}
+	if *safeSearch != "" {
+		if _, err := ParseSafeSearchMode(*safeSearch); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	if *journalDir != "" {
+		if info, err := os.Stat(*journalDir); err != nil || !info.IsDir() {
+			fmt.Fprintf(os.Stderr, "-journal-dir %s is not a directory\n", *journalDir)
+			return 2
+		}
+	}
+	if *domainLimit != "" {
+		if _, err := ParseDomainLimitMode(*domainLimit); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if *domainLimitThreshold < 1 || *domainLimitRate < 0 {
+			fmt.Fprintln(os.Stderr, "-domain-limit-threshold must be positive and -domain-limit-rate not negative")
+			return 2
+		}
+	}
+	if _, err := ParseUpstreamSelection(*upstreamSelect); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *maxOutstanding < 0 || *maxQueued < 0 {
+		fmt.Fprintln(os.Stderr, "-max-outstanding and -max-queued must not be negative")
+		return 2
+	}
+	if *statsRetention <= 0 {
+		fmt.Fprintln(os.Stderr, "-stats-retention must be positive")
+		return 2
+	}
+	if *blocklistUpdate <= 0 {
+		fmt.Fprintln(os.Stderr, "-blocklist-update must be positive")
+		return 2
+	}
+	if *tunnelMode != "" {
+		if _, err := ParseTunnelMode(*tunnelMode); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if *tunnelUnique < 1 {
+			fmt.Fprintln(os.Stderr, "-tunnel-max-unique must be positive")
+			return 2
+		}
+	}
+	if *pslFile != "" {
+		list, err := LoadPublicSuffixList(*pslFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		UsePublicSuffixList(list)
+	}
+	if *nodMode != "" {
+		if _, err := ParseNODMode(*nodMode); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if *nodWindow <= 0 || *nodDelay <= 0 {
+			fmt.Fprintln(os.Stderr, "-nod-window and -nod-delay must be positive")
+			return 2
+		}
+	}
+	if *leaseDomain != "" && *leasesFile == "" {
+		fmt.Fprintln(os.Stderr, "-dhcp-domain needs -dhcp-leases")
+		return 2
+	}
+	if *geoIP != "" && *geoPools == "" {
+		fmt.Fprintln(os.Stderr, "-geoip needs -geo-pools")
+		return 2
+	}
+	if (*etcdURL != "" || *consulURL != "") != (*kvZone != "") {
+		fmt.Fprintln(os.Stderr, "-kv-zone needs -etcd or -consul, and they need -kv-zone")
+		return 2
+	}
+	if (*dnssec || *trustAnchors != "") && (*upstreams == "" || !*dnssec) {
+		fmt.Fprintln(os.Stderr, "-dnssec needs -upstream, and -trust-anchors needs -dnssec")
+		return 2
+	}
+	forwarder := NewForwarder(nil)
+	if *upstreams != "" {
+		for _, upstream := range strings.Split(*upstreams, ",") {
+			forwarder.Upstreams = append(forwarder.Upstreams, strings.TrimSpace(upstream))
+		}
+	}
+	forwarder.ECS = *ecsMode
+	forwarder.Selection = *upstreamSelect
+	forwarder.Client.Timeout = *timeout
+	forwarder.Client.UDPSize = uint16(*udpSize)
+	forwarder.Client.CaseRandomization = *caseRandomization
+	forwarder.Client.Outstanding = NewOutstandingTable(*maxOutstanding, *maxQueued)
+	if *ddr {
+		for _, upstream := range forwarder.Upstreams {
+			if d, err := forwarder.Client.Upgrade(upstream); err != nil {
+				log.Printf("ddr: %v", err)
+			} else {
+				log.Printf("ddr: %s upgraded to %s", upstream, d.URL)
+			}
+		}
+	}
+
+	var handler Handler
+	var caching *CachingHandler
+	if len(forwarder.Upstreams) > 0 {
+		handler = forwarder
+		if *domainLimit != "" {
+			limiter := NewDomainLimiter(forwarder, *domainLimit)
+			limiter.Threshold, limiter.Rate = *domainLimitThreshold, *domainLimitRate
+			handler = limiter
+		}
+		if *dnssec {
+			validator := NewValidator(forwarder.Client, forwarder.Upstreams)
+			if *trustAnchors != "" {
+				if err := validator.LoadTrustAnchors(*trustAnchors); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return 1
+				}
+			}
+			handler = &ValidatingHandler{Next: handler, Validator: validator}
+		}
+		switch {
+		case *redisAddr != "":
+			cache := NewRedisCache(*redisAddr)
+			cache.Password = *redisPassword
+			caching = NewCachingHandler(handler, cache)
+		case *cacheSize > 0:
+			caching = NewCachingHandler(handler, NewMemoryCache(*cacheSize))
+		}
+		if caching != nil {
+			handler = caching
+		}
+		if *dnssec {
+			handler = &DNSSECOKHandler{Next: handler}
+		}
+	}
+	if *preload != "" {
+		if caching == nil {
+			fmt.Fprintln(os.Stderr, "-preload needs -upstream and a cache")
+			return 2
+		}
+		preloader, err := NewPreloader(caching, *preload)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		preloader.Run()
+	}
+	admin := &AdminAPI{Debug: *debug}
+	if *adminListen != "" {
+		admin.Stats = &QueryStats{}
+		admin.Upstreams = forwarder.Client.Outstanding
+	}
+	if len(zoneFiles) > 0 || *zoneDB != "" || *kvZone != "" || *kubeZone != "" || *dockerHost != "" {
+		auth := NewAuthority(handler)
+		admin.Authority = auth
+		for _, zf := range zoneFiles {
+			zone, err := LoadZoneFile(zf.path, zf.origin)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			authZone := NewAuthZone(zone)
+			if *journalDir != "" {
+				if err := authZone.OpenJournal(*journalDir); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return 1
+				}
+			}
+			auth.SetZone(authZone)
+			go auth.WatchZoneFile(zf.path, zf.origin, *syncInterval)
+		}
+		if *zoneDB != "" {
+			store, err := OpenSQLiteZoneStore(*zoneDB)
+			if err == nil {
+				store.JournalDir = *journalDir
+				err = store.Load(auth)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			defer store.Close()
+			go store.Watch(auth, *syncInterval)
+			admin.Store = store
+		}
+		if *kvZone != "" {
+			zone := NewAuthZone(&Zone{Origin: *kvZone})
+			auth.SetZone(zone)
+			source := NewKVSource(zone)
+			if *etcdURL != "" {
+				go (&EtcdWatcher{Endpoint: *etcdURL, Prefix: *kvPrefix, Source: source}).Run()
+			}
+			if *consulURL != "" {
+				go (&ConsulWatcher{Addr: *consulURL, Prefix: *kvPrefix, Token: *consulToken, Source: source}).Run()
+			}
+		}
+		if *kubeZone != "" {
+			zone := NewAuthZone(&Zone{Origin: *kubeZone})
+			auth.SetZone(zone)
+			watcher, err := NewKubernetesWatcher(*kubeAPI, *kubeToken, *kubeCA, NewKVSource(zone))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			go watcher.Run()
+		}
+		handler = auth
+		if *geoPools != "" {
+			pools, err := LoadGeoPools(*geoPools)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			geo := &GeoHandler{Next: auth, Pools: pools}
+			if *geoIP != "" {
+				if geo.DB, err = OpenGeoDB(*geoIP); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return 1
+				}
+			}
+			handler = geo
+		}
+		if *dockerHost != "" {
+			zone := NewAuthZone(&Zone{Origin: *dockerDomain})
+			auth.SetZone(zone)
+			watcher, err := NewDockerWatcher(*dockerHost, NewKVSource(zone), handler)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			go watcher.Run()
+			handler = watcher
+		}
+	}
+	if memoryBudget > 0 {
+		budget := NewMemoryBudget(int64(memoryBudget), nil, admin.Authority)
+		if caching != nil {
+			budget.Cache, _ = caching.Cache.(*MemoryCache)
+		}
+		go budget.Run()
+	}
+	var leases *LeaseFile
+	if *leasesFile != "" {
+		var err error
+		if leases, err = NewLeaseFile(*leasesFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		go leases.Watch(5 * time.Second)
+	}
+	if *leaseDomain != "" {
+		domain, err := ParseName(*leaseDomain)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		handler = &LeaseHandler{Next: handler, Leases: leases, Domain: domain}
+	}
+	if *weightedPools != "" {
+		pools, err := LoadWeightedPools(*weightedPools)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		pools.StartChecks(*healthInterval, *healthRise, *healthFall)
+		handler = &WeightedHandler{Next: handler, Pools: pools, Answers: *weightedAnswers}
+	}
+	if *failover != "" {
+		records, err := LoadFailoverRecords(*failover)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		records.StartChecks(*healthInterval, *healthRise, *healthFall)
+		handler = &FailoverHandler{Next: handler, Records: records}
+	}
+	if *safeSearch != "" {
+		handler = &SafeSearchHandler{Next: handler, Mode: *safeSearch}
+	}
+	if *anyMode != ANYFull {
+		handler = &ANYHandler{Next: handler, Mode: *anyMode}
+	}
+	if *minimal {
+		handler = &MinimalHandler{Next: handler}
+	}
+	if *fingerprint != "" || *versionString != "" {
+		handler = &FingerprintHandler{Next: handler, Mode: *fingerprint, Version: *versionString}
+	}
+	var groups *ClientGroups
+	if *groupsFile != "" {
+		var err error
+		if groups, err = LoadClientGroups(*groupsFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, group := range groups.Groups {
+			if len(group.Upstreams) > 0 && len(forwarder.Upstreams) == 0 {
+				fmt.Fprintf(os.Stderr, "group %s sets upstreams, which needs -upstream\n", group.Name)
+				return 2
+			}
+		}
+		if groups.usesMACs() && leases == nil {
+			fmt.Fprintln(os.Stderr, "hardware addresses in -groups need -dhcp-leases")
+			return 2
+		}
+		groups.Leases = leases
+	}
+	if *nodMode != "" {
+		seen, err := OpenFirstSeen(*nodFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer seen.Close()
+		handler = &NODHandler{Next: handler, Mode: *nodMode, Seen: seen, Window: *nodWindow, Delay: *nodDelay, Response: blocked}
+	}
+	if *policyFile != "" || groups != nil {
+		policy := &PolicyHandler{Next: handler, Response: blocked}
+		if *policyFile != "" {
+			var err error
+			if policy.Policy, err = LoadPolicy(*policyFile); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+		admin.Blocking = append(admin.Blocking, policy)
+		handler = policy
+	}
+	if len(blocklists) > 0 {
+		blocklist := &BlocklistHandler{Next: handler, Response: blocked}
+		for _, location := range blocklists {
+			source, err := NewBlocklistSource(location)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			go source.Run(*blocklistUpdate)
+			blocklist.Lists = append(blocklist.Lists, source)
+		}
+		admin.Blocking = append(admin.Blocking, blocklist)
+		handler = blocklist
+	}
+	if len(allowlists) > 0 || groups.usesAllowlists() {
+		allow := &AllowlistHandler{Next: handler}
+		for _, location := range allowlists {
+			source, err := NewBlocklistSource(location)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			go source.Run(*blocklistUpdate)
+			allow.Lists = append(allow.Lists, source)
+		}
+		handler = allow
+	}
+	if *tunnelMode != "" {
+		tunnel := NewTunnelDetector(handler, *tunnelMode)
+		tunnel.MaxUnique = *tunnelUnique
+		handler = tunnel
+	}
+	if *statsDB != "" {
+		db, err := OpenStatsDB(*statsDB, *statsRetention)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer db.Close()
+		admin.History = db
+	}
+	if admin.Stats != nil || admin.History != nil {
+		admin.Caching = caching
+		handler = &StatsHandler{Next: handler, Stats: admin.Stats, DB: admin.History}
+	}
+	if *queryLog != QueryLogNone || groups != nil {
+		queries := NewQueryLogHandler(handler, *queryLog)
+		queries.Clients, queries.MinClients, queries.Aggregate = *logClients, *logMinClients, *logAggregate
+		queries.Shipper = shipper
+		if queries.Aggregate > 0 {
+			go queries.LogAggregates()
+		}
+		handler = queries
+	}
+	if groups != nil {
+		handler = &GroupHandler{Next: handler, Groups: groups}
+	}
+	if *aclFile != "" {
+		acl, err := LoadACL(*aclFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		handler = &ACLHandler{Next: handler, ACL: acl}
+	}
+	if *adminListen != "" {
+		if *debug {
+			var cache Cache
+			if caching != nil {
+				cache = caching.Cache
+			}
+			publishDebugVars(cache, admin.Authority)
+		}
+		go func() {
+			log.Fatal(admin.ListenAndServe(*adminListen))
+		}()
+	}
+	server := NewServer(*listen, handler)
+	server.TLSAddr, server.HTTPSAddr = *tlsListen, *httpsListen
+	if *tlsListen != "" || *httpsListen != "" {
+		config, err := LoadServerTLSConfig(*certFile, *keyFile, *clientCA)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		server.TLSConfig = config
+	}
+	if *trustedProxies != "" {
+		networks, err := ParseNetworks(*trustedProxies)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		server.TrustedProxies = networks
+	}
+	server.BatchSize = *batch
+	server.Strict = strictChecks
+	server.MultiQuestion = *multiQuestion
+	server.ClientAnswers = groups != nil || *aclFile != "" || *policyFile != "" || len(blocklists) > 0 ||
+		len(allowlists) > 0 || *geoPools != ""
+	if chaos != nil {
+		log.Printf("chaos: injecting faults into responses: %s", chaos)
+		server.Chaos = chaos
+	}
+	if *otlpEndpoint != "" {
+		server.Tracer = NewTracer(*otlpEndpoint)
+		server.Tracer.SampleRate = *traceSample
+	}
+	server.UDPSize = uint16(*udpSize)
+	if *reusePort {
+		server.UDPSockets = runtime.NumCPU()
+	}
+	if err := server.ListenAndServe(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// zoneFlags collects repeated -zone origin=path flags
+type zoneFlags []struct{ origin, path string }
+
+func (z *zoneFlags) String() string {
+	return fmt.Sprint(*z)
+}
+
+func (z *zoneFlags) Set(value string) error {
+	origin, path, ok := strings.Cut(value, "=")
+	if !ok || path == "" {
+		return fmt.Errorf("expected origin=path, got %q", value)
+	}
+	*z = append(*z, struct{ origin, path string }{origin, path})
+	return nil
+}
+
+// listFlags collects the values of a repeated flag
+type listFlags []string
+
+func (l *listFlags) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlags) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
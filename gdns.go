@@ -4,17 +4,24 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 )
 
 type BytePacketBuffer struct {
-	buf [512]byte // 512 bytes standard size for dns packets
-	pos int       // current position in the buffer
+	buf []byte // 512 bytes standard size for dns packets, up to 65535 over TCP
+	pos int    // current position in the buffer
 }
 
 // NewBytePacketBuffer initializes and returns a new BytePacketBuffer
 func NewBytePacketBuffer() *BytePacketBuffer {
+	return NewBytePacketBufferSize(512)
+}
+
+// NewBytePacketBufferSize initializes a BytePacketBuffer holding up to size bytes
+func NewBytePacketBufferSize(size int) *BytePacketBuffer {
 	return &BytePacketBuffer{
-		buf: [512]byte{},
+		buf: make([]byte, size),
 		pos: 0,
 	}
 }
@@ -38,8 +45,8 @@ func (b *BytePacketBuffer) Seek(pos int) error {
 
 // Read a single byte and move the position one step forward
 func (b *BytePacketBuffer) Read() (byte, error) {
-	if b.pos >= 512 {
-		return 0, fmt.Errorf("end of buffer")
+	if b.pos >= len(b.buf) {
+		return 0, ErrBufferOverrun
 	}
 	res := b.buf[b.pos]
 	b.pos += 1
@@ -48,19 +55,19 @@ func (b *BytePacketBuffer) Read() (byte, error) {
 
 // Get a single byte, without changing the buffer position
 func (b *BytePacketBuffer) Get(pos int) (byte, error) {
-	if b.pos >= 512 {
-		return 0, fmt.Errorf("end of buffer")
+	if pos >= len(b.buf) {
+		return 0, ErrBufferOverrun
 	}
 	res := b.buf[pos]
 	return res, nil
 }
 
 // Get a range of bytes
-func (b *BytePacketBuffer) GetRange(start, len int) ([]byte, error) {
-	if start+len >= 512 {
-		return nil, fmt.Errorf("End of buffer")
+func (b *BytePacketBuffer) GetRange(start, length int) ([]byte, error) {
+	if start+length > len(b.buf) {
+		return nil, ErrBufferOverrun
 	}
-	return b.buf[start : start+len], nil
+	return b.buf[start : start+length], nil
 }
 
 // Read two bytes, stepping two steps forward
@@ -115,12 +122,11 @@ func (b *BytePacketBuffer) Read_qname(outstr *string) error {
 	var pos = b.Pos()
 	var delim = ""
 	var jumped bool
-	const maxJumps = 5
 	var jumpsPerformed int
 
 	for {
-		if jumpsPerformed > maxJumps {
-			return fmt.Errorf("limit of %d jumps exceeded", maxJumps)
+		if jumpsPerformed > maxCompressionJumps {
+			return fmt.Errorf("%w: limit of %d jumps exceeded", ErrTooManyJumps, maxCompressionJumps)
 		}
 
 		len, err := b.Get(pos)
@@ -153,7 +159,7 @@ func (b *BytePacketBuffer) Read_qname(outstr *string) error {
 				return err
 			}
 
-			*outstr += string(rangeBytes)
+			*outstr += escapeLabel(string(rangeBytes))
 			delim = "."
 			pos += int(len)
 		}
@@ -166,6 +172,69 @@ func (b *BytePacketBuffer) Read_qname(outstr *string) error {
 	return nil
 }
 
+// Write a single byte and move the position one step forward
+func (b *BytePacketBuffer) Write(val byte) error {
+	if b.pos >= len(b.buf) {
+		return ErrBufferOverrun
+	}
+	b.buf[b.pos] = val
+	b.pos += 1
+	return nil
+}
+
+// WriteU8 writes a single byte
+func (b *BytePacketBuffer) WriteU8(val uint8) error {
+	return b.Write(val)
+}
+
+// WriteU16 writes two bytes in network byte order
+func (b *BytePacketBuffer) WriteU16(val uint16) error {
+	if err := b.Write(byte(val >> 8)); err != nil {
+		return err
+	}
+	return b.Write(byte(val & 0xFF))
+}
+
+// WriteU32 writes four bytes in network byte order
+func (b *BytePacketBuffer) WriteU32(val uint32) error {
+	if err := b.Write(byte(val >> 24)); err != nil {
+		return err
+	}
+	if err := b.Write(byte(val >> 16)); err != nil {
+		return err
+	}
+	if err := b.Write(byte(val >> 8)); err != nil {
+		return err
+	}
+	return b.Write(byte(val))
+}
+
+// Write_qname writes a domain name in presentation format as a sequence of length-prefixed labels
+func (b *BytePacketBuffer) Write_qname(qname string) error {
+	name, err := ParseName(qname)
+	if err != nil {
+		return err
+	}
+	return b.WriteName(name)
+}
+
+// Set a single byte at a position, without changing the buffer position
+func (b *BytePacketBuffer) Set(pos int, val byte) error {
+	if pos >= len(b.buf) {
+		return ErrBufferOverrun
+	}
+	b.buf[pos] = val
+	return nil
+}
+
+// SetU16 sets two bytes at a position, without changing the buffer position
+func (b *BytePacketBuffer) SetU16(pos int, val uint16) error {
+	if err := b.Set(pos, byte(val>>8)); err != nil {
+		return err
+	}
+	return b.Set(pos+1, byte(val&0xFF))
+}
+
 // ResultCode is an enumeration representing DNS response codes
 type ResultCode uint8
 
@@ -276,9 +345,9 @@ func (h *DnsHeader) Read(buffer *BytePacketBuffer) error {
 	h.Response = (flags >> 15 & 1) > 0
 
 	h.ResCode = ResultCodeFromNum(uint8(flags & 0xF))
-	h.CheckingDisabled = (flags >> 12 & 1) > 0
-	h.AuthedData = (flags >> 13 & 1) > 0
-	h.Z = (flags >> 14 & 1) > 0
+	h.CheckingDisabled = (flags >> 4 & 1) > 0
+	h.AuthedData = (flags >> 5 & 1) > 0
+	h.Z = (flags >> 6 & 1) > 0
 	h.RecursionAvailable = (flags >> 7 & 1) > 0
 
 	h.Questions, err = buffer.ReadU16() // Read number of questions
@@ -304,11 +373,57 @@ func (h *DnsHeader) Read(buffer *BytePacketBuffer) error {
 	return nil
 }
 
+// Write serializes the DNS packet header into the buffer
+func (h *DnsHeader) Write(buffer *BytePacketBuffer) error {
+	if err := buffer.WriteU16(h.ID); err != nil {
+		return err
+	}
+
+	var flags uint16
+	flags |= boolBit(h.RecursionDesired) << 8
+	flags |= boolBit(h.TruncatedMessage) << 9
+	flags |= boolBit(h.AuthoritativeAnswer) << 10
+	flags |= uint16(h.Opcode&0xF) << 11
+	flags |= boolBit(h.Response) << 15
+	flags |= uint16(h.ResCode) & 0xF
+	flags |= boolBit(h.CheckingDisabled) << 4
+	flags |= boolBit(h.AuthedData) << 5
+	flags |= boolBit(h.Z) << 6
+	flags |= boolBit(h.RecursionAvailable) << 7
+	if err := buffer.WriteU16(flags); err != nil {
+		return err
+	}
+
+	for _, count := range []uint16{h.Questions, h.Answers, h.AuthoritativeEntries, h.ResourceEntries} {
+		if err := buffer.WriteU16(count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boolBit converts a flag into a single bit
+func boolBit(v bool) uint16 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
 // DnsQuestion represents a DNS question in the packet
 type DnsQuestion struct {
 	Name   string // The domain name being queried
 	Qtype  uint16 // The type of query (e.g., A, AAAA, MX)
-	Qclass uint16 // The class of query (usually 1 for Internet)
+	Qclass Class  // The class of query (usually IN)
+}
+
+// NewDnsQuestion initializes and returns a new IN class DnsQuestion
+func NewDnsQuestion(name string, qtype QueryType) *DnsQuestion {
+	return &DnsQuestion{
+		Name:   name,
+		Qtype:  uint16(qtype),
+		Qclass: CLASS_IN,
+	}
 }
 
 // Read parses the DNS question from the buffer
@@ -323,150 +438,595 @@ func (q *DnsQuestion) Read(buffer *BytePacketBuffer) error {
 		return err
 	}
 
-	q.Qclass, err = buffer.ReadU16() // Read the query class
+	qclass, err := buffer.ReadU16() // Read the query class
 	if err != nil {
 		return err
 	}
+	q.Qclass = Class(qclass)
 
 	return nil
 }
 
+// Write serializes the DNS question into the buffer
+func (q *DnsQuestion) Write(buffer *BytePacketBuffer) error {
+	if err := buffer.Write_qname(q.Name); err != nil {
+		return err
+	}
+	if err := buffer.WriteU16(q.Qtype); err != nil {
+		return err
+	}
+	return buffer.WriteU16(uint16(q.Qclass))
+}
+
 // QueryType represents the various DNS record types
 type QueryType uint16
 
 // DNS record types
 const (
-	QTYPE_A     QueryType = 1  // IPv4 address
-	QTYPE_NS    QueryType = 2  // Name server
-	QTYPE_CNAME QueryType = 5  // Canonical name
-	QTYPE_MX    QueryType = 15 // Mail exchange
-	QTYPE_AAAA  QueryType = 28 // IPv6 address
+	QTYPE_A          QueryType = 1   // IPv4 address
+	QTYPE_NS         QueryType = 2   // Name server
+	QTYPE_CNAME      QueryType = 5   // Canonical name
+	QTYPE_SOA        QueryType = 6   // Start of authority
+	QTYPE_PTR        QueryType = 12  // Domain name pointer
+	QTYPE_HINFO      QueryType = 13  // Host information
+	QTYPE_MX         QueryType = 15  // Mail exchange
+	QTYPE_TXT        QueryType = 16  // Text strings
+	QTYPE_RP         QueryType = 17  // Responsible person
+	QTYPE_AAAA       QueryType = 28  // IPv6 address
+	QTYPE_LOC        QueryType = 29  // Location
+	QTYPE_SRV        QueryType = 33  // Service locator
+	QTYPE_NAPTR      QueryType = 35  // Naming authority pointer
+	QTYPE_DNAME      QueryType = 39  // Delegation of a subtree
+	QTYPE_OPT        QueryType = 41  // EDNS pseudo-record
+	QTYPE_DS         QueryType = 43  // Delegation signer
+	QTYPE_SSHFP      QueryType = 44  // SSH host key fingerprint
+	QTYPE_RRSIG      QueryType = 46  // DNSSEC signature
+	QTYPE_NSEC       QueryType = 47  // Next secure name
+	QTYPE_DNSKEY     QueryType = 48  // DNSSEC public key
+	QTYPE_NSEC3      QueryType = 50  // Next secure hashed name
+	QTYPE_NSEC3PARAM QueryType = 51  // NSEC3 parameters of a zone
+	QTYPE_TLSA       QueryType = 52  // TLS certificate association
+	QTYPE_OPENPGPKEY QueryType = 61  // OpenPGP public key
+	QTYPE_SVCB       QueryType = 64  // Service binding
+	QTYPE_HTTPS      QueryType = 65  // Service binding for HTTPS
+	QTYPE_IXFR       QueryType = 251 // Incremental zone transfer
+	QTYPE_AXFR       QueryType = 252 // Zone transfer
+	QTYPE_ANY        QueryType = 255 // All records at a name
+	QTYPE_URI        QueryType = 256 // Uniform resource identifier
 )
 
-// DnsRecord represents a DNS record (answer, authority, or additional)
+// queryTypeNames maps record types to their mnemonics
+var queryTypeNames = map[QueryType]string{
+	QTYPE_A:          "A",
+	QTYPE_NS:         "NS",
+	QTYPE_CNAME:      "CNAME",
+	QTYPE_SOA:        "SOA",
+	QTYPE_PTR:        "PTR",
+	QTYPE_HINFO:      "HINFO",
+	QTYPE_MX:         "MX",
+	QTYPE_TXT:        "TXT",
+	QTYPE_RP:         "RP",
+	QTYPE_AAAA:       "AAAA",
+	QTYPE_LOC:        "LOC",
+	QTYPE_SRV:        "SRV",
+	QTYPE_NAPTR:      "NAPTR",
+	QTYPE_DNAME:      "DNAME",
+	QTYPE_OPT:        "OPT",
+	QTYPE_DS:         "DS",
+	QTYPE_SSHFP:      "SSHFP",
+	QTYPE_RRSIG:      "RRSIG",
+	QTYPE_NSEC:       "NSEC",
+	QTYPE_DNSKEY:     "DNSKEY",
+	QTYPE_NSEC3:      "NSEC3",
+	QTYPE_NSEC3PARAM: "NSEC3PARAM",
+	QTYPE_TLSA:       "TLSA",
+	QTYPE_OPENPGPKEY: "OPENPGPKEY",
+	QTYPE_SVCB:       "SVCB",
+	QTYPE_HTTPS:      "HTTPS",
+	QTYPE_IXFR:       "IXFR",
+	QTYPE_AXFR:       "AXFR",
+	QTYPE_ANY:        "ANY",
+	QTYPE_URI:        "URI",
+}
+
+// String converts a QueryType to its mnemonic, or TYPEnnn when unknown
+func (qt QueryType) String() string {
+	if name, ok := queryTypeNames[qt]; ok {
+		return name
+	}
+	if codec := customCodec(qt); codec != nil {
+		return codec.Name
+	}
+	return fmt.Sprintf("TYPE%d", uint16(qt))
+}
+
+// QueryTypeFromString parses a record type mnemonic or TYPEnnn notation
+func QueryTypeFromString(s string) (QueryType, error) {
+	s = strings.ToUpper(s)
+	for qt, name := range queryTypeNames {
+		if name == s {
+			return qt, nil
+		}
+	}
+	if qt, ok := customTypeByName(s); ok {
+		return qt, nil
+	}
+	if strings.HasPrefix(s, "TYPE") {
+		n, err := strconv.ParseUint(s[4:], 10, 16)
+		if err == nil {
+			return QueryType(n), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown record type %q", s)
+}
+
+// DnsRecord represents a DNS record (answer, authority, or additional): the fields every record has,
+// and its typed data
 type DnsRecord struct {
-	Name     string    // The domain name associated with the record
-	Qtype    QueryType // The type of record
-	Class    uint16    // The class of record (usually 1 for Internet)
-	TTL      uint32    // Time to live (in seconds) for caching
-	DataLen  uint16    // The length of the record data
-	Addr     net.IP    // The IP address for A and AAAA records
-	Host     string    // The host name for CNAME and MX records
-	Priority uint16    // The priority for MX records
+	Name    string    // The domain name associated with the record
+	Qtype   QueryType // The type of record
+	Class   Class     // The class of record (usually IN), or the UDP payload size for OPT records
+	TTL     uint32    // Time to live (in seconds) for caching
+	DataLen uint16    // The length of the record data
+	Data    RData     // The record data, such as *A or *MX, of the record's type
 }
 
-// DnsRecordRead parses a DNS record from the buffer
+// DnsRecordRead parses a DNS record from the buffer. The buffer is left just past the record's
+// RDLENGTH bytes of data even if decoding the data used fewer, so a malformed record can't
+// desynchronize the records that follow; data that would run past RDLENGTH is an error.
 func DnsRecordRead(buffer *BytePacketBuffer) (*DnsRecord, error) {
+	rec, _, err := readRecord(buffer)
+	return rec, err
+}
+
+// readRecord parses a DNS record from the buffer like DnsRecordRead, also returning how many bytes
+// decoding its data consumed, for strict parsing to compare against RDLENGTH
+func readRecord(buffer *BytePacketBuffer) (*DnsRecord, int, error) {
+	rec, consumed, err := readRecordData(buffer)
+	if err != nil {
+		return nil, 0, err
+	}
+	if consumed > int(rec.DataLen) {
+		return nil, 0, fmt.Errorf("%s record data overruns its RDLENGTH of %d", rec.Qtype, rec.DataLen)
+	}
+	buffer.Step(int(rec.DataLen) - consumed)
+	return rec, consumed, nil
+}
+
+// readRecordData parses the record at the buffer position and returns the number of data bytes
+// the type's decoder consumed
+func readRecordData(buffer *BytePacketBuffer) (*DnsRecord, int, error) {
 	var rec DnsRecord
 	err := buffer.Read_qname(&rec.Name) // Read the domain name
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	rec.Qtype, err = buffer.ReadU16_Query() // Read the record type
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	rec.Class, err = buffer.ReadU16() // Read the class of the record
+	class, err := buffer.ReadU16() // Read the class of the record
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
+	rec.Class = Class(class)
 
 	rec.TTL, err = buffer.ReadU32() // Read the time to live (TTL)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	if rec.Qtype != QTYPE_OPT {
+		// OPT records carry the extended RCODE and flags in the TTL field
+		rec.TTL = wireTTL(rec.TTL)
 	}
 
 	rec.DataLen, err = buffer.ReadU16() // Read the length of the record data
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
+	dataStart := buffer.Pos()
 
-	// Parse the record based on its type
-	switch rec.Qtype {
+	rec.Data, err = readRdata(buffer, rec.Qtype, rec.DataLen)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &rec, buffer.Pos() - dataStart, nil
+}
+
+// readRdata parses record data of the given type and length into the struct of its type
+func readRdata(buffer *BytePacketBuffer, qtype QueryType, length uint16) (RData, error) {
+	var err error
+	switch qtype {
 	case QTYPE_A:
-		var addr [4]byte
-		for i := 0; i < 4; i++ {
-			b, err := buffer.Read()
-			if err != nil {
+		addr, err := buffer.GetRange(buffer.Pos(), 4)
+		if err != nil {
+			return nil, err
+		}
+		buffer.Step(4)
+		return &A{Addr: net.IPv4(addr[0], addr[1], addr[2], addr[3])}, nil
+
+	case QTYPE_AAAA:
+		addr, err := buffer.GetRange(buffer.Pos(), 16)
+		if err != nil {
+			return nil, err
+		}
+		buffer.Step(16)
+		return &AAAA{Addr: append(net.IP(nil), addr...)}, nil
+
+	case QTYPE_NS:
+		d := &NS{}
+		return d, buffer.Read_qname(&d.Host)
+
+	case QTYPE_CNAME:
+		d := &CNAME{}
+		return d, buffer.Read_qname(&d.Target)
+
+	case QTYPE_PTR:
+		d := &PTR{}
+		return d, buffer.Read_qname(&d.Host)
+
+	case QTYPE_SOA:
+		d := &SOA{}
+		if err = buffer.Read_qname(&d.MName); err != nil {
+			return nil, err
+		}
+		if err = buffer.Read_qname(&d.RName); err != nil {
+			return nil, err
+		}
+		for _, field := range []*uint32{&d.Serial, &d.Refresh, &d.Retry, &d.Expire, &d.Minimum} {
+			if *field, err = buffer.ReadU32(); err != nil {
 				return nil, err
 			}
-			addr[i] = b
 		}
-		rec.Addr = net.IPv4(addr[0], addr[1], addr[2], addr[3])
+		return d, nil
 
-	case QTYPE_AAAA:
-		var addr [16]byte
-		for i := 0; i < 16; i++ {
-			b, err := buffer.Read()
+	case QTYPE_RP:
+		d := &RP{}
+		if err = buffer.Read_qname(&d.Mbox); err != nil {
+			return nil, err
+		}
+		return d, buffer.Read_qname(&d.Txt)
+
+	case QTYPE_TXT:
+		end := buffer.Pos() + int(length)
+		d := &TXT{Txt: []string{}}
+		for buffer.Pos() < end {
+			length, err := buffer.Read()
 			if err != nil {
 				return nil, err
 			}
-			addr[i] = b
+			text, err := buffer.GetRange(buffer.Pos(), int(length))
+			if err != nil {
+				return nil, err
+			}
+			d.Txt = append(d.Txt, string(text))
+			buffer.Step(int(length))
 		}
-		rec.Addr = net.IP(addr[:])
+		return d, nil
 
-	case QTYPE_CNAME:
-		err := buffer.Read_qname(&rec.Host)
-		if err != nil {
-			return nil, err
+	case QTYPE_SRV:
+		d := &SRV{}
+		for _, field := range []*uint16{&d.Priority, &d.Weight, &d.Port} {
+			if *field, err = buffer.ReadU16(); err != nil {
+				return nil, err
+			}
 		}
+		return d, buffer.Read_qname(&d.Target)
 
 	case QTYPE_MX:
-		rec.Priority, err = buffer.ReadU16()
-		if err != nil {
+		d := &MX{}
+		if d.Preference, err = buffer.ReadU16(); err != nil {
 			return nil, err
 		}
-		err = buffer.Read_qname(&rec.Host)
+		return d, buffer.Read_qname(&d.Host)
+
+	case QTYPE_SVCB, QTYPE_HTTPS:
+		end := buffer.Pos() + int(length)
+		d := &SVCB{}
+		if d.Priority, err = buffer.ReadU16(); err != nil {
+			return nil, err
+		}
+		if err = buffer.Read_qname(&d.Target); err != nil {
+			return nil, err
+		}
+		if d.Params, err = readSVCBParams(buffer, end); err != nil {
+			return nil, err
+		}
+		if qtype == QTYPE_HTTPS {
+			return &HTTPS{*d}, nil
+		}
+		return d, nil
+	}
+
+	data, err := buffer.GetRange(buffer.Pos(), int(length))
+	if err != nil {
+		return nil, err
+	}
+	buffer.Step(int(length))
+	if qtype == QTYPE_OPT {
+		return &OPT{Options: append([]byte(nil), data...)}, nil
+	}
+	if standard, ok := standardTypes[qtype]; ok {
+		d, err := standard.decode(data)
 		if err != nil {
+			return nil, fmt.Errorf("%s record: %v", qtype, err)
+		}
+		return d, nil
+	}
+	if codec := customCodec(qtype); codec != nil {
+		d, err := codec.Decode(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s record: %v", codec.Name, err)
+		}
+		return &Registered{Qtype: qtype, Data: d}, nil
+	}
+	return &Unknown{Qtype: qtype, Data: append([]byte(nil), data...)}, nil
+}
+
+// Write serializes the DNS record into the buffer, filling in the data length. Names are written
+// uncompressed; the data of types without a case here is written as its type packs it.
+func (r *DnsRecord) Write(buffer *BytePacketBuffer) error {
+	if err := buffer.Write_qname(r.Name); err != nil {
+		return err
+	}
+	if err := buffer.WriteU16(uint16(r.Qtype)); err != nil {
+		return err
+	}
+	if err := buffer.WriteU16(uint16(r.Class)); err != nil {
+		return err
+	}
+	if err := buffer.WriteU32(r.TTL); err != nil {
+		return err
+	}
+
+	lenPos := buffer.Pos()
+	if err := buffer.WriteU16(0); err != nil {
+		return err
+	}
+
+	var err error
+	switch data := r.Data.(type) {
+	case nil:
+		// Records without data, such as a bare OPT record
+
+	case *NS:
+		err = buffer.Write_qname(data.Host)
+
+	case *CNAME:
+		err = buffer.Write_qname(data.Target)
+
+	case *PTR:
+		err = buffer.Write_qname(data.Host)
+
+	case *SOA:
+		if err = buffer.Write_qname(data.MName); err != nil {
+			return err
+		}
+		if err = buffer.Write_qname(data.RName); err != nil {
+			return err
+		}
+		for _, field := range []uint32{data.Serial, data.Refresh, data.Retry, data.Expire, data.Minimum} {
+			if err = buffer.WriteU32(field); err != nil {
+				return err
+			}
+		}
+
+	case *RP:
+		if err = buffer.Write_qname(data.Mbox); err != nil {
+			return err
+		}
+		err = buffer.Write_qname(data.Txt)
+
+	case *SRV:
+		for _, field := range []uint16{data.Priority, data.Weight, data.Port} {
+			if err = buffer.WriteU16(field); err != nil {
+				return err
+			}
+		}
+		err = buffer.Write_qname(data.Target)
+
+	case *MX:
+		if err = buffer.WriteU16(data.Preference); err != nil {
+			return err
+		}
+		err = buffer.Write_qname(data.Host)
+
+	case *SVCB:
+		err = data.write(buffer)
+
+	case *HTTPS:
+		err = data.write(buffer)
+
+	default:
+		packed, err := data.Pack()
+		if err != nil {
+			return err
+		}
+		for _, b := range packed {
+			if err = buffer.Write(b); err != nil {
+				return err
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	r.DataLen = uint16(buffer.Pos() - (lenPos + 2))
+	return buffer.SetU16(lenPos, r.DataLen)
+}
+
+// RdataString returns the presentation format of the record data
+func (r *DnsRecord) RdataString() string {
+	if r.Data == nil {
+		return `\# 0`
+	}
+	return r.Data.String()
+}
+
+// quoteCharString quotes a character string, escaping quotes, backslashes and non-printable bytes
+func quoteCharString(text string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < 0x20 || c > 0x7e:
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// String returns the record in zone file presentation format
+func (r *DnsRecord) String() string {
+	return fmt.Sprintf("%s.\t%d\t%s\t%s\t%s", r.Name, r.TTL, className(r.Class), r.Qtype, r.RdataString())
+}
+
+// DnsPacket represents a complete DNS message
+type DnsPacket struct {
+	Header      *DnsHeader     // The packet header
+	Questions   []*DnsQuestion // The question section
+	Answers     []*DnsRecord   // The answer section
+	Authorities []*DnsRecord   // The authority section
+	Resources   []*DnsRecord   // The additional section
+}
+
+// NewDnsPacket initializes and returns an empty DnsPacket
+func NewDnsPacket() *DnsPacket {
+	return &DnsPacket{
+		Header: NewDnsHeader(),
+	}
+}
+
+// DnsPacketFromBuffer parses a complete DNS message from the buffer
+func DnsPacketFromBuffer(buffer *BytePacketBuffer) (*DnsPacket, error) {
+	packet := NewDnsPacket()
+	if err := packet.Header.Read(buffer); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < int(packet.Header.Questions); i++ {
+		var question DnsQuestion
+		if err := question.Read(buffer); err != nil {
 			return nil, err
 		}
+		packet.Questions = append(packet.Questions, &question)
+	}
+
+	sections := []struct {
+		count uint16
+		dst   *[]*DnsRecord
+	}{
+		{packet.Header.Answers, &packet.Answers},
+		{packet.Header.AuthoritativeEntries, &packet.Authorities},
+		{packet.Header.ResourceEntries, &packet.Resources},
+	}
+	for _, section := range sections {
+		for i := 0; i < int(section.count); i++ {
+			record, err := DnsRecordRead(buffer)
+			if err != nil {
+				return nil, err
+			}
+			*section.dst = append(*section.dst, record)
+		}
 	}
 
-	return &rec, nil
+	if err := checkOPT(packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// Write serializes the packet into the buffer, updating the header counts
+func (p *DnsPacket) Write(buffer *BytePacketBuffer) error {
+	p.Header.Questions = uint16(len(p.Questions))
+	p.Header.Answers = uint16(len(p.Answers))
+	p.Header.AuthoritativeEntries = uint16(len(p.Authorities))
+	p.Header.ResourceEntries = uint16(len(p.Resources))
+
+	if err := p.Header.Write(buffer); err != nil {
+		return err
+	}
+	for _, question := range p.Questions {
+		if err := question.Write(buffer); err != nil {
+			return err
+		}
+	}
+	for _, section := range [][]*DnsRecord{p.Answers, p.Authorities, optLast(p.Resources)} {
+		for _, record := range section {
+			if err := record.Write(buffer); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "query":
+			os.Exit(runQuery(os.Args[2:]))
+		case "ptr":
+			os.Exit(runPTR(os.Args[2:]))
+		case "shell":
+			os.Exit(runShell(os.Args[2:]))
+		case "watch":
+			os.Exit(runWatch(os.Args[2:]))
+		case "decode":
+			os.Exit(runDecode(os.Args[2:]))
+		case "diff":
+			os.Exit(runDiff(os.Args[2:]))
+		case "checkzone":
+			os.Exit(runCheckZone(os.Args[2:]))
+		case "transfer":
+			os.Exit(runTransfer(os.Args[2:]))
+		case "zonediff":
+			os.Exit(runZoneDiff(os.Args[2:]))
+		case "propagation":
+			os.Exit(runPropagation(os.Args[2:]))
+		case "mailcheck":
+			os.Exit(runMailCheck(os.Args[2:]))
+		case "spf":
+			os.Exit(runSPF(os.Args[2:]))
+		case "sshfp":
+			os.Exit(runSSHFP(os.Args[2:]))
+		case "ds":
+			os.Exit(runDS(os.Args[2:]))
+		case "serve":
+			os.Exit(runServe(os.Args[2:]))
+		}
+	}
+
 	// Example usage: reading a DNS response from a binary file
-	data, err := os.ReadFile("response_packet.txt")
+	f, err := os.Open("response_packet.txt")
 	if err != nil {
 		fmt.Printf("Failed to read file: %v\n", err)
 		os.Exit(1)
 	}
+	defer f.Close()
 
-	// Initialize a new buffer and copy the file data into it
-	buffer := NewBytePacketBuffer()
-	copy(buffer.buf[:], data)
-
-	// Parse the DNS header
-	header := NewDnsHeader()
-	err = header.Read(buffer)
+	// Parse the whole message straight from the file
+	packet, err := ReadMessage(f)
 	if err != nil {
-		fmt.Printf("Failed to read DNS header: %v\n", err)
+		fmt.Printf("Failed to read DNS message: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("DNS Header: %+v\n", header)
-
-	// Parse each DNS question
-	for i := 0; i < int(header.Questions); i++ {
-		var question DnsQuestion
-		err = question.Read(buffer)
-		if err != nil {
-			fmt.Printf("Failed to read DNS question: %v\n", err)
-			os.Exit(1)
-		}
-		fmt.Printf("DNS Question: %+v\n", question)
+	fmt.Printf("DNS Header: %+v\n", packet.Header)
+	for _, question := range packet.Questions {
+		fmt.Printf("DNS Question: %+v\n", *question)
 	}
-
-	// Parse each DNS record in the answers section
-	for i := 0; i < int(header.Answers); i++ {
-		record, err := DnsRecordRead(buffer)
-		if err != nil {
-			fmt.Printf("Failed to read DNS record: %v\n", err)
-			os.Exit(1)
-		}
+	for _, record := range packet.Answers {
 		fmt.Printf("DNS Record: %+v\n", record)
 	}
 }
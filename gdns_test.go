@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestReadRecord checks how much of a record's data its decoder consumes against RDLENGTH, and that
+// the buffer is always left just past the RDLENGTH bytes
+func TestReadRecord(t *testing.T) {
+	tests := []struct {
+		name     string
+		record   string // A record owned by the root, followed by a next record's first bytes
+		consumed int
+		end      int   // Buffer position after the record
+		err      error // A decoding error wrapping this
+		overrun  bool  // Data running past RDLENGTH
+	}{
+		{"A", "00 0001 0001 00000e10 0004 c0000201 ffff", 4, 15, nil, false},
+		{"A with RDLENGTH longer than the data", "00 0001 0001 00000e10 0006 c0000201 0000 ffff", 4, 17, nil, false},
+		{"A with RDLENGTH shorter than the data", "00 0001 0001 00000e10 0003 c0000201 ffff", 0, 0, nil, true},
+		{"A cut off", "00 0001 0001 00000e10 0004 c000", 0, 0, ErrBufferOverrun, false},
+		{"TXT", "00 0010 0001 00000e10 0006 05 68656c6c6f ffff", 6, 17, nil, false},
+		{"TXT string past RDLENGTH", "00 0010 0001 00000e10 0003 05 68656c6c6f ffff", 0, 0, nil, true},
+		{"MX with RDLENGTH 1", "00 000f 0001 00000e10 0001 00 0a 00", 0, 0, nil, true},
+		{"OPT", "00 0029 1000 00000000 0004 000a 0000 ffff", 4, 15, nil, false},
+		{"fixed fields cut off", "00 0001 0001 0000", 0, 0, ErrBufferOverrun, false},
+	}
+	for _, tt := range tests {
+		buffer := &BytePacketBuffer{buf: testHex(t, tt.record)}
+		rec, consumed, err := readRecord(buffer)
+		switch {
+		case tt.overrun:
+			if err == nil || errors.Is(err, ErrBufferOverrun) {
+				t.Errorf("%s: got %v, want data overrunning RDLENGTH", tt.name, err)
+			}
+		case tt.err != nil:
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		default:
+			if consumed != tt.consumed || buffer.Pos() != tt.end {
+				t.Errorf("%s: consumed %d bytes ending at %d, want %d ending at %d", tt.name, consumed,
+					buffer.Pos(), tt.consumed, tt.end)
+			}
+			if int(rec.DataLen) != tt.end-11 {
+				t.Errorf("%s: RDLENGTH %d, want %d", tt.name, rec.DataLen, tt.end-11)
+			}
+		}
+		if err != nil && rec != nil {
+			t.Errorf("%s: got a record along with %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// earthRadiusKm is the mean radius of the Earth, for great-circle distances
+const earthRadiusKm = 6371
+
+// GeoPool is a set of records answered to clients closest to its location
+type GeoPool struct {
+	Latitude  float64
+	Longitude float64
+	Default   bool         // Answered when the client's location is unknown, rather than by distance
+	Records   []*DnsRecord // Records of one name and type
+}
+
+// poolKey identifies the name and type a pool of records answers for
+type poolKey struct {
+	name  string // Name.Key() of the owner
+	qtype QueryType
+}
+
+// GeoPools holds the location-tagged record pools of authoritative names
+type GeoPools struct {
+	pools map[poolKey][]*GeoPool
+}
+
+// LoadGeoPools reads a pool file holding one "location record" entry per line, where the location is
+// "latitude,longitude" or "*" for the pool served to clients that can't be located and the record is
+// a master file entry with an absolute owner name, e.g.
+//
+//	52.37,4.89   www.example.com. 60 IN A 192.0.2.1
+//	*            www.example.com. 60 IN A 203.0.113.1
+//
+// Records of the same name, type and location form one pool; lines starting with # are comments.
+func LoadGeoPools(path string) (*GeoPools, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &GeoPools{pools: make(map[poolKey][]*GeoPool)}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.IndexAny(text, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected location and record", path, line)
+		}
+		location, entry := text[:i], text[i+1:]
+		pool := &GeoPool{Default: location == "*"}
+		if !pool.Default {
+			if pool.Latitude, pool.Longitude, err = parseCoordinates(location); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+		}
+		zone, err := ParseZone(strings.NewReader(strings.TrimSpace(entry)), "")
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		for _, rec := range zone.Records {
+			p.add(pool, rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// add puts rec into the pool of its name and type at the location of pool, creating it if needed
+func (p *GeoPools) add(pool *GeoPool, rec *DnsRecord) {
+	key := poolKey{parseNameLoose(rec.Name).Key(), rec.Qtype}
+	for _, existing := range p.pools[key] {
+		if existing.Default == pool.Default && existing.Latitude == pool.Latitude && existing.Longitude == pool.Longitude {
+			existing.Records = append(existing.Records, rec)
+			return
+		}
+	}
+	p.pools[key] = append(p.pools[key], &GeoPool{
+		Latitude:  pool.Latitude,
+		Longitude: pool.Longitude,
+		Default:   pool.Default,
+		Records:   []*DnsRecord{rec},
+	})
+}
+
+// Lookup returns the pools of a name and type
+func (p *GeoPools) Lookup(name string, qtype QueryType) []*GeoPool {
+	n, err := ParseName(name)
+	if err != nil {
+		return nil
+	}
+	return p.pools[poolKey{n.Key(), qtype}]
+}
+
+// Nearest returns the pool closest to loc, or the default pool when loc is nil. It returns nil if
+// the client can't be located and there is no default pool.
+func Nearest(pools []*GeoPool, loc *GeoLocation) *GeoPool {
+	var best, fallback *GeoPool
+	bestDistance := math.Inf(1)
+	for _, pool := range pools {
+		if pool.Default {
+			fallback = pool
+			continue
+		}
+		if loc == nil {
+			continue
+		}
+		if d := greatCircleKm(loc.Latitude, loc.Longitude, pool.Latitude, pool.Longitude); d < bestDistance {
+			best, bestDistance = pool, d
+		}
+	}
+	if best == nil {
+		return fallback
+	}
+	return best
+}
+
+// GeoHandler answers queries for names with location-tagged pools from the pool nearest the client,
+// located by the EDNS Client Subnet of the query or else by its source address, and passes all
+// other queries on to Next
+type GeoHandler struct {
+	Next  Handler
+	DB    *GeoDB // Locates clients; without it only default pools are answered
+	Pools *GeoPools
+}
+
+// ServeDNS answers from the nearest pool of the queried name and type, or of a CNAME at the name
+func (h *GeoHandler) ServeDNS(req *Request) *DnsPacket {
+	query := req.Packet
+	if len(query.Questions) != 1 {
+		return h.Next.ServeDNS(req)
+	}
+	q := query.Questions[0]
+	pools := h.Pools.Lookup(q.Name, QueryType(q.Qtype))
+	if len(pools) == 0 {
+		pools = h.Pools.Lookup(q.Name, QTYPE_CNAME)
+	}
+	if len(pools) == 0 {
+		return h.Next.ServeDNS(req)
+	}
+
+	ip, ecs := clientSubnet(req)
+	var loc *GeoLocation
+	if h.DB != nil && ip != nil {
+		var err error
+		if loc, err = h.DB.Locate(ip); err != nil {
+			log.Printf("geoip %s: %v", ip, err)
+		}
+	}
+	pool := Nearest(pools, loc)
+	if pool == nil {
+		return h.Next.ServeDNS(req)
+	}
+
+	res := NewResponse(query)
+	res.Header.AuthoritativeAnswer = true
+	for _, rec := range pool.Records {
+		answer := *rec
+		answer.Name = q.Name
+		res.Answers = append(res.Answers, &answer)
+	}
+	if ecs != nil {
+		// The answer holds for the whole subnet the client disclosed (RFC 7871 section 7.2.1)
+		ecs.ScopePrefix = ecs.SourcePrefix
+		opt := res.SetEDNS(DefaultEDNSSize)
+		opt.Data = &OPT{Options: PackEDNSOptions([]EDNSOption{{Code: EDNSClientSubnet, Data: ecs.Pack()}})}
+	}
+	return res
+}
+
+// clientSubnet returns the address to locate the client of req by: the EDNS Client Subnet of the
+// query when it has one with a non-zero prefix, returned as well, or else the source address
+func clientSubnet(req *Request) (net.IP, *ClientSubnet) {
+	if opt := req.Packet.OPT(); opt != nil && len(opt.ednsOptions()) > 0 {
+		options, _ := ParseEDNSOptions(opt.ednsOptions())
+		for _, option := range options {
+			if option.Code != EDNSClientSubnet {
+				continue
+			}
+			if ecs, err := ParseClientSubnet(option.Data); err == nil {
+				if ecs.SourcePrefix == 0 {
+					return nil, ecs
+				}
+				return ecs.Address, ecs
+			}
+		}
+	}
+	return addrIP(req.RemoteAddr), nil
+}
+
+// addrIP returns the IP address of a UDP or TCP address, or nil for other kinds
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// parseCoordinates parses a "latitude,longitude" pair in decimal degrees
+func parseCoordinates(s string) (float64, float64, error) {
+	latText, lonText, ok := strings.Cut(s, ",")
+	lat, err1 := strconv.ParseFloat(latText, 64)
+	lon, err2 := strconv.ParseFloat(lonText, 64)
+	if !ok || err1 != nil || err2 != nil || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		return 0, 0, fmt.Errorf("invalid location %q, expected latitude,longitude or *", s)
+	}
+	return lat, lon, nil
+}
+
+// greatCircleKm returns the distance between two points on the Earth with the haversine formula
+func greatCircleKm(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
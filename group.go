@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// ClientGroup is a set of clients sharing settings that differ from the server's defaults
+type ClientGroup struct {
+	Name      string
+	Clients   *ClientSet      // Members by address, network or certificate identity
+	MACs      map[string]bool // Members by hardware address, looked up in the DHCP leases
+	Upstreams []string        // Resolvers forwarded to instead of the server's; nil means the server's
+	Policy    *Policy         // Rules applied before the server's; nil means none
+	LogLevel  string          // Query log level instead of the server's; empty means the server's
+	Allowlist *Blocklist      // Names exempt from blocking for the group in addition to the server's
+}
+
+// ClientGroups assigns clients to the first group they belong to
+type ClientGroups struct {
+	Groups []*ClientGroup
+	Leases *LeaseFile // Maps client addresses to hardware addresses; nil if MACs aren't used
+}
+
+// LoadClientGroups reads a group file holding one "name option=value..." entry per line. Options are
+// clients, a comma-separated list of IP addresses, CIDR networks, hardware addresses and certificate
+// identities; upstream, a comma-separated list of resolvers; policy, a policy file as LoadPolicy
+// reads; allowlist, a file of names exempt from blocking as LoadBlocklist reads; and log, a query
+// log level. For example:
+//
+//	kids    clients=192.168.1.16/28,3c:22:fb:12:34:56 upstream=1.1.1.3 policy=kids.policy log=all
+//	adults  clients=192.168.1.0/24 allowlist=adults.allow log=none
+//
+// Lines starting with # are comments.
+func LoadClientGroups(path string) (*ClientGroups, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	groups := &ClientGroups{}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		group := &ClientGroup{Name: fields[0], Clients: &ClientSet{}, MACs: make(map[string]bool)}
+		for _, option := range fields[1:] {
+			key, value, ok := strings.Cut(option, "=")
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: expected option=value, got %q", path, line, option)
+			}
+			switch key {
+			case "clients":
+				var rest []string
+				for _, item := range strings.Split(value, ",") {
+					if mac, err := net.ParseMAC(item); err == nil {
+						group.MACs[mac.String()] = true
+					} else {
+						rest = append(rest, item)
+					}
+				}
+				group.Clients = parseClientSet(strings.Join(rest, ","))
+			case "upstream":
+				for _, upstream := range strings.Split(value, ",") {
+					group.Upstreams = append(group.Upstreams, strings.TrimSpace(upstream))
+				}
+			case "policy":
+				if group.Policy, err = LoadPolicy(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+				}
+			case "allowlist":
+				if group.Allowlist, err = LoadBlocklist(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+				}
+			case "log":
+				if group.LogLevel, err = ParseQueryLogLevel(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+				}
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown option %q", path, line, key)
+			}
+		}
+		groups.Groups = append(groups.Groups, group)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// usesMACs reports whether any group lists hardware addresses
+func (g *ClientGroups) usesMACs() bool {
+	for _, group := range g.Groups {
+		if len(group.MACs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// usesAllowlists reports whether any group has an allowlist; groups may be nil
+func (g *ClientGroups) usesAllowlists() bool {
+	if g == nil {
+		return false
+	}
+	for _, group := range g.Groups {
+		if group.Allowlist != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns the first group the client that sent req belongs to, or nil
+func (g *ClientGroups) Match(req *Request) *ClientGroup {
+	var mac string
+	if g.Leases != nil {
+		if ip := addrIP(req.RemoteAddr); ip != nil {
+			mac = g.Leases.MAC(ip)
+		}
+	}
+	for _, group := range g.Groups {
+		if group.Clients.Contains(req) || (mac != "" && group.MACs[mac]) {
+			return group
+		}
+	}
+	return nil
+}
+
+// policy returns the group's policy, or nil for requests outside any group
+func (g *ClientGroup) policy() *Policy {
+	if g == nil {
+		return nil
+	}
+	return g.Policy
+}
+
+// GroupHandler assigns each request to its client's group before passing it on to Next, whose
+// handlers pick up the group's settings from Request.Group
+type GroupHandler struct {
+	Next   Handler
+	Groups *ClientGroups
+}
+
+// ServeDNS sets the request's group
+func (h *GroupHandler) ServeDNS(req *Request) *DnsPacket {
+	req.Group = h.Groups.Match(req)
+	return h.Next.ServeDNS(req)
+}
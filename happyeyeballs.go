@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// connectionAttemptDelay is the head start each connection attempt gets before the next address is
+// tried alongside it (RFC 8305 section 5)
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// interleaveFamilies reorders sorted addresses to alternate between address families, starting with
+// the family of the first, so a broken family delays a connection by one attempt at most
+// (RFC 8305 section 4)
+func interleaveFamilies(ips []net.IP) []net.IP {
+	var preferred, other []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (ips[0].To4() != nil) {
+			preferred = append(preferred, ip)
+		} else {
+			other = append(other, ip)
+		}
+	}
+	interleaved := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(preferred) || i < len(other); i++ {
+		if i < len(preferred) {
+			interleaved = append(interleaved, preferred[i])
+		}
+		if i < len(other) {
+			interleaved = append(interleaved, other[i])
+		}
+	}
+	return interleaved
+}
+
+// dialHappyEyeballs connects to port on the first of ips that accepts, starting an attempt to the
+// next address whenever the latest one fails or has had connectionAttemptDelay to itself, and
+// abandoning the rest once one succeeds (RFC 8305 section 5)
+func dialHappyEyeballs(ctx context.Context, d *net.Dialer, network string, ips []net.IP, port string) (net.Conn, error) {
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses to connect to on port %s", port)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := d.DialContext(ctx, network, addr)
+			results <- result{conn, err}
+		}()
+	}
+
+	start()
+	var lastErr error
+	for pending > 0 {
+		var timer *time.Timer
+		var headStart <-chan time.Time
+		if next < len(ips) {
+			timer = time.NewTimer(connectionAttemptDelay)
+			headStart = timer.C
+		}
+		var r result
+		waited := false
+		select {
+		case r = <-results:
+		case <-headStart:
+			waited = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if waited {
+			start()
+			continue
+		}
+
+		pending--
+		if r.err == nil {
+			// Close what the attempts still under way connect before seeing the cancellation
+			go func(n int) {
+				for ; n > 0; n-- {
+					if r := <-results; r.conn != nil {
+						r.conn.Close()
+					}
+				}
+			}(pending)
+			return r.conn, nil
+		}
+		lastErr = r.err
+		if next < len(ips) {
+			start()
+		}
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// TestDialHappyEyeballs checks that a refused address moves on to the next, and that an empty
+// address list is an error rather than a panic
+func TestDialHappyEyeballs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// Nothing listens on 127.0.0.2, which refuses the first attempt
+	ips := []net.IP{net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 1)}
+	conn, err := dialHappyEyeballs(context.Background(), &net.Dialer{}, "tcp", ips, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.RemoteAddr().String(); got != l.Addr().String() {
+		t.Errorf("connected to %s, want %s", got, l.Addr())
+	}
+	conn.Close()
+
+	if conn, err := dialHappyEyeballs(context.Background(), &net.Dialer{}, "tcp", nil, port); err == nil {
+		conn.Close()
+		t.Error("connected without addresses")
+	}
+}
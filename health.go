@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HealthCheck probes a target by connecting to a tcp://host:port address or by fetching an http or
+// https URL, which counts as healthy when it answers with a 2xx or 3xx status. To damp flapping, the
+// target's state only changes after several probes in a row disagree with it.
+type HealthCheck struct {
+	URL      *url.URL
+	Interval time.Duration // Time between probes
+	Timeout  time.Duration // Time a probe may take before it counts as failed
+	Rise     int           // Passing probes in a row that bring a failed target back
+	Fall     int           // Failing probes in a row that take a healthy target down
+
+	healthy bool
+	streak  int // Probes in a row disagreeing with the current state
+	mu      sync.Mutex
+}
+
+// NewHealthCheck parses the target of a health check. Targets count as healthy until probes fail.
+func NewHealthCheck(target string) (*HealthCheck, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "tcp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return nil, fmt.Errorf("health check %s: %v", target, err)
+		}
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("health check %s: expected a tcp://, http:// or https:// URL", target)
+	}
+	return &HealthCheck{URL: u, Interval: 10 * time.Second, Timeout: 3 * time.Second, Rise: 2, Fall: 3, healthy: true}, nil
+}
+
+// Healthy reports whether the target is considered up
+func (c *HealthCheck) Healthy() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.healthy
+}
+
+// Probe checks the target once
+func (c *HealthCheck) Probe() error {
+	if c.URL.Scheme == "tcp" {
+		conn, err := net.DialTimeout("tcp", c.URL.Host, c.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	client := &http.Client{
+		Timeout: c.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Get(c.URL.String())
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("status %s", res.Status)
+	}
+	return nil
+}
+
+// Start applies a probe interval and flap damping thresholds, then runs the check in the background
+func (c *HealthCheck) Start(interval time.Duration, rise, fall int) {
+	c.Interval, c.Rise, c.Fall = interval, rise, fall
+	go c.Run()
+}
+
+// Run probes the target every Interval until the process exits, logging changes of health
+func (c *HealthCheck) Run() {
+	for {
+		err := c.Probe()
+		changed := c.record(err == nil)
+		if changed && err != nil {
+			log.Printf("health %s: down: %v", c.URL, err)
+		} else if changed {
+			log.Printf("health %s: up", c.URL)
+		}
+		time.Sleep(c.Interval)
+	}
+}
+
+// record accounts for the outcome of a probe and reports whether it changed the target's state
+func (c *HealthCheck) record(ok bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ok == c.healthy {
+		c.streak = 0
+		return false
+	}
+	c.streak++
+	need := c.Rise
+	if c.healthy {
+		need = c.Fall
+	}
+	if c.streak < need {
+		return false
+	}
+	c.healthy, c.streak = ok, 0
+	return true
+}
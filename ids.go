@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// idAttempts is how many random IDs Acquire tries before scanning for a free one
+const idAttempts = 8
+
+// IDAllocator hands out message IDs for outstanding queries. IDs come from crypto/rand so
+// off-path attackers can't predict them, and an ID in flight to an upstream is never reused for
+// another query to it until released, so responses can't be matched to the wrong query.
+type IDAllocator struct {
+	inFlight map[string]map[uint16]bool // Upstream addresses mapped to the IDs awaiting a response
+	mu       sync.Mutex
+}
+
+// NewIDAllocator initializes and returns an empty IDAllocator
+func NewIDAllocator() *IDAllocator {
+	return &IDAllocator{inFlight: make(map[string]map[uint16]bool)}
+}
+
+// Acquire reserves an ID for a query to the upstream; Release must be called once the exchange is
+// over. It fails only when all 65536 IDs are in flight to the upstream.
+func (a *IDAllocator) Acquire(upstream string) (uint16, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	used := a.inFlight[upstream]
+	if used == nil {
+		used = make(map[uint16]bool)
+		a.inFlight[upstream] = used
+	}
+	if len(used) > 0xffff {
+		return 0, fmt.Errorf("%s: all message IDs are in flight", upstream)
+	}
+
+	id := randomID()
+	for i := 1; used[id] && i < idAttempts; i++ {
+		id = randomID()
+	}
+	// Nearly full: walk on from the last random pick rather than keep guessing
+	for used[id] {
+		id++
+	}
+	used[id] = true
+	return id, nil
+}
+
+// Release frees an ID acquired for the upstream
+func (a *IDAllocator) Release(upstream string, id uint16) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	used := a.inFlight[upstream]
+	delete(used, id)
+	if len(used) == 0 {
+		delete(a.inFlight, upstream)
+	}
+}
+
+// InFlight returns the number of IDs currently reserved for the upstream
+func (a *IDAllocator) InFlight(upstream string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.inFlight[upstream])
+}
+
+// randomID returns an unpredictable message ID
+func randomID() uint16 {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("crypto/rand: %v", err))
+	}
+	return binary.BigEndian.Uint16(b[:])
+}
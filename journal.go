@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxJournalChanges bounds the versions a journal keeps; older ones are dropped when it is compacted
+const maxJournalChanges = 1000
+
+// ZoneChange is one version of a zone: the records deleted from the previous version and the ones
+// added, each list starting with the SOA of its version as in an IXFR (RFC 1995)
+type ZoneChange struct {
+	Time    time.Time
+	Deleted []*DnsRecord
+	Added   []*DnsRecord
+}
+
+// From returns the serial of the version the change applies to
+func (c *ZoneChange) From() uint32 {
+	return serialOf(c.Deleted[0].Data)
+}
+
+// To returns the serial of the version the change produces
+func (c *ZoneChange) To() uint32 {
+	return serialOf(c.Added[0].Data)
+}
+
+// ZoneJournal records the changes between versions of a zone in an append-only file, so IXFR
+// requests can be answered with differences and changes audited or rolled back. The file holds
+// one block per version:
+//
+//	change 2024010101 2024010102 1704067200
+//	- www.example.com.	300	IN	A	192.0.2.1
+//	+ www.example.com.	300	IN	A	192.0.2.2
+type ZoneJournal struct {
+	Path string
+
+	changes []*ZoneChange
+	file    *os.File
+	mu      sync.Mutex
+}
+
+// OpenZoneJournal reads the journal at path, creating it if needed, and opens it for appending
+func OpenZoneJournal(path string) (*ZoneJournal, error) {
+	j := &ZoneJournal{Path: path}
+	if err := j.read(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	j.file = f
+	return j, nil
+}
+
+// read loads the changes in the journal file
+func (j *ZoneJournal) read() error {
+	f, err := os.Open(j.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var c *ZoneChange
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		if fields := strings.Fields(text); fields[0] == "change" {
+			if len(fields) != 4 {
+				return fmt.Errorf("%s:%d: expected change, two serials and a time", j.Path, line)
+			}
+			unix, err := strconv.ParseInt(fields[3], 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %v", j.Path, line, err)
+			}
+			c = &ZoneChange{Time: time.Unix(unix, 0)}
+			j.changes = append(j.changes, c)
+			continue
+		}
+		if c == nil || len(text) < 2 || (text[0] != '-' && text[0] != '+') {
+			return fmt.Errorf("%s:%d: expected a change or a record starting with - or +", j.Path, line)
+		}
+		zone, err := ParseZone(strings.NewReader(text[2:]+"\n"), ".")
+		if err != nil || len(zone.Records) != 1 {
+			return fmt.Errorf("%s:%d: invalid record: %v", j.Path, line, err)
+		}
+		if text[0] == '-' {
+			c.Deleted = append(c.Deleted, zone.Records[0])
+		} else {
+			c.Added = append(c.Added, zone.Records[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for i, c := range j.changes {
+		if len(c.Deleted) == 0 || len(c.Added) == 0 || c.Deleted[0].Qtype != QTYPE_SOA || c.Added[0].Qtype != QTYPE_SOA {
+			return fmt.Errorf("%s: change %d doesn't start with the SOA records of its versions", j.Path, i+1)
+		}
+	}
+	return nil
+}
+
+// Changes returns the recorded changes, oldest first
+func (j *ZoneJournal) Changes() []*ZoneChange {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]*ZoneChange(nil), j.changes...)
+}
+
+// Serial returns the serial of the latest version, false if the journal is empty
+func (j *ZoneJournal) Serial() (uint32, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.changes) == 0 {
+		return 0, false
+	}
+	return j.changes[len(j.changes)-1].To(), true
+}
+
+// Since returns the changes leading from the version with the given serial to the latest one,
+// false if the journal doesn't reach back that far
+func (j *ZoneJournal) Since(serial uint32) ([]*ZoneChange, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i := len(j.changes) - 1; i >= 0; i-- {
+		if j.changes[i].From() == serial {
+			return append([]*ZoneChange(nil), j.changes[i:]...), true
+		}
+	}
+	return nil, false
+}
+
+// Append records a change, compacting the file when it holds too many
+func (j *ZoneJournal) Append(c *ZoneChange) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.changes = append(j.changes, c)
+	if len(j.changes) > maxJournalChanges {
+		j.changes = append([]*ZoneChange(nil), j.changes[len(j.changes)-maxJournalChanges/2:]...)
+		return j.rewrite()
+	}
+	if _, err := j.file.WriteString(formatChange(c)); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Reset discards every recorded change
+func (j *ZoneJournal) Reset() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.changes = nil
+	return j.rewrite()
+}
+
+// rewrite replaces the file with the changes in memory
+func (j *ZoneJournal) rewrite() error {
+	var sb strings.Builder
+	for _, c := range j.changes {
+		sb.WriteString(formatChange(c))
+	}
+	tmp := j.Path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(sb.String()), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, j.Path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.Path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	j.file.Close()
+	j.file = f
+	return nil
+}
+
+// Close closes the journal file
+func (j *ZoneJournal) Close() error {
+	return j.file.Close()
+}
+
+// formatChange writes a change as it is stored in the file
+func formatChange(c *ZoneChange) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "change %d %d %d\n", c.From(), c.To(), c.Time.Unix())
+	for _, rec := range c.Deleted {
+		sb.WriteString("- " + rec.String() + "\n")
+	}
+	for _, rec := range c.Added {
+		sb.WriteString("+ " + rec.String() + "\n")
+	}
+	return sb.String()
+}
+
+// Revert returns the records of the version with the given serial, undoing the changes made since
+// on records, the current version
+func (j *ZoneJournal) Revert(records []*DnsRecord, serial uint32) ([]*DnsRecord, error) {
+	changes, ok := j.Since(serial)
+	if !ok {
+		return nil, fmt.Errorf("no version with serial %d in the journal", serial)
+	}
+	current := make(map[string]*DnsRecord, len(records))
+	for _, rec := range records {
+		current[journalKey(rec)] = rec
+	}
+	for i := len(changes) - 1; i >= 0; i-- {
+		for _, rec := range changes[i].Added {
+			delete(current, journalKey(rec))
+		}
+		for _, rec := range changes[i].Deleted {
+			current[journalKey(rec)] = rec
+		}
+	}
+	reverted := make([]*DnsRecord, 0, len(current))
+	for _, rec := range current {
+		reverted = append(reverted, rec)
+	}
+	return reverted, nil
+}
+
+// journalKey identifies a record by owner, type, class, TTL and data, so a change of TTL is
+// journaled as a change of record
+func journalKey(rec *DnsRecord) string {
+	rdata, err := CanonicalRdata(rec)
+	if err != nil {
+		rdata = []byte(rec.RdataString())
+	}
+	return fmt.Sprintf("%s/%d/%d/%d/%x", parseNameLoose(rec.Name).Key(), rec.Qtype, rec.Class, rec.TTL, rdata)
+}
+
+// DiffRecords returns the records only in old and the ones only in new, sorted by owner and type
+func DiffRecords(old, new []*DnsRecord) (deleted, added []*DnsRecord) {
+	inOld := make(map[string]bool, len(old))
+	for _, rec := range old {
+		inOld[journalKey(rec)] = true
+	}
+	inNew := make(map[string]bool, len(new))
+	for _, rec := range new {
+		key := journalKey(rec)
+		inNew[key] = true
+		if !inOld[key] {
+			added = append(added, rec)
+		}
+	}
+	for _, rec := range old {
+		if !inNew[journalKey(rec)] {
+			deleted = append(deleted, rec)
+		}
+	}
+	sortRecords(deleted)
+	sortRecords(added)
+	return deleted, added
+}
+
+// sortRecords orders records by owner name and type
+func sortRecords(records []*DnsRecord) {
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := parseNameLoose(records[i].Name).Key(), parseNameLoose(records[j].Name).Key()
+		if a != b {
+			return a < b
+		}
+		return records[i].Qtype < records[j].Qtype
+	})
+}
+
+// serialGreater reports whether serial a is after b in serial number arithmetic (RFC 1982)
+func serialGreater(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// OpenJournal records the zone's changes in a journal named after its origin in dir. A journal that
+// doesn't end at the zone's current serial, because the zone was edited while it wasn't served, is
+// started over.
+func (z *AuthZone) OpenJournal(dir string) error {
+	name := z.Origin.Key()
+	if name == "" {
+		name = "root"
+	}
+	j, err := OpenZoneJournal(filepath.Join(dir, name+".jnl"))
+	if err != nil {
+		return err
+	}
+	if serial, ok := j.Serial(); ok {
+		if soa := z.soa(); soa == nil || serialOf(soa.Data) != serial {
+			log.Printf("zone %s: journal %s ends at serial %d, not the zone's, starting it over", z.Origin.FQDN(), j.Path, serial)
+			if err := j.Reset(); err != nil {
+				j.Close()
+				return err
+			}
+		}
+	}
+	z.SetJournal(j)
+	return nil
+}
+
+// SetJournal records the zone's future changes in j
+func (z *AuthZone) SetJournal(j *ZoneJournal) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.journal = j
+}
+
+// Journal returns the zone's journal, or nil
+func (z *AuthZone) Journal() *ZoneJournal {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.journal
+}
+
+// Commit journals the differences between old, the zone's previous records, and its current ones
+// as a new version. When the records changed but the SOA serial didn't increase, the serial is
+// increased so secondaries notice; Commit then returns true, as it does when it keeps a serial that
+// went back. Zones without a journal or an SOA aren't journaled.
+func (z *AuthZone) Commit(old []*DnsRecord) (bool, error) {
+	j := z.Journal()
+	if j == nil {
+		return false, nil
+	}
+	var oldSOA *DnsRecord
+	for _, rec := range old {
+		if rec.Qtype == QTYPE_SOA {
+			oldSOA = rec
+		}
+	}
+	newSOA := z.soa()
+	if oldSOA == nil || newSOA == nil {
+		return false, nil
+	}
+	oldSerial, newSerial := serialOf(oldSOA.Data), serialOf(newSOA.Data)
+	deleted, added := DiffRecords(withoutType(old, QTYPE_SOA), withoutType(z.Records(), QTYPE_SOA))
+	if len(deleted) == 0 && len(added) == 0 {
+		if journalKey(newSOA) == journalKey(oldSOA) {
+			return false, nil
+		}
+		if !serialGreater(newSerial, oldSerial) && journalKey(withSerial(newSOA, oldSerial)) == journalKey(oldSOA) {
+			// Only the serial went back, as when a zone file is reloaded after its serial was
+			// increased here: keep the previous version
+			z.replaceSOA(newSOA, oldSOA)
+			return true, nil
+		}
+	}
+	bumped := false
+	if !serialGreater(newSerial, oldSerial) {
+		increased := withSerial(newSOA, oldSerial+1)
+		log.Printf("zone %s: changed without increasing the SOA serial %d, serving it as %d", z.Origin.FQDN(), newSerial, oldSerial+1)
+		z.replaceSOA(newSOA, increased)
+		newSOA, bumped = increased, true
+	}
+	if serial, ok := j.Serial(); ok && serial != oldSerial {
+		log.Printf("zone %s: journal ends at serial %d but the zone was at %d, starting it over", z.Origin.FQDN(), serial, oldSerial)
+		if err := j.Reset(); err != nil {
+			return bumped, err
+		}
+	}
+	c := &ZoneChange{
+		Time:    time.Now(),
+		Deleted: append([]*DnsRecord{oldSOA}, deleted...),
+		Added:   append([]*DnsRecord{newSOA}, added...),
+	}
+	return bumped, j.Append(c)
+}
+
+// withSerial returns a copy of an SOA record with another serial
+func withSerial(soa *DnsRecord, serial uint32) *DnsRecord {
+	data := *soa.Data.(*SOA)
+	data.Serial = serial
+	c := *soa
+	c.Data = &data
+	return &c
+}
+
+// replaceSOA swaps the zone's SOA record for another
+func (z *AuthZone) replaceSOA(old, soa *DnsRecord) {
+	z.Remove(old)
+	z.Add(soa)
+}
+
+// withoutType returns the records that aren't of the given type
+func withoutType(records []*DnsRecord, qtype QueryType) []*DnsRecord {
+	var kept []*DnsRecord
+	for _, rec := range records {
+		if rec.Qtype != qtype {
+			kept = append(kept, rec)
+		}
+	}
+	return kept
+}
+
+// transfer answers an IXFR query for the zone (RFC 1995): with the journaled changes since the
+// client's serial if there are all of them, with the whole zone as in an AXFR otherwise, and with
+// the current SOA alone when the client is up to date
+func (z *AuthZone) transfer(query *DnsPacket, res *DnsPacket) {
+	soa := z.soa()
+	if soa == nil {
+		res.Header.ResCode = SERVFAIL
+		return
+	}
+	res.Header.AuthoritativeAnswer = true
+	var client *DnsRecord
+	for _, rec := range query.Authorities {
+		if rec.Qtype == QTYPE_SOA {
+			client = rec
+		}
+	}
+	if client == nil {
+		res.Header.ResCode = FORMERR
+		return
+	}
+	if !serialGreater(serialOf(soa.Data), serialOf(client.Data)) {
+		res.Answers = []*DnsRecord{soa}
+		return
+	}
+	if j := z.Journal(); j != nil {
+		if serial, ok := j.Serial(); ok && serial == serialOf(soa.Data) {
+			if changes, ok := j.Since(serialOf(client.Data)); ok {
+				res.Answers = []*DnsRecord{soa}
+				for _, c := range changes {
+					res.Answers = append(res.Answers, c.Deleted...)
+					res.Answers = append(res.Answers, c.Added...)
+				}
+				res.Answers = append(res.Answers, soa)
+				return
+			}
+		}
+	}
+	records := withoutType(z.Records(), QTYPE_SOA)
+	sortRecords(records)
+	res.Answers = append(append([]*DnsRecord{soa}, records...), soa)
+}
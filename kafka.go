@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Kafka API keys and the versions spoken
+const (
+	kafkaProduce         = 0
+	kafkaProduceVersion  = 3 // The first version taking v2 record batches
+	kafkaMetadata        = 3
+	kafkaMetadataVersion = 1
+)
+
+// kafkaCRC is the CRC-32C table record batches are checksummed with
+var kafkaCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// KafkaProducer appends records to partition 0 of a Kafka topic. It finds the partition's leader
+// through a metadata request to Broker and sends uncompressed record batches to it, waiting for the
+// leader's acknowledgement.
+type KafkaProducer struct {
+	Broker  string        // Bootstrap broker address
+	Topic   string        // Topic written to
+	Timeout time.Duration // Time allowed for each request
+
+	conn          net.Conn // Connection to the partition leader
+	r             *bufio.Reader
+	correlationID int32
+}
+
+// send appends the records as one batch of JSON values
+func (p *KafkaProducer) send(records []*logRecord) error {
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	values := make([][]byte, len(records))
+	for i, r := range records {
+		values[i] = r.JSON()
+	}
+	batch := kafkaRecordBatch(values, records[0].Time)
+
+	var req []byte
+	req = binary.BigEndian.AppendUint16(req, 0xffff) // No transactional ID
+	req = binary.BigEndian.AppendUint16(req, 1)      // acks: the leader
+	req = binary.BigEndian.AppendUint32(req, uint32(p.Timeout/time.Millisecond))
+	req = binary.BigEndian.AppendUint32(req, 1)
+	req = kafkaAppendString(req, p.Topic)
+	req = binary.BigEndian.AppendUint32(req, 1)
+	req = binary.BigEndian.AppendUint32(req, 0) // Partition
+	req = binary.BigEndian.AppendUint32(req, uint32(len(batch)))
+	req = append(req, batch...)
+	res, err := p.roundTrip(kafkaProduce, kafkaProduceVersion, req)
+	if err != nil {
+		return err
+	}
+
+	// [topic [partition error_code base_offset log_append_time]] throttle_time
+	d := &kafkaDecoder{buf: res}
+	for topics := d.int32(); topics > 0; topics-- {
+		d.string()
+		for partitions := d.int32(); partitions > 0; partitions-- {
+			d.int32()
+			if code := d.int16(); code != 0 && d.err == nil {
+				return fmt.Errorf("kafka produce to %s: error code %d", p.Topic, code)
+			}
+			d.int64()
+			d.int64()
+		}
+	}
+	return d.err
+}
+
+// close drops the connection to the leader, so the next send looks it up again
+func (p *KafkaProducer) close() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// connect asks the bootstrap broker for the leader of partition 0 and connects to it
+func (p *KafkaProducer) connect() error {
+	conn, err := net.DialTimeout("tcp", p.Broker, p.Timeout)
+	if err != nil {
+		return err
+	}
+	p.conn, p.r = conn, bufio.NewReader(conn)
+	var req []byte
+	req = binary.BigEndian.AppendUint32(req, 1)
+	req = kafkaAppendString(req, p.Topic)
+	res, err := p.roundTrip(kafkaMetadata, kafkaMetadataVersion, req)
+	p.close()
+	if err != nil {
+		return err
+	}
+
+	// [node_id host port rack] controller_id [error_code name is_internal [error_code partition leader [replicas] [isr]]]
+	d := &kafkaDecoder{buf: res}
+	brokers := make(map[int32]string)
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		id, host, port := d.int32(), d.string(), d.int32()
+		d.string()
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.int32()
+	leader := ""
+	for topics := d.int32(); topics > 0 && d.err == nil; topics-- {
+		if code := d.int16(); code != 0 && d.err == nil {
+			return fmt.Errorf("kafka metadata for %s: error code %d", p.Topic, code)
+		}
+		d.string()
+		d.int8()
+		for partitions := d.int32(); partitions > 0 && d.err == nil; partitions-- {
+			d.int16()
+			partition, node := d.int32(), d.int32()
+			for replicas := d.int32(); replicas > 0; replicas-- {
+				d.int32()
+			}
+			for isr := d.int32(); isr > 0; isr-- {
+				d.int32()
+			}
+			if partition == 0 {
+				leader = brokers[node]
+			}
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if leader == "" {
+		return fmt.Errorf("kafka metadata for %s: no leader for partition 0", p.Topic)
+	}
+
+	if conn, err = net.DialTimeout("tcp", leader, p.Timeout); err != nil {
+		return err
+	}
+	p.conn, p.r = conn, bufio.NewReader(conn)
+	return nil
+}
+
+// roundTrip sends a request and returns the body of its response
+func (p *KafkaProducer) roundTrip(apiKey, apiVersion int16, body []byte) ([]byte, error) {
+	p.correlationID++
+	var msg []byte
+	msg = binary.BigEndian.AppendUint32(msg, 0) // Length, filled in below
+	msg = binary.BigEndian.AppendUint16(msg, uint16(apiKey))
+	msg = binary.BigEndian.AppendUint16(msg, uint16(apiVersion))
+	msg = binary.BigEndian.AppendUint32(msg, uint32(p.correlationID))
+	msg = kafkaAppendString(msg, "gdns")
+	msg = append(msg, body...)
+	binary.BigEndian.PutUint32(msg, uint32(len(msg)-4))
+
+	p.conn.SetDeadline(time.Now().Add(p.Timeout))
+	if _, err := p.conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var header [8]byte
+	if _, err := io.ReadFull(p.r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size < 4 || size > 1<<24 {
+		return nil, fmt.Errorf("kafka response of %d bytes", size)
+	}
+	if id := int32(binary.BigEndian.Uint32(header[4:])); id != p.correlationID {
+		return nil, fmt.Errorf("kafka response for request %d, expected %d", id, p.correlationID)
+	}
+	res := make([]byte, size-4)
+	if _, err := io.ReadFull(p.r, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// kafkaRecordBatch encodes values as a v2 record batch without keys, timestamped at t
+func kafkaRecordBatch(values [][]byte, t time.Time) []byte {
+	ms := t.UnixMilli()
+	var records []byte
+	for i, value := range values {
+		var rec []byte
+		rec = append(rec, 0) // Attributes
+		rec = binary.AppendVarint(rec, 0)
+		rec = binary.AppendVarint(rec, int64(i))
+		rec = binary.AppendVarint(rec, -1) // No key
+		rec = binary.AppendVarint(rec, int64(len(value)))
+		rec = append(rec, value...)
+		rec = binary.AppendVarint(rec, 0) // No headers
+		records = binary.AppendVarint(records, int64(len(rec)))
+		records = append(records, rec...)
+	}
+
+	// The CRC covers everything from the attributes on
+	var tail []byte
+	tail = binary.BigEndian.AppendUint16(tail, 0) // Attributes: no compression
+	tail = binary.BigEndian.AppendUint32(tail, uint32(len(values)-1))
+	tail = binary.BigEndian.AppendUint64(tail, uint64(ms))
+	tail = binary.BigEndian.AppendUint64(tail, uint64(ms))
+	tail = binary.BigEndian.AppendUint64(tail, 0xffffffffffffffff) // No producer ID
+	tail = binary.BigEndian.AppendUint16(tail, 0xffff)
+	tail = binary.BigEndian.AppendUint32(tail, 0xffffffff)
+	tail = binary.BigEndian.AppendUint32(tail, uint32(len(values)))
+	tail = append(tail, records...)
+
+	var batch []byte
+	batch = binary.BigEndian.AppendUint64(batch, 0) // Base offset, assigned by the broker
+	batch = binary.BigEndian.AppendUint32(batch, uint32(4+1+4+len(tail)))
+	batch = binary.BigEndian.AppendUint32(batch, 0) // Partition leader epoch
+	batch = append(batch, 2)                        // Magic
+	batch = binary.BigEndian.AppendUint32(batch, crc32.Checksum(tail, kafkaCRC))
+	return append(batch, tail...)
+}
+
+// kafkaAppendString appends a string with its 16 bit length
+func kafkaAppendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+// errKafkaShort reports a response ending too soon
+var errKafkaShort = errors.New("kafka response too short")
+
+// kafkaDecoder reads big endian fields from a response, remembering the first error
+type kafkaDecoder struct {
+	buf []byte
+	err error
+}
+
+// take returns the next n bytes, or nil at the end of the response
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil || n < 0 || len(d.buf) < n {
+		d.err = errKafkaShort
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a string with a 16 bit length; null strings read as ""
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// EDNSTCPKeepalive is the option code of edns-tcp-keepalive (RFC 7828), with which clients ask how
+// long a TCP or TLS connection may stay idle and servers tell them
+const EDNSTCPKeepalive = 11
+
+// keepaliveUnit is the unit of the option's TIMEOUT field
+const keepaliveUnit = 100 * time.Millisecond
+
+// findEDNSOption returns the option with the given code in the packet's OPT record
+func findEDNSOption(p *DnsPacket, code uint16) (EDNSOption, bool) {
+	opt := p.OPT()
+	if opt == nil {
+		return EDNSOption{}, false
+	}
+	options, _ := ParseEDNSOptions(opt.ednsOptions())
+	for _, option := range options {
+		if option.Code == code {
+			return option, true
+		}
+	}
+	return EDNSOption{}, false
+}
+
+// setEDNSOption replaces the options with the given code in an OPT record by option, or removes them
+// if option is nil. Malformed option data is left alone.
+func setEDNSOption(opt *DnsRecord, code uint16, option *EDNSOption) {
+	options, err := ParseEDNSOptions(opt.ednsOptions())
+	if err != nil {
+		return
+	}
+	var kept []EDNSOption
+	for _, o := range options {
+		if o.Code != code {
+			kept = append(kept, o)
+		}
+	}
+	if option != nil {
+		kept = append(kept, *option)
+	}
+	opt.Data = &OPT{Options: PackEDNSOptions(kept)}
+}
+
+// keepaliveOption builds an edns-tcp-keepalive option carrying timeout, as servers send it
+func keepaliveOption(timeout time.Duration) *EDNSOption {
+	units := min(timeout/keepaliveUnit, 0xffff)
+	return &EDNSOption{Code: EDNSTCPKeepalive, Data: binary.BigEndian.AppendUint16(nil, uint16(units))}
+}
+
+// KeepaliveTimeout returns how long the server that sent a response lets its connection stay idle,
+// false if the response doesn't say
+func KeepaliveTimeout(res *DnsPacket) (time.Duration, bool) {
+	option, ok := findEDNSOption(res, EDNSTCPKeepalive)
+	if !ok || len(option.Data) != 2 {
+		return 0, false
+	}
+	return time.Duration(binary.BigEndian.Uint16(option.Data)) * keepaliveUnit, true
+}
+
+// checkKeepalive rejects queries whose edns-tcp-keepalive option carries a timeout, which only
+// servers may send (RFC 7828 section 3.2.1)
+func checkKeepalive(query *DnsPacket) error {
+	if option, ok := findEDNSOption(query, EDNSTCPKeepalive); ok && len(option.Data) > 0 {
+		return fmt.Errorf("edns-tcp-keepalive option with a timeout in a query")
+	}
+	return nil
+}
+
+// withKeepalive returns a copy of an EDNS query asking for the server's idle timeout, or the query
+// itself if it doesn't use EDNS
+func withKeepalive(query *DnsPacket) *DnsPacket {
+	opt := query.OPT()
+	if opt == nil {
+		return query
+	}
+	wire := *query
+	wire.Resources = make([]*DnsRecord, len(query.Resources))
+	for i, rec := range query.Resources {
+		if rec == opt {
+			copied := *opt
+			setEDNSOption(&copied, EDNSTCPKeepalive, &EDNSOption{Code: EDNSTCPKeepalive})
+			rec = &copied
+		}
+		wire.Resources[i] = rec
+	}
+	return &wire
+}
+
+// idleConn is a stream connection kept open between queries
+type idleConn struct {
+	conn  net.Conn
+	timer *time.Timer // Closes the connection when the server's idle timeout runs out
+}
+
+// takeConn returns the idle connection kept for a server, or nil
+func (c *Client) takeConn(key string) net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	idle := c.idle[key]
+	if idle == nil || !idle.timer.Stop() {
+		return nil
+	}
+	delete(c.idle, key)
+	return idle.conn
+}
+
+// keepConn keeps a connection for the next query to the server, closing it a little before the
+// server's idle timeout so the server isn't the one to close it
+func (c *Client) keepConn(key string, conn net.Conn, timeout time.Duration) {
+	idle := &idleConn{conn: conn}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old := c.idle[key]; old != nil && old.timer.Stop() {
+		old.conn.Close()
+	}
+	if c.idle == nil {
+		c.idle = make(map[string]*idleConn)
+	}
+	c.idle[key] = idle
+	idle.timer = time.AfterFunc(timeout*9/10, func() {
+		c.mu.Lock()
+		if c.idle[key] == idle {
+			delete(c.idle, key)
+		}
+		c.mu.Unlock()
+		conn.Close()
+	})
+}
+
+// exchangeStream sends an EDNS query over a TCP or TLS connection kept from an earlier query to
+// the server if there is one, or over a new one from dial, and keeps the connection afterwards for
+// as long as the server's edns-tcp-keepalive option allows
+func (c *Client) exchangeStream(key string, query *DnsPacket, dial func() (net.Conn, error)) (*DnsPacket, error) {
+	wire := withKeepalive(query)
+	for attempt := 0; ; attempt++ {
+		var conn net.Conn
+		if attempt == 0 {
+			conn = c.takeConn(key)
+		}
+		reused := conn != nil
+		if !reused {
+			var err error
+			if conn, err = dial(); err != nil {
+				return nil, err
+			}
+		}
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+		_, err := wire.WriteToStream(conn)
+		var res *DnsPacket
+		if err == nil {
+			var buffer *BytePacketBuffer
+			if buffer, err = readTCPMessage(conn); err == nil {
+				res, err = DnsPacketFromBuffer(buffer)
+			}
+		}
+		if err != nil {
+			conn.Close()
+			if reused {
+				// The server closed the kept connection first; try once more on a new one
+				continue
+			}
+			return nil, err
+		}
+		if err := acceptResponse(query, res, false); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if timeout, ok := KeepaliveTimeout(res); ok && timeout > 0 && wire != query {
+			c.keepConn(key, conn, timeout)
+		} else {
+			conn.Close()
+		}
+		return res, nil
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kubeTTL is the TTL of records generated for Kubernetes services, short so changes spread quickly
+const kubeTTL = 5
+
+// Files mounted into pods for talking to the API server
+const (
+	kubeTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubeCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// KubernetesWatcher answers cluster DNS queries for Services (the Kubernetes DNS specification),
+// following Services and Endpoints through the API server's list and watch calls:
+//
+//	<service>.<ns>.svc.<zone>                     cluster IPs, or ready endpoints of headless services
+//	<hostname>.<service>.<ns>.svc.<zone>          endpoints of headless services
+//	_<port>._<proto>.<service>.<ns>.svc.<zone>    SRV for named ports
+//
+// ExternalName services are answered with a CNAME.
+type KubernetesWatcher struct {
+	API       string // API server URL, e.g. https://10.0.0.1:443
+	TokenFile string // Bearer token file, reread on every request so rotated tokens are used
+	Client    *http.Client
+	Source    *KVSource
+
+	services  map[string]*kubeService   // By namespace/name
+	endpoints map[string]*kubeEndpoints // By namespace/name
+	mu        sync.Mutex
+}
+
+// kubeMeta is the part of an object's metadata the watcher uses
+type kubeMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+// kubeService is a core/v1 Service
+type kubeService struct {
+	Metadata kubeMeta `json:"metadata"`
+	Spec     struct {
+		Type         string   `json:"type"`
+		ClusterIP    string   `json:"clusterIP"`
+		ClusterIPs   []string `json:"clusterIPs"`
+		ExternalName string   `json:"externalName"`
+		Ports        []struct {
+			Name     string `json:"name"`
+			Protocol string `json:"protocol"`
+			Port     int    `json:"port"`
+		} `json:"ports"`
+	} `json:"spec"`
+}
+
+// kubeEndpoints is a core/v1 Endpoints object
+type kubeEndpoints struct {
+	Metadata kubeMeta `json:"metadata"`
+	Subsets  []struct {
+		Addresses []struct {
+			IP       string `json:"ip"`
+			Hostname string `json:"hostname"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name     string `json:"name"`
+			Protocol string `json:"protocol"`
+			Port     int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+// NewKubernetesWatcher creates a watcher for the API server at api. An empty api uses the in-cluster
+// configuration: the API server address from the environment and the pod's service account.
+func NewKubernetesWatcher(api, tokenFile, caFile string, source *KVSource) (*KubernetesWatcher, error) {
+	if api == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("not running in a Kubernetes cluster; give the API server URL")
+		}
+		api = "https://" + net.JoinHostPort(host, port)
+		tokenFile = defaultString(tokenFile, kubeTokenFile)
+		caFile = defaultString(caFile, kubeCAFile)
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return &KubernetesWatcher{
+		API:       strings.TrimSuffix(api, "/"),
+		TokenFile: tokenFile,
+		Client:    &http.Client{Transport: &http.Transport{TLSClientConfig: config, Proxy: http.ProxyFromEnvironment}},
+		Source:    source,
+		services:  make(map[string]*kubeService),
+		endpoints: make(map[string]*kubeEndpoints),
+	}, nil
+}
+
+// Run serves the cluster's services, following changes until the process exits
+func (w *KubernetesWatcher) Run() {
+	w.Source.Put("", fmt.Sprintf("@ %d SOA ns.dns hostmaster 1 7200 1800 86400 %d", kubeTTL, kubeTTL))
+	go w.follow("services")
+	w.follow("endpoints")
+}
+
+// follow lists a resource and watches it from the listed version, starting over on errors
+func (w *KubernetesWatcher) follow(resource string) {
+	for {
+		version, err := w.list(resource)
+		for err == nil {
+			// Watches end after a server-chosen timeout; resume from the last version seen
+			version, err = w.watch(resource, version)
+		}
+		log.Printf("kubernetes %s: %v", resource, err)
+		time.Sleep(kvRetryDelay)
+	}
+}
+
+// list reads every object of a resource, replacing what was known of it
+func (w *KubernetesWatcher) list(resource string) (string, error) {
+	resp, err := w.get("/api/v1/" + resource)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Metadata kubeMeta          `json:"metadata"`
+		Items    []json.RawMessage `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", err
+	}
+
+	w.mu.Lock()
+	changed := make(map[string]bool)
+	if resource == "services" {
+		for key := range w.services {
+			changed[key] = true
+		}
+		w.services = make(map[string]*kubeService)
+	} else {
+		for key := range w.endpoints {
+			changed[key] = true
+		}
+		w.endpoints = make(map[string]*kubeEndpoints)
+	}
+	w.mu.Unlock()
+	for _, item := range list.Items {
+		key, _, err := w.apply(resource, "ADDED", item)
+		if err != nil {
+			return "", err
+		}
+		changed[key] = true
+	}
+	for key := range changed {
+		w.publish(key)
+	}
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch applies changes to a resource after version until the watch ends, returning the last version
+func (w *KubernetesWatcher) watch(resource, version string) (string, error) {
+	query := url.Values{"watch": {"1"}, "resourceVersion": {version}, "allowWatchBookmarks": {"true"}}
+	resp, err := w.get("/api/v1/" + resource + "?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := dec.Decode(&event); err != nil {
+			// A watch closed by the server is routine
+			return version, nil
+		}
+		switch event.Type {
+		case "ERROR":
+			// Typically 410 Gone: the version is too old and the resource must be listed again
+			var status struct {
+				Message string `json:"message"`
+			}
+			json.Unmarshal(event.Object, &status)
+			return "", fmt.Errorf("watch: %s", status.Message)
+		case "BOOKMARK":
+			var obj struct {
+				Metadata kubeMeta `json:"metadata"`
+			}
+			if err := json.Unmarshal(event.Object, &obj); err == nil {
+				version = obj.Metadata.ResourceVersion
+			}
+		default:
+			key, objVersion, err := w.apply(resource, event.Type, event.Object)
+			if err != nil {
+				return "", err
+			}
+			version = objVersion
+			w.publish(key)
+		}
+	}
+}
+
+// apply records an added, modified or deleted object, returning its key and resource version
+func (w *KubernetesWatcher) apply(resource, eventType string, raw json.RawMessage) (string, string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if resource == "services" {
+		svc := &kubeService{}
+		if err := json.Unmarshal(raw, svc); err != nil {
+			return "", "", err
+		}
+		key := svc.Metadata.Namespace + "/" + svc.Metadata.Name
+		if eventType == "DELETED" {
+			delete(w.services, key)
+		} else {
+			w.services[key] = svc
+		}
+		return key, svc.Metadata.ResourceVersion, nil
+	}
+	ep := &kubeEndpoints{}
+	if err := json.Unmarshal(raw, ep); err != nil {
+		return "", "", err
+	}
+	key := ep.Metadata.Namespace + "/" + ep.Metadata.Name
+	if eventType == "DELETED" {
+		delete(w.endpoints, key)
+	} else {
+		w.endpoints[key] = ep
+	}
+	return key, ep.Metadata.ResourceVersion, nil
+}
+
+// publish regenerates the records of the service with the given namespace/name key
+func (w *KubernetesWatcher) publish(key string) {
+	w.mu.Lock()
+	records := w.records(w.services[key], w.endpoints[key])
+	w.mu.Unlock()
+	if len(records) == 0 {
+		w.Source.Delete(key)
+	} else {
+		w.Source.Put(key, strings.Join(records, "\n"))
+	}
+}
+
+// records returns master file lines for a service, relative to the cluster zone
+func (w *KubernetesWatcher) records(svc *kubeService, ep *kubeEndpoints) []string {
+	if svc == nil {
+		return nil
+	}
+	base := svc.Metadata.Name + "." + svc.Metadata.Namespace + ".svc"
+	var lines []string
+	addAddr := func(owner, ip string) {
+		if addr := net.ParseIP(ip); addr != nil && addr.To4() != nil {
+			lines = append(lines, fmt.Sprintf("%s %d A %s", owner, kubeTTL, ip))
+		} else if addr != nil {
+			lines = append(lines, fmt.Sprintf("%s %d AAAA %s", owner, kubeTTL, ip))
+		}
+	}
+
+	switch {
+	case svc.Spec.Type == "ExternalName":
+		lines = append(lines, fmt.Sprintf("%s %d CNAME %s.", base, kubeTTL, strings.TrimSuffix(svc.Spec.ExternalName, ".")))
+	case svc.Spec.ClusterIP != "None":
+		ips := svc.Spec.ClusterIPs
+		if len(ips) == 0 && svc.Spec.ClusterIP != "" {
+			ips = []string{svc.Spec.ClusterIP}
+		}
+		for _, ip := range ips {
+			addAddr(base, ip)
+		}
+		for _, port := range svc.Spec.Ports {
+			if port.Name != "" {
+				lines = append(lines, fmt.Sprintf("_%s._%s.%s %d SRV 0 100 %d %s",
+					port.Name, strings.ToLower(port.Protocol), base, kubeTTL, port.Port, base))
+			}
+		}
+	case ep != nil:
+		// Headless: answer with the ready endpoints themselves
+		for _, subset := range ep.Subsets {
+			for _, addr := range subset.Addresses {
+				host := addr.Hostname
+				if host == "" {
+					host = strings.NewReplacer(".", "-", ":", "-").Replace(addr.IP)
+				}
+				addAddr(base, addr.IP)
+				addAddr(host+"."+base, addr.IP)
+				for _, port := range subset.Ports {
+					if port.Name != "" {
+						lines = append(lines, fmt.Sprintf("_%s._%s.%s %d SRV 0 100 %d %s.%s",
+							port.Name, strings.ToLower(port.Protocol), base, kubeTTL, port.Port, host, base))
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// get sends an authenticated GET request to the API server
+func (w *KubernetesWatcher) get(path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, w.API+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if w.TokenFile != "" {
+		token, err := os.ReadFile(w.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: HTTP status %s", path, resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kvDefaultTTL applies to records in a key-value store that don't give a TTL
+const kvDefaultTTL = 60
+
+// kvRetryDelay is how long watchers wait before reconnecting to a failed store
+const kvRetryDelay = 2 * time.Second
+
+// KVSource serves records kept under a key prefix in a key-value store such as etcd or Consul.
+// Each key holds one or more master file lines with owners relative to the zone origin, e.g.
+// "api 30 A 192.0.2.10"; keys are applied and withdrawn individually as the store changes.
+type KVSource struct {
+	Zone *AuthZone
+
+	records map[string][]*DnsRecord // Records currently served, by key
+	values  map[string]string       // Value each key was last applied from
+	mu      sync.Mutex
+}
+
+// NewKVSource initializes a source feeding the given zone
+func NewKVSource(zone *AuthZone) *KVSource {
+	return &KVSource{Zone: zone, records: make(map[string][]*DnsRecord), values: make(map[string]string)}
+}
+
+// Put sets the records held by key, replacing the ones it held before. Records kept across the
+// change are never withdrawn, so queries don't see them flap.
+func (k *KVSource) Put(key, value string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if old, ok := k.values[key]; ok && old == value {
+		return
+	}
+	k.values[key] = value
+
+	zone, err := ParseZone(strings.NewReader(fmt.Sprintf("$TTL %d\n%s\n", kvDefaultTTL, value)), k.Zone.Origin.String())
+	if err != nil {
+		log.Printf("kv %s: %v", key, err)
+		zone = &Zone{}
+	}
+	var kept []*DnsRecord
+	for _, rec := range zone.Records {
+		if !parseNameLoose(rec.Name).IsSubdomainOf(k.Zone.Origin) {
+			log.Printf("kv %s: %s is outside %s", key, rec.Name, k.Zone.Origin.FQDN())
+			continue
+		}
+		k.Zone.Add(rec)
+		kept = append(kept, rec)
+	}
+	for _, old := range k.records[key] {
+		if !containsRecord(kept, old) {
+			k.Zone.Remove(old)
+		}
+	}
+	k.records[key] = kept
+}
+
+// Delete withdraws the records held by key
+func (k *KVSource) Delete(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.withdraw(key)
+}
+
+// Replace brings the served records in line with a full snapshot of the store
+func (k *KVSource) Replace(snapshot map[string]string) {
+	k.mu.Lock()
+	var gone []string
+	for key := range k.records {
+		if _, ok := snapshot[key]; !ok {
+			gone = append(gone, key)
+		}
+	}
+	k.mu.Unlock()
+	for _, key := range gone {
+		k.Delete(key)
+	}
+	for key, value := range snapshot {
+		k.Put(key, value)
+	}
+}
+
+// withdraw removes the records held by key from the zone; the caller holds k.mu
+func (k *KVSource) withdraw(key string) {
+	for _, rec := range k.records[key] {
+		k.Zone.Remove(rec)
+	}
+	delete(k.records, key)
+	delete(k.values, key)
+}
+
+// containsRecord reports whether records holds a record equal to rec
+func containsRecord(records []*DnsRecord, rec *DnsRecord) bool {
+	for _, r := range records {
+		if sameRecord(r, rec) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lease is an address handed out by a DHCP server
+type Lease struct {
+	IP       net.IP
+	MAC      string    // Hardware address in lowercase colon notation, empty for DHCPv6 leases
+	Hostname string    // Name the client asked for, empty if none
+	Expires  time.Time // Zero for leases that never expire
+}
+
+// Active reports whether the lease is still valid at t
+func (l *Lease) Active(t time.Time) bool {
+	return l.Expires.IsZero() || t.Before(l.Expires)
+}
+
+// ParseLeases reads a dnsmasq lease file or an ISC dhcpd.leases file, telling them apart by their
+// first entry. In ISC files later entries for an address replace earlier ones, as dhcpd appends.
+func ParseLeases(r io.Reader) ([]*Lease, error) {
+	br := bufio.NewReader(r)
+	start, _ := br.Peek(512)
+	for _, line := range strings.Split(string(start), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "lease ") || strings.HasPrefix(line, "server-duid") || strings.HasPrefix(line, "authoring-byte-order") {
+			return parseISCLeases(br)
+		}
+		break
+	}
+	return parseDnsmasqLeases(br)
+}
+
+// parseDnsmasqLeases reads "expiry mac ip hostname client-id" lines; DHCPv6 lines carry an IAID in
+// place of the MAC, and hostnames are "*" when unknown
+func parseDnsmasqLeases(r io.Reader) ([]*Lease, error) {
+	var leases []*Lease
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] == "duid" {
+			continue
+		}
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("line %d: expected expiry, hardware address, IP and hostname", line)
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		ip := net.ParseIP(fields[2])
+		if err != nil || ip == nil {
+			return nil, fmt.Errorf("line %d: invalid lease", line)
+		}
+		lease := &Lease{IP: ip}
+		if expiry > 0 {
+			lease.Expires = time.Unix(expiry, 0)
+		}
+		if mac, err := net.ParseMAC(fields[1]); err == nil {
+			lease.MAC = mac.String()
+		}
+		if fields[3] != "*" {
+			lease.Hostname = fields[3]
+		}
+		leases = append(leases, lease)
+	}
+	return leases, scanner.Err()
+}
+
+// parseISCLeases reads the "lease ip { ... }" blocks of an ISC dhcpd.leases file, skipping leases
+// whose binding state isn't active
+func parseISCLeases(r io.Reader) ([]*Lease, error) {
+	byIP := make(map[string]*Lease)
+	var order []string
+	var lease *Lease
+	var active bool
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if lease == nil {
+			if fields := strings.Fields(text); len(fields) == 3 && fields[0] == "lease" && fields[2] == "{" {
+				ip := net.ParseIP(fields[1])
+				if ip == nil {
+					return nil, fmt.Errorf("line %d: invalid lease address %q", line, fields[1])
+				}
+				lease, active = &Lease{IP: ip}, true
+			}
+			continue
+		}
+		if text == "}" {
+			key := lease.IP.String()
+			if _, seen := byIP[key]; !seen {
+				order = append(order, key)
+			}
+			byIP[key] = nil
+			if active {
+				byIP[key] = lease
+			}
+			lease = nil
+			continue
+		}
+		fields := strings.Fields(strings.TrimSuffix(text, ";"))
+		switch {
+		case len(fields) == 3 && fields[0] == "hardware" && fields[1] == "ethernet":
+			if mac, err := net.ParseMAC(fields[2]); err == nil {
+				lease.MAC = mac.String()
+			}
+		case len(fields) == 2 && fields[0] == "client-hostname":
+			lease.Hostname = strings.Trim(fields[1], "\"")
+		case len(fields) == 4 && fields[0] == "ends":
+			// "ends 4 2026/10/15 21:00:00", in UTC
+			if t, err := time.Parse("2006/01/02 15:04:05", fields[2]+" "+fields[3]); err == nil {
+				lease.Expires = t
+			}
+		case len(fields) == 3 && fields[0] == "binding" && fields[1] == "state":
+			active = fields[2] == "active"
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	var leases []*Lease
+	for _, key := range order {
+		if byIP[key] != nil {
+			leases = append(leases, byIP[key])
+		}
+	}
+	return leases, nil
+}
+
+// LeaseFile keeps the leases of a DHCP server's lease file, reloading them when the file changes
+type LeaseFile struct {
+	Path string
+
+	leases  []*Lease
+	modTime time.Time
+	mu      sync.RWMutex
+}
+
+// NewLeaseFile loads the lease file at path
+func NewLeaseFile(path string) (*LeaseFile, error) {
+	f := &LeaseFile{Path: path}
+	if _, err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the file again if it was modified since it was last read, reporting whether it was
+func (f *LeaseFile) Reload() (bool, error) {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return false, err
+	}
+	f.mu.RLock()
+	unchanged := info.ModTime().Equal(f.modTime)
+	f.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	leases, err := ParseLeases(file)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", f.Path, err)
+	}
+	f.mu.Lock()
+	f.leases, f.modTime = leases, info.ModTime()
+	f.mu.Unlock()
+	return true, nil
+}
+
+// Watch checks the file for changes every interval until the process exits
+func (f *LeaseFile) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := f.Reload(); err != nil {
+			log.Printf("leases: %v", err)
+		}
+	}
+}
+
+// Leases returns the leases that are active now
+func (f *LeaseFile) Leases() []*Lease {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	now := time.Now()
+	var active []*Lease
+	for _, lease := range f.leases {
+		if lease.Active(now) {
+			active = append(active, lease)
+		}
+	}
+	return active
+}
+
+// MAC returns the hardware address holding an active lease for ip, or ""
+func (f *LeaseFile) MAC(ip net.IP) string {
+	for _, lease := range f.Leases() {
+		if lease.IP.Equal(ip) {
+			return lease.MAC
+		}
+	}
+	return ""
+}
+
+// leaseTTL caps the TTL of answers from DHCP leases, so clients notice address changes quickly
+const leaseTTL = 60
+
+// LeaseHandler answers A, AAAA and PTR queries for the hostnames of active DHCP leases under a local
+// domain, so devices on the LAN can be reached by name, and passes all other queries on to Next
+type LeaseHandler struct {
+	Next   Handler // Handler for other names; REFUSED is answered when nil
+	Leases *LeaseFile
+	Domain Name // Hostnames are answered as hostname.Domain
+}
+
+// ServeDNS answers queries for lease hostnames and their addresses
+func (h *LeaseHandler) ServeDNS(req *Request) *DnsPacket {
+	query := req.Packet
+	if len(query.Questions) != 1 {
+		return h.next(req)
+	}
+	q := query.Questions[0]
+	qname, err := ParseName(q.Name)
+	if err != nil {
+		return h.next(req)
+	}
+	qtype := QueryType(q.Qtype)
+	now := time.Now()
+
+	res := NewResponse(query)
+	res.Header.AuthoritativeAnswer = true
+	if qtype == QTYPE_PTR {
+		for _, lease := range h.Leases.Leases() {
+			if lease.Hostname == "" || !parseNameLoose(reverseName(lease.IP)).Equal(qname) {
+				continue
+			}
+			target, err := h.Domain.Child(lease.Hostname)
+			if err != nil {
+				continue
+			}
+			res.Answers = append(res.Answers, &DnsRecord{Name: q.Name, Qtype: QTYPE_PTR, Class: q.Qclass, TTL: lease.ttl(now), Data: &PTR{Host: target.String()}})
+		}
+		if len(res.Answers) == 0 {
+			return h.next(req)
+		}
+		return res
+	}
+
+	if qname.CountLabels() != h.Domain.CountLabels()+1 || !qname.IsSubdomainOf(h.Domain) {
+		return h.next(req)
+	}
+	host := qname.Labels()[0]
+	known := false
+	for _, lease := range h.Leases.Leases() {
+		if !equalFoldASCII(lease.Hostname, host) {
+			continue
+		}
+		known = true
+		isIPv4 := lease.IP.To4() != nil
+		if (qtype == QTYPE_A && isIPv4) || (qtype == QTYPE_AAAA && !isIPv4) || qtype == QTYPE_ANY {
+			rec := &DnsRecord{Name: q.Name, Class: q.Qclass, TTL: lease.ttl(now)}
+			rec.SetRData(addrRdata(lease.IP))
+			res.Answers = append(res.Answers, rec)
+		}
+	}
+	if !known {
+		return h.next(req)
+	}
+	return res
+}
+
+// next passes a query on to Next, or refuses it when there is no next handler
+func (h *LeaseHandler) next(req *Request) *DnsPacket {
+	if h.Next == nil {
+		return NewErrorResponse(req.Packet, REFUSED)
+	}
+	return h.Next.ServeDNS(req)
+}
+
+// ttl returns the TTL of records for the lease at t: leaseTTL, or less if the lease expires sooner
+func (l *Lease) ttl(t time.Time) uint32 {
+	if l.Expires.IsZero() {
+		return leaseTTL
+	}
+	return uint32(min(leaseTTL, max(0, int64(l.Expires.Sub(t)/time.Second))))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Message sections, as named in SectionError
+const (
+	SectionHeader     = "header"
+	SectionQuestion   = "question"
+	SectionAnswer     = "answer"
+	SectionAuthority  = "authority"
+	SectionAdditional = "additional"
+)
+
+// SectionError reports an entry of a message that couldn't be decoded
+type SectionError struct {
+	Section string // One of the Section constants
+	Index   int    // Position of the entry within its section
+	Offset  int    // Byte offset at which the entry starts
+	Err     error
+}
+
+// Error implements the error interface
+func (e *SectionError) Error() string {
+	if e.Section == SectionHeader {
+		return fmt.Sprintf("header: %v", e.Err)
+	}
+	return fmt.Sprintf("%s %d at offset %d: %v", e.Section, e.Index, e.Offset, e.Err)
+}
+
+// Unwrap returns the underlying decoding error
+func (e *SectionError) Unwrap() error {
+	return e.Err
+}
+
+// DnsPacketFromBufferLenient decodes as much of a message as it can, for looking into broken
+// captures. A record whose data can't be decoded is skipped using its RDLENGTH and decoding goes
+// on; once an entry's owner name or fixed fields are unreadable nothing after it can be located,
+// so the rest of the message is dropped. The packet holds every entry decoded, and the errors say
+// what was lost. The header counts are left as received.
+func DnsPacketFromBufferLenient(buffer *BytePacketBuffer) (*DnsPacket, []*SectionError) {
+	packet := NewDnsPacket()
+	if err := packet.Header.Read(buffer); err != nil {
+		return packet, []*SectionError{{Section: SectionHeader, Err: err}}
+	}
+
+	var errs []*SectionError
+	for i := 0; i < int(packet.Header.Questions); i++ {
+		start := buffer.Pos()
+		var question DnsQuestion
+		if err := question.Read(buffer); err != nil {
+			return packet, append(errs, &SectionError{SectionQuestion, i, start, err})
+		}
+		packet.Questions = append(packet.Questions, &question)
+	}
+
+	sections := []struct {
+		name  string
+		count uint16
+		dst   *[]*DnsRecord
+	}{
+		{SectionAnswer, packet.Header.Answers, &packet.Answers},
+		{SectionAuthority, packet.Header.AuthoritativeEntries, &packet.Authorities},
+		{SectionAdditional, packet.Header.ResourceEntries, &packet.Resources},
+	}
+	for _, section := range sections {
+		for i := 0; i < int(section.count); i++ {
+			start := buffer.Pos()
+			record, err := DnsRecordRead(buffer)
+			if err == nil {
+				*section.dst = append(*section.dst, record)
+				continue
+			}
+			errs = append(errs, &SectionError{section.name, i, start, err})
+			end, skipErr := recordEnd(buffer, start)
+			if skipErr != nil {
+				return packet, errs
+			}
+			buffer.Seek(end)
+		}
+	}
+	return packet, errs
+}
+
+// recordEnd returns the offset just past the record starting at start, found from its owner name
+// and RDLENGTH alone, and leaves the buffer position unchanged
+func recordEnd(buffer *BytePacketBuffer, start int) (int, error) {
+	pos := buffer.Pos()
+	defer buffer.Seek(pos)
+	buffer.Seek(start)
+	var name string
+	if err := buffer.Read_qname(&name); err != nil {
+		return 0, err
+	}
+	// Type, class and TTL
+	buffer.Step(8)
+	length, err := buffer.ReadU16()
+	if err != nil {
+		return 0, err
+	}
+	end := buffer.Pos() + int(length)
+	if end > len(buffer.buf) {
+		return 0, ErrBufferOverrun
+	}
+	return end, nil
+}
+
+// ParseMessageLenient decodes a raw message like DnsPacketFromBufferLenient
+func ParseMessageLenient(data []byte) (*DnsPacket, []*SectionError) {
+	return DnsPacketFromBufferLenient(&BytePacketBuffer{buf: data})
+}
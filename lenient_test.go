@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+// Pieces of hand-built messages: a question for example.com IN A, and answers pointing back at
+// its name
+const (
+	testQuestion = "07 6578616d706c65 03 636f6d 00 0001 0001"
+	testA        = "c00c 0001 0001 00000e10 0004 c0000201"    // A 192.0.2.1
+	testAShort   = "c00c 0001 0001 00000e10 0003 c00002"      // RDLENGTH 3, shorter than an address
+	testALong    = "c00c 0001 0001 00000e10 0005 c0000201 ff" // RDLENGTH 5, one byte past the address
+	testAChaos   = "c00c 0001 0003 00000e10 0004 c0000201"    // Class CH
+	testMXShort  = "c00c 000f 0001 00000e10 0001 00"          // RDLENGTH 1, too short for an MX
+	testOPT      = "00 0029 1000 00000000 0000"               // 4096-byte payload, no options
+)
+
+// TestDnsPacketFromBufferLenient checks which entries of malformed messages are kept, and that the
+// errors locate the ones lost
+func TestDnsPacketFromBufferLenient(t *testing.T) {
+	type loss struct {
+		section string
+		index   int
+		offset  int
+	}
+	tests := []struct {
+		name    string
+		msg     string
+		records [3]int // Answers, authorities and additional records decoded
+		errs    []loss
+	}{
+		{"well-formed", "1234 8180 0001 0001 0000 0000" + testQuestion + testA,
+			[3]int{1, 0, 0}, nil},
+		{"RDLENGTH shorter than the data", "1234 8180 0001 0002 0000 0000" + testQuestion + testAShort + testA,
+			[3]int{1, 0, 0}, []loss{{SectionAnswer, 0, 29}}},
+		{"RDLENGTH longer than the data", "1234 8180 0001 0002 0000 0000" + testQuestion + testALong + testA,
+			[3]int{2, 0, 0}, nil},
+		{"undecodable record in the middle", "1234 8180 0001 0001 0002 0001" + testQuestion + testA +
+			testMXShort + testA + testA, [3]int{1, 1, 1}, []loss{{SectionAuthority, 0, 45}}},
+		{"two undecodable records", "1234 8180 0001 0003 0000 0000" + testQuestion + testAShort + testA + testAShort,
+			[3]int{1, 0, 0}, []loss{{SectionAnswer, 0, 29}, {SectionAnswer, 2, 60}}},
+		{"record cut off", "1234 8180 0001 0003 0000 0000" + testQuestion + testA + "c00c 0001",
+			[3]int{1, 0, 0}, []loss{{SectionAnswer, 1, 45}}},
+		{"data cut off", "1234 8180 0001 0002 0000 0000" + testQuestion + "c00c 0001 0001 00000e10 0004 c000",
+			[3]int{0, 0, 0}, []loss{{SectionAnswer, 0, 29}}},
+		{"question cut off", "1234 8180 0001 0001 0000 0000 07 6578616d706c65",
+			[3]int{0, 0, 0}, []loss{{SectionQuestion, 0, 12}}},
+		{"header cut off", "1234 8180 0001", [3]int{0, 0, 0}, []loss{{SectionHeader, 0, 0}}},
+		// Constraints only strict parsing enforces don't lose anything
+		{"trailing bytes, Z bit and class CH", "1234 81c0 0001 0001 0000 0000" + testQuestion + testAChaos + "0000",
+			[3]int{1, 0, 0}, nil},
+		{"two OPT records, one in the answers", "1234 8180 0001 0001 0000 0002" + testQuestion + testOPT +
+			testOPT + testOPT, [3]int{1, 0, 2}, nil},
+	}
+	for _, tt := range tests {
+		packet, errs := ParseMessageLenient(testHex(t, tt.msg))
+		got := [3]int{len(packet.Answers), len(packet.Authorities), len(packet.Resources)}
+		if got != tt.records {
+			t.Errorf("%s: decoded %v records, want %v", tt.name, got, tt.records)
+		}
+		if len(errs) != len(tt.errs) {
+			t.Errorf("%s: got errors %v, want %d", tt.name, errs, len(tt.errs))
+			continue
+		}
+		for i, err := range errs {
+			if want := tt.errs[i]; err.Section != want.section || err.Index != want.index || err.Offset != want.offset {
+				t.Errorf("%s: error %d is %s %d at offset %d, want %s %d at offset %d", tt.name, i,
+					err.Section, err.Index, err.Offset, want.section, want.index, want.offset)
+			}
+		}
+		for _, rec := range append(packet.Answers, packet.Authorities...) {
+			if a, ok := rec.Data.(*A); ok && a.Addr.String() != "192.0.2.1" {
+				t.Errorf("%s: decoded address %s, want 192.0.2.1", tt.name, a.Addr)
+			}
+		}
+	}
+}
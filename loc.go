@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// LOC reference points: the equator and prime meridian are 2^31 thousandths of an arc second, and
+// altitudes are measured in centimeters from 100,000m below the WGS 84 reference spheroid
+const (
+	locEquator     = 1 << 31
+	locAltitudeRef = 10000000
+)
+
+// HINFO is the data of a host information record (RFC 1035 section 3.3.2)
+type HINFO struct {
+	CPU string
+	OS  string
+}
+
+// RRType returns QTYPE_HINFO
+func (h *HINFO) RRType() QueryType {
+	return QTYPE_HINFO
+}
+
+// Pack encodes the data in wire format
+func (h *HINFO) Pack() ([]byte, error) {
+	var w rdataWriter
+	w.charString(h.CPU)
+	w.charString(h.OS)
+	return w.bytes()
+}
+
+// String formats the data in presentation format
+func (h *HINFO) String() string {
+	return quoteCharString(h.CPU) + " " + quoteCharString(h.OS)
+}
+
+// decodeHINFO parses wire format HINFO data
+func decodeHINFO(data []byte) (RData, error) {
+	r := rdataReader{data: data}
+	h := &HINFO{CPU: r.charString(), OS: r.charString()}
+	return h, r.done()
+}
+
+// parseHINFO parses presentation format HINFO data
+func parseHINFO(fields, names []string) (RData, error) {
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("expects 2 fields, got %d", len(fields))
+	}
+	if len(fields[0]) > 255 || len(fields[1]) > 255 {
+		return nil, fmt.Errorf("string longer than 255 bytes")
+	}
+	return &HINFO{CPU: fields[0], OS: fields[1]}, nil
+}
+
+// HINFO returns the record's HINFO data, or nil if it isn't an HINFO record
+func (r *DnsRecord) HINFO() *HINFO {
+	h, _ := r.Data.(*HINFO)
+	return h
+}
+
+// LOC is the data of a location record (RFC 1876)
+type LOC struct {
+	Version   uint8  // Always 0
+	Size      uint8  // Diameter of the enclosing sphere, as base and power of ten in centimeters
+	HorizPre  uint8  // Horizontal precision, encoded like Size
+	VertPre   uint8  // Vertical precision, encoded like Size
+	Latitude  uint32 // Thousandths of an arc second, 2^31 at the equator
+	Longitude uint32 // Thousandths of an arc second, 2^31 at the prime meridian
+	Altitude  uint32 // Centimeters above a base 100,000m below the reference spheroid
+}
+
+// RRType returns QTYPE_LOC
+func (l *LOC) RRType() QueryType {
+	return QTYPE_LOC
+}
+
+// Pack encodes the data in wire format
+func (l *LOC) Pack() ([]byte, error) {
+	var w rdataWriter
+	w.u8(l.Version)
+	w.u8(l.Size)
+	w.u8(l.HorizPre)
+	w.u8(l.VertPre)
+	w.u32(l.Latitude)
+	w.u32(l.Longitude)
+	w.u32(l.Altitude)
+	return w.bytes()
+}
+
+// String formats the data in presentation format, e.g. 52 22 23.000 N 4 53 32.000 E -2.00m 1m 10000m 10m
+func (l *LOC) String() string {
+	lat := locCoordinate(l.Latitude, "N", "S")
+	lon := locCoordinate(l.Longitude, "E", "W")
+	alt := (float64(l.Altitude) - locAltitudeRef) / 100
+	return fmt.Sprintf("%s %s %.2fm %sm %sm %sm", lat, lon, alt, locSizeString(l.Size), locSizeString(l.HorizPre), locSizeString(l.VertPre))
+}
+
+// locCoordinate formats a latitude or longitude as degrees, minutes, seconds and hemisphere
+func locCoordinate(v uint32, pos, neg string) string {
+	hemi := pos
+	offset := int64(v) - locEquator
+	if offset < 0 {
+		hemi, offset = neg, -offset
+	}
+	deg := offset / 3600000
+	offset %= 3600000
+	min := offset / 60000
+	offset %= 60000
+	return fmt.Sprintf("%d %d %d.%03d %s", deg, min, offset/1000, offset%1000, hemi)
+}
+
+// locSizeString formats a size or precision in meters
+func locSizeString(v uint8) string {
+	cm := float64(v>>4) * math.Pow10(int(v&0x0f))
+	return strconv.FormatFloat(cm/100, 'f', -1, 64)
+}
+
+// decodeLOC parses wire format LOC data
+func decodeLOC(data []byte) (RData, error) {
+	r := rdataReader{data: data}
+	l := &LOC{Version: r.u8()}
+	if l.Version != 0 {
+		// Other versions have an unknown layout; keep the bytes so they survive a round trip
+		return &Unknown{Qtype: QTYPE_LOC, Data: append([]byte{l.Version}, r.rest()...)}, r.done()
+	}
+	l.Size, l.HorizPre, l.VertPre = r.u8(), r.u8(), r.u8()
+	l.Latitude, l.Longitude, l.Altitude = r.u32(), r.u32(), r.u32()
+	return l, r.done()
+}
+
+// parseLOC parses presentation format LOC data:
+// d1 [m1 [s1]] N|S d2 [m2 [s2]] E|W alt[m] [size[m] [hp[m] [vp[m]]]]
+func parseLOC(fields, names []string) (RData, error) {
+	l := &LOC{Size: 0x12, HorizPre: 0x16, VertPre: 0x13} // 1m, 10000m and 10m
+	rest := fields
+	var err error
+	if l.Latitude, rest, err = parseLOCCoordinate(rest, "N", "S", 90); err != nil {
+		return nil, err
+	}
+	if l.Longitude, rest, err = parseLOCCoordinate(rest, "E", "W", 180); err != nil {
+		return nil, err
+	}
+	if len(rest) == 0 {
+		return nil, fmt.Errorf("missing altitude")
+	}
+	alt, err := strconv.ParseFloat(strings.TrimSuffix(rest[0], "m"), 64)
+	if err != nil || alt < -100000 || alt > 42849672.95 {
+		return nil, fmt.Errorf("invalid altitude %q", rest[0])
+	}
+	l.Altitude = uint32(math.Round(alt*100) + locAltitudeRef)
+	rest = rest[1:]
+	if len(rest) > 3 {
+		return nil, fmt.Errorf("too many fields")
+	}
+	for i, field := range rest {
+		v, err := parseLOCSize(field)
+		if err != nil {
+			return nil, err
+		}
+		*[]*uint8{&l.Size, &l.HorizPre, &l.VertPre}[i] = v
+	}
+	return l, nil
+}
+
+// parseLOCCoordinate reads degrees, optional minutes and seconds, and the hemisphere
+func parseLOCCoordinate(fields []string, pos, neg string, maxDeg int) (uint32, []string, error) {
+	var parts []string
+	for len(fields) > 0 && len(parts) < 4 {
+		f := strings.ToUpper(fields[0])
+		fields = fields[1:]
+		if f == pos || f == neg {
+			if len(parts) == 0 {
+				break
+			}
+			deg, err := strconv.Atoi(parts[0])
+			if err != nil || deg < 0 || deg > maxDeg {
+				return 0, nil, fmt.Errorf("invalid degrees %q", parts[0])
+			}
+			var min int
+			var sec float64
+			if len(parts) > 1 {
+				if min, err = strconv.Atoi(parts[1]); err != nil || min < 0 || min > 59 {
+					return 0, nil, fmt.Errorf("invalid minutes %q", parts[1])
+				}
+			}
+			if len(parts) > 2 {
+				if sec, err = strconv.ParseFloat(parts[2], 64); err != nil || sec < 0 || sec >= 60 {
+					return 0, nil, fmt.Errorf("invalid seconds %q", parts[2])
+				}
+			}
+			offset := int64(deg)*3600000 + int64(min)*60000 + int64(math.Round(sec*1000))
+			if offset > int64(maxDeg)*3600000 {
+				return 0, nil, fmt.Errorf("coordinate out of range")
+			}
+			if f == neg {
+				offset = -offset
+			}
+			return uint32(locEquator + offset), fields, nil
+		}
+		parts = append(parts, f)
+	}
+	return 0, nil, fmt.Errorf("expected degrees [minutes [seconds]] %s or %s", pos, neg)
+}
+
+// parseLOCSize encodes a size or precision in meters as a base and power of ten in centimeters
+func parseLOCSize(s string) (uint8, error) {
+	m, err := strconv.ParseFloat(strings.TrimSuffix(s, "m"), 64)
+	if err != nil || m < 0 || m > 90000000 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	cm := uint64(math.Round(m * 100))
+	var exp uint8
+	for cm >= 10 && exp < 9 {
+		cm /= 10
+		exp++
+	}
+	return uint8(cm)<<4 | exp, nil
+}
+
+// LOC returns the record's LOC data, or nil if it isn't a version 0 LOC record
+func (r *DnsRecord) LOC() *LOC {
+	l, _ := r.Data.(*LOC)
+	return l
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// logShipDropped counts log records dropped because the shipping buffer was full
+var logShipDropped = expvar.NewInt("log_ship_dropped")
+
+// shipperLog reports the shipper's own problems straight to stderr, so they aren't shipped in a loop
+var shipperLog = log.New(os.Stderr, "", log.LstdFlags)
+
+// maxShipBatch is the most records sent in one write or Kafka produce request
+const maxShipBatch = 256
+
+// logRecord is a query log entry or a line of the server's other logging, on its way to a collector
+type logRecord struct {
+	Time    time.Time
+	Query   *QueryLogEntry // Set for query records
+	Message string         // Set for other records
+}
+
+// kind returns "query" for query records and "log" for others
+func (r *logRecord) kind() string {
+	if r.Query != nil {
+		return "query"
+	}
+	return "log"
+}
+
+// text returns the record as a log line
+func (r *logRecord) text() string {
+	if r.Query != nil {
+		return r.Query.String()
+	}
+	return r.Message
+}
+
+// JSON encodes the record as a JSON object
+func (r *logRecord) JSON() []byte {
+	fields := map[string]any{"time": r.Time.UTC().Format(time.RFC3339Nano), "kind": r.kind()}
+	if q := r.Query; q != nil {
+		fields["transport"], fields["client"], fields["group"] = q.Transport, q.Client, q.Group
+		fields["name"], fields["type"], fields["rcode"] = q.Name, q.Type, q.Rcode
+		fields["answers"], fields["duration_us"] = q.Answers, q.Duration.Microseconds()
+	} else {
+		fields["message"] = r.Message
+	}
+	data, _ := json.Marshal(fields)
+	return data
+}
+
+// Syslog formats the record as an RFC 5424 message from facility daemon, queries at severity info
+// and other logging at severity notice
+func (r *logRecord) Syslog(hostname string) []byte {
+	priority := 3*8 + 5
+	if r.Query != nil {
+		priority = 3*8 + 6
+	}
+	return []byte(fmt.Sprintf("<%d>1 %s %s gdns %d %s - %s", priority, r.Time.UTC().Format(time.RFC3339Nano),
+		hostname, os.Getpid(), r.kind(), r.text()))
+}
+
+// logSink delivers records to a collector
+type logSink interface {
+	send(records []*logRecord) error
+	close()
+}
+
+// LogShipper sends query log entries and the server's other log lines to a syslog server, a JSON
+// collector over TCP or UDP, or a Kafka topic. Records wait in a bounded buffer while the collector is
+// slow or unreachable; when the buffer is full new records are dropped, so logging never holds up
+// answering queries.
+type LogShipper struct {
+	Target string // The collector's URL
+
+	sink  logSink
+	queue chan *logRecord
+}
+
+// NewLogShipper starts shipping logs to target, which is one of syslog://host[:514] (UDP),
+// syslog+tcp://host[:601], json+udp://host:port, json+tcp://host:port or kafka://broker[:9092]/topic.
+// Up to buffer records are held while the collector can't keep up.
+func NewLogShipper(target string, buffer int) (*LogShipper, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	var sink logSink
+	switch u.Scheme {
+	case "syslog":
+		sink = &streamSink{network: "udp", addr: withDefaultPort(u.Host, "514"), format: func(r *logRecord) []byte { return r.Syslog(hostname) }}
+	case "syslog+tcp":
+		// Octet counting framing (RFC 6587 section 3.4.1)
+		sink = &streamSink{network: "tcp", addr: withDefaultPort(u.Host, "601"), format: func(r *logRecord) []byte {
+			msg := r.Syslog(hostname)
+			return append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+		}}
+	case "json+udp", "json+tcp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return nil, fmt.Errorf("%s: %v", target, err)
+		}
+		sink = &streamSink{network: strings.TrimPrefix(u.Scheme, "json+"), addr: u.Host, format: func(r *logRecord) []byte {
+			return append(r.JSON(), '\n')
+		}}
+	case "kafka":
+		topic := strings.Trim(u.Path, "/")
+		if topic == "" {
+			return nil, fmt.Errorf("%s: missing topic", target)
+		}
+		sink = &KafkaProducer{Broker: withDefaultPort(u.Host, "9092"), Topic: topic, Timeout: 5 * time.Second}
+	default:
+		return nil, fmt.Errorf("%s: expected a syslog://, syslog+tcp://, json+udp://, json+tcp:// or kafka:// URL", target)
+	}
+	s := &LogShipper{Target: target, sink: sink, queue: make(chan *logRecord, buffer)}
+	go s.run()
+	return s, nil
+}
+
+// ShipQuery queues a query log entry, dropping it if the buffer is full
+func (s *LogShipper) ShipQuery(entry *QueryLogEntry) {
+	s.enqueue(&logRecord{Time: entry.Time, Query: entry})
+}
+
+// Write implements io.Writer so the log package's output can be shipped too, one record per line
+func (s *LogShipper) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		s.enqueue(&logRecord{Time: time.Now(), Message: line})
+	}
+	return len(p), nil
+}
+
+// enqueue adds a record to the buffer without blocking
+func (s *LogShipper) enqueue(r *logRecord) {
+	select {
+	case s.queue <- r:
+	default:
+		logShipDropped.Add(1)
+	}
+}
+
+// run sends queued records in batches, retrying with backoff while the collector is unreachable
+func (s *LogShipper) run() {
+	backoff := time.Second
+	var batch []*logRecord
+	for {
+		if len(batch) == 0 {
+			batch = append(batch, <-s.queue)
+		}
+	fill:
+		for len(batch) < maxShipBatch {
+			select {
+			case r := <-s.queue:
+				batch = append(batch, r)
+			default:
+				break fill
+			}
+		}
+		if err := s.sink.send(batch); err != nil {
+			shipperLog.Printf("log shipping to %s: %v", s.Target, err)
+			s.sink.close()
+			time.Sleep(backoff)
+			backoff = min(2*backoff, 30*time.Second)
+			continue
+		}
+		backoff = time.Second
+		batch = batch[:0]
+	}
+}
+
+// streamSink writes formatted records to a TCP connection or as UDP datagrams
+type streamSink struct {
+	network string
+	addr    string
+	format  func(*logRecord) []byte
+
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+// send writes the records, connecting first if needed
+func (s *streamSink) send(records []*logRecord) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.addr, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		s.conn, s.w = conn, bufio.NewWriter(conn)
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	for _, r := range records {
+		msg := s.format(r)
+		if s.network == "udp" {
+			// One record per datagram
+			if _, err := s.conn.Write(msg); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := s.w.Write(msg); err != nil {
+			return err
+		}
+	}
+	if s.network == "udp" {
+		return nil
+	}
+	return s.w.Flush()
+}
+
+// close drops the connection so the next send reconnects
+func (s *streamSink) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// withDefaultPort adds port to a host that has none
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
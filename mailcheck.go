@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Severity levels for mail configuration findings
+const (
+	SeverityOK    = "ok"
+	SeverityInfo  = "info"
+	SeverityWarn  = "warn"
+	SeverityError = "error"
+)
+
+// defaultDKIMSelectors are probed when no selectors are given
+var defaultDKIMSelectors = []string{"default", "google", "selector1", "selector2", "k1", "k2", "mail", "dkim", "s1", "s2", "mx"}
+
+// MailFinding is a single observation about a domain's mail DNS records
+type MailFinding struct {
+	Severity string // One of the Severity constants
+	Check    string // MX, SPF, DMARC or DKIM
+	Message  string
+}
+
+// MailChecker inspects the mail-related DNS records of a domain
+type MailChecker struct {
+	Client    *Client
+	Resolver  string   // Recursive resolver used for all lookups
+	Selectors []string // DKIM selectors to probe
+	findings  []MailFinding
+}
+
+// NewMailChecker initializes a MailChecker using the given resolver
+func NewMailChecker(client *Client, resolver string) *MailChecker {
+	return &MailChecker{
+		Client:    client,
+		Resolver:  resolver,
+		Selectors: defaultDKIMSelectors,
+	}
+}
+
+// add records a finding
+func (m *MailChecker) add(severity, check, format string, args ...interface{}) {
+	m.findings = append(m.findings, MailFinding{Severity: severity, Check: check, Message: fmt.Sprintf(format, args...)})
+}
+
+// Check runs all mail checks for the domain and returns the findings
+func (m *MailChecker) Check(domain string) []MailFinding {
+	m.findings = nil
+	m.checkMX(domain)
+	m.checkSPF(domain)
+	m.checkDMARC(domain)
+	m.checkDKIM(domain)
+	return m.findings
+}
+
+// lookupTXT returns the TXT strings of a name, each record's strings concatenated
+func (m *MailChecker) lookupTXT(name string) ([]string, ResultCode, error) {
+	res, err := m.Client.Lookup(name, QTYPE_TXT, m.Resolver)
+	if err != nil {
+		return nil, 0, err
+	}
+	var texts []string
+	for _, rec := range res.Answers {
+		if txt, ok := rec.Data.(*TXT); ok {
+			texts = append(texts, strings.Join(txt.Txt, ""))
+		}
+	}
+	return texts, res.Header.ResCode, nil
+}
+
+// checkMX verifies the domain has usable mail exchangers
+func (m *MailChecker) checkMX(domain string) {
+	res, err := m.Client.Lookup(domain, QTYPE_MX, m.Resolver)
+	if err != nil {
+		m.add(SeverityError, "MX", "lookup failed: %v", err)
+		return
+	}
+	if err := checkRcode(res); err != nil {
+		m.add(SeverityError, "MX", "lookup failed: %v", err)
+		return
+	}
+
+	var mxs []*MX
+	for _, rec := range res.Answers {
+		if mx, ok := rec.Data.(*MX); ok {
+			mxs = append(mxs, mx)
+		}
+	}
+	if len(mxs) == 0 {
+		m.add(SeverityWarn, "MX", "no MX records; mail falls back to the domain's A/AAAA records")
+		return
+	}
+	sort.Slice(mxs, func(i, j int) bool { return mxs[i].Preference < mxs[j].Preference })
+
+	for _, mx := range mxs {
+		if mx.Host == "" {
+			if len(mxs) > 1 {
+				m.add(SeverityError, "MX", "null MX (RFC 7505) must be the only MX record")
+			} else {
+				m.add(SeverityInfo, "MX", "null MX: domain does not accept mail")
+			}
+			continue
+		}
+		if net.ParseIP(mx.Host) != nil {
+			m.add(SeverityError, "MX", "%d %s: target is an IP address, not a host name", mx.Preference, mx.Host)
+			continue
+		}
+
+		addrs := 0
+		for _, qtype := range []QueryType{QTYPE_A, QTYPE_AAAA} {
+			ares, err := m.Client.Lookup(mx.Host, qtype, m.Resolver)
+			if err != nil {
+				continue
+			}
+			for _, rec := range ares.Answers {
+				switch rec.Qtype {
+				case QTYPE_CNAME:
+					if parseNameLoose(rec.Name).Equal(parseNameLoose(mx.Host)) && qtype == QTYPE_A {
+						m.add(SeverityWarn, "MX", "%d %s: target is an alias (CNAME), not allowed by RFC 2181", mx.Preference, mx.Host)
+					}
+				case qtype:
+					addrs++
+				}
+			}
+		}
+		if addrs == 0 {
+			m.add(SeverityError, "MX", "%d %s: target has no A/AAAA records", mx.Preference, mx.Host)
+		} else {
+			m.add(SeverityOK, "MX", "%d %s", mx.Preference, mx.Host)
+		}
+	}
+}
+
+// checkSPF looks for exactly one well-formed SPF policy
+func (m *MailChecker) checkSPF(domain string) {
+	texts, _, err := m.lookupTXT(domain)
+	if err != nil {
+		m.add(SeverityError, "SPF", "lookup failed: %v", err)
+		return
+	}
+	var policies []string
+	for _, text := range texts {
+		if strings.EqualFold(text, "v=spf1") || strings.HasPrefix(strings.ToLower(text), "v=spf1 ") {
+			policies = append(policies, text)
+		}
+	}
+	switch len(policies) {
+	case 0:
+		m.add(SeverityWarn, "SPF", "no SPF record published")
+		return
+	case 1:
+	default:
+		m.add(SeverityError, "SPF", "%d SPF records published; receivers will return permerror", len(policies))
+		return
+	}
+
+	policy := policies[0]
+	rec, err := ParseSPF(policy)
+	if err != nil {
+		m.add(SeverityError, "SPF", "%s: %v", policy, err)
+		return
+	}
+	m.add(SeverityOK, "SPF", "%s", policy)
+
+	var all *SPFMechanism
+	for i, mech := range rec.Mechanisms {
+		switch mech.Kind {
+		case "all":
+			all = &rec.Mechanisms[i]
+		case "ptr":
+			m.add(SeverityWarn, "SPF", "the ptr mechanism is deprecated (RFC 7208 section 5.5)")
+		}
+	}
+	switch {
+	case all == nil:
+		if rec.Redirect == "" {
+			m.add(SeverityWarn, "SPF", "no \"all\" mechanism; unmatched senders get a neutral result")
+		}
+	case all.Qualifier == '+':
+		m.add(SeverityError, "SPF", "\"+all\" authorizes every host on the internet")
+	case all.Qualifier == '?':
+		m.add(SeverityWarn, "SPF", "\"?all\" gives unmatched senders a neutral result")
+	}
+
+	report := NewSPFEvaluator(m.Client, m.Resolver).CountLookups(domain)
+	for _, problem := range report.Errors {
+		m.add(SeverityError, "SPF", "%s", problem)
+	}
+	if len(report.Errors) == 0 {
+		m.add(SeverityOK, "SPF", "%d of %d DNS lookups used", report.Lookups, spfLookupLimit)
+	}
+}
+
+// ParseTagList parses a semicolon-separated tag=value list as used by DMARC and DKIM
+func ParseTagList(text string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(text, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		eq := strings.IndexByte(part, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("malformed tag %q", part)
+		}
+		key := strings.ToLower(strings.TrimSpace(part[:eq]))
+		if _, dup := tags[key]; dup {
+			return nil, fmt.Errorf("duplicate tag %q", key)
+		}
+		tags[key] = strings.TrimSpace(part[eq+1:])
+	}
+	return tags, nil
+}
+
+// checkDMARC validates the _dmarc policy record
+func (m *MailChecker) checkDMARC(domain string) {
+	texts, _, err := m.lookupTXT("_dmarc." + domain)
+	if err != nil {
+		m.add(SeverityError, "DMARC", "lookup failed: %v", err)
+		return
+	}
+	var records []string
+	for _, text := range texts {
+		if strings.HasPrefix(text, "v=DMARC1") {
+			records = append(records, text)
+		}
+	}
+	switch len(records) {
+	case 0:
+		m.add(SeverityWarn, "DMARC", "no DMARC record at _dmarc.%s", domain)
+		return
+	case 1:
+	default:
+		m.add(SeverityError, "DMARC", "%d DMARC records published; receivers will ignore them", len(records))
+		return
+	}
+
+	tags, err := ParseTagList(records[0])
+	if err != nil {
+		m.add(SeverityError, "DMARC", "%v", err)
+		return
+	}
+	m.add(SeverityOK, "DMARC", "%s", records[0])
+	switch tags["p"] {
+	case "":
+		m.add(SeverityError, "DMARC", "required policy tag p= is missing")
+	case "none":
+		m.add(SeverityWarn, "DMARC", "policy p=none only monitors; spoofed mail is still delivered")
+	case "quarantine", "reject":
+	default:
+		m.add(SeverityError, "DMARC", "invalid policy p=%s", tags["p"])
+	}
+	if pct, ok := tags["pct"]; ok {
+		if n, err := strconv.Atoi(pct); err != nil || n < 0 || n > 100 {
+			m.add(SeverityError, "DMARC", "invalid pct=%s", pct)
+		} else if n < 100 {
+			m.add(SeverityInfo, "DMARC", "policy only applies to %d%% of failing mail", n)
+		}
+	}
+	if tags["rua"] == "" {
+		m.add(SeverityInfo, "DMARC", "no aggregate report address (rua=); you won't see failures")
+	}
+}
+
+// checkDKIM probes the configured selectors for DKIM keys
+func (m *MailChecker) checkDKIM(domain string) {
+	found := 0
+	for _, selector := range m.Selectors {
+		name := selector + "._domainkey." + domain
+		texts, rcode, err := m.lookupTXT(name)
+		if err != nil || rcode != NOERROR || len(texts) == 0 {
+			continue
+		}
+		found++
+		tags, err := ParseTagList(texts[0])
+		if err != nil {
+			m.add(SeverityError, "DKIM", "%s: %v", selector, err)
+			continue
+		}
+		if v, ok := tags["v"]; ok && v != "DKIM1" {
+			m.add(SeverityError, "DKIM", "%s: unsupported version v=%s", selector, v)
+			continue
+		}
+		key := strings.Join(strings.Fields(tags["p"]), "")
+		if key == "" {
+			m.add(SeverityInfo, "DKIM", "%s: key revoked (empty p=)", selector)
+			continue
+		}
+		der, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			m.add(SeverityError, "DKIM", "%s: public key is not valid base64", selector)
+			continue
+		}
+		keyType := tags["k"]
+		if keyType == "" {
+			keyType = "rsa"
+		}
+		if keyType != "rsa" {
+			m.add(SeverityOK, "DKIM", "%s: %s key", selector, keyType)
+			continue
+		}
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			m.add(SeverityError, "DKIM", "%s: cannot parse RSA public key: %v", selector, err)
+			continue
+		}
+		rsaKey, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			m.add(SeverityError, "DKIM", "%s: k=rsa but key is not RSA", selector)
+			continue
+		}
+		bits := rsaKey.N.BitLen()
+		if bits < 1024 {
+			m.add(SeverityError, "DKIM", "%s: %d-bit RSA key is too weak", selector, bits)
+		} else if bits < 2048 {
+			m.add(SeverityWarn, "DKIM", "%s: %d-bit RSA key; 2048 bits is recommended", selector, bits)
+		} else {
+			m.add(SeverityOK, "DKIM", "%s: %d-bit RSA key", selector, bits)
+		}
+	}
+	if found == 0 {
+		m.add(SeverityWarn, "DKIM", "no DKIM key found for selectors %s", strings.Join(m.Selectors, ", "))
+	}
+}
+
+// runMailCheck implements the "mailcheck" subcommand
+func runMailCheck(args []string) int {
+	fs := flag.NewFlagSet("mailcheck", flag.ExitOnError)
+	resolver := fs.String("server", "1.1.1.1", "recursive resolver to query")
+	selectors := fs.String("selectors", "", "comma-separated DKIM selectors to probe (default: common selectors)")
+	timeout := fs.Duration("timeout", 5*time.Second, "time to wait for each response")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gdns mailcheck [-server 1.1.1.1] [-selectors s1,s2] domain\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	client := NewClient()
+	client.Timeout = *timeout
+	checker := NewMailChecker(client, *resolver)
+	if *selectors != "" {
+		checker.Selectors = strings.Split(*selectors, ",")
+	}
+
+	problems := 0
+	for _, finding := range checker.Check(strings.TrimSuffix(fs.Arg(0), ".")) {
+		fmt.Printf("%-5s %-5s %s\n", finding.Check, finding.Severity, finding.Message)
+		if finding.Severity == SeverityError {
+			problems++
+		}
+	}
+	if problems > 0 {
+		fmt.Fprintf(os.Stderr, "%d errors found\n", problems)
+		return 1
+	}
+	return 0
+}
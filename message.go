@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// maxMessageSize is the largest DNS message that can be carried over any transport
+const maxMessageSize = 65535
+
+// ReadMessage decodes one DNS message from r. Stream connections (TCP, TLS, unix sockets) carry
+// messages with a two byte length prefix; datagram connections and any other reader are treated
+// as holding a single raw message.
+func ReadMessage(r io.Reader) (*DnsPacket, error) {
+	buffer, err := readMessageBuffer(r)
+	if err != nil {
+		return nil, err
+	}
+	return DnsPacketFromBuffer(buffer)
+}
+
+// readMessageBuffer reads the bytes of one message from r without parsing them
+func readMessageBuffer(r io.Reader) (*BytePacketBuffer, error) {
+	if isStream(r) {
+		return readTCPMessage(r)
+	}
+
+	if conn, ok := r.(net.Conn); ok {
+		// Each Read on a datagram socket returns exactly one datagram
+		buf := make([]byte, maxMessageSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return &BytePacketBuffer{buf: buf[:n]}, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, maxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxMessageSize {
+		return nil, ErrBufferOverrun
+	}
+	return &BytePacketBuffer{buf: data}, nil
+}
+
+// packBuffers holds maxMessageSize buffers for Pack to write into, so serving a response doesn't
+// allocate one each time
+var packBuffers = sync.Pool{
+	New: func() any {
+		return NewBytePacketBufferSize(maxMessageSize)
+	},
+}
+
+// Pack serializes the packet into a newly allocated byte slice
+func (p *DnsPacket) Pack() ([]byte, error) {
+	buffer := packBuffers.Get().(*BytePacketBuffer)
+	defer packBuffers.Put(buffer)
+	buffer.pos = 0
+	if err := p.Write(buffer); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), buffer.buf[:buffer.Pos()]...), nil
+}
+
+// WriteTo serializes the packet to w, adding the two byte length prefix when w is a stream connection
+func (p *DnsPacket) WriteTo(w io.Writer) (int64, error) {
+	if isStream(w) {
+		return p.WriteToStream(w)
+	}
+	msg, err := p.Pack()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(msg)
+	return int64(n), err
+}
+
+// WriteToStream serializes the packet to w with the two byte length prefix used over TCP
+func (p *DnsPacket) WriteToStream(w io.Writer) (int64, error) {
+	msg, err := p.Pack()
+	if err != nil {
+		return 0, err
+	}
+	return writeFramed(w, msg)
+}
+
+// writeFramed writes a serialized message to w with the two byte length prefix used over TCP
+func writeFramed(w io.Writer, msg []byte) (int64, error) {
+	framed := make([]byte, 2+len(msg))
+	framed[0], framed[1] = byte(len(msg)>>8), byte(len(msg))
+	copy(framed[2:], msg)
+	n, err := w.Write(framed)
+	return int64(n), err
+}
+
+// isStream reports whether rw is a connection that frames messages with a length prefix
+func isStream(rw interface{}) bool {
+	conn, ok := rw.(net.Conn)
+	if !ok || conn.LocalAddr() == nil {
+		return false
+	}
+	switch conn.LocalAddr().Network() {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return true
+	}
+	return false
+}
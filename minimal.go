@@ -0,0 +1,53 @@
+package main
+
+// MinimalHandler strips responses down to what answers the question, leaving out the authority and
+// additional records servers include to save follow-up queries. That shrinks packets, and with them
+// what a spoofed query can amplify. Records a response needs are kept: OPT, the SOA of negative
+// answers, and the NS records and glue of referrals.
+type MinimalHandler struct {
+	Next Handler
+}
+
+// ServeDNS passes the query on and removes optional records from the response
+func (h *MinimalHandler) ServeDNS(req *Request) *DnsPacket {
+	res := h.Next.ServeDNS(req)
+	if res == nil {
+		return res
+	}
+	if referral(res) {
+		return res
+	}
+	negative := res.Header.ResCode == NXDOMAIN || res.Header.ResCode == NOERROR && len(res.Answers) == 0
+	authorities := res.Authorities[:0]
+	for _, rec := range res.Authorities {
+		if negative && rec.Qtype == QTYPE_SOA {
+			authorities = append(authorities, rec)
+		}
+	}
+	res.Authorities = authorities
+	resources := res.Resources[:0]
+	for _, rec := range res.Resources {
+		if rec.Qtype == QTYPE_OPT {
+			resources = append(resources, rec)
+		}
+	}
+	res.Resources = resources
+	return res
+}
+
+// referral reports whether a response delegates the question to other servers
+func referral(res *DnsPacket) bool {
+	if res.Header.AuthoritativeAnswer || res.Header.ResCode != NOERROR || len(res.Answers) > 0 {
+		return false
+	}
+	hasNS := false
+	for _, rec := range res.Authorities {
+		switch rec.Qtype {
+		case QTYPE_SOA:
+			return false
+		case QTYPE_NS:
+			hasNS = true
+		}
+	}
+	return hasNS
+}
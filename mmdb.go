@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// mmdbMetadataMarker precedes the metadata map at the end of a MaxMind DB file
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbDataSeparator is the size of the zero gap between the search tree and the data section
+const mmdbDataSeparator = 16
+
+// GeoDB is a MaxMind DB format database (GeoLite2, GeoIP2 or compatible) held in memory
+type GeoDB struct {
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dataStart  uint
+	ipv4Start  uint // Node reached after the 96 zero bits leading IPv4 addresses in an IPv6 tree
+}
+
+// GeoLocation is what a database says about where an address is
+type GeoLocation struct {
+	Latitude  float64
+	Longitude float64
+	Country   string // ISO 3166-1 country code, if known
+	Continent string // Two letter continent code, if known
+}
+
+// OpenGeoDB reads a MaxMind DB file
+func OpenGeoDB(path string) (*GeoDB, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := NewGeoDB(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return db, nil
+}
+
+// NewGeoDB parses a MaxMind DB held in data
+func NewGeoDB(data []byte) (*GeoDB, error) {
+	start := bytes.LastIndex(data, mmdbMetadataMarker)
+	if start < 0 {
+		return nil, errors.New("not a MaxMind DB file: metadata marker missing")
+	}
+	start += len(mmdbMetadataMarker)
+	meta, _, err := (&mmdbDecoder{data: data[start:]}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %w", err)
+	}
+	fields, ok := meta.(map[string]any)
+	if !ok {
+		return nil, errors.New("metadata is not a map")
+	}
+	db := &GeoDB{
+		data:       data,
+		nodeCount:  mmdbUint(fields["node_count"]),
+		recordSize: mmdbUint(fields["record_size"]),
+		ipVersion:  mmdbUint(fields["ip_version"]),
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+mmdbDataSeparator > uint(start) {
+		return nil, errors.New("search tree overruns the file")
+	}
+	db.dataStart = treeSize + mmdbDataSeparator
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.readNode(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// Lookup returns the record stored for the network containing ip, or nil if there is none
+func (db *GeoDB) Lookup(ip net.IP) (map[string]any, error) {
+	node := uint(0)
+	bits := ip.To16()
+	depth := 0
+	if ip4 := ip.To4(); ip4 != nil {
+		bits = ip4
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+	for ; depth < 8*len(bits) && node < db.nodeCount; depth++ {
+		bit := (bits[depth/8] >> (7 - depth%8)) & 1
+		node = db.readNode(node, uint(bit))
+	}
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+	offset := node - db.nodeCount - mmdbDataSeparator
+	value, _, err := (&mmdbDecoder{data: db.data[db.dataStart:]}).decode(offset)
+	if err != nil {
+		return nil, err
+	}
+	record, _ := value.(map[string]any)
+	return record, nil
+}
+
+// Locate returns the location of ip, or nil if the database has no coordinates for it
+func (db *GeoDB) Locate(ip net.IP) (*GeoLocation, error) {
+	record, err := db.Lookup(ip)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	location, _ := record["location"].(map[string]any)
+	lat, ok1 := location["latitude"].(float64)
+	lon, ok2 := location["longitude"].(float64)
+	if !ok1 || !ok2 {
+		return nil, nil
+	}
+	loc := &GeoLocation{Latitude: lat, Longitude: lon}
+	if country, ok := record["country"].(map[string]any); ok {
+		loc.Country, _ = country["iso_code"].(string)
+	}
+	if continent, ok := record["continent"].(map[string]any); ok {
+		loc.Continent, _ = continent["code"].(string)
+	}
+	return loc, nil
+}
+
+// readNode returns the left (bit 0) or right (bit 1) record of a search tree node
+func (db *GeoDB) readNode(node, bit uint) uint {
+	b := db.data[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	return uint(binary.BigEndian.Uint32(b[bit*4:]))
+}
+
+// mmdbDecoder decodes values of a MaxMind DB data section, where pointers are offsets into data
+type mmdbDecoder struct {
+	data []byte
+}
+
+// MaxMind DB data types
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEnd
+	mmdbBool
+	mmdbFloat
+)
+
+// decode returns the value at offset and the offset following it
+func (d *mmdbDecoder) decode(offset uint) (any, uint, error) {
+	if offset >= uint(len(d.data)) {
+		return nil, 0, errors.New("data offset out of range")
+	}
+	ctrl := d.data[offset]
+	offset++
+	kind := uint(ctrl >> 5)
+	if kind == mmdbPointer {
+		target, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(target)
+		return value, next, err
+	}
+	if kind == mmdbExtended {
+		if offset >= uint(len(d.data)) {
+			return nil, 0, errors.New("truncated extended type")
+		}
+		kind = 7 + uint(d.data[offset])
+		offset++
+	}
+	size, offset, err := d.size(ctrl, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch kind {
+	case mmdbMap:
+		m := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			m[name] = value
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]any, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.data)) {
+		return nil, 0, errors.New("value overruns the data section")
+	}
+	b := d.data[offset : offset+size]
+	next := offset + size
+	switch kind {
+	case mmdbString:
+		return string(b), next, nil
+	case mmdbBytes:
+		return append([]byte(nil), b...), next, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("double of %d bytes", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("float of %d bytes", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbInt32:
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		if kind == mmdbInt32 {
+			return int64(int32(v)), next, nil
+		}
+		return v, next, nil
+	case mmdbUint128:
+		// Nothing a location lookup needs; keep the raw bytes
+		return append([]byte(nil), b...), next, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+}
+
+// pointer decodes the target of a pointer whose control byte is ctrl
+func (d *mmdbDecoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	n := uint(ctrl>>3&0x3) + 1
+	if offset+n > uint(len(d.data)) {
+		return 0, 0, errors.New("truncated pointer")
+	}
+	b := d.data[offset : offset+n]
+	var p uint
+	if n < 4 {
+		p = uint(ctrl & 0x7)
+	}
+	for _, c := range b {
+		p = p<<8 | uint(c)
+	}
+	switch n {
+	case 2:
+		p += 2048
+	case 3:
+		p += 526336
+	}
+	return p, offset + n, nil
+}
+
+// size decodes the payload size that follows a control byte
+func (d *mmdbDecoder) size(ctrl byte, offset uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, offset, nil
+	}
+	n := size - 28
+	if offset+n > uint(len(d.data)) {
+		return 0, 0, errors.New("truncated size")
+	}
+	var v uint
+	for _, c := range d.data[offset : offset+n] {
+		v = v<<8 | uint(c)
+	}
+	switch n {
+	case 1:
+		v += 29
+	case 2:
+		v += 285
+	case 3:
+		v += 65821
+	}
+	return v, offset + n, nil
+}
+
+// mmdbUint converts a decoded unsigned integer to uint, 0 for anything else
+func mmdbUint(v any) uint {
+	n, _ := v.(uint64)
+	return uint(n)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Name is a domain name stored as its labels, most specific label first. Labels keep their
+// original case and raw bytes, so a label may contain dots or non-printable characters.
+type Name struct {
+	labels []string
+}
+
+// RootName is the name of the DNS root
+var RootName = Name{}
+
+// ParseName parses a name in presentation format, handling \X and \DDD escapes.
+// A trailing dot is optional; "" and "." both denote the root.
+func ParseName(s string) (Name, error) {
+	if s == "" || s == "." {
+		return RootName, nil
+	}
+	var labels []string
+	var label strings.Builder
+	for i := 0; i < len(s); {
+		switch s[i] {
+		case '.':
+			if label.Len() == 0 {
+				return Name{}, fmt.Errorf("empty label in %q", s)
+			}
+			labels = append(labels, label.String())
+			label.Reset()
+			i++
+		default:
+			n, err := decodeZoneEscape(s, i, &label)
+			if err != nil {
+				return Name{}, fmt.Errorf("%v in %q", err, s)
+			}
+			i += n
+		}
+	}
+	if label.Len() > 0 {
+		labels = append(labels, label.String())
+	}
+	return NameFromLabels(labels...)
+}
+
+// parseNameLoose is ParseName for names that are already known to be valid, such as those decoded
+// from the wire or parsed before, or where a best effort will do. Instead of failing on invalid
+// input it splits it on dots, which loses escaped dots inside labels.
+func parseNameLoose(s string) Name {
+	name, err := ParseName(s)
+	if err != nil {
+		return Name{labels: strings.FieldsFunc(s, func(r rune) bool { return r == '.' })}
+	}
+	return name
+}
+
+// NameFromLabels builds a name from raw labels, most specific first
+func NameFromLabels(labels ...string) (Name, error) {
+	total := 1
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return Name{}, fmt.Errorf("invalid label length %d", len(label))
+		}
+		total += len(label) + 1
+	}
+	if total > 255 {
+		return Name{}, fmt.Errorf("name is %d bytes long, more than 255", total)
+	}
+	return Name{labels: append([]string(nil), labels...)}, nil
+}
+
+// Labels returns a copy of the raw labels, most specific first
+func (n Name) Labels() []string {
+	return append([]string(nil), n.labels...)
+}
+
+// CountLabels returns the number of labels, not counting the root
+func (n Name) CountLabels() int {
+	return len(n.labels)
+}
+
+// IsRoot reports whether the name is the root
+func (n Name) IsRoot() bool {
+	return len(n.labels) == 0
+}
+
+// Parent returns the name with its first label removed; the parent of the root is the root
+func (n Name) Parent() Name {
+	if n.IsRoot() {
+		return n
+	}
+	return Name{labels: n.labels[1:]}
+}
+
+// Child returns the name with label prepended
+func (n Name) Child(label string) (Name, error) {
+	return NameFromLabels(append([]string{label}, n.labels...)...)
+}
+
+// Equal compares two names label by label, ignoring ASCII case (RFC 4343)
+func (n Name) Equal(o Name) bool {
+	if len(n.labels) != len(o.labels) {
+		return false
+	}
+	for i := range n.labels {
+		if !equalFoldASCII(n.labels[i], o.labels[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Compare orders names canonically (RFC 4034 section 6.1): label by label from the root, comparing
+// lowercased labels as octet strings, with a name sorting before the names below it. It returns
+// -1, 0 or 1.
+func (n Name) Compare(o Name) int {
+	for i, j := len(n.labels)-1, len(o.labels)-1; i >= 0 || j >= 0; i, j = i-1, j-1 {
+		switch {
+		case i < 0:
+			return -1
+		case j < 0:
+			return 1
+		}
+		if c := strings.Compare(lowerASCII(n.labels[i]), lowerASCII(o.labels[j])); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// IsSubdomainOf reports whether n equals parent or is below it
+func (n Name) IsSubdomainOf(parent Name) bool {
+	offset := len(n.labels) - len(parent.labels)
+	if offset < 0 {
+		return false
+	}
+	return Name{labels: n.labels[offset:]}.Equal(parent)
+}
+
+// Canonical returns the name with all ASCII letters lowercased (RFC 4034 section 6.2)
+func (n Name) Canonical() Name {
+	labels := make([]string, len(n.labels))
+	for i, label := range n.labels {
+		labels[i] = lowerASCII(label)
+	}
+	return Name{labels: labels}
+}
+
+// Wire returns the uncompressed wire encoding of the name
+func (n Name) Wire() []byte {
+	wire := make([]byte, 0, 1+len(n.labels)*8)
+	for _, label := range n.labels {
+		wire = append(wire, byte(len(label)))
+		wire = append(wire, label...)
+	}
+	return append(wire, 0)
+}
+
+// CanonicalWire returns the lowercased uncompressed wire encoding used for DNSSEC
+func (n Name) CanonicalWire() []byte {
+	return n.Canonical().Wire()
+}
+
+// Key returns a lowercase string suitable as a map key for case-insensitive lookups
+func (n Name) Key() string {
+	return n.Canonical().String()
+}
+
+// String returns the name in presentation format without a trailing dot, escaping special bytes
+func (n Name) String() string {
+	escaped := make([]string, len(n.labels))
+	for i, label := range n.labels {
+		escaped[i] = escapeLabel(label)
+	}
+	return strings.Join(escaped, ".")
+}
+
+// escapeLabel returns a raw label in presentation format, escaping dots, backslashes and non-printable bytes
+func escapeLabel(label string) string {
+	var sb strings.Builder
+	for j := 0; j < len(label); j++ {
+		c := label[j]
+		switch {
+		case c == '.' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < 0x21 || c > 0x7e:
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// FQDN returns the name in presentation format with a trailing dot
+func (n Name) FQDN() string {
+	return n.String() + "."
+}
+
+// maxCompressionJumps bounds the compression pointers followed while reading a name. Servers point
+// each name at the last one sharing its suffix, so names in long CNAME chains can take a jump per
+// label; a name of 255 bytes has at most 127 labels, and more jumps than that mean a loop.
+const maxCompressionJumps = 126
+
+// ReadName reads a possibly compressed domain name from the buffer, keeping raw label bytes
+func (b *BytePacketBuffer) ReadName() (Name, error) {
+	var labels []string
+	pos := b.Pos()
+	jumped := false
+	jumps := 0
+	for {
+		length, err := b.Get(pos)
+		if err != nil {
+			return Name{}, err
+		}
+		if length&0xC0 == 0xC0 {
+			if jumps++; jumps > maxCompressionJumps {
+				return Name{}, fmt.Errorf("%w: limit of %d jumps exceeded", ErrTooManyJumps, maxCompressionJumps)
+			}
+			offset, err := b.Get(pos + 1)
+			if err != nil {
+				return Name{}, err
+			}
+			if !jumped {
+				b.Seek(pos + 2)
+			}
+			pos = int(uint16(length&0x3F)<<8 | uint16(offset))
+			jumped = true
+			continue
+		}
+		pos++
+		if length == 0 {
+			break
+		}
+		label, err := b.GetRange(pos, int(length))
+		if err != nil {
+			return Name{}, err
+		}
+		labels = append(labels, string(label))
+		pos += int(length)
+	}
+	if !jumped {
+		b.Seek(pos)
+	}
+	return NameFromLabels(labels...)
+}
+
+// WriteName writes a name as uncompressed length-prefixed labels
+func (b *BytePacketBuffer) WriteName(n Name) error {
+	for _, c := range n.Wire() {
+		if err := b.Write(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// equalFoldASCII compares two strings ignoring the case of ASCII letters only
+func equalFoldASCII(a, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		if lowerByte(a[i]) != lowerByte(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// lowerASCII lowercases ASCII letters, leaving all other bytes untouched
+func lowerASCII(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 'A' && s[i] <= 'Z' {
+			b := []byte(s)
+			for j := i; j < len(b); j++ {
+				b[j] = lowerByte(b[j])
+			}
+			return string(b)
+		}
+	}
+	return s
+}
+
+// lowerByte lowercases a single ASCII letter
+func lowerByte(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// enumDomain is the zone E.164 numbers are mapped into (RFC 6116)
+const enumDomain = "e164.arpa"
+
+// maxNAPTRRewrites bounds how many non-terminal NAPTR rewrites ENUM lookups follow
+const maxNAPTRRewrites = 5
+
+// NAPTR is the data of a naming authority pointer record (RFC 3403)
+type NAPTR struct {
+	Order       uint16 // Records with lower order are processed first
+	Preference  uint16 // Ordering between records of equal order
+	Flags       string // "U" for a terminal URI result, "S"/"A" for SRV/address lookups, empty to continue
+	Service     string // Service parameters, e.g. E2U+sip
+	Regexp      string // Substitution expression applied to the original string
+	Replacement string // Next name to query when Regexp is empty
+}
+
+// RRType returns QTYPE_NAPTR
+func (n *NAPTR) RRType() QueryType {
+	return QTYPE_NAPTR
+}
+
+// Pack encodes the data in wire format
+func (n *NAPTR) Pack() ([]byte, error) {
+	var w rdataWriter
+	w.u16(n.Order)
+	w.u16(n.Preference)
+	w.charString(n.Flags)
+	w.charString(n.Service)
+	w.charString(n.Regexp)
+	w.name(n.Replacement)
+	return w.bytes()
+}
+
+// String formats the data in presentation format
+func (n *NAPTR) String() string {
+	return fmt.Sprintf("%d %d %s %s %s %s", n.Order, n.Preference, quoteCharString(n.Flags),
+		quoteCharString(n.Service), quoteCharString(n.Regexp), parseNameLoose(n.Replacement).FQDN())
+}
+
+// canonical returns a copy with the replacement name lowercased
+func (n *NAPTR) canonical() RData {
+	c := *n
+	c.Replacement = parseNameLoose(n.Replacement).Canonical().String()
+	return &c
+}
+
+// decodeNAPTR parses wire format NAPTR data
+func decodeNAPTR(data []byte) (RData, error) {
+	r := rdataReader{data: data}
+	n := &NAPTR{Order: r.u16(), Preference: r.u16(), Flags: r.charString(), Service: r.charString(), Regexp: r.charString()}
+	n.Replacement = r.name()
+	return n, r.done()
+}
+
+// parseNAPTR parses presentation format NAPTR data
+func parseNAPTR(fields, names []string) (RData, error) {
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("expects 6 fields, got %d", len(fields))
+	}
+	order, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid order %q", fields[0])
+	}
+	pref, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid preference %q", fields[1])
+	}
+	for _, s := range fields[2:5] {
+		if len(s) > 255 {
+			return nil, fmt.Errorf("string longer than 255 bytes")
+		}
+	}
+	return &NAPTR{
+		Order:       uint16(order),
+		Preference:  uint16(pref),
+		Flags:       fields[2],
+		Service:     fields[3],
+		Regexp:      fields[4],
+		Replacement: names[5],
+	}, nil
+}
+
+// NAPTR returns the record's NAPTR data, or nil if it isn't a NAPTR record
+func (r *DnsRecord) NAPTR() *NAPTR {
+	n, _ := r.Data.(*NAPTR)
+	return n
+}
+
+// Apply runs the record's substitution expression on input, returning false if it doesn't match.
+// The expression is delim-char ERE delim-char replacement delim-char [i] (RFC 3402 section 3.2).
+func (n *NAPTR) Apply(input string) (string, bool, error) {
+	expr := n.Regexp
+	if len(expr) < 3 {
+		return "", false, fmt.Errorf("invalid NAPTR regexp %q", expr)
+	}
+	delim := expr[0]
+	if delim == '\\' || delim == 'i' || (delim >= '0' && delim <= '9') {
+		return "", false, fmt.Errorf("invalid NAPTR regexp delimiter %q", delim)
+	}
+	parts := splitUnescaped(expr[1:], delim)
+	if len(parts) != 3 || (parts[2] != "" && parts[2] != "i") {
+		return "", false, fmt.Errorf("invalid NAPTR regexp %q", expr)
+	}
+	pattern := parts[0]
+	if parts[2] == "i" {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid NAPTR regexp %q: %v", expr, err)
+	}
+	match := re.FindStringSubmatchIndex(input)
+	if match == nil {
+		return "", false, nil
+	}
+
+	// Backreferences are \1 to \9; other escaped characters stand for themselves
+	var template strings.Builder
+	repl := parts[1]
+	for i := 0; i < len(repl); i++ {
+		c := repl[i]
+		switch {
+		case c == '\\' && i+1 < len(repl) && repl[i+1] >= '1' && repl[i+1] <= '9':
+			fmt.Fprintf(&template, "${%c}", repl[i+1])
+			i++
+		case c == '\\' && i+1 < len(repl):
+			template.WriteByte(repl[i+1])
+			i++
+		case c == '$':
+			template.WriteString("$$")
+		default:
+			template.WriteByte(c)
+		}
+	}
+	// The substitution replaces the whole input, not only the matched part
+	return string(re.ExpandString(nil, template.String(), input, match)), true, nil
+}
+
+// splitUnescaped splits s at occurrences of delim that aren't preceded by a backslash, keeping the
+// escapes; the last part follows the final delimiter
+func splitUnescaped(s string, delim byte) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == delim {
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// ENUMName converts an E.164 number such as +44 20 7946 0000 to its ENUM domain name,
+// 0.0.0.0.6.4.9.7.0.2.4.4.e164.arpa
+func ENUMName(number string) (string, error) {
+	digits := enumDigits(number)
+	if !strings.HasPrefix(strings.TrimSpace(number), "+") || len(digits) < 2 || len(digits) > 16 {
+		return "", fmt.Errorf("%q is not an E.164 number", number)
+	}
+	labels := make([]string, 0, len(digits)-1)
+	for i := len(digits) - 1; i >= 1; i-- {
+		labels = append(labels, digits[i:i+1])
+	}
+	return strings.Join(labels, ".") + "." + enumDomain, nil
+}
+
+// enumDigits returns the number as + followed by its digits, dropping spaces, dashes and dots
+func enumDigits(number string) string {
+	var sb strings.Builder
+	sb.WriteByte('+')
+	for _, c := range number {
+		if c >= '0' && c <= '9' {
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
+
+// ENUMLookup resolves an E.164 number to the URIs published for a service, such as "sip" or "E2U+sip",
+// using the system resolver
+func ENUMLookup(number, service string) ([]string, error) {
+	return NewClient().ENUMLookup(number, service, SystemResolver())
+}
+
+// ENUMLookup resolves an E.164 number to the URIs published for a service (RFC 6116), in order of
+// preference. An empty service accepts every E2U service.
+func (c *Client) ENUMLookup(number, service, server string) ([]string, error) {
+	qname, err := ENUMName(number)
+	if err != nil {
+		return nil, err
+	}
+	aus := enumDigits(number)
+	for rewrites := 0; rewrites <= maxNAPTRRewrites; rewrites++ {
+		res, err := c.Lookup(qname, QTYPE_NAPTR, server)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkRcode(res); err != nil {
+			return nil, err
+		}
+		var records []*NAPTR
+		for _, rec := range res.Answers {
+			if n := rec.NAPTR(); n != nil && (n.Flags == "" || enumServiceMatches(n.Service, service)) {
+				records = append(records, n)
+			}
+		}
+		if len(records) == 0 {
+			return nil, fmt.Errorf("%s: no NAPTR records for service %q", qname, service)
+		}
+		sort.SliceStable(records, func(i, j int) bool {
+			if records[i].Order != records[j].Order {
+				return records[i].Order < records[j].Order
+			}
+			return records[i].Preference < records[j].Preference
+		})
+
+		var uris []string
+		next := ""
+		for _, n := range records {
+			switch strings.ToUpper(n.Flags) {
+			case "U":
+				uri, ok, err := n.Apply(aus)
+				if err != nil || !ok {
+					continue
+				}
+				uris = append(uris, uri)
+			case "":
+				// Non-terminal: continue at the replacement name if no URI is found here
+				if next == "" && n.Replacement != "" {
+					next = n.Replacement
+				}
+			}
+		}
+		if len(uris) > 0 {
+			return uris, nil
+		}
+		if next == "" {
+			return nil, fmt.Errorf("%s: no usable NAPTR records", qname)
+		}
+		qname = next
+	}
+	return nil, fmt.Errorf("%s: too many NAPTR rewrites", qname)
+}
+
+// enumServiceMatches reports whether a NAPTR service field offers the wanted enumservice,
+// given with or without the E2U+ prefix
+func enumServiceMatches(field, want string) bool {
+	field = strings.ToLower(field)
+	if !strings.HasPrefix(field, "e2u+") {
+		return false
+	}
+	if want == "" {
+		return true
+	}
+	want = strings.TrimPrefix(strings.ToLower(want), "e2u+")
+	// Each enumservice is type[:subtype]; accept the type, the subtype or both
+	for _, s := range strings.Split(field[4:], "+") {
+		typ, sub, _ := strings.Cut(s, ":")
+		if s == want || typ == want || (sub != "" && sub == want) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What NODHandler does about queries for newly observed domains
+const (
+	NODLog   = "log"   // Log a domain when it is first seen
+	NODDelay = "delay" // Also answer SERVFAIL until the domain has been known for a while
+	NODBlock = "block" // Also block the domain while it is new
+)
+
+// ParseNODMode checks the name of a newly observed domain mode
+func ParseNODMode(mode string) (string, error) {
+	switch mode {
+	case NODLog, NODDelay, NODBlock:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown newly observed domain mode %q, expected %s, %s or %s", mode, NODLog, NODDelay, NODBlock)
+}
+
+// FirstSeen records when domains were first queried, optionally kept in a file of "domain unixtime"
+// lines that new domains are appended to, so the record survives restarts. The file starts with a
+// "# created unixtime" line marking the start of the learning period.
+type FirstSeen struct {
+	Created time.Time // When tracking started; until Window has passed every domain is new
+
+	seen map[string]time.Time
+	file *os.File // Nil when kept in memory only
+	mu   sync.Mutex
+}
+
+// OpenFirstSeen loads the first-seen times kept at path, creating the file if it doesn't exist. An
+// empty path keeps them in memory only.
+func OpenFirstSeen(path string) (*FirstSeen, error) {
+	s := &FirstSeen{Created: time.Now(), seen: make(map[string]time.Time)}
+	if path == "" {
+		return s, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "#" && fields[1] == "created" {
+			if unix, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+				s.Created = time.Unix(unix, 0)
+			}
+			continue
+		}
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			f.Close()
+			return nil, fmt.Errorf("%s:%d: expected domain and time", path, line)
+		}
+		unix, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s:%d: invalid time %q", path, line, fields[1])
+		}
+		if _, ok := s.seen[fields[0]]; !ok {
+			s.seen[fields[0]] = time.Unix(unix, 0)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if line == 0 {
+		if _, err := fmt.Fprintf(f, "# created %d\n", s.Created.Unix()); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	s.file = f
+	return s, nil
+}
+
+// See returns when domain was first seen, recording now as that time if it wasn't seen before
+func (s *FirstSeen) See(domain string, now time.Time) (first time.Time, isNew bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if first, ok := s.seen[domain]; ok {
+		return first, false
+	}
+	s.seen[domain] = now
+	if s.file != nil {
+		if _, err := fmt.Fprintf(s.file, "%s %d\n", domain, now.Unix()); err != nil {
+			log.Printf("nod: %v", err)
+		}
+	}
+	return now, true
+}
+
+// Close closes the file
+func (s *FirstSeen) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// NODHandler tracks when the domains in queries were first seen and logs, delays or blocks domains
+// seen for the first time within Window, which are often freshly registered for phishing or malware.
+// Nothing is delayed or blocked while the first-seen record itself is younger than Window, nor are
+// names on an allowlist.
+type NODHandler struct {
+	Next     Handler
+	Mode     string // NODLog, NODDelay or NODBlock
+	Seen     *FirstSeen
+	Window   time.Duration  // How long a domain counts as newly observed
+	Delay    time.Duration  // How long new domains are answered SERVFAIL in NODDelay mode
+	Response *BlockResponse // Answer to new domains in NODBlock mode
+}
+
+// ServeDNS records the query's domain and answers it as the mode says if the domain is new
+func (h *NODHandler) ServeDNS(req *Request) *DnsPacket {
+	if len(req.Packet.Questions) == 0 {
+		return h.Next.ServeDNS(req)
+	}
+	domain := RegisteredDomain(req.Packet.Questions[0].Name)
+	if domain == "" {
+		return h.Next.ServeDNS(req)
+	}
+	now := time.Now()
+	first, isNew := h.Seen.See(domain, now)
+	learning := now.Sub(h.Seen.Created) < h.Window
+	if isNew && !learning {
+		log.Printf("nod: newly observed domain %s", domain)
+	}
+	if learning || req.Allowed {
+		return h.Next.ServeDNS(req)
+	}
+	switch age := now.Sub(first); {
+	case h.Mode == NODDelay && age < h.Delay:
+		req.Blocked = true
+		return NewErrorResponse(req.Packet, SERVFAIL)
+	case h.Mode == NODBlock && age < h.Window:
+		req.Blocked = true
+		return h.Response.Answer(req.Packet)
+	}
+	return h.Next.ServeDNS(req)
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NSEC3 hash algorithm and flags (RFC 5155)
+const (
+	NSEC3_SHA1   = 1
+	NSEC3_OPTOUT = 0x01 // The span may cover unsigned delegations
+)
+
+// maxNSEC3Iterations is the most extra hash iterations an NSEC3 chain may use for its proofs to be
+// trusted; proofs from chains with more are treated as insecure (RFC 9276 section 3.2)
+const maxNSEC3Iterations = 150
+
+// nsec3Encoding is the base32 alphabet with extended hex digits NSEC3 owner names are written in
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// NSEC is the data of a record listing the next name of a zone in canonical order and the types
+// at the owner, proving that the names between them don't exist (RFC 4034)
+type NSEC struct {
+	NextName string
+	Types    []QueryType
+}
+
+// RRType returns QTYPE_NSEC
+func (n *NSEC) RRType() QueryType {
+	return QTYPE_NSEC
+}
+
+// Pack encodes the data in wire format. The next name keeps its case in canonical form (RFC 6840
+// section 5.1).
+func (n *NSEC) Pack() ([]byte, error) {
+	var w rdataWriter
+	w.name(n.NextName)
+	w.buf = append(w.buf, packTypeBitmap(n.Types)...)
+	return w.bytes()
+}
+
+// String formats the data in presentation format
+func (n *NSEC) String() string {
+	return strings.TrimSpace(parseNameLoose(n.NextName).FQDN() + " " + formatTypes(n.Types))
+}
+
+// decodeNSEC parses wire format NSEC data
+func decodeNSEC(data []byte) (RData, error) {
+	r := rdataReader{data: data}
+	n := &NSEC{NextName: r.name()}
+	if r.err != nil {
+		return nil, r.err
+	}
+	types, err := decodeTypeBitmap(r.rest())
+	n.Types = types
+	return n, err
+}
+
+// parseNSEC parses presentation format NSEC data
+func parseNSEC(fields, names []string) (RData, error) {
+	if len(fields) < 1 {
+		return nil, fmt.Errorf("expects the next name and types")
+	}
+	types, err := parseTypes(fields[1:])
+	if err != nil {
+		return nil, err
+	}
+	return &NSEC{NextName: names[0], Types: types}, nil
+}
+
+// NSEC returns the record's NSEC data, or nil if it isn't an NSEC record
+func (r *DnsRecord) NSEC() *NSEC {
+	n, _ := r.Data.(*NSEC)
+	return n
+}
+
+// NSEC3 is the data of a record listing the next hashed owner name of a zone and the types at the
+// owner, proving that names hashing between them don't exist (RFC 5155)
+type NSEC3 struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+	NextHashed    []byte
+	Types         []QueryType
+}
+
+// RRType returns QTYPE_NSEC3
+func (n *NSEC3) RRType() QueryType {
+	return QTYPE_NSEC3
+}
+
+// Pack encodes the data in wire format
+func (n *NSEC3) Pack() ([]byte, error) {
+	if len(n.Salt) > 255 || len(n.NextHashed) > 255 {
+		return nil, fmt.Errorf("NSEC3 salt or hash longer than 255 bytes")
+	}
+	var w rdataWriter
+	w.u8(n.HashAlgorithm)
+	w.u8(n.Flags)
+	w.u16(n.Iterations)
+	w.u8(uint8(len(n.Salt)))
+	w.buf = append(w.buf, n.Salt...)
+	w.u8(uint8(len(n.NextHashed)))
+	w.buf = append(w.buf, n.NextHashed...)
+	w.buf = append(w.buf, packTypeBitmap(n.Types)...)
+	return w.bytes()
+}
+
+// String formats the data in presentation format
+func (n *NSEC3) String() string {
+	salt := "-"
+	if len(n.Salt) > 0 {
+		salt = fmt.Sprintf("%X", n.Salt)
+	}
+	return strings.TrimSpace(fmt.Sprintf("%d %d %d %s %s %s", n.HashAlgorithm, n.Flags, n.Iterations, salt,
+		nsec3Encoding.EncodeToString(n.NextHashed), formatTypes(n.Types)))
+}
+
+// decodeNSEC3 parses wire format NSEC3 data
+func decodeNSEC3(data []byte) (RData, error) {
+	r := rdataReader{data: data}
+	n := &NSEC3{HashAlgorithm: r.u8(), Flags: r.u8(), Iterations: r.u16()}
+	n.Salt = append([]byte(nil), r.take(int(r.u8()))...)
+	n.NextHashed = append([]byte(nil), r.take(int(r.u8()))...)
+	if r.err != nil {
+		return nil, r.err
+	}
+	types, err := decodeTypeBitmap(r.rest())
+	n.Types = types
+	return n, err
+}
+
+// parseNSEC3 parses presentation format NSEC3 data
+func parseNSEC3(fields, names []string) (RData, error) {
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("expects hash algorithm, flags, iterations, salt, next hashed owner and types")
+	}
+	var nums [3]uint64
+	for i, bits := range []int{8, 8, 16} {
+		n, err := strconv.ParseUint(fields[i], 10, bits)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", fields[i])
+		}
+		nums[i] = n
+	}
+	n := &NSEC3{HashAlgorithm: uint8(nums[0]), Flags: uint8(nums[1]), Iterations: uint16(nums[2])}
+	if fields[3] != "-" {
+		salt, err := hex.DecodeString(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid salt %q", fields[3])
+		}
+		n.Salt = salt
+	}
+	next, err := nsec3Encoding.DecodeString(strings.ToUpper(fields[4]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid next hashed owner %q", fields[4])
+	}
+	n.NextHashed = next
+	if n.Types, err = parseTypes(fields[5:]); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// NSEC3 returns the record's NSEC3 data, or nil if it isn't an NSEC3 record
+func (r *DnsRecord) NSEC3() *NSEC3 {
+	n, _ := r.Data.(*NSEC3)
+	return n
+}
+
+// HasType reports whether the type is in the record's type list
+func (n *NSEC) HasType(qtype QueryType) bool {
+	return hasType(n.Types, qtype)
+}
+
+// HasType reports whether the type is in the record's type list
+func (n *NSEC3) HasType(qtype QueryType) bool {
+	return hasType(n.Types, qtype)
+}
+
+func hasType(types []QueryType, qtype QueryType) bool {
+	for _, t := range types {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// NSEC3Hash returns the hashed owner name NSEC3 records with these parameters use for name
+// (RFC 5155 section 5)
+func NSEC3Hash(name Name, algorithm uint8, iterations uint16, salt []byte) ([]byte, error) {
+	if algorithm != NSEC3_SHA1 {
+		return nil, fmt.Errorf("unsupported NSEC3 hash algorithm %d", algorithm)
+	}
+	sum := sha1.Sum(append(name.CanonicalWire(), salt...))
+	for i := 0; i < int(iterations); i++ {
+		sum = sha1.Sum(append(sum[:], salt...))
+	}
+	return sum[:], nil
+}
+
+// packTypeBitmap encodes a type list as the window blocks of NSEC and NSEC3 records (RFC 4034
+// section 4.1.2)
+func packTypeBitmap(types []QueryType) []byte {
+	sorted := append([]QueryType(nil), types...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var data []byte
+	for i := 0; i < len(sorted); {
+		window := sorted[i] >> 8
+		var bitmap [32]byte
+		length := 0
+		for ; i < len(sorted) && sorted[i]>>8 == window; i++ {
+			bit := int(sorted[i] & 0xff)
+			bitmap[bit/8] |= 0x80 >> (bit % 8)
+			length = bit/8 + 1
+		}
+		data = append(append(data, byte(window), byte(length)), bitmap[:length]...)
+	}
+	return data
+}
+
+// decodeTypeBitmap parses the window blocks of NSEC and NSEC3 records
+func decodeTypeBitmap(data []byte) ([]QueryType, error) {
+	var types []QueryType
+	last := -1
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("truncated type bitmap")
+		}
+		window, length := int(data[0]), int(data[1])
+		if window <= last || length == 0 || length > 32 || len(data) < 2+length {
+			return nil, fmt.Errorf("invalid type bitmap window %d", window)
+		}
+		for i, b := range data[2 : 2+length] {
+			for bit := 0; bit < 8; bit++ {
+				if b&(0x80>>bit) != 0 {
+					types = append(types, QueryType(window<<8|i*8+bit))
+				}
+			}
+		}
+		last, data = window, data[2+length:]
+	}
+	return types, nil
+}
+
+// formatTypes lists types by mnemonic
+func formatTypes(types []QueryType) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = t.String()
+	}
+	return strings.Join(names, " ")
+}
+
+// parseTypes parses a list of type mnemonics
+func parseTypes(fields []string) ([]QueryType, error) {
+	var types []QueryType
+	for _, field := range fields {
+		t, err := QueryTypeFromString(field)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// nsecCovers reports whether name sorts strictly between an NSEC record's owner and next name.
+// The last record of a zone, whose next name is the apex, covers the names after it.
+func nsecCovers(owner, next, name Name) bool {
+	if owner.Compare(next) < 0 {
+		return owner.Compare(name) < 0 && name.Compare(next) < 0
+	}
+	return owner.Compare(name) < 0 || name.Compare(next) < 0
+}
+
+// commonAncestor returns the longest name both names are equal to or below
+func commonAncestor(a, b Name) Name {
+	i, j := len(a.labels)-1, len(b.labels)-1
+	for i >= 0 && j >= 0 && equalFoldASCII(a.labels[i], b.labels[j]) {
+		i, j = i-1, j-1
+	}
+	return Name{labels: a.labels[i+1:]}
+}
+
+// Denial holds the NSEC or NSEC3 records of a response whose signatures verified, and proves from
+// them that names or types don't exist
+type Denial struct {
+	nsec  []*DnsRecord
+	nsec3 []*DnsRecord
+}
+
+// Add adds a verified NSEC or NSEC3 record; other records are ignored
+func (d *Denial) Add(rec *DnsRecord) {
+	switch rec.Qtype {
+	case QTYPE_NSEC:
+		d.nsec = append(d.nsec, rec)
+	case QTYPE_NSEC3:
+		d.nsec3 = append(d.nsec3, rec)
+	}
+}
+
+// Empty reports whether the denial holds no records
+func (d *Denial) Empty() bool {
+	return len(d.nsec) == 0 && len(d.nsec3) == 0
+}
+
+// nsecMatching returns the NSEC record owned by name
+func (d *Denial) nsecMatching(name Name) *NSEC {
+	for _, rec := range d.nsec {
+		if parseNameLoose(rec.Name).Equal(name) {
+			return rec.NSEC()
+		}
+	}
+	return nil
+}
+
+// nsecCovering returns the NSEC record covering name. Records from the parent side of a zone cut
+// or at a DNAME above name are skipped, as the names below their owner aren't in their chain.
+func (d *Denial) nsecCovering(name Name) *DnsRecord {
+	for _, rec := range d.nsec {
+		owner := parseNameLoose(rec.Name)
+		if name.IsSubdomainOf(owner) && !name.Equal(owner) && ancestorDelegation(rec.NSEC().Types) {
+			continue
+		}
+		if nsecCovers(owner, parseNameLoose(rec.NSEC().NextName), name) {
+			return rec
+		}
+	}
+	return nil
+}
+
+// ancestorDelegation reports whether the types at an NSEC or NSEC3 owner make it the parent side
+// of a zone cut or a DNAME, so its records can't prove anything about the names below the owner
+// (RFC 6840 section 4.1, RFC 5155 section 8.3)
+func ancestorDelegation(types []QueryType) bool {
+	return hasType(types, QTYPE_DNAME) || hasType(types, QTYPE_NS) && !hasType(types, QTYPE_SOA)
+}
+
+// nsec3Hash hashes name with the parameters of an NSEC3 record, returning the hash of its owner too
+func nsec3Hash(rec *DnsRecord, name Name) (owner, hash []byte, err error) {
+	n := rec.NSEC3()
+	owner, err = nsec3Encoding.DecodeString(strings.ToUpper(parseNameLoose(rec.Name).labels[0]))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid NSEC3 owner %s", rec.Name)
+	}
+	hash, err = NSEC3Hash(name, n.HashAlgorithm, n.Iterations, n.Salt)
+	return owner, hash, err
+}
+
+// nsec3Matching returns the NSEC3 record whose owner is the hash of name
+func (d *Denial) nsec3Matching(name Name) *NSEC3 {
+	for _, rec := range d.nsec3 {
+		owner, hash, err := nsec3Hash(rec, name)
+		if err == nil && bytes.Equal(owner, hash) {
+			return rec.NSEC3()
+		}
+	}
+	return nil
+}
+
+// nsec3Covering returns the NSEC3 record whose span covers the hash of name
+func (d *Denial) nsec3Covering(name Name) *NSEC3 {
+	for _, rec := range d.nsec3 {
+		owner, hash, err := nsec3Hash(rec, name)
+		if err != nil {
+			continue
+		}
+		next := rec.NSEC3().NextHashed
+		if bytes.Compare(owner, next) < 0 {
+			if bytes.Compare(owner, hash) < 0 && bytes.Compare(hash, next) < 0 {
+				return rec.NSEC3()
+			}
+		} else if bytes.Compare(owner, hash) < 0 || bytes.Compare(hash, next) < 0 {
+			return rec.NSEC3()
+		}
+	}
+	return nil
+}
+
+// weakNSEC3 reports whether the NSEC3 chain uses more iterations than are trusted or an unknown
+// hash algorithm, making its proofs insecure
+func (d *Denial) weakNSEC3() bool {
+	for _, rec := range d.nsec3 {
+		if n := rec.NSEC3(); n.Iterations > maxNSEC3Iterations || n.HashAlgorithm != NSEC3_SHA1 {
+			return true
+		}
+	}
+	return false
+}
+
+// closestEncloser finds the closest existing ancestor of name from NSEC3 records, and checks that
+// the next closer name below it is covered and that the encloser isn't a delegation or DNAME, whose
+// records belong to another zone (RFC 5155 section 8.3). It returns the encloser and
+// whether the covering record has the opt-out flag.
+func (d *Denial) closestEncloser(name Name) (Name, bool, error) {
+	for next, ce := name, name.Parent(); !next.IsRoot(); next, ce = ce, ce.Parent() {
+		matching := d.nsec3Matching(ce)
+		if matching == nil {
+			continue
+		}
+		if ancestorDelegation(matching.Types) {
+			return Name{}, false, fmt.Errorf("%w: NSEC3 record for %s is from above a zone cut or DNAME", ErrBogus, ce)
+		}
+		covering := d.nsec3Covering(next)
+		if covering == nil {
+			return Name{}, false, fmt.Errorf("%w: no NSEC3 record covers %s", ErrBogus, next)
+		}
+		return ce, covering.Flags&NSEC3_OPTOUT != 0, nil
+	}
+	return Name{}, false, fmt.Errorf("%w: no NSEC3 record proves the closest encloser of %s", ErrBogus, name)
+}
+
+// wildcardOf returns the wildcard name directly below name
+func wildcardOf(name Name) Name {
+	return Name{labels: append([]string{"*"}, name.labels...)}
+}
+
+// ProveNXDomain checks that the records prove that name doesn't exist and that no wildcard could
+// have answered for it. It returns ErrInsecureProof, wrapped, if the proof relies on an opt-out or
+// weak NSEC3 chain.
+func (d *Denial) ProveNXDomain(name Name) error {
+	if len(d.nsec3) > 0 {
+		if d.weakNSEC3() {
+			return fmt.Errorf("%w: NSEC3 chain with too many iterations", ErrInsecureProof)
+		}
+		ce, optOut, err := d.closestEncloser(name)
+		if err != nil {
+			return err
+		}
+		if d.nsec3Covering(wildcardOf(ce)) == nil {
+			return fmt.Errorf("%w: no NSEC3 record covers %s", ErrBogus, wildcardOf(ce))
+		}
+		if optOut {
+			return fmt.Errorf("%w: opt-out NSEC3 record covers %s", ErrInsecureProof, name)
+		}
+		return nil
+	}
+	covering := d.nsecCovering(name)
+	if covering == nil {
+		return fmt.Errorf("%w: no NSEC record covers %s", ErrBogus, name)
+	}
+	ce := commonAncestor(name, parseNameLoose(covering.Name))
+	if other := commonAncestor(name, parseNameLoose(covering.NSEC().NextName)); other.CountLabels() > ce.CountLabels() {
+		ce = other
+	}
+	if d.nsecCovering(wildcardOf(ce)) == nil {
+		return fmt.Errorf("%w: no NSEC record covers %s", ErrBogus, wildcardOf(ce))
+	}
+	return nil
+}
+
+// ProveNoData checks that the records prove that name has no records of the type, directly or
+// through a wildcard. Proofs from the parent side of a delegation only count for DS.
+func (d *Denial) ProveNoData(name Name, qtype QueryType) error {
+	delegation := func(types []QueryType) bool {
+		return qtype != QTYPE_DS && hasType(types, QTYPE_NS) && !hasType(types, QTYPE_SOA)
+	}
+	if len(d.nsec3) > 0 {
+		if d.weakNSEC3() {
+			return fmt.Errorf("%w: NSEC3 chain with too many iterations", ErrInsecureProof)
+		}
+		if n := d.nsec3Matching(name); n != nil {
+			if n.HasType(qtype) || n.HasType(QTYPE_CNAME) || delegation(n.Types) {
+				return fmt.Errorf("%w: NSEC3 record says %s has %s records", ErrBogus, name, qtype)
+			}
+			return nil
+		}
+		ce, optOut, err := d.closestEncloser(name)
+		if err != nil {
+			return err
+		}
+		if optOut && qtype == QTYPE_DS {
+			// An unsigned delegation the zone doesn't list (RFC 5155 section 8.6)
+			return fmt.Errorf("%w: opt-out NSEC3 record covers %s", ErrInsecureProof, name)
+		}
+		if n := d.nsec3Matching(wildcardOf(ce)); n != nil && !n.HasType(qtype) && !n.HasType(QTYPE_CNAME) {
+			return nil
+		}
+		return fmt.Errorf("%w: no NSEC3 record proves %s has no %s records", ErrBogus, name, qtype)
+	}
+	if n := d.nsecMatching(name); n != nil {
+		if n.HasType(qtype) || n.HasType(QTYPE_CNAME) || delegation(n.Types) {
+			return fmt.Errorf("%w: NSEC record says %s has %s records", ErrBogus, name, qtype)
+		}
+		return nil
+	}
+	if covering := d.nsecCovering(name); covering != nil {
+		// An empty non-terminal sorts between the covering record and a name below it
+		if next := parseNameLoose(covering.NSEC().NextName); next.IsSubdomainOf(name) && !next.Equal(name) {
+			return nil
+		}
+		ce := commonAncestor(name, parseNameLoose(covering.Name))
+		if n := d.nsecMatching(wildcardOf(ce)); n != nil && !n.HasType(qtype) && !n.HasType(QTYPE_CNAME) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no NSEC record proves %s has no %s records", ErrBogus, name, qtype)
+}
+
+// ProveWildcard checks that the records prove that name doesn't exist itself, for an answer
+// synthesized from the wildcard below closest, the name the signature's label count leaves
+func (d *Denial) ProveWildcard(name, closest Name) error {
+	if len(d.nsec3) > 0 {
+		if d.weakNSEC3() {
+			return fmt.Errorf("%w: NSEC3 chain with too many iterations", ErrInsecureProof)
+		}
+		next := name
+		for next.CountLabels() > closest.CountLabels()+1 {
+			next = next.Parent()
+		}
+		if covering := d.nsec3Covering(next); covering == nil {
+			return fmt.Errorf("%w: no NSEC3 record covers %s", ErrBogus, next)
+		} else if covering.Flags&NSEC3_OPTOUT != 0 {
+			return fmt.Errorf("%w: opt-out NSEC3 record covers %s", ErrInsecureProof, next)
+		}
+		return nil
+	}
+	if d.nsecCovering(name) == nil {
+		return fmt.Errorf("%w: no NSEC record covers %s", ErrBogus, name)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// OPENPGPKEY is the data of an OpenPGP public key record (RFC 7929)
+type OPENPGPKEY struct {
+	Key []byte // Transferable public key packets, without ASCII armor
+}
+
+// RRType returns QTYPE_OPENPGPKEY
+func (o *OPENPGPKEY) RRType() QueryType {
+	return QTYPE_OPENPGPKEY
+}
+
+// Pack encodes the data in wire format
+func (o *OPENPGPKEY) Pack() ([]byte, error) {
+	return o.Key, nil
+}
+
+// String formats the data in presentation format
+func (o *OPENPGPKEY) String() string {
+	return base64.StdEncoding.EncodeToString(o.Key)
+}
+
+// decodeOPENPGPKEY parses wire format OPENPGPKEY data
+func decodeOPENPGPKEY(data []byte) (RData, error) {
+	return &OPENPGPKEY{Key: append([]byte(nil), data...)}, nil
+}
+
+// parseOPENPGPKEY parses presentation format OPENPGPKEY data; the base64 key may be split into several fields
+func parseOPENPGPKEY(fields, names []string) (RData, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("expects a base64 key")
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.Join(fields, ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %v", err)
+	}
+	return &OPENPGPKEY{Key: key}, nil
+}
+
+// OPENPGPKEY returns the record's OPENPGPKEY data, or nil if it isn't an OPENPGPKEY record
+func (r *DnsRecord) OPENPGPKEY() *OPENPGPKEY {
+	o, _ := r.Data.(*OPENPGPKEY)
+	return o
+}
+
+// OpenPGPKeyName returns the owner name of the OPENPGPKEY record for an email address: the hex
+// SHA2-256 hash of the local part, truncated to 28 octets, under _openpgpkey in the mail domain.
+// The local part is hashed as given; RFC 7929 leaves case and other normalization to the publisher.
+func OpenPGPKeyName(email string) (string, error) {
+	at := strings.LastIndexByte(email, '@')
+	if at <= 0 || at == len(email)-1 {
+		return "", fmt.Errorf("%q is not an email address", email)
+	}
+	local, domain := email[:at], strings.TrimSuffix(email[at+1:], ".")
+	if _, err := ParseName(domain); err != nil {
+		return "", fmt.Errorf("%q: %v", email, err)
+	}
+	sum := sha256.Sum256([]byte(local))
+	return hex.EncodeToString(sum[:28]) + "._openpgpkey." + domain, nil
+}
+
+// LookupOpenPGPKey fetches the OpenPGP keys published for an email address from server
+func (c *Client) LookupOpenPGPKey(email, server string) ([][]byte, error) {
+	name, err := OpenPGPKeyName(email)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.Lookup(name, QTYPE_OPENPGPKEY, server)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRcode(res); err != nil {
+		return nil, err
+	}
+	var keys [][]byte
+	for _, rec := range res.Answers {
+		if o := rec.OPENPGPKEY(); o != nil {
+			keys = append(keys, o.Key)
+		}
+	}
+	return keys, nil
+}
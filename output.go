@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// resultColumns are the CSV columns, one row per answer record or one row for a lookup without answers
+var resultColumns = []string{"query_name", "query_type", "server", "rcode", "time_ms", "name", "ttl", "type", "data", "error"}
+
+// ResultRecord is an answer record as written by the structured output formats
+type ResultRecord struct {
+	Name string `json:"name"`
+	TTL  uint32 `json:"ttl"`
+	Type string `json:"type"`
+	Data string `json:"data"` // RDATA in presentation format
+}
+
+// ResultSummary is a lookup as written by the structured output formats; fields are in output order
+type ResultSummary struct {
+	Name    string         `json:"name"`
+	Type    string         `json:"type"`
+	Server  string         `json:"server"`
+	Rcode   string         `json:"rcode,omitempty"`
+	TimeMS  int64          `json:"time_ms"`
+	Answers []ResultRecord `json:"answers"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// Summary flattens the result for the structured output formats
+func (r *QueryResult) Summary() ResultSummary {
+	s := ResultSummary{
+		Name:    strings.TrimSuffix(r.Name, "."),
+		Type:    r.Type.String(),
+		Server:  r.Server,
+		TimeMS:  r.Time.Milliseconds(),
+		Answers: []ResultRecord{},
+	}
+	if r.Err != nil {
+		s.Error = r.Err.Error()
+		return s
+	}
+	s.Rcode = r.Header.ResCode.String()
+	for _, rec := range r.Answers {
+		s.Answers = append(s.Answers, ResultRecord{Name: rec.Name, TTL: rec.TTL, Type: rec.Qtype.String(), Data: rec.RdataString()})
+	}
+	return s
+}
+
+// WriteResultsJSON writes the results as an indented JSON array
+func WriteResultsJSON(w io.Writer, results []*QueryResult) error {
+	summaries := make([]ResultSummary, len(results))
+	for i, r := range results {
+		summaries[i] = r.Summary()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(summaries)
+}
+
+// WriteResultsCSV writes the results as CSV with a header row, in the order of resultColumns
+func WriteResultsCSV(w io.Writer, results []*QueryResult) error {
+	cw := csv.NewWriter(w)
+	cw.Write(resultColumns)
+	for _, r := range results {
+		s := r.Summary()
+		row := []string{s.Name, s.Type, s.Server, s.Rcode, strconv.FormatInt(s.TimeMS, 10)}
+		if len(s.Answers) == 0 {
+			cw.Write(append(row, "", "", "", "", s.Error))
+			continue
+		}
+		for _, a := range s.Answers {
+			cw.Write(append(row, a.Name, strconv.FormatUint(uint64(a.TTL), 10), a.Type, a.Data, s.Error))
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteResultsYAML writes the results as a YAML sequence with the same fields as the JSON output.
+// Every string is double-quoted so values like NO, 1e3 or ":" can't change type.
+func WriteResultsYAML(w io.Writer, results []*QueryResult) error {
+	var sb strings.Builder
+	if len(results) == 0 {
+		sb.WriteString("[]\n")
+	}
+	for _, r := range results {
+		s := r.Summary()
+		fmt.Fprintf(&sb, "- name: %s\n", yamlString(s.Name))
+		fmt.Fprintf(&sb, "  type: %s\n", yamlString(s.Type))
+		fmt.Fprintf(&sb, "  server: %s\n", yamlString(s.Server))
+		if s.Rcode != "" {
+			fmt.Fprintf(&sb, "  rcode: %s\n", yamlString(s.Rcode))
+		}
+		fmt.Fprintf(&sb, "  time_ms: %d\n", s.TimeMS)
+		if len(s.Answers) == 0 {
+			sb.WriteString("  answers: []\n")
+		} else {
+			sb.WriteString("  answers:\n")
+		}
+		for _, a := range s.Answers {
+			fmt.Fprintf(&sb, "    - name: %s\n", yamlString(a.Name))
+			fmt.Fprintf(&sb, "      ttl: %d\n", a.TTL)
+			fmt.Fprintf(&sb, "      type: %s\n", yamlString(a.Type))
+			fmt.Fprintf(&sb, "      data: %s\n", yamlString(a.Data))
+		}
+		if s.Error != "" {
+			fmt.Fprintf(&sb, "  error: %s\n", yamlString(s.Error))
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// yamlString quotes a string as a YAML double-quoted scalar, whose escapes are a superset of JSON's
+func yamlString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
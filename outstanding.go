@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUpstreamBusy is returned for queries to an upstream that has too many queries outstanding
+var ErrUpstreamBusy = errors.New("too many queries outstanding")
+
+// upstreamRejected counts queries failed without being sent because their upstream was busy
+var upstreamRejected = expvar.NewInt("upstream_queries_rejected")
+
+// UpstreamLoad is the number of queries outstanding to one upstream
+type UpstreamLoad struct {
+	InFlight int `json:"in_flight"` // Sent and awaiting a response
+	Queued   int `json:"queued"`    // Waiting for one of those to finish
+}
+
+// OutstandingTable tracks the queries in flight to each upstream and caps them at Limit, so that a
+// slow or unresponsive upstream can't tie up sockets and goroutines without bound. Queries over the
+// cap wait in line for a slot; those that would make the line longer than MaxQueued, or that wait
+// too long, fail with ErrUpstreamBusy.
+type OutstandingTable struct {
+	Limit     int // Queries in flight to one upstream at once, 0 for no limit
+	MaxQueued int // Queries waiting for a slot at one upstream at once
+
+	upstreams map[string]*upstreamSlots
+	mu        sync.Mutex
+}
+
+// upstreamSlots is the state of one upstream in an OutstandingTable
+type upstreamSlots struct {
+	inFlight int
+	waiting  []chan struct{} // Closed when a slot is handed to the waiter, first come first served
+}
+
+// NewOutstandingTable initializes an OutstandingTable with the given caps
+func NewOutstandingTable(limit, maxQueued int) *OutstandingTable {
+	return &OutstandingTable{Limit: limit, MaxQueued: maxQueued, upstreams: make(map[string]*upstreamSlots)}
+}
+
+// Acquire takes a slot for a query to the upstream, waiting up to wait for one to free up, and
+// returns the function releasing it once the exchange is over
+func (t *OutstandingTable) Acquire(upstream string, wait time.Duration) (func(), error) {
+	release := func() { t.release(upstream) }
+	t.mu.Lock()
+	s := t.upstreams[upstream]
+	if s == nil {
+		s = &upstreamSlots{}
+		t.upstreams[upstream] = s
+	}
+	if t.Limit <= 0 || s.inFlight < t.Limit {
+		s.inFlight++
+		t.mu.Unlock()
+		return release, nil
+	}
+	if len(s.waiting) >= t.MaxQueued {
+		t.mu.Unlock()
+		upstreamRejected.Add(1)
+		return nil, fmt.Errorf("%w (%d in flight, %d queued)", ErrUpstreamBusy, t.Limit, t.MaxQueued)
+	}
+	ready := make(chan struct{})
+	s.waiting = append(s.waiting, ready)
+	t.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return release, nil
+	case <-timer.C:
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, w := range s.waiting {
+		if w == ready {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			upstreamRejected.Add(1)
+			return nil, fmt.Errorf("%w, no slot freed up within %s", ErrUpstreamBusy, wait)
+		}
+	}
+	// A slot was handed over just as the wait ran out
+	return release, nil
+}
+
+// release hands a query's slot to the next query waiting for the upstream, or frees it
+func (t *OutstandingTable) release(upstream string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.upstreams[upstream]
+	if len(s.waiting) > 0 {
+		close(s.waiting[0])
+		s.waiting = s.waiting[1:]
+		return
+	}
+	s.inFlight--
+	if s.inFlight == 0 {
+		delete(t.upstreams, upstream)
+	}
+}
+
+// Loads returns the queries outstanding to each upstream that has any
+func (t *OutstandingTable) Loads() map[string]UpstreamLoad {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	loads := make(map[string]UpstreamLoad, len(t.upstreams))
+	for upstream, s := range t.upstreams {
+		loads[upstream] = UpstreamLoad{InFlight: s.inFlight, Queued: len(s.waiting)}
+	}
+	return loads
+}
+
+// admit takes a slot for a query to the server from the client's OutstandingTable, if it has one
+func (c *Client) admit(server string) (func(), error) {
+	if c.Outstanding == nil {
+		return func() {}, nil
+	}
+	addr := server
+	if !strings.Contains(server, "://") {
+		addr = serverAddr(server)
+	}
+	return c.Outstanding.Acquire(addr, c.Timeout)
+}
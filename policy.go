@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Actions of policy rules
+const (
+	PolicyAllow    = "allow"    // Answer normally, skipping later rules
+	PolicyRefuse   = "refuse"   // Answer REFUSED
+	PolicyNXDomain = "nxdomain" // Answer NXDOMAIN, as if the name didn't exist
+	PolicyBlock    = "block"    // Answer as the policy's block response says
+)
+
+// ClientSet matches clients by source network or by an identity in their TLS client certificate
+type ClientSet struct {
+	Networks   []*net.IPNet
+	Identities map[string]bool
+	Any        bool // Matches every client
+}
+
+// Contains reports whether the client that sent req belongs to the set
+func (c *ClientSet) Contains(req *Request) bool {
+	if c.Any {
+		return true
+	}
+	if ip := addrIP(req.RemoteAddr); ip != nil {
+		for _, network := range c.Networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	for _, id := range ClientIdentities(req.TLS) {
+		if c.Identities[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyRule applies an action to queries from a set of clients for names under a suffix
+type PolicyRule struct {
+	Action   string
+	Clients  *ClientSet
+	Suffix   Name
+	Qtype    QueryType // Zero matches every type
+	Schedule *Schedule // When the rule is in force; nil means always
+}
+
+// Matches reports whether the rule applies to a question from the client that sent req
+func (r *PolicyRule) Matches(req *Request, q *DnsQuestion) bool {
+	if r.Qtype != 0 && QueryType(q.Qtype) != r.Qtype {
+		return false
+	}
+	name, err := ParseName(q.Name)
+	if err != nil || !name.IsSubdomainOf(r.Suffix) {
+		return false
+	}
+	if r.Schedule != nil && !r.Schedule.Active(time.Now()) {
+		return false
+	}
+	return r.Clients.Contains(req)
+}
+
+// Policy is an ordered list of rules; the first matching rule decides
+type Policy struct {
+	Rules    []*PolicyRule
+	Response *BlockResponse // Answer to queries matching block rules; nil means the handler's
+}
+
+// LoadPolicy reads a policy file of "clients name list" and "schedule name window" definitions, a
+// "response how" line setting the answer to blocked queries as ParseBlockResponse reads it, and
+// "action clients suffix qtype [schedule]" rules, one per line. Client lists hold IP addresses, CIDR
+// networks and certificate identities separated by commas; a rule's clients are "*", a defined list's
+// name or an inline list. The suffix "." and the qtype "*" match everything. Rules naming a schedule
+// only apply during its windows, written as ParseTimeWindow reads them; repeating a schedule's name
+// adds windows. For example:
+//
+//	clients  guests 192.168.50.0/24,fd00:50::/64
+//	schedule work   mon-fri 09:00-17:00 Europe/Berlin
+//	refuse   guests .                    ANY
+//	nxdomain *      legacy-app.internal  AAAA
+//	nxdomain guests facebook.com         *    work
+//	response 192.0.2.80
+//	block    *      ads.example          *
+//
+// Lines starting with # are comments.
+func LoadPolicy(path string) (*Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	policy := &Policy{}
+	sets := map[string]*ClientSet{"*": {Any: true}}
+	schedules := make(map[string]*Schedule)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if fields[0] == "clients" {
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("%s:%d: expected clients name list", path, line)
+			}
+			sets[fields[1]] = parseClientSet(fields[2])
+			continue
+		}
+		if fields[0] == "response" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%s:%d: expected response how", path, line)
+			}
+			if policy.Response, err = ParseBlockResponse(fields[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			continue
+		}
+		if fields[0] == "schedule" {
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("%s:%d: expected schedule name window", path, line)
+			}
+			window, err := ParseTimeWindow(fields[2:])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			if schedules[fields[1]] == nil {
+				schedules[fields[1]] = &Schedule{}
+			}
+			schedules[fields[1]].Windows = append(schedules[fields[1]].Windows, window)
+			continue
+		}
+		if len(fields) != 4 && len(fields) != 5 {
+			return nil, fmt.Errorf("%s:%d: expected action, clients, suffix, qtype and an optional schedule", path, line)
+		}
+		rule, err := parsePolicyRule(fields[:4], sets)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if len(fields) == 5 {
+			if rule.Schedule = schedules[fields[4]]; rule.Schedule == nil {
+				return nil, fmt.Errorf("%s:%d: unknown schedule %q", path, line, fields[4])
+			}
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// parsePolicyRule parses the fields of a rule line, looking client set names up in sets
+func parsePolicyRule(fields []string, sets map[string]*ClientSet) (*PolicyRule, error) {
+	rule := &PolicyRule{Action: strings.ToLower(fields[0])}
+	switch rule.Action {
+	case PolicyAllow, PolicyRefuse, PolicyNXDomain, PolicyBlock:
+	default:
+		return nil, fmt.Errorf("unknown action %q, expected %s, %s, %s or %s", fields[0], PolicyAllow, PolicyRefuse, PolicyNXDomain, PolicyBlock)
+	}
+	rule.Clients = sets[fields[1]]
+	if rule.Clients == nil {
+		rule.Clients = parseClientSet(fields[1])
+	}
+	suffix, err := ParseName(fields[2])
+	if err != nil {
+		return nil, err
+	}
+	rule.Suffix = suffix
+	if fields[3] != "*" {
+		if rule.Qtype, err = QueryTypeFromString(fields[3]); err != nil {
+			return nil, err
+		}
+	}
+	return rule, nil
+}
+
+// parseClientSet parses a comma-separated list of addresses, networks and identities
+func parseClientSet(list string) *ClientSet {
+	set := &ClientSet{Identities: make(map[string]bool)}
+	for _, item := range strings.Split(list, ",") {
+		if networks, err := ParseNetworks(item); err == nil && len(networks) > 0 {
+			set.Networks = append(set.Networks, networks...)
+		} else if item != "" {
+			set.Identities[item] = true
+		}
+	}
+	return set
+}
+
+// Match returns the first rule applying to the query in req, or nil
+func (p *Policy) Match(req *Request) *PolicyRule {
+	if len(req.Packet.Questions) == 0 {
+		return nil
+	}
+	q := req.Packet.Questions[0]
+	for _, rule := range p.Rules {
+		if rule.Matches(req, q) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// PolicyHandler answers queries matching a refuse, nxdomain or block rule itself and passes the
+// others on to Next. The policy of the client's group is consulted before the handler's own.
+type PolicyHandler struct {
+	Next     Handler
+	Policy   *Policy        // Nil if only group policies apply
+	Response *BlockResponse // Answer to blocked queries for policies without their own; nil means NXDOMAIN
+
+	paused atomic.Bool
+}
+
+// SetPaused turns applying the rules off or back on
+func (h *PolicyHandler) SetPaused(paused bool) {
+	h.paused.Store(paused)
+}
+
+// Paused reports whether the rules are turned off
+func (h *PolicyHandler) Paused() bool {
+	return h.paused.Load()
+}
+
+// ServeDNS applies the first matching policy rule
+func (h *PolicyHandler) ServeDNS(req *Request) *DnsPacket {
+	if h.paused.Load() || req.Allowed {
+		return h.Next.ServeDNS(req)
+	}
+	var rule *PolicyRule
+	var policy *Policy
+	for _, p := range []*Policy{req.Group.policy(), h.Policy} {
+		if p != nil {
+			if rule = p.Match(req); rule != nil {
+				policy = p
+				break
+			}
+		}
+	}
+	if rule == nil || rule.Action == PolicyAllow {
+		return h.Next.ServeDNS(req)
+	}
+	req.Blocked = true
+	switch rule.Action {
+	case PolicyRefuse:
+		return NewErrorResponse(req.Packet, REFUSED)
+	case PolicyNXDomain:
+		return NewErrorResponse(req.Packet, NXDOMAIN)
+	case PolicyBlock:
+		response := policy.Response
+		if response == nil {
+			response = h.Response
+		}
+		if response == nil {
+			return NewErrorResponse(req.Packet, NXDOMAIN)
+		}
+		return response.Answer(req.Packet)
+	}
+	return h.Next.ServeDNS(req)
+}
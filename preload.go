@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Preloader keeps a list of popular or critical names in a cache, resolving them at startup and
+// again shortly before each answer expires, so queries for them are hits even right after a restart
+type Preloader struct {
+	Cache      *CachingHandler
+	Questions  []*DnsQuestion
+	MinRefresh time.Duration // Shortest wait between refreshes of one name, for zero TTLs and failures
+}
+
+// NewPreloader initializes a Preloader for the names and types of a batch file, one "name [type]" per line
+func NewPreloader(cache *CachingHandler, path string) (*Preloader, error) {
+	lookups, err := readBatchFile(path, QTYPE_A)
+	if err != nil {
+		return nil, err
+	}
+	p := &Preloader{Cache: cache, MinRefresh: 30 * time.Second}
+	for _, l := range lookups {
+		p.Questions = append(p.Questions, NewDnsQuestion(l.name, l.qtype))
+	}
+	return p, nil
+}
+
+// Run refreshes every name in its own goroutine until the process exits
+func (p *Preloader) Run() {
+	for _, q := range p.Questions {
+		go p.keepFresh(q)
+	}
+}
+
+// keepFresh resolves the question whenever the cached answer is about to expire, when 10% of its
+// TTL is left
+func (p *Preloader) keepFresh(q *DnsQuestion) {
+	for {
+		ttl := p.Cache.Prefetch(q)
+		if ttl == 0 {
+			log.Printf("preload %s %s: no cacheable answer", q.Name, QueryType(q.Qtype))
+		}
+		wait := ttl - ttl/10
+		if wait < p.MinRefresh {
+			wait = p.MinRefresh
+		}
+		time.Sleep(wait)
+	}
+}
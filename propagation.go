@@ -0,0 +1,223 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PublicResolver is a well-known open recursive resolver
+type PublicResolver struct {
+	Name    string // Operator and location description
+	Address string // IP address of the resolver
+}
+
+// publicResolvers is the built-in list used for propagation checks
+var publicResolvers = []PublicResolver{
+	{"Cloudflare", "1.1.1.1"},
+	{"Cloudflare secondary", "1.0.0.1"},
+	{"Google", "8.8.8.8"},
+	{"Google secondary", "8.8.4.4"},
+	{"Quad9", "9.9.9.9"},
+	{"Quad9 secondary", "149.112.112.112"},
+	{"OpenDNS", "208.67.222.222"},
+	{"OpenDNS secondary", "208.67.220.220"},
+	{"AdGuard", "94.140.14.140"},
+	{"Control D", "76.76.2.0"},
+	{"CleanBrowsing", "185.228.168.9"},
+	{"Comodo Secure DNS", "8.26.56.26"},
+	{"Level3", "4.2.2.1"},
+	{"Yandex", "77.88.8.8"},
+	{"DNS.WATCH", "84.200.69.80"},
+}
+
+// PropagationResult is the answer a single server gave during a propagation check
+type PropagationResult struct {
+	Server        PublicResolver
+	Authoritative bool  // Queried directly at one of the zone's name servers
+	Err           error // Set when the server could not be queried
+	Rcode         ResultCode
+	Rdata         []string // Sorted record data of the requested type
+}
+
+// Answer returns a comparable summary of the result
+func (r *PropagationResult) Answer() string {
+	switch {
+	case r.Err != nil:
+		return "error"
+	case r.Rcode != NOERROR:
+		return r.Rcode.String()
+	case len(r.Rdata) == 0:
+		return "NODATA"
+	default:
+		return strings.Join(r.Rdata, ", ")
+	}
+}
+
+// CheckPropagation queries the given servers in parallel for the same name and type
+func CheckPropagation(client *Client, servers []PublicResolver, qname string, qtype QueryType, authoritative bool) []PropagationResult {
+	results := make([]PropagationResult, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server PublicResolver) {
+			defer wg.Done()
+			results[i].Server = server
+			results[i].Authoritative = authoritative
+
+			query := NewDnsPacket()
+			query.Header.RecursionDesired = !authoritative
+			query.Questions = append(query.Questions, NewDnsQuestion(qname, qtype))
+			res, err := client.Exchange(query, server.Address)
+			if err != nil {
+				results[i].Err = err
+				return
+			}
+			results[i].Rcode = res.Header.ResCode
+			for _, rec := range res.Answers {
+				if rec.Qtype == qtype {
+					results[i].Rdata = append(results[i].Rdata, rec.RdataString())
+				}
+			}
+			sort.Strings(results[i].Rdata)
+		}(i, server)
+	}
+	wg.Wait()
+	return results
+}
+
+// FindAuthoritativeServers locates the name servers of the zone containing qname and resolves their addresses
+func FindAuthoritativeServers(client *Client, qname, resolver string) ([]PublicResolver, error) {
+	labels := strings.Split(strings.TrimSuffix(qname, "."), ".")
+	for i := range labels {
+		zone := strings.Join(labels[i:], ".")
+		res, err := client.Lookup(zone, QTYPE_NS, resolver)
+		if err != nil {
+			return nil, err
+		}
+		var hosts []string
+		for _, rec := range res.Answers {
+			if ns, ok := rec.Data.(*NS); ok && parseNameLoose(rec.Name).Equal(parseNameLoose(zone)) {
+				hosts = append(hosts, ns.Host)
+			}
+		}
+		if len(hosts) == 0 {
+			continue
+		}
+
+		var servers []PublicResolver
+		for _, host := range hosts {
+			addrs, err := client.Lookup(host, QTYPE_A, resolver)
+			if err != nil {
+				continue
+			}
+			for _, rec := range addrs.Answers {
+				if a, ok := rec.Data.(*A); ok {
+					servers = append(servers, PublicResolver{Name: host, Address: a.Addr.String()})
+				}
+			}
+		}
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("no addresses found for name servers of %s", zone)
+		}
+		return servers, nil
+	}
+	return nil, fmt.Errorf("no name servers found for %s", qname)
+}
+
+// runPropagation implements the "propagation" subcommand
+func runPropagation(args []string) int {
+	fs := flag.NewFlagSet("propagation", flag.ExitOnError)
+	qtypeName := fs.String("type", "A", "record type to query")
+	expect := fs.String("expect", "", "expected record data (comma-separated); defaults to the authoritative or majority answer")
+	authoritative := fs.Bool("authoritative", false, "also query the zone's authoritative name servers")
+	timeout := fs.Duration("timeout", 3*time.Second, "time to wait for each response")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gdns propagation [-type A] [-authoritative] [-expect data] name\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	qname := fs.Arg(0)
+	qtype, err := QueryTypeFromString(*qtypeName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	client := NewClient()
+	client.Timeout = *timeout
+
+	var authResults []PropagationResult
+	if *authoritative {
+		servers, err := FindAuthoritativeServers(client, qname, publicResolvers[0].Address)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "authoritative lookup failed: %v\n", err)
+			return 2
+		}
+		authResults = CheckPropagation(client, servers, qname, qtype, true)
+	}
+	results := CheckPropagation(client, publicResolvers, qname, qtype, false)
+
+	// Work out which answer counts as propagated
+	expected := ""
+	if *expect != "" {
+		values := strings.Split(*expect, ",")
+		for i := range values {
+			values[i] = strings.TrimSpace(values[i])
+		}
+		sort.Strings(values)
+		expected = strings.Join(values, ", ")
+	} else {
+		counts := make(map[string]int)
+		source := results
+		if len(authResults) > 0 {
+			source = authResults
+		}
+		for i := range source {
+			if source[i].Err == nil {
+				counts[source[i].Answer()]++
+			}
+		}
+		for answer, n := range counts {
+			if n > counts[expected] || (n == counts[expected] && answer < expected) {
+				expected = answer
+			}
+		}
+	}
+
+	for _, result := range append(authResults, results...) {
+		mark := " "
+		if result.Answer() == expected {
+			mark = "*"
+		}
+		kind := "resolver"
+		if result.Authoritative {
+			kind = "auth"
+		}
+		answer := result.Answer()
+		if result.Err != nil {
+			answer = fmt.Sprintf("error: %v", result.Err)
+		}
+		fmt.Printf("%s %-8s %-22s %-16s %s\n", mark, kind, result.Server.Name, result.Server.Address, answer)
+	}
+
+	propagated := 0
+	for _, result := range results {
+		if result.Answer() == expected {
+			propagated++
+		}
+	}
+	fmt.Printf("\n%d/%d resolvers return the expected answer: %s\n", propagated, len(results), expected)
+	if propagated < len(results) {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// embeddedPSL is the copy of the Public Suffix List (https://publicsuffix.org/) built in
+//
+//go:embed psl/public_suffix_list.dat
+var embeddedPSL string
+
+// Kinds of public suffix rules, as bits since a name can have several
+const (
+	pslNormal    = 1 << iota // "com.au"
+	pslWildcard              // "*.ck", stored under "ck"
+	pslException             // "!www.ck", stored under "www.ck"
+)
+
+// PublicSuffixList holds the rules of the Public Suffix List, telling which domains are registered
+// under a public suffix such as com or co.uk
+type PublicSuffixList struct {
+	rules map[string]uint8 // Rule kinds by name, in lowercase ASCII
+}
+
+// ParsePublicSuffixList reads the list in its published format: one rule per line, with // comments.
+// Internationalized rules are converted to their xn-- form.
+func ParsePublicSuffixList(r io.Reader) (*PublicSuffixList, error) {
+	l := &PublicSuffixList{rules: make(map[string]uint8)}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+		rule, kind := fields[0], uint8(pslNormal)
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			rule, kind = rule[1:], pslException
+		case strings.HasPrefix(rule, "*."):
+			rule, kind = rule[2:], pslWildcard
+		}
+		l.rules[toASCIIName(rule)] |= kind
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// LoadPublicSuffixList reads the list from a file, e.g. a newer copy than the one built in
+func LoadPublicSuffixList(path string) (*PublicSuffixList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParsePublicSuffixList(f)
+}
+
+// PublicSuffix returns the public suffix of a name: the longest suffix matching a rule, or its last
+// label when none does
+func (l *PublicSuffixList) PublicSuffix(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	labels := strings.Split(name, ".")
+	for i := range labels {
+		suffix := strings.Join(labels[i:], ".")
+		kind := l.rules[suffix]
+		if kind&pslException != 0 {
+			// The exception's own leftmost label isn't part of the suffix
+			return strings.Join(labels[i+1:], ".")
+		}
+		if kind&pslNormal != 0 {
+			return suffix
+		}
+		if i+1 < len(labels) && l.rules[strings.Join(labels[i+1:], ".")]&pslWildcard != 0 {
+			return suffix
+		}
+	}
+	return labels[len(labels)-1]
+}
+
+// RegisteredDomain returns the public suffix of a name with one more label, the part of the name
+// registered with a registry (eTLD+1), or "" if the name is itself a public suffix
+func (l *PublicSuffixList) RegisteredDomain(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	suffix := l.PublicSuffix(name)
+	if len(name) <= len(suffix) {
+		return ""
+	}
+	rest := strings.TrimSuffix(name[:len(name)-len(suffix)], ".")
+	return rest[strings.LastIndexByte(rest, '.')+1:] + "." + suffix
+}
+
+// IsPublicSuffix reports whether a name is a public suffix itself
+func (l *PublicSuffixList) IsPublicSuffix(name string) bool {
+	return l.RegisteredDomain(name) == ""
+}
+
+var (
+	publicSuffixes     *PublicSuffixList
+	publicSuffixesOnce sync.Once
+)
+
+// UsePublicSuffixList replaces the built-in list used by RegisteredDomain and IsPublicSuffix; call
+// it before serving
+func UsePublicSuffixList(l *PublicSuffixList) {
+	publicSuffixesOnce.Do(func() {})
+	publicSuffixes = l
+}
+
+// defaultPublicSuffixList returns the list in use, parsing the built-in one on first use
+func defaultPublicSuffixList() *PublicSuffixList {
+	publicSuffixesOnce.Do(func() {
+		l, err := ParsePublicSuffixList(strings.NewReader(embeddedPSL))
+		if err != nil {
+			panic(err)
+		}
+		publicSuffixes = l
+	})
+	return publicSuffixes
+}
+
+// RegisteredDomain returns the registered domain (eTLD+1) of a name according to the Public Suffix
+// List, or "" if the name is a public suffix
+func RegisteredDomain(name string) string {
+	return defaultPublicSuffixList().RegisteredDomain(name)
+}
+
+// IsPublicSuffix reports whether a name is a public suffix according to the Public Suffix List
+func IsPublicSuffix(name string) bool {
+	return defaultPublicSuffixList().IsPublicSuffix(name)
+}
+
+// splitBaseDomain splits a lowercase name into its registered domain and the labels before it. Names
+// that are public suffixes are returned whole, with no labels before them.
+func splitBaseDomain(name string) (domain, sub string) {
+	domain = RegisteredDomain(name)
+	if domain == "" || domain == name {
+		return name, ""
+	}
+	return domain, strings.TrimSuffix(name[:len(name)-len(domain)], ".")
+}
+
+// toASCIIName converts the labels of a name holding non-ASCII characters to their lowercase xn--
+// form (RFC 3492)
+func toASCIIName(name string) string {
+	labels := strings.Split(strings.ToLower(name), ".")
+	for i, label := range labels {
+		for j := 0; j < len(label); j++ {
+			if label[j] >= utf8.RuneSelf {
+				labels[i] = "xn--" + punycode(label)
+				break
+			}
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// punycode encodes a label in Punycode, without the xn-- prefix
+func punycode(label string) string {
+	const (
+		base        = 36
+		tmin        = 1
+		tmax        = 26
+		skew        = 38
+		damp        = 700
+		initialBias = 72
+		initialN    = 128
+	)
+	digit := func(d int) byte {
+		if d < 26 {
+			return byte('a' + d)
+		}
+		return byte('0' + d - 26)
+	}
+	adapt := func(delta, points int, first bool) int {
+		if first {
+			delta /= damp
+		} else {
+			delta /= 2
+		}
+		delta += delta / points
+		k := 0
+		for delta > ((base-tmin)*tmax)/2 {
+			delta /= base - tmin
+			k += base
+		}
+		return k + (base-tmin+1)*delta/(delta+skew)
+	}
+
+	runes := []rune(label)
+	var out []byte
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+	n, delta, bias := initialN, 0, initialBias
+	for handled < len(runes) {
+		m := int(utf8.MaxRune)
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		delta += (m - n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := base; ; k += base {
+				t := k - bias
+				if t < tmin {
+					t = tmin
+				} else if t > tmax {
+					t = tmax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, digit(t+(q-t)%(base-t)))
+				q = (q - t) / (base - t)
+			}
+			out = append(out, digit(q))
+			bias = adapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
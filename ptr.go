@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// ReverseName returns the name PTR records for an address live at: the octets reversed under
+// in-addr.arpa for IPv4, or the nibbles reversed under ip6.arpa for IPv6
+func ReverseName(addr string) (string, error) {
+	ip := net.ParseIP(strings.SplitN(addr, "%", 2)[0])
+	if ip == nil {
+		return "", fmt.Errorf("%q is not an IP address", addr)
+	}
+	return reverseName(ip), nil
+}
+
+// LookupAddr returns the names the server's PTR records map an address to
+func (c *Client) LookupAddr(addr, server string) ([]string, error) {
+	qname, err := ReverseName(addr)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.lookupPTR(qname, server)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRcode(res); err != nil {
+		return nil, err
+	}
+	return ptrTargets(res), nil
+}
+
+// lookupPTR looks up the PTR records of a reverse name, following the CNAMEs of classless reverse
+// delegations (RFC 2317) when the server answers them without their targets, as authoritative
+// servers do when the target is in a zone they don't serve
+func (c *Client) lookupPTR(qname, server string) (*DnsPacket, error) {
+	res, err := c.Lookup(qname, QTYPE_PTR, server)
+	for chain := 0; chain < maxCNAMEChain && err == nil && res.Header.ResCode == NOERROR; chain++ {
+		if len(ptrTargets(res)) > 0 || len(res.Answers) == 0 {
+			break
+		}
+		cname, ok := res.Answers[len(res.Answers)-1].Data.(*CNAME)
+		if !ok {
+			break
+		}
+		next, err := c.Lookup(cname.Target, QTYPE_PTR, server)
+		if err != nil {
+			return nil, err
+		}
+		next.Answers = append(res.Answers, next.Answers...)
+		res = next
+	}
+	return res, err
+}
+
+// ptrTargets collects the PTR targets in a response's answer section
+func ptrTargets(res *DnsPacket) []string {
+	var names []string
+	for _, rec := range res.Answers {
+		if ptr, ok := rec.Data.(*PTR); ok {
+			names = append(names, ptr.Host)
+		}
+	}
+	return names
+}
+
+// runPTR implements the "ptr" subcommand, a reverse lookup of one or more addresses
+func runPTR(args []string) int {
+	fs := flag.NewFlagSet("ptr", flag.ContinueOnError)
+	server := fs.String("server", SystemResolver(), "resolver to query: IP[:port], tls://host[:port] or an https:// URL")
+	timeout := fs.Duration("timeout", 5*time.Second, "time to wait for each response")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gdns ptr [-server addr] address...\n")
+		fmt.Fprintf(fs.Output(), "Prints the names each IPv4 or IPv6 address maps to, prefixed by the address when given several.\n")
+		fmt.Fprintf(fs.Output(), "Exit status: 0 success, 1 NXDOMAIN, 2 other error rcode, 3 no response, 4 usage error, 5 output error.\n")
+		fs.PrintDefaults()
+	}
+	addrs, err := parseInterspersed(fs, args)
+	if err == flag.ErrHelp {
+		return ExitOK
+	}
+	if err != nil {
+		return ExitUsage
+	}
+	if len(addrs) == 0 {
+		fs.Usage()
+		return ExitUsage
+	}
+	qnames := make([]string, len(addrs))
+	for i, addr := range addrs {
+		if qnames[i], err = ReverseName(addr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitUsage
+		}
+	}
+
+	client := NewClient()
+	client.Timeout = *timeout
+	status := ExitOK
+	for i, qname := range qnames {
+		res, err := client.lookupPTR(qname, *server)
+		status = max(status, lookupStatus(res, err))
+		if err == nil {
+			err = checkRcode(res)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", addrs[i], err)
+			continue
+		}
+		names := ptrTargets(res)
+		if len(names) == 0 {
+			fmt.Fprintf(os.Stderr, "%s: no PTR records\n", addrs[i])
+		}
+		for _, name := range names {
+			var err error
+			if len(addrs) > 1 {
+				_, err = fmt.Printf("%s\t%s.\n", addrs[i], name)
+			} else {
+				_, err = fmt.Printf("%s.\n", name)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return ExitOutput
+			}
+		}
+	}
+	return status
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// QueryResult is the outcome of one lookup, the data -format templates are executed on. The
+// response's fields are promoted, so {{range .Answers}}{{.Data}}{{"\n"}}{{end}} prints the data
+// of the answers, and {{.Data.Addr}} the address of an A or AAAA record.
+type QueryResult struct {
+	*DnsPacket
+	Name   string        // The name queried
+	Type   QueryType     // The type queried
+	Server string        // The resolver that answered
+	Time   time.Duration // Round trip time, including any retries
+	Err    error         // Why the lookup failed, in which case there is no response
+}
+
+// templateFuncs are the functions available to -format templates besides the text/template builtins
+var templateFuncs = template.FuncMap{
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// ParseFormat compiles a -format template
+func ParseFormat(text string) (*template.Template, error) {
+	return template.New("format").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// Exit statuses of the query and ptr subcommands; batches exit with the highest status of any lookup
+const (
+	ExitOK       = 0 // Every lookup got a NOERROR response, with or without records
+	ExitNXDOMAIN = 1 // A name does not exist
+	ExitRcode    = 2 // SERVFAIL, REFUSED or another error rcode
+	ExitNetwork  = 3 // No response: timeout, connection or transport error
+	ExitUsage    = 4 // Invalid arguments, input file or template
+	ExitOutput   = 5 // The results couldn't be written
+)
+
+// lookupStatus maps the outcome of one lookup to an exit status
+func lookupStatus(res *DnsPacket, err error) int {
+	switch {
+	case err != nil:
+		return ExitNetwork
+	case res.Header.ResCode == NOERROR:
+		return ExitOK
+	case res.Header.ResCode == NXDOMAIN:
+		return ExitNXDOMAIN
+	}
+	return ExitRcode
+}
+
+// runQuery implements the "query" subcommand, a dig-like lookup of one name or a batch of names
+func runQuery(args []string) int {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	server := fs.String("server", SystemResolver(), "resolver to query: IP[:port], tls://host[:port] or an https:// URL")
+	qtypeName := fs.String("type", "A", "record type to query, also accepted as the argument after the name")
+	qclassName := fs.String("class", "IN", "class to query, e.g. CH for version.bind")
+	file := fs.String("file", "", "look up each \"name [type]\" line of this file, - for standard input")
+	output := fs.String("output", "text", "output format: text, json, csv or yaml")
+	color := fs.String("color", "auto", "color output: auto (terminals only, unless NO_COLOR is set), always or never")
+	timeout := fs.Duration("timeout", 5*time.Second, "time to wait for each response")
+	dnssecTrace := fs.Bool("dnssec-trace", false, "validate each answer and print each step: keys fetched, DS matches, signature checks and denial proofs")
+	format := fs.String("format", "", "print each result through this Go template instead, e.g. '{{range .Answers}}{{.Data}}{{\"\\n\"}}{{end}}'")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gdns query [-server addr] [-type A] [-class IN] [-output text|json|csv|yaml | -format template] [-dnssec-trace] name [type]\n")
+		fmt.Fprintf(fs.Output(), "       gdns query [-server addr] [-type A] [-output ...] -file names.txt\n")
+		fmt.Fprintf(fs.Output(), "Templates see the response (.Header, .Questions, .Answers, .Authorities, .Resources)\n")
+		fmt.Fprintf(fs.Output(), "and .Name, .Type, .Server and .Time; the functions join, lower and upper are available.\n")
+		fmt.Fprintf(fs.Output(), "Exit status: 0 success, 1 NXDOMAIN, 2 other error rcode, 3 no response, 4 usage error, 5 output error.\n")
+		fs.PrintDefaults()
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err == flag.ErrHelp {
+		return ExitOK
+	}
+	if err != nil {
+		return ExitUsage
+	}
+	if (*file == "" && (len(positional) < 1 || len(positional) > 2)) || (*file != "" && len(positional) > 0) {
+		fs.Usage()
+		return ExitUsage
+	}
+	defaultType, err := QueryTypeFromString(*qtypeName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+	qclass, err := ClassFromString(*qclassName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+	var lookups []batchLookup
+	if *file != "" {
+		lookups, err = readBatchFile(*file, defaultType)
+	} else {
+		lookups, err = parseBatchLine(strings.Join(positional, " "), defaultType)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+	palette, err := NewPalette(*color, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+	var tmpl *template.Template
+	if *format != "" {
+		if tmpl, err = ParseFormat(*format); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ExitUsage
+		}
+	}
+	if *output != "text" && *output != "json" && *output != "csv" && *output != "yaml" {
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *output)
+		return ExitUsage
+	}
+	if *dnssecTrace && (*output != "text" || tmpl != nil || qclass != CLASS_IN) {
+		fmt.Fprintln(os.Stderr, "-dnssec-trace needs text output and class IN")
+		return ExitUsage
+	}
+
+	client := NewClient()
+	client.Timeout = *timeout
+	var validator *Validator
+	if *dnssecTrace {
+		validator = NewValidator(client, []string{*server})
+		validator.Trace = func(format string, args ...any) {
+			fmt.Println(palette.Comment(";; dnssec: " + fmt.Sprintf(format, args...)))
+		}
+	}
+	var results []*QueryResult
+	status := ExitOK
+	for _, l := range lookups {
+		start := time.Now()
+		var res *DnsPacket
+		var err error
+		if validator != nil {
+			res, err = lookupDNSSEC(client, l.name, l.qtype, *server)
+		} else {
+			res, err = client.LookupClass(l.name, l.qtype, qclass, *server)
+		}
+		result := &QueryResult{DnsPacket: res, Name: l.name, Type: l.qtype, Server: *server, Time: time.Since(start), Err: err}
+		results = append(results, result)
+		status = max(status, lookupStatus(res, err))
+		if *output != "text" {
+			continue
+		}
+
+		// Text and template output is written as results arrive
+		switch {
+		case err != nil:
+			fmt.Fprintln(os.Stderr, err)
+		case tmpl != nil:
+			if err := tmpl.Execute(os.Stdout, result); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return ExitUsage
+			}
+		default:
+			PrintResponse(os.Stdout, res, palette)
+			fmt.Println(palette.Comment(fmt.Sprintf(";; server %s in %d ms", *server, result.Time.Milliseconds())))
+			if validator != nil {
+				security, err := validator.Validate(res)
+				if err != nil {
+					fmt.Println(palette.Comment(fmt.Sprintf(";; dnssec: %s: %v", security, err)))
+				} else {
+					fmt.Println(palette.Comment(fmt.Sprintf(";; dnssec: %s", security)))
+				}
+			}
+		}
+	}
+
+	switch *output {
+	case "json":
+		err = WriteResultsJSON(os.Stdout, results)
+	case "csv":
+		err = WriteResultsCSV(os.Stdout, results)
+	case "yaml":
+		err = WriteResultsYAML(os.Stdout, results)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitOutput
+	}
+	return status
+}
+
+// lookupDNSSEC queries the server for a name's records of the type with their signatures, as a
+// Validator needs them
+func lookupDNSSEC(client *Client, qname string, qtype QueryType, server string) (*DnsPacket, error) {
+	query := NewDNSSECQuery(qname, qtype)
+	res, err := client.Exchange(query, server)
+	if err == nil && res.Header.TruncatedMessage {
+		res, err = client.ExchangeTCP(query, server)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", server, err)
+	}
+	return res, nil
+}
+
+// batchLookup is one name and type to look up
+type batchLookup struct {
+	name  string
+	qtype QueryType
+}
+
+// parseBatchLine parses "name [type]", returning nothing for blank lines and # comments
+func parseBatchLine(line string, defaultType QueryType) ([]batchLookup, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return nil, nil
+	}
+	if len(fields) > 2 {
+		return nil, fmt.Errorf("%q: expected name [type]", line)
+	}
+	l := batchLookup{name: fields[0], qtype: defaultType}
+	if len(fields) == 2 {
+		qtype, err := QueryTypeFromString(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		l.qtype = qtype
+	}
+	return []batchLookup{l}, nil
+}
+
+// readBatchFile reads the lookups of a -file, one "name [type]" per line
+func readBatchFile(path string, defaultType QueryType) ([]batchLookup, error) {
+	f := os.Stdin
+	if path != "-" {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	}
+	var lookups []batchLookup
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		l, err := parseBatchLine(scanner.Text(), defaultType)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		lookups = append(lookups, l...)
+	}
+	return lookups, scanner.Err()
+}
+
+// parseInterspersed parses flags that may appear before, between or after the positional
+// arguments, as in "gdns watch example.com A -interval 30s", and returns the positional ones
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// PrintResponse writes a response in the layout dig uses: the header, question and each non-empty
+// section, with records in zone file presentation format
+func PrintResponse(w io.Writer, res *DnsPacket, palette *Palette) {
+	var flags []string
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{res.Header.Response, "qr"},
+		{res.Header.AuthoritativeAnswer, "aa"},
+		{res.Header.TruncatedMessage, "tc"},
+		{res.Header.RecursionDesired, "rd"},
+		{res.Header.RecursionAvailable, "ra"},
+		{res.Header.AuthedData, "ad"},
+		{res.Header.CheckingDisabled, "cd"},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	fmt.Fprintf(w, ";; status: %s, id: %d, flags: %s\n", palette.Rcode(res.Header.ResCode), res.Header.ID, strings.Join(flags, " "))
+	for _, q := range res.Questions {
+		fmt.Fprintf(w, ";%s.\t%s\t%s\n", palette.Name(q.Name), className(q.Qclass), palette.Type(QueryType(q.Qtype)))
+	}
+
+	sections := []struct {
+		title   string
+		records []*DnsRecord
+	}{
+		{"ANSWER", res.Answers},
+		{"AUTHORITY", res.Authorities},
+		{"ADDITIONAL", res.Resources},
+	}
+	for _, section := range sections {
+		var records []*DnsRecord
+		for _, rec := range section.records {
+			if rec.Qtype != QTYPE_OPT {
+				records = append(records, rec)
+			}
+		}
+		if len(records) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s\n", palette.Comment(";; "+section.title+" SECTION:"))
+		for _, rec := range records {
+			fmt.Fprintln(w, palette.Record(rec))
+		}
+	}
+	fmt.Fprintln(w)
+}
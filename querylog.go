@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How much QueryLogHandler logs
+const (
+	QueryLogNone   = "none"   // Nothing
+	QueryLogErrors = "errors" // Queries answered with an rcode other than NOERROR and NXDOMAIN
+	QueryLogAll    = "all"    // Every query
+)
+
+// How the query log shows client addresses
+const (
+	LogClientsFull     = "full"     // As they are
+	LogClientsHash     = "hash"     // As a keyed hash, stable while the process runs but not reversible
+	LogClientsTruncate = "truncate" // Cut to their /24 or /48 network
+)
+
+// popularityWindow is how long distinct clients are counted per name before the counts start over
+const popularityWindow = time.Hour
+
+// maxPopularityNames bounds the names tracked for the popularity threshold
+const maxPopularityNames = 100000
+
+// ParseQueryLogLevel checks the name of a query log level
+func ParseQueryLogLevel(level string) (string, error) {
+	switch level {
+	case QueryLogNone, QueryLogErrors, QueryLogAll:
+		return level, nil
+	}
+	return "", fmt.Errorf("unknown query log level %q, expected %s, %s or %s", level, QueryLogNone, QueryLogErrors, QueryLogAll)
+}
+
+// ParseLogClientsMode checks the name of a way of showing clients in the query log
+func ParseLogClientsMode(mode string) (string, error) {
+	switch mode {
+	case LogClientsFull, LogClientsHash, LogClientsTruncate:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown log clients mode %q, expected %s, %s or %s", mode, LogClientsFull, LogClientsHash, LogClientsTruncate)
+}
+
+// QueryLogEntry is what the query log records about a query
+type QueryLogEntry struct {
+	Time      time.Time
+	Transport string
+	Client    string // The client address, anonymized as the log's Clients mode says
+	Group     string // The client's group, "-" if none
+	Name      string // The queried name, "-" if it is too rare to be logged
+	Type      string
+	Rcode     string
+	Answers   int
+	Duration  time.Duration
+}
+
+// String formats the entry as a log line
+func (e *QueryLogEntry) String() string {
+	return fmt.Sprintf("query %s %s %s %s %s %s %d answers %s", e.Transport, e.Client, e.Group, e.Name,
+		e.Type, e.Rcode, e.Answers, e.Duration.Round(time.Microsecond))
+}
+
+// QueryLogHandler logs queries and their outcome after Next answers them. For privacy it can hide
+// client addresses, leave out names too few clients ask for, or log only periodic totals.
+type QueryLogHandler struct {
+	Next       Handler
+	Level      string        // QueryLogNone, QueryLogErrors or QueryLogAll; the client's group may override it
+	Clients    string        // LogClientsFull, LogClientsHash or LogClientsTruncate; empty means full
+	MinClients int           // Names asked for by fewer distinct clients within an hour are logged as "-"
+	Aggregate  time.Duration // When set, only totals are logged, this often
+	Shipper    *LogShipper   // When set, entries are shipped to a collector instead of logged
+
+	key        []byte                         // HMAC key for hashed client addresses
+	popularity map[string]map[string]struct{} // Distinct clients per name in the current window
+	windowEnd  time.Time
+	totals     map[string]int // Queries per rcode and per type since the last aggregate
+	mu         sync.Mutex
+}
+
+// NewQueryLogHandler initializes a QueryLogHandler logging at the given level
+func NewQueryLogHandler(next Handler, level string) *QueryLogHandler {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &QueryLogHandler{
+		Next:       next,
+		Level:      level,
+		key:        key,
+		popularity: make(map[string]map[string]struct{}),
+		totals:     make(map[string]int),
+	}
+}
+
+// ServeDNS answers the query through Next and logs it according to the level
+func (h *QueryLogHandler) ServeDNS(req *Request) *DnsPacket {
+	level := h.Level
+	if req.Group != nil && req.Group.LogLevel != "" {
+		level = req.Group.LogLevel
+	}
+	if level == QueryLogNone || level == "" {
+		return h.Next.ServeDNS(req)
+	}
+	start := time.Now()
+	res := h.Next.ServeDNS(req)
+	if res == nil || len(req.Packet.Questions) == 0 {
+		return res
+	}
+	rcode := res.Header.ResCode
+	if level == QueryLogErrors && (rcode == NOERROR || rcode == NXDOMAIN) {
+		return res
+	}
+	q := req.Packet.Questions[0]
+	qtype := QueryType(q.Qtype).String()
+	if h.Aggregate > 0 {
+		h.mu.Lock()
+		h.totals["rcode "+rcode.String()]++
+		h.totals["type "+qtype]++
+		h.mu.Unlock()
+		return res
+	}
+
+	entry := &QueryLogEntry{
+		Time:      start,
+		Transport: req.Transport,
+		Client:    h.client(req.RemoteAddr),
+		Group:     "-",
+		Name:      q.Name,
+		Type:      qtype,
+		Rcode:     rcode.String(),
+		Answers:   len(res.Answers),
+		Duration:  time.Since(start),
+	}
+	if req.Group != nil {
+		entry.Group = req.Group.Name
+	}
+	if h.MinClients > 1 && !h.popular(q.Name, addrIP(req.RemoteAddr), start) {
+		entry.Name = "-"
+	}
+	if h.Shipper != nil {
+		h.Shipper.ShipQuery(entry)
+	} else {
+		log.Print(entry)
+	}
+	return res
+}
+
+// client formats a client address as the Clients mode says
+func (h *QueryLogHandler) client(addr net.Addr) string {
+	ip := addrIP(addr)
+	switch {
+	case ip == nil || h.Clients == "" || h.Clients == LogClientsFull:
+		return fmt.Sprint(addr)
+	case h.Clients == LogClientsHash:
+		mac := hmac.New(sha256.New, h.key)
+		mac.Write(ip.To16())
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// popular records that ip asked for name and reports whether at least MinClients distinct clients
+// have in the current window
+func (h *QueryLogHandler) popular(name string, ip net.IP, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now.After(h.windowEnd) || len(h.popularity) >= maxPopularityNames {
+		h.popularity = make(map[string]map[string]struct{})
+		h.windowEnd = now.Add(popularityWindow)
+	}
+	key := strings.ToLower(strings.TrimSuffix(name, "."))
+	clients := h.popularity[key]
+	if clients == nil {
+		clients = make(map[string]struct{})
+		h.popularity[key] = clients
+	}
+	if len(clients) < h.MinClients {
+		clients[string(ip)] = struct{}{}
+	}
+	return len(clients) >= h.MinClients
+}
+
+// LogAggregates logs the totals collected since the previous call every Aggregate until the process
+// exits
+func (h *QueryLogHandler) LogAggregates() {
+	for range time.Tick(h.Aggregate) {
+		h.mu.Lock()
+		totals := h.totals
+		h.totals = make(map[string]int)
+		h.mu.Unlock()
+
+		keys := make([]string, 0, len(totals))
+		n := 0
+		for key, count := range totals {
+			keys = append(keys, key)
+			if strings.HasPrefix(key, "rcode ") {
+				n += count
+			}
+		}
+		if n == 0 {
+			continue
+		}
+		sort.Strings(keys)
+		parts := []string{fmt.Sprintf("%d queries", n)}
+		for _, key := range keys {
+			parts = append(parts, fmt.Sprintf("%s %d", key, totals[key]))
+		}
+		log.Printf("queries in the last %s: %s", h.Aggregate, strings.Join(parts, ", "))
+	}
+}
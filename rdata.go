@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// RData is the typed data of a record, held in DnsRecord.Data. Every type has its own struct: those
+// below for the classic types, the ones next to their codecs for types such as HINFO and TLSA,
+// Registered for types registered with RegisterType and Unknown for types this package doesn't
+// decode. Code handling records switches on the RData type rather than on DnsRecord.Qtype.
+type RData interface {
+	CustomRdata
+	RRType() QueryType // The record type the data belongs to
+}
+
+// NewRecord builds an IN class record owned by name with the given data
+func NewRecord(name string, ttl uint32, data RData) *DnsRecord {
+	r := &DnsRecord{Name: name, Class: CLASS_IN, TTL: ttl}
+	r.SetRData(data)
+	return r
+}
+
+// SetRData replaces the record's type and data, keeping its owner, class and TTL. Unknown data of a
+// type this package decodes is decoded first; if that fails, it is kept as Unknown.
+func (r *DnsRecord) SetRData(data RData) {
+	if unknown, ok := data.(*Unknown); ok {
+		if decoded, err := decodeRdata(unknown.Qtype, unknown.Data); err == nil {
+			data = decoded
+		}
+	}
+	r.Qtype, r.Data = data.RRType(), data
+}
+
+// decodeRdata parses wire format data of the given type into its struct
+func decodeRdata(qtype QueryType, data []byte) (RData, error) {
+	if len(data) > 0xffff {
+		return nil, fmt.Errorf("%s data of %d bytes", qtype, len(data))
+	}
+	// A record owned by the root, so the reader has a complete record to work on
+	wire := []byte{0, byte(qtype >> 8), byte(qtype), 0, 1, 0, 0, 0, 0, byte(len(data) >> 8), byte(len(data))}
+	rec, err := DnsRecordRead(&BytePacketBuffer{buf: append(wire, data...)})
+	if err != nil {
+		return nil, err
+	}
+	return rec.Data, nil
+}
+
+// packRdata returns a record's data in uncompressed wire format, nothing for records without data
+func packRdata(rec *DnsRecord) ([]byte, error) {
+	if rec.Data == nil {
+		return nil, nil
+	}
+	return rec.Data.Pack()
+}
+
+// A is the data of an IPv4 address record
+type A struct {
+	Addr net.IP
+}
+
+func (d *A) RRType() QueryType { return QTYPE_A }
+func (d *A) String() string    { return d.Addr.String() }
+func (d *A) Pack() ([]byte, error) {
+	addr := d.Addr.To4()
+	if addr == nil {
+		return nil, fmt.Errorf("invalid IPv4 address %v", d.Addr)
+	}
+	return append([]byte(nil), addr...), nil
+}
+
+// AAAA is the data of an IPv6 address record
+type AAAA struct {
+	Addr net.IP
+}
+
+func (d *AAAA) RRType() QueryType { return QTYPE_AAAA }
+func (d *AAAA) String() string    { return d.Addr.String() }
+func (d *AAAA) Pack() ([]byte, error) {
+	addr := d.Addr.To16()
+	if addr == nil {
+		return nil, fmt.Errorf("invalid IPv6 address %v", d.Addr)
+	}
+	return append([]byte(nil), addr...), nil
+}
+
+// NS is the data of a name server record
+type NS struct {
+	Host string
+}
+
+func (d *NS) RRType() QueryType     { return QTYPE_NS }
+func (d *NS) String() string        { return d.Host + "." }
+func (d *NS) Pack() ([]byte, error) { return packNames(d.Host) }
+func (d *NS) canonical() RData      { return &NS{Host: canonicalName(d.Host)} }
+
+// CNAME is the data of an alias record
+type CNAME struct {
+	Target string
+}
+
+func (d *CNAME) RRType() QueryType     { return QTYPE_CNAME }
+func (d *CNAME) String() string        { return d.Target + "." }
+func (d *CNAME) Pack() ([]byte, error) { return packNames(d.Target) }
+func (d *CNAME) canonical() RData      { return &CNAME{Target: canonicalName(d.Target)} }
+
+// PTR is the data of a pointer record
+type PTR struct {
+	Host string
+}
+
+func (d *PTR) RRType() QueryType     { return QTYPE_PTR }
+func (d *PTR) String() string        { return d.Host + "." }
+func (d *PTR) Pack() ([]byte, error) { return packNames(d.Host) }
+func (d *PTR) canonical() RData      { return &PTR{Host: canonicalName(d.Host)} }
+
+// MX is the data of a mail exchange record
+type MX struct {
+	Preference uint16
+	Host       string
+}
+
+func (d *MX) RRType() QueryType { return QTYPE_MX }
+func (d *MX) String() string    { return fmt.Sprintf("%d %s.", d.Preference, d.Host) }
+func (d *MX) canonical() RData  { return &MX{Preference: d.Preference, Host: canonicalName(d.Host)} }
+func (d *MX) Pack() ([]byte, error) {
+	w := &rdataWriter{}
+	w.u16(d.Preference)
+	w.name(d.Host)
+	return w.bytes()
+}
+
+// SRV is the data of a service location record (RFC 2782)
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+func (d *SRV) RRType() QueryType { return QTYPE_SRV }
+func (d *SRV) String() string {
+	return fmt.Sprintf("%d %d %d %s.", d.Priority, d.Weight, d.Port, d.Target)
+}
+func (d *SRV) canonical() RData {
+	c := *d
+	c.Target = canonicalName(d.Target)
+	return &c
+}
+func (d *SRV) Pack() ([]byte, error) {
+	w := &rdataWriter{}
+	w.u16(d.Priority)
+	w.u16(d.Weight)
+	w.u16(d.Port)
+	w.name(d.Target)
+	return w.bytes()
+}
+
+// TXT is the data of a text record, one or more character strings
+type TXT struct {
+	Txt []string
+}
+
+func (d *TXT) RRType() QueryType { return QTYPE_TXT }
+func (d *TXT) String() string {
+	quoted := make([]string, len(d.Txt))
+	for i, text := range d.Txt {
+		quoted[i] = quoteCharString(text)
+	}
+	return strings.Join(quoted, " ")
+}
+func (d *TXT) Pack() ([]byte, error) {
+	w := &rdataWriter{}
+	for _, text := range d.Txt {
+		if len(text) > 255 {
+			return nil, fmt.Errorf("TXT string longer than 255 bytes")
+		}
+		w.charString(text)
+	}
+	return w.bytes()
+}
+
+// SOA is the data of a start of authority record
+type SOA struct {
+	MName   string // Primary name server
+	RName   string // Mailbox of the person responsible, with the @ as a dot
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32 // Negative caching TTL (RFC 2308)
+}
+
+func (d *SOA) RRType() QueryType { return QTYPE_SOA }
+func (d *SOA) String() string {
+	return fmt.Sprintf("%s. %s. %d %d %d %d %d", d.MName, d.RName, d.Serial, d.Refresh, d.Retry, d.Expire, d.Minimum)
+}
+func (d *SOA) canonical() RData {
+	c := *d
+	c.MName, c.RName = canonicalName(d.MName), canonicalName(d.RName)
+	return &c
+}
+func (d *SOA) Pack() ([]byte, error) {
+	w := &rdataWriter{}
+	w.name(d.MName)
+	w.name(d.RName)
+	for _, field := range []uint32{d.Serial, d.Refresh, d.Retry, d.Expire, d.Minimum} {
+		w.u32(field)
+	}
+	return w.bytes()
+}
+
+// RP is the data of a responsible person record (RFC 1183)
+type RP struct {
+	Mbox string // Mailbox of the person responsible, with the @ as a dot
+	Txt  string // Name of TXT records with more about them
+}
+
+func (d *RP) RRType() QueryType { return QTYPE_RP }
+func (d *RP) String() string {
+	return parseNameLoose(d.Mbox).FQDN() + " " + parseNameLoose(d.Txt).FQDN()
+}
+func (d *RP) Pack() ([]byte, error) { return packNames(d.Mbox, d.Txt) }
+func (d *RP) canonical() RData      { return &RP{Mbox: canonicalName(d.Mbox), Txt: canonicalName(d.Txt)} }
+
+// SVCB is the data of a service binding record (RFC 9460)
+type SVCB struct {
+	Priority uint16 // 0 for alias mode
+	Target   string
+	Params   []SVCBParam
+}
+
+func (d *SVCB) RRType() QueryType { return QTYPE_SVCB }
+func (d *SVCB) String() string {
+	parts := []string{strconv.Itoa(int(d.Priority)), parseNameLoose(d.Target).FQDN()}
+	for _, p := range d.Params {
+		parts = append(parts, p.String())
+	}
+	return strings.Join(parts, " ")
+}
+func (d *SVCB) Pack() ([]byte, error) {
+	buffer := NewBytePacketBufferSize(maxMessageSize)
+	if err := d.write(buffer); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), buffer.buf[:buffer.Pos()]...), nil
+}
+
+// write encodes the data into a message buffer, which may compress the target name
+func (d *SVCB) write(buffer *BytePacketBuffer) error {
+	if err := buffer.WriteU16(d.Priority); err != nil {
+		return err
+	}
+	if err := buffer.Write_qname(d.Target); err != nil {
+		return err
+	}
+	return writeSVCBParams(buffer, d.Params)
+}
+
+// HTTPS is the data of a service binding record for HTTPS origins (RFC 9460)
+type HTTPS struct {
+	SVCB
+}
+
+func (d *HTTPS) RRType() QueryType { return QTYPE_HTTPS }
+
+// OPT is the data of the EDNS pseudo-record: its options in wire format, as ParseEDNSOptions reads
+// them (RFC 6891)
+type OPT struct {
+	Options []byte
+}
+
+func (d *OPT) RRType() QueryType     { return QTYPE_OPT }
+func (d *OPT) Pack() ([]byte, error) { return d.Options, nil }
+func (d *OPT) String() string        { return fmt.Sprintf("\\# %d %x", len(d.Options), d.Options) }
+
+// Registered is the data of a record whose type was registered with RegisterType, as its codec
+// decoded it
+type Registered struct {
+	Qtype QueryType
+	Data  CustomRdata
+}
+
+func (d *Registered) RRType() QueryType     { return d.Qtype }
+func (d *Registered) Pack() ([]byte, error) { return d.Data.Pack() }
+func (d *Registered) String() string        { return d.Data.String() }
+
+// Unknown is the data of a record of a type this package doesn't decode, kept as is (RFC 3597)
+type Unknown struct {
+	Qtype QueryType
+	Data  []byte
+}
+
+func (d *Unknown) RRType() QueryType     { return d.Qtype }
+func (d *Unknown) Pack() ([]byte, error) { return d.Data, nil }
+func (d *Unknown) String() string        { return fmt.Sprintf("\\# %d %x", len(d.Data), d.Data) }
+
+// packNames encodes domain names one after the other without compression
+func packNames(names ...string) ([]byte, error) {
+	w := &rdataWriter{}
+	for _, name := range names {
+		w.name(name)
+	}
+	return w.bytes()
+}
+
+// canonicalName lowercases a name embedded in record data
+func canonicalName(name string) string {
+	return parseNameLoose(name).Canonical().String()
+}
+
+// targetName returns the host name the data of an NS, CNAME, PTR, MX, SRV, SVCB or HTTPS record
+// points to, and false for other data
+func targetName(data RData) (string, bool) {
+	switch d := data.(type) {
+	case *NS:
+		return d.Host, true
+	case *CNAME:
+		return d.Target, true
+	case *PTR:
+		return d.Host, true
+	case *MX:
+		return d.Host, true
+	case *SRV:
+		return d.Target, true
+	case *SVCB:
+		return d.Target, true
+	case *HTTPS:
+		return d.Target, true
+	}
+	return "", false
+}
+
+// addrOf returns the address of an A or AAAA record, or nil for other data
+func addrOf(data RData) net.IP {
+	switch d := data.(type) {
+	case *A:
+		return d.Addr
+	case *AAAA:
+		return d.Addr
+	}
+	return nil
+}
+
+// addrRdata returns the data of an A record for an IPv4 address and of an AAAA record otherwise
+func addrRdata(ip net.IP) RData {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &A{Addr: ip4}
+	}
+	return &AAAA{Addr: ip}
+}
+
+// serialOf returns the serial of SOA data, 0 for other data
+func serialOf(data RData) uint32 {
+	if soa, ok := data.(*SOA); ok {
+		return soa.Serial
+	}
+	return 0
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RedisCache is a Cache kept in Redis so several servers share cached answers. Values are stored as
+// wire-format messages with the TTL mapped onto a Redis key expiry.
+type RedisCache struct {
+	Addr     string        // Redis server address
+	Password string        // Password sent with AUTH, if any
+	DB       int           // Database selected on connect
+	Prefix   string        // Prefix added to every key
+	Timeout  time.Duration // Time allowed for each command
+
+	idle chan *redisConn
+}
+
+// redisConn is a connection speaking RESP
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewRedisCache initializes a RedisCache talking to the server at addr
+func NewRedisCache(addr string) *RedisCache {
+	return &RedisCache{
+		Addr:    addr,
+		Prefix:  "gdns:",
+		Timeout: time.Second,
+		idle:    make(chan *redisConn, 16),
+	}
+}
+
+// Get fetches the value and its remaining time to live; errors are logged and treated as misses
+func (c *RedisCache) Get(key string) ([]byte, time.Duration, bool) {
+	replies, err := c.do([]string{"GET", c.Prefix + key}, []string{"PTTL", c.Prefix + key})
+	if err != nil {
+		log.Printf("redis get: %v", err)
+		return nil, 0, false
+	}
+	value, ok := replies[0].([]byte)
+	ttl, _ := replies[1].(int64)
+	if !ok || ttl <= 0 {
+		return nil, 0, false
+	}
+	return value, time.Duration(ttl) * time.Millisecond, true
+}
+
+// Set stores the value with a Redis expiry of ttl
+func (c *RedisCache) Set(key string, value []byte, ttl time.Duration) {
+	if ttl < time.Millisecond {
+		return
+	}
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	if _, err := c.do([]string{"SET", c.Prefix + key, string(value), "PX", ms}); err != nil {
+		log.Printf("redis set: %v", err)
+	}
+}
+
+// Delete removes the key
+func (c *RedisCache) Delete(key string) {
+	if _, err := c.do([]string{"DEL", c.Prefix + key}); err != nil {
+		log.Printf("redis del: %v", err)
+	}
+}
+
+// do pipelines the commands on a pooled connection and returns one reply per command
+func (c *RedisCache) do(commands ...[]string) ([]interface{}, error) {
+	rc, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	rc.conn.SetDeadline(time.Now().Add(c.Timeout))
+
+	var buf []byte
+	for _, args := range commands {
+		buf = appendRESPCommand(buf, args)
+	}
+	if _, err := rc.conn.Write(buf); err != nil {
+		rc.conn.Close()
+		return nil, err
+	}
+	replies := make([]interface{}, len(commands))
+	var replyErr error
+	for i := range commands {
+		reply, err := readRESP(rc.r)
+		var re redisError
+		switch {
+		case errors.As(err, &re):
+			replyErr = err
+		case err != nil:
+			rc.conn.Close()
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	c.put(rc)
+	return replies, replyErr
+}
+
+// get returns an idle connection or dials a new one, authenticating and selecting the database
+func (c *RedisCache) get() (*redisConn, error) {
+	select {
+	case rc := <-c.idle:
+		return rc, nil
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", c.Addr, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	var setup [][]string
+	if c.Password != "" {
+		setup = append(setup, []string{"AUTH", c.Password})
+	}
+	if c.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.DB)})
+	}
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+	for _, args := range setup {
+		if _, err := conn.Write(appendRESPCommand(nil, args)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if _, err := readRESP(rc.r); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: %w", args[0], err)
+		}
+	}
+	return rc, nil
+}
+
+// put returns a healthy connection to the pool, closing it if the pool is full
+func (c *RedisCache) put(rc *redisConn) {
+	select {
+	case c.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+}
+
+// redisError is an error reply sent by the server
+type redisError string
+
+// Error implements the error interface
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// appendRESPCommand encodes a command as a RESP array of bulk strings
+func appendRESPCommand(buf []byte, args []string) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// readRESP reads one reply: a string, []byte, int64, nil, redisError or []interface{}
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
@@ -0,0 +1,20 @@
+//go:build linux && !(mips || mipsle || mips64 || mips64le)
+
+package main
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT from <asm-generic/socket.h>, missing from package syscall on Linux
+const soReusePort = 0xf
+
+// reusePortControl sets SO_REUSEPORT on a socket before it is bound
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
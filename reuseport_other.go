@@ -0,0 +1,14 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// reusePortControl fails because SO_REUSEPORT load balancing isn't supported on this platform
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("SO_REUSEPORT is not supported on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
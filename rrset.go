@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// RRSet is a group of records sharing owner name, type and class. RRSIG records also share the type
+// they cover, since signatures over different RRsets are separate sets (RFC 4034 section 3)
+type RRSet struct {
+	Name    string       // Owner name of every record in the set
+	Qtype   QueryType    // Record type of every record in the set
+	Class   Class        // Record class of every record in the set
+	Covered QueryType    // Type covered by every signature in an RRSIG set, 0 for other types
+	TTL     uint32       // Lowest TTL of the records in the set
+	Records []*DnsRecord // Member records without duplicates
+	rdata   [][]byte     // Canonical RDATA of each record, parallel to Records
+}
+
+// NewRRSet initializes an empty RRSet matching the given record
+func NewRRSet(rec *DnsRecord) *RRSet {
+	return &RRSet{
+		Name:    rec.Name,
+		Qtype:   rec.Qtype,
+		Class:   rec.Class,
+		Covered: coveredType(rec),
+		TTL:     rec.TTL,
+	}
+}
+
+// coveredType returns the type an RRSIG record covers, 0 for other records
+func coveredType(rec *DnsRecord) QueryType {
+	if sig := rec.RRSIG(); sig != nil {
+		return sig.TypeCovered
+	}
+	return 0
+}
+
+// Matches reports whether the record belongs in this RRset
+func (s *RRSet) Matches(rec *DnsRecord) bool {
+	return rec.Qtype == s.Qtype && rec.Class == s.Class && coveredType(rec) == s.Covered &&
+		parseNameLoose(rec.Name).Equal(parseNameLoose(s.Name))
+}
+
+// Add inserts a record, returning false if an identical record is already present
+func (s *RRSet) Add(rec *DnsRecord) (bool, error) {
+	if !s.Matches(rec) {
+		return false, fmt.Errorf("%s %s does not belong to RRset %s %s", rec.Name, rec.Qtype, s.Name, s.Qtype)
+	}
+	rdata, err := CanonicalRdata(rec)
+	if err != nil {
+		return false, err
+	}
+	for _, existing := range s.rdata {
+		if bytes.Equal(existing, rdata) {
+			return false, nil
+		}
+	}
+	if len(s.Records) == 0 || rec.TTL < s.TTL {
+		s.TTL = rec.TTL
+	}
+	s.Records = append(s.Records, rec)
+	s.rdata = append(s.rdata, rdata)
+	return true, nil
+}
+
+// Len returns the number of records in the set
+func (s *RRSet) Len() int {
+	return len(s.Records)
+}
+
+// Sort orders the records canonically, treating RDATA as left-justified octet strings (RFC 4034 section 6.3)
+func (s *RRSet) Sort() {
+	sort.Sort(canonicalOrder{s})
+}
+
+// canonicalOrder sorts an RRset's records and their RDATA together
+type canonicalOrder struct{ s *RRSet }
+
+func (o canonicalOrder) Len() int { return len(o.s.Records) }
+func (o canonicalOrder) Less(i, j int) bool {
+	return bytes.Compare(o.s.rdata[i], o.s.rdata[j]) < 0
+}
+func (o canonicalOrder) Swap(i, j int) {
+	o.s.Records[i], o.s.Records[j] = o.s.Records[j], o.s.Records[i]
+	o.s.rdata[i], o.s.rdata[j] = o.s.rdata[j], o.s.rdata[i]
+}
+
+// GroupRRSets groups records into RRsets in order of first appearance, dropping duplicates
+func GroupRRSets(records []*DnsRecord) ([]*RRSet, error) {
+	var sets []*RRSet
+	index := make(map[rrsetKey][]*RRSet)
+	for _, rec := range records {
+		key := rrsetKey{Name: parseNameLoose(rec.Name).Key(), Qtype: rec.Qtype}
+		var set *RRSet
+		for _, candidate := range index[key] {
+			if candidate.Class == rec.Class && candidate.Covered == coveredType(rec) {
+				set = candidate
+			}
+		}
+		if set == nil {
+			set = NewRRSet(rec)
+			sets = append(sets, set)
+			index[key] = append(index[key], set)
+		}
+		if _, err := set.Add(rec); err != nil {
+			return nil, err
+		}
+	}
+	return sets, nil
+}
+
+// MergeRRSets drops duplicate records and lowers the TTL of every record to the lowest in its
+// RRset, so a set isn't cached for longer than its shortest-lived copy. Signatures are grouped by
+// the type they cover, so an RRSIG keeps the TTL of the RRset it signs. The records stay in their
+// order; those whose TTL changes are copied. OPT records are left alone.
+func MergeRRSets(records []*DnsRecord) ([]*DnsRecord, error) {
+	var data []*DnsRecord
+	for _, rec := range records {
+		if rec.Qtype != QTYPE_OPT {
+			data = append(data, rec)
+		}
+	}
+	sets, err := GroupRRSets(data)
+	if err != nil {
+		return nil, err
+	}
+	kept := make(map[*DnsRecord]*RRSet, len(data))
+	for _, set := range sets {
+		for _, rec := range set.Records {
+			kept[rec] = set
+		}
+	}
+	merged := make([]*DnsRecord, 0, len(records))
+	for _, rec := range records {
+		if rec.Qtype == QTYPE_OPT {
+			merged = append(merged, rec)
+			continue
+		}
+		set, ok := kept[rec]
+		if !ok {
+			continue
+		}
+		delete(kept, rec) // The same record twice is a duplicate too
+		if rec.TTL != set.TTL {
+			copied := *rec
+			copied.TTL = set.TTL
+			rec = &copied
+		}
+		merged = append(merged, rec)
+	}
+	return merged, nil
+}
+
+// MergeRRSets applies MergeRRSets to each section of the packet, leaving sections it can't group
+// as they are
+func (p *DnsPacket) MergeRRSets() {
+	for _, section := range []*[]*DnsRecord{&p.Answers, &p.Authorities, &p.Resources} {
+		if merged, err := MergeRRSets(*section); err == nil {
+			*section = merged
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// TestMergeRRSetsSignatures checks that signatures over different RRsets at one name keep the TTLs
+// of the sets they cover rather than sharing the lowest
+func TestMergeRRSetsSignatures(t *testing.T) {
+	sig := func(ttl uint32, covered QueryType, keyTag uint16) *DnsRecord {
+		return NewRecord("example.com", ttl, &RRSIG{TypeCovered: covered, Algorithm: 13, Labels: 2,
+			OriginalTTL: ttl, KeyTag: keyTag, SignerName: "example.com", Signature: []byte{1, 2, 3}})
+	}
+	records := []*DnsRecord{
+		NewRecord("example.com", 3600, &A{Addr: net.IPv4(192, 0, 2, 1)}),
+		sig(3600, QTYPE_A, 1),
+		NewRecord("example.com", 300, &MX{Preference: 10, Host: "mail.example.com"}),
+		sig(300, QTYPE_MX, 1),
+		sig(600, QTYPE_A, 2),  // A second signature over the A RRset lowers its first
+		sig(300, QTYPE_MX, 1), // A duplicate
+	}
+	merged, err := MergeRRSets(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		qtype QueryType
+		ttl   uint32
+	}{
+		{QTYPE_A, 3600},
+		{QTYPE_RRSIG, 600},
+		{QTYPE_MX, 300},
+		{QTYPE_RRSIG, 300},
+		{QTYPE_RRSIG, 600},
+	}
+	if len(merged) != len(want) {
+		t.Fatalf("got %d records, want %d", len(merged), len(want))
+	}
+	for i, rec := range merged {
+		if rec.Qtype != want[i].qtype || rec.TTL != want[i].ttl {
+			t.Errorf("record %d: got %s TTL %d, want %s TTL %d", i, rec.Qtype, rec.TTL, want[i].qtype, want[i].ttl)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Range of record types reserved for private use (RFC 6895 section 3.1)
+const (
+	QTYPE_PRIVATE_FIRST QueryType = 65280
+	QTYPE_PRIVATE_LAST  QueryType = 65534
+)
+
+// CustomRdata is the decoded data of a record whose type was registered with RegisterType
+type CustomRdata interface {
+	Pack() ([]byte, error) // Encodes the data in wire format
+	String() string        // Formats the data in presentation format
+}
+
+// RdataCodec holds the functions handling one registered record type
+type RdataCodec struct {
+	Name   string                                     // Mnemonic used in presentation format
+	Decode func(data []byte) (CustomRdata, error)     // Parses wire format RDATA
+	Parse  func(fields []string) (CustomRdata, error) // Parses presentation format RDATA; optional
+}
+
+// customTypes holds the registered private-use record types
+var customTypes = struct {
+	sync.RWMutex
+	codecs map[QueryType]*RdataCodec
+}{codecs: make(map[QueryType]*RdataCodec)}
+
+// RegisterType installs the codec for a private-use record type so records of that type are
+// decoded, encoded, printed and parsed from zone files with it
+func RegisterType(qtype QueryType, codec RdataCodec) error {
+	if qtype < QTYPE_PRIVATE_FIRST || qtype > QTYPE_PRIVATE_LAST {
+		return fmt.Errorf("type %d is outside the private use range %d-%d", qtype, QTYPE_PRIVATE_FIRST, QTYPE_PRIVATE_LAST)
+	}
+	if codec.Decode == nil {
+		return fmt.Errorf("type %d: codec has no Decode function", qtype)
+	}
+	codec.Name = strings.ToUpper(codec.Name)
+	if codec.Name == "" || strings.HasPrefix(codec.Name, "TYPE") {
+		return fmt.Errorf("type %d: invalid mnemonic %q", qtype, codec.Name)
+	}
+
+	customTypes.Lock()
+	defer customTypes.Unlock()
+	if _, exists := customTypes.codecs[qtype]; exists {
+		return fmt.Errorf("type %d is already registered", qtype)
+	}
+	for other, existing := range customTypes.codecs {
+		if existing.Name == codec.Name {
+			return fmt.Errorf("mnemonic %s is already registered for type %d", codec.Name, other)
+		}
+	}
+	for _, name := range queryTypeNames {
+		if name == codec.Name {
+			return fmt.Errorf("mnemonic %s is already used by a standard type", codec.Name)
+		}
+	}
+	customTypes.codecs[qtype] = &codec
+	return nil
+}
+
+// customCodec returns the codec registered for the type, or nil
+func customCodec(qtype QueryType) *RdataCodec {
+	customTypes.RLock()
+	defer customTypes.RUnlock()
+	return customTypes.codecs[qtype]
+}
+
+// customTypeByName returns the registered type with the given mnemonic
+func customTypeByName(name string) (QueryType, bool) {
+	customTypes.RLock()
+	defer customTypes.RUnlock()
+	for qtype, codec := range customTypes.codecs {
+		if codec.Name == name {
+			return qtype, true
+		}
+	}
+	return 0, false
+}
+
+// standardType handles a standard record type whose data is encoded by its RData struct
+type standardType struct {
+	decode func(data []byte) (RData, error)
+	parse  func(fields, names []string) (RData, error) // names holds each field read as an absolute domain name
+}
+
+// standardTypes lists the standard types whose data has a codec of its own rather than a case in
+// the record reader
+var standardTypes = map[QueryType]standardType{
+	QTYPE_DNSKEY:     {decodeDNSKEY, parseDNSKEY},
+	QTYPE_DS:         {decodeDS, parseDS},
+	QTYPE_HINFO:      {decodeHINFO, parseHINFO},
+	QTYPE_LOC:        {decodeLOC, parseLOC},
+	QTYPE_NAPTR:      {decodeNAPTR, parseNAPTR},
+	QTYPE_NSEC:       {decodeNSEC, parseNSEC},
+	QTYPE_NSEC3:      {decodeNSEC3, parseNSEC3},
+	QTYPE_OPENPGPKEY: {decodeOPENPGPKEY, parseOPENPGPKEY},
+	QTYPE_RRSIG:      {decodeRRSIG, parseRRSIG},
+	QTYPE_SSHFP:      {decodeSSHFP, parseSSHFP},
+	QTYPE_TLSA:       {decodeTLSA, parseTLSA},
+	QTYPE_URI:        {decodeURI, parseURI},
+}
+
+// rdataReader decodes the fields of wire format RDATA in order
+type rdataReader struct {
+	data []byte
+	err  error
+}
+
+// take returns the next n bytes, recording an error if the data is too short
+func (r *rdataReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data) {
+		r.err = fmt.Errorf("record data truncated")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *rdataReader) u8() uint8 {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *rdataReader) u16() uint16 {
+	if b := r.take(2); b != nil {
+		return uint16(b[0])<<8 | uint16(b[1])
+	}
+	return 0
+}
+
+func (r *rdataReader) u32() uint32 {
+	if b := r.take(4); b != nil {
+		return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	}
+	return 0
+}
+
+// charString reads a length-prefixed character string
+func (r *rdataReader) charString() string {
+	return string(r.take(int(r.u8())))
+}
+
+// name reads an uncompressed domain name, as used in the data of all but the oldest types
+func (r *rdataReader) name() string {
+	var labels []string
+	for r.err == nil {
+		n := int(r.u8())
+		if n == 0 {
+			break
+		}
+		if n > 63 {
+			r.err = fmt.Errorf("compressed or invalid name in record data")
+			break
+		}
+		labels = append(labels, string(r.take(n)))
+	}
+	if r.err != nil {
+		return ""
+	}
+	name, err := NameFromLabels(labels...)
+	if err != nil {
+		r.err = err
+	}
+	return name.String()
+}
+
+// rest returns the remaining data
+func (r *rdataReader) rest() []byte {
+	return r.take(len(r.data))
+}
+
+// done returns the first decoding error, or an error if data is left over
+func (r *rdataReader) done() error {
+	if r.err == nil && len(r.data) > 0 {
+		return fmt.Errorf("%d trailing bytes in record data", len(r.data))
+	}
+	return r.err
+}
+
+// rdataWriter encodes wire format RDATA
+type rdataWriter struct {
+	buf []byte
+	err error
+}
+
+func (w *rdataWriter) u8(v uint8) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *rdataWriter) u16(v uint16) {
+	w.buf = append(w.buf, byte(v>>8), byte(v))
+}
+
+func (w *rdataWriter) u32(v uint32) {
+	w.buf = append(w.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// charString writes a length-prefixed character string
+func (w *rdataWriter) charString(s string) {
+	if len(s) > 255 {
+		w.err = fmt.Errorf("character string longer than 255 bytes")
+		return
+	}
+	w.buf = append(append(w.buf, byte(len(s))), s...)
+}
+
+// name writes a domain name without compression
+func (w *rdataWriter) name(s string) {
+	name, err := ParseName(s)
+	if err != nil {
+		w.err = err
+		return
+	}
+	w.buf = append(w.buf, name.Wire()...)
+}
+
+// bytes returns the encoded data or the first error
+func (w *rdataWriter) bytes() ([]byte, error) {
+	return w.buf, w.err
+}
@@ -0,0 +1,111 @@
+package main
+
+import "fmt"
+
+// Levels of safe search enforcement, set with SafeSearchHandler.Mode. They only differ for YouTube,
+// which offers a moderate restriction besides the strict one.
+const (
+	SafeSearchStrict   = "strict"
+	SafeSearchModerate = "moderate"
+)
+
+// safeSearchTTL is the TTL of synthesized safe search CNAME records
+const safeSearchTTL = 300
+
+// ParseSafeSearchMode checks the name of a safe search level
+func ParseSafeSearchMode(mode string) (string, error) {
+	switch mode {
+	case SafeSearchStrict, SafeSearchModerate:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown safe search mode %q, expected %s or %s", mode, SafeSearchStrict, SafeSearchModerate)
+}
+
+// safeSearchHosts maps search engine host names to the names that force safe search on them
+var safeSearchHosts = map[string]string{
+	"www.bing.com":             "strict.bing.com",
+	"duckduckgo.com":           "safe.duckduckgo.com",
+	"www.duckduckgo.com":       "safe.duckduckgo.com",
+	"www.youtube.com":          "restrict.youtube.com",
+	"m.youtube.com":            "restrict.youtube.com",
+	"youtubei.googleapis.com":  "restrict.youtube.com",
+	"youtube.googleapis.com":   "restrict.youtube.com",
+	"www.youtube-nocookie.com": "restrict.youtube.com",
+}
+
+// SafeSearchHandler answers queries for search engines with a CNAME to the host that enforces safe
+// search there, followed by the records of that host as Next resolves them, so clients can't turn
+// filtering off in their browser. Other queries are passed on to Next.
+type SafeSearchHandler struct {
+	Next Handler
+	Mode string // SafeSearchStrict or SafeSearchModerate; empty means SafeSearchStrict
+}
+
+// ServeDNS rewrites queries for search engines to their safe search hosts
+func (h *SafeSearchHandler) ServeDNS(req *Request) *DnsPacket {
+	query := req.Packet
+	if len(query.Questions) != 1 {
+		return h.Next.ServeDNS(req)
+	}
+	q := query.Questions[0]
+	target := h.safeHost(q.Name)
+	if target == "" {
+		return h.Next.ServeDNS(req)
+	}
+
+	res := NewResponse(query)
+	res.Header.RecursionAvailable = true
+	res.Answers = []*DnsRecord{{Name: q.Name, Qtype: QTYPE_CNAME, Class: q.Qclass, TTL: safeSearchTTL, Data: &CNAME{Target: target}}}
+	if QueryType(q.Qtype) == QTYPE_CNAME {
+		return res
+	}
+	sub := NewDnsPacket()
+	sub.Header.RecursionDesired = true
+	sub.Questions = []*DnsQuestion{{Name: target, Qtype: q.Qtype, Qclass: q.Qclass}}
+	if opt := query.OPT(); opt != nil {
+		sub.Resources = append(sub.Resources, opt)
+	}
+	subReq := *req
+	subReq.Packet = sub
+	answer := h.Next.ServeDNS(&subReq)
+	if answer == nil {
+		return NewErrorResponse(query, SERVFAIL)
+	}
+	res.Header.ResCode = answer.Header.ResCode
+	res.Answers = append(res.Answers, answer.Answers...)
+	res.Authorities = answer.Authorities
+	return res
+}
+
+// safeHost returns the safe search host for a queried name, or "" if it isn't a search engine
+func (h *SafeSearchHandler) safeHost(qname string) string {
+	name, err := ParseName(qname)
+	if err != nil {
+		return ""
+	}
+	host := lowerASCII(name.String())
+	target := safeSearchHosts[host]
+	if target == "" && isGoogleHost(name.Labels()) {
+		target = "forcesafesearch.google.com"
+	}
+	if target == "restrict.youtube.com" && h.Mode == SafeSearchModerate {
+		target = "restrictmoderate.youtube.com"
+	}
+	return target
+}
+
+// isGoogleHost reports whether labels spell the Google search host of a country, like google.com,
+// www.google.de or www.google.co.uk
+func isGoogleHost(labels []string) bool {
+	if len(labels) > 0 && equalFoldASCII(labels[0], "www") {
+		labels = labels[1:]
+	}
+	switch len(labels) {
+	case 2:
+		return equalFoldASCII(labels[0], "google")
+	case 3:
+		second := lowerASCII(labels[1])
+		return equalFoldASCII(labels[0], "google") && (second == "co" || second == "com") && len(labels[2]) == 2
+	}
+	return false
+}
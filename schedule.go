@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// weekdayNames are the day abbreviations schedules are written with
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// TimeWindow is a daily span of wall clock time on some days of the week, in a time zone. Windows
+// ending before they start run past midnight into the next day.
+type TimeWindow struct {
+	Days     [7]bool       // Days the window opens on, indexed by time.Weekday
+	Start    time.Duration // Offset from midnight the window opens at
+	End      time.Duration // Offset from midnight the window closes at
+	Location *time.Location
+}
+
+// Contains reports whether t falls inside the window
+func (w *TimeWindow) Contains(t time.Time) bool {
+	t = t.In(w.Location)
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	day := t.Weekday()
+	if w.Start <= w.End {
+		return w.Days[day] && offset >= w.Start && offset < w.End
+	}
+	// Overnight: the evening part belongs to today, the morning part to the day before
+	return (w.Days[day] && offset >= w.Start) || (w.Days[(day+6)%7] && offset < w.End)
+}
+
+// Schedule is a set of time windows; it is active while any of them is
+type Schedule struct {
+	Windows []*TimeWindow
+}
+
+// Active reports whether t falls inside one of the schedule's windows
+func (s *Schedule) Active(t time.Time) bool {
+	for _, w := range s.Windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTimeWindow parses the fields of a window: days, a span of 24 hour times and an optional IANA
+// time zone, local time otherwise. Days are "*", a day or a range like "mon-fri", or a
+// comma-separated list of those, e.g. "mon-fri 09:00-17:00 Europe/Berlin" or "sat,sun 22:00-07:00".
+func ParseTimeWindow(fields []string) (*TimeWindow, error) {
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, fmt.Errorf("expected days, times and an optional time zone")
+	}
+	w := &TimeWindow{Location: time.Local}
+	if err := parseWeekdays(fields[0], &w.Days); err != nil {
+		return nil, err
+	}
+	start, end, ok := strings.Cut(fields[1], "-")
+	var err1, err2 error
+	w.Start, err1 = parseClock(start)
+	w.End, err2 = parseClock(end)
+	if !ok || err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("invalid times %q, expected hh:mm-hh:mm", fields[1])
+	}
+	if len(fields) == 3 {
+		location, err := time.LoadLocation(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("time zone %s: %v", fields[2], err)
+		}
+		w.Location = location
+	}
+	return w, nil
+}
+
+// parseWeekdays sets the days named by a list of days and day ranges
+func parseWeekdays(list string, days *[7]bool) error {
+	for _, item := range strings.Split(strings.ToLower(list), ",") {
+		if item == "*" {
+			*days = [7]bool{true, true, true, true, true, true, true}
+			continue
+		}
+		from, to, isRange := strings.Cut(item, "-")
+		first, last := weekdayIndex(from), weekdayIndex(to)
+		if !isRange {
+			last = first
+		}
+		if first < 0 || last < 0 {
+			return fmt.Errorf("invalid days %q, expected e.g. mon-fri or sat,sun", list)
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// weekdayIndex returns the time.Weekday of a day abbreviation, or -1
+func weekdayIndex(name string) int {
+	for i, day := range weekdayNames {
+		if name == day {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseClock parses a 24 hour hh:mm time into an offset from midnight; 24:00 ends a day
+func parseClock(s string) (time.Duration, error) {
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Request is a query travelling through the server's handler chain
+type Request struct {
+	Packet     *DnsPacket           // The parsed query
+	RemoteAddr net.Addr             // The client that sent the query
+	Transport  string               // "udp", "tcp", "tls" or "https"
+	TLS        *tls.ConnectionState // Connection details for encrypted transports, nil otherwise
+	Span       *Span                // Trace span of the request, nil unless it is being traced
+	Group      *ClientGroup         // Group the client belongs to, nil if none
+	Blocked    bool                 // Set once a blocklist or policy rule refused or blocked the query
+	Allowed    bool                 // Set when an allowlist exempts the query from blocking
+}
+
+// Handler answers DNS queries
+type Handler interface {
+	ServeDNS(req *Request) *DnsPacket
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface
+type HandlerFunc func(req *Request) *DnsPacket
+
+// ServeDNS calls f(req)
+func (f HandlerFunc) ServeDNS(req *Request) *DnsPacket {
+	return f(req)
+}
+
+// NewResponse builds an empty response to a query, echoing its ID, flags and questions
+func NewResponse(query *DnsPacket) *DnsPacket {
+	res := NewDnsPacket()
+	res.Header.ID = query.Header.ID
+	res.Header.Opcode = query.Header.Opcode
+	res.Header.RecursionDesired = query.Header.RecursionDesired
+	res.Header.CheckingDisabled = query.Header.CheckingDisabled
+	res.Header.Response = true
+	res.Questions = query.Questions
+	return res
+}
+
+// NewErrorResponse builds a response to a query carrying only a result code
+func NewErrorResponse(query *DnsPacket, rcode ResultCode) *DnsPacket {
+	res := NewResponse(query)
+	res.Header.ResCode = rcode
+	return res
+}
+
+// Ways of answering standard queries with more than one question, set with Server.MultiQuestion
+const (
+	MultiQuestionFormErr = "formerr" // Answer FORMERR, echoing every question (RFC 9619)
+	MultiQuestionFirst   = "first"   // Answer the first question alone, as if the others weren't there
+)
+
+// Server listens for DNS queries over UDP and TCP and answers them with its Handler
+type Server struct {
+	Addr           string        // Address to listen on, ":53" if empty
+	Handler        Handler       // Handler invoked for every query
+	BatchSize      int           // Datagrams read or written per system call where supported
+	UDPSockets     int           // UDP sockets sharing Addr through SO_REUSEPORT, each with its own reader; 0 opens one
+	UDPSize        uint16        // Largest UDP response sent to EDNS clients; bigger ones are truncated to force TCP
+	TLSAddr        string        // Address for DNS over TLS, disabled if empty
+	HTTPSAddr      string        // Address for DNS over HTTPS, disabled if empty
+	TLSConfig      *tls.Config   // Certificates and client authentication for the encrypted listeners
+	TCPTimeout     time.Duration // Idle time after which TCP connections are closed
+	Strict         StrictCheck   // Checks a query must pass or be answered FORMERR; 0 accepts anything that decodes
+	Tracer         *Tracer       // Exports a span for each query and the work done for it, nil to disable tracing
+	TrustedProxies []*net.IPNet  // Reverse proxies whose Forwarded and X-Forwarded-For headers identify DoH clients
+	MultiQuestion  string        // How standard queries with several questions are answered: MultiQuestionFormErr (the default) or MultiQuestionFirst
+	Chaos          *Chaos        // Faults injected into responses over UDP and TCP, nil for none
+	ClientAnswers  bool          // Answers depend on who asks, through groups, ACLs, policies or GeoIP, so HTTP caches mustn't share them
+	udpListeners   []*net.UDPConn
+	tcpListeners   []net.Listener
+	mu             sync.Mutex
+}
+
+// maxUDPQuerySize bounds the size of datagrams the server reads
+const maxUDPQuerySize = 4096
+
+// NewServer initializes a Server answering queries on addr with handler
+func NewServer(addr string, handler Handler) *Server {
+	return &Server{
+		Addr:       addr,
+		Handler:    handler,
+		BatchSize:  64,
+		UDPSize:    DefaultEDNSSize,
+		TCPTimeout: 10 * time.Second,
+	}
+}
+
+// ListenAndServe opens UDP and TCP listeners on the server address and serves until one fails
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":53"
+	}
+	if (s.TLSAddr != "" || s.HTTPSAddr != "") && s.TLSConfig == nil {
+		return errors.New("encrypted listeners need a TLS configuration")
+	}
+	udp, err := s.listenUDP(addr)
+	if err != nil {
+		return err
+	}
+	var streams []net.Listener
+	closeAll := func() {
+		for _, conn := range udp {
+			conn.Close()
+		}
+		for _, l := range streams {
+			l.Close()
+		}
+	}
+	tcp, err := net.Listen("tcp", udp[0].LocalAddr().String())
+	if err != nil {
+		closeAll()
+		return err
+	}
+	streams = append(streams, tcp)
+	var tlsListener, httpsListener net.Listener
+	if s.TLSAddr != "" {
+		if tlsListener, err = tls.Listen("tcp", s.TLSAddr, s.TLSConfig); err != nil {
+			closeAll()
+			return err
+		}
+		streams = append(streams, tlsListener)
+	}
+	if s.HTTPSAddr != "" {
+		if httpsListener, err = tls.Listen("tcp", s.HTTPSAddr, s.httpsConfig()); err != nil {
+			closeAll()
+			return err
+		}
+		streams = append(streams, httpsListener)
+	}
+
+	errs := make(chan error, len(udp)+len(streams))
+	for _, conn := range udp {
+		go func(conn *net.UDPConn) { errs <- s.ServeUDP(conn) }(conn)
+	}
+	go func() { errs <- s.ServeTCP(tcp) }()
+	if tlsListener != nil {
+		go func() { errs <- s.ServeTCP(tlsListener) }()
+	}
+	if httpsListener != nil {
+		go func() { errs <- s.ServeHTTPS(httpsListener) }()
+	}
+	return <-errs
+}
+
+// listenUDP opens the server's UDP sockets on addr, binding them with SO_REUSEPORT when more than one is wanted
+func (s *Server) listenUDP(addr string) ([]*net.UDPConn, error) {
+	if s.UDPSockets <= 1 {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return nil, err
+		}
+		return []*net.UDPConn{conn}, nil
+	}
+
+	lc := net.ListenConfig{Control: reusePortControl}
+	var conns []*net.UDPConn
+	for i := 0; i < s.UDPSockets; i++ {
+		pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, err
+		}
+		conn := pc.(*net.UDPConn)
+		// Bind the remaining sockets to the port the first one got, in case addr asked for any port
+		if i == 0 {
+			addr = conn.LocalAddr().String()
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// Shutdown closes all listeners
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.udpListeners {
+		conn.Close()
+	}
+	for _, l := range s.tcpListeners {
+		l.Close()
+	}
+}
+
+// ServeUDP reads queries from conn in batches and answers each in its own goroutine
+func (s *Server) ServeUDP(conn *net.UDPConn) error {
+	s.mu.Lock()
+	s.udpListeners = append(s.udpListeners, conn)
+	s.mu.Unlock()
+
+	size := s.BatchSize
+	if size < 1 {
+		size = 1
+	}
+	batch := newBatchConn(conn, size)
+
+	responses := make(chan datagram, size*4)
+	done := make(chan struct{})
+	defer close(done)
+	go s.writeUDP(batch, responses, done, size)
+
+	msgs := make([]datagram, size)
+	for i := range msgs {
+		msgs[i].buf = make([]byte, maxUDPQuerySize)
+	}
+	for {
+		n, err := batch.ReadBatch(msgs)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		for i, msg := range msgs[:n] {
+			// The goroutine keeps the buffer it was handed; the next read gets a fresh one
+			msgs[i].buf = make([]byte, maxUDPQuerySize)
+			go func(msg datagram) {
+				query, res := s.handle(msg.buf[:msg.n], Request{RemoteAddr: msg.addr, Transport: "udp"})
+				if res == nil {
+					return
+				}
+				out, err := packUDPResponse(res, udpPayloadLimit(query, s.UDPSize))
+				if err == nil && s.Chaos.truncate() {
+					out, err = packTruncated(res)
+				}
+				if err != nil {
+					log.Printf("udp %s: %v", msg.addr, err)
+					return
+				}
+				for _, out := range s.Chaos.Inject(out) {
+					select {
+					case responses <- datagram{buf: out, n: len(out), addr: msg.addr}:
+					case <-done:
+						return
+					}
+				}
+			}(msg)
+		}
+	}
+}
+
+// writeUDP sends queued responses, gathering whatever is ready into one batch per system call
+func (s *Server) writeUDP(batch batchConn, responses <-chan datagram, done <-chan struct{}, size int) {
+	pending := make([]datagram, 0, size)
+	for {
+		select {
+		case msg := <-responses:
+			pending = append(pending[:0], msg)
+		case <-done:
+			return
+		}
+	gather:
+		for len(pending) < size {
+			select {
+			case msg := <-responses:
+				pending = append(pending, msg)
+			default:
+				break gather
+			}
+		}
+		for sent := 0; sent < len(pending); {
+			n, err := batch.WriteBatch(pending[sent:])
+			if err != nil {
+				log.Printf("udp write: %v", err)
+				break
+			}
+			sent += n
+		}
+	}
+}
+
+// ServeTCP accepts connections from l and answers length-prefixed queries on each
+func (s *Server) ServeTCP(l net.Listener) error {
+	s.mu.Lock()
+	s.tcpListeners = append(s.tcpListeners, l)
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.serveTCPConn(conn)
+	}
+}
+
+// serveTCPConn answers queries on a single TCP or TLS connection until it goes idle
+func (s *Server) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	template := Request{RemoteAddr: conn.RemoteAddr(), Transport: "tcp"}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn.SetDeadline(time.Now().Add(s.TCPTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("tls %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		state := tlsConn.ConnectionState()
+		template.Transport, template.TLS = "tls", &state
+	}
+	for {
+		conn.SetDeadline(time.Now().Add(s.TCPTimeout))
+		buffer, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		query, res := s.handle(buffer.buf, template)
+		if res == nil {
+			return
+		}
+		// Tell clients that ask how long the connection may stay idle (RFC 7828)
+		if _, ok := findEDNSOption(query, EDNSTCPKeepalive); ok {
+			if opt := res.OPT(); opt != nil {
+				setEDNSOption(opt, EDNSTCPKeepalive, keepaliveOption(s.TCPTimeout))
+			}
+		}
+		if s.Chaos != nil {
+			msg, err := res.Pack()
+			if err != nil {
+				return
+			}
+			for _, msg := range s.Chaos.Inject(msg) {
+				if _, err := writeFramed(conn, msg); err != nil {
+					return
+				}
+			}
+			continue
+		}
+		if _, err := res.WriteToStream(conn); err != nil {
+			return
+		}
+	}
+}
+
+// handle parses a raw query and passes it to the handler, answering FORMERR for malformed queries.
+// The request template carries the client's connection details. It returns the parsed query along
+// with the response; either may be nil.
+func (s *Server) handle(msg []byte, req Request) (*DnsPacket, *DnsPacket) {
+	buffer := &BytePacketBuffer{buf: msg}
+	var query *DnsPacket
+	var err error
+	if s.Strict != 0 {
+		query, err = DnsPacketFromBufferStrict(buffer, s.Strict)
+	} else {
+		query, err = DnsPacketFromBuffer(buffer)
+	}
+	if err != nil {
+		// Answer FORMERR if at least the header could be read
+		header := NewDnsHeader()
+		if len(msg) < 12 || header.Read(&BytePacketBuffer{buf: msg}) != nil || header.Response {
+			return nil, nil
+		}
+		query = &DnsPacket{Header: header}
+		return query, NewErrorResponse(query, FORMERR)
+	}
+	if query.Header.Response {
+		return query, nil
+	}
+
+	req.Packet = query
+	if len(query.Questions) > 1 && query.Header.Opcode == 0 {
+		if s.MultiQuestion != MultiQuestionFirst {
+			return query, s.finish(query, NewErrorResponse(query, FORMERR))
+		}
+		first := *query
+		first.Questions = query.Questions[:1]
+		req.Packet = &first
+	}
+	if query.Header.Opcode == 0 && len(query.Questions) > 0 && !servedClass(query.Questions[0].Qclass) {
+		return query, s.finish(query, NewErrorResponse(query, NOTIMP))
+	}
+	if req.Transport == "tcp" || req.Transport == "tls" {
+		if err := checkKeepalive(query); err != nil {
+			return query, s.finish(query, NewErrorResponse(query, FORMERR))
+		}
+	}
+	req.Span = s.Tracer.Start("dns.query", SpanServer)
+	if req.Span != nil {
+		defer req.Span.Finish()
+		req.Span.SetAttr("client.address", req.RemoteAddr.String())
+		req.Span.SetAttr("network.transport", req.Transport)
+		if len(query.Questions) > 0 {
+			req.Span.SetAttr("dns.question.name", query.Questions[0].Name)
+			req.Span.SetAttr("dns.question.type", QueryType(query.Questions[0].Qtype).String())
+		}
+	}
+	res := s.Handler.ServeDNS(&req)
+	if res == nil {
+		res = NewErrorResponse(query, SERVFAIL)
+	}
+	req.Span.SetAttr("dns.response.rcode", res.Header.ResCode.String())
+	return query, s.finish(query, res)
+}
+
+// finish completes a response to the query: it copies the ID, sets QR and gives EDNS queries, and
+// only them, an OPT record advertising our own limit whatever the handler put there, without any
+// edns-tcp-keepalive option
+func (s *Server) finish(query, res *DnsPacket) *DnsPacket {
+	res.Header.ID = query.Header.ID
+	res.Header.Response = true
+	old := res.OPT()
+	if query.OPT() == nil {
+		if old != nil {
+			res.RemoveEDNS()
+		}
+	} else {
+		opt := res.SetEDNS(s.UDPSize)
+		if old != nil {
+			opt.TTL, opt.Data = old.TTL, old.Data
+			// Keepalive timeouts from upstream servers say nothing about our connections
+			setEDNSOption(opt, EDNSTCPKeepalive, nil)
+		}
+	}
+	return res
+}
+
+// packUDPResponse serializes a response, truncating it to the question section and OPT record with TC set
+// when it exceeds limit
+func packUDPResponse(res *DnsPacket, limit int) ([]byte, error) {
+	msg, err := res.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) <= limit {
+		return msg, nil
+	}
+	msg, err = packTruncated(res)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) > limit {
+		return nil, fmt.Errorf("response header and question exceed %d bytes", limit)
+	}
+	return msg, nil
+}
+
+// packTruncated serializes a response cut down to its question section and OPT record, with TC set
+func packTruncated(res *DnsPacket) ([]byte, error) {
+	header := *res.Header
+	header.TruncatedMessage = true
+	truncated := &DnsPacket{Header: &header, Questions: res.Questions}
+	if opt := res.OPT(); opt != nil {
+		truncated.Resources = []*DnsRecord{opt}
+	}
+	return truncated.Pack()
+}
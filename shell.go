@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// shellCommands are the words the shell understands at the start of a line; anything else is a name to query
+var shellCommands = []string{"exit", "help", "quit", "server", "set"}
+
+// shellSettings are the options changed with "set <option> <value>"
+var shellSettings = []string{"color", "server", "timeout", "type"}
+
+// shell holds the state of an interactive session
+type shell struct {
+	client  *Client
+	server  string
+	qtype   QueryType
+	palette *Palette
+	out     io.Writer
+}
+
+// runShell implements the "shell" subcommand, an interactive prompt for repeated queries in the
+// manner of nslookup's interactive mode
+func runShell(args []string) int {
+	fs := flag.NewFlagSet("shell", flag.ExitOnError)
+	server := fs.String("server", SystemResolver(), "resolver to query until changed with \"set server\"")
+	qtypeName := fs.String("type", "A", "record type to query until changed with \"set type\"")
+	color := fs.String("color", "auto", "color output: auto (terminals only, unless NO_COLOR is set), always or never")
+	timeout := fs.Duration("timeout", 5*time.Second, "time to wait for each response")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gdns shell [-server addr] [-type A]\n")
+		fmt.Fprintf(fs.Output(), "Reads commands from standard input; type help at the prompt for the list.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	qtype, err := QueryTypeFromString(*qtypeName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	palette, err := NewPalette(*color, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	sh := &shell{client: NewClient(), server: *server, qtype: qtype, palette: palette, out: os.Stdout}
+	sh.client.Timeout = *timeout
+
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		// Scripted input: no prompt or line editing
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if !sh.execute(scanner.Text()) {
+				break
+			}
+		}
+		return 0
+	}
+
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer term.Restore(int(os.Stdin.Fd()), state)
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "> ")
+	if width, height, err := term.GetSize(int(os.Stdout.Fd())); err == nil {
+		t.SetSize(width, height)
+	}
+	t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		return completeShellLine(line, pos)
+	}
+	// The terminal translates newlines for raw mode; up and down arrows recall earlier lines
+	sh.out = t
+	for {
+		line, err := t.ReadLine()
+		if err != nil {
+			// io.EOF on Ctrl-D
+			return 0
+		}
+		if !sh.execute(line) {
+			return 0
+		}
+	}
+}
+
+// execute runs one line of input, returning false when the session should end
+func (sh *shell) execute(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return true
+	}
+	switch strings.ToLower(fields[0]) {
+	case "exit", "quit":
+		return false
+	case "help", "?":
+		fmt.Fprint(sh.out, shellHelp)
+	case "server":
+		// nslookup shorthand for "set server"
+		if len(fields) != 2 {
+			fmt.Fprintf(sh.out, "server %s\n", sh.server)
+			break
+		}
+		sh.set("server", fields[1])
+	case "set":
+		switch len(fields) {
+		case 1:
+			fmt.Fprintf(sh.out, "server %s\ntype %s\ntimeout %v\ncolor %v\n", sh.server, sh.qtype, sh.client.Timeout, sh.palette.Enabled)
+		case 3:
+			sh.set(strings.ToLower(fields[1]), fields[2])
+		default:
+			fmt.Fprintln(sh.out, "usage: set [option value]")
+		}
+	default:
+		if len(fields) > 2 {
+			fmt.Fprintln(sh.out, "usage: name [type]")
+			break
+		}
+		qtype := sh.qtype
+		if len(fields) == 2 {
+			var err error
+			if qtype, err = QueryTypeFromString(fields[1]); err != nil {
+				fmt.Fprintln(sh.out, err)
+				break
+			}
+		}
+		sh.query(fields[0], qtype)
+	}
+	return true
+}
+
+// set changes one option of the session
+func (sh *shell) set(option, value string) {
+	switch option {
+	case "server":
+		sh.server = value
+	case "type":
+		qtype, err := QueryTypeFromString(value)
+		if err != nil {
+			fmt.Fprintln(sh.out, err)
+			return
+		}
+		sh.qtype = qtype
+	case "timeout":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			fmt.Fprintf(sh.out, "invalid timeout %q\n", value)
+			return
+		}
+		sh.client.Timeout = d
+	case "color":
+		switch strings.ToLower(value) {
+		case "on", "always", "true":
+			sh.palette.Enabled = true
+		case "off", "never", "false":
+			sh.palette.Enabled = false
+		default:
+			fmt.Fprintf(sh.out, "invalid color setting %q, expected on or off\n", value)
+		}
+	default:
+		fmt.Fprintf(sh.out, "unknown option %q, expected one of %s\n", option, strings.Join(shellSettings, ", "))
+	}
+}
+
+// query looks up a name and prints the response
+func (sh *shell) query(name string, qtype QueryType) {
+	start := time.Now()
+	res, err := sh.client.Lookup(name, qtype, sh.server)
+	if err != nil {
+		fmt.Fprintln(sh.out, err)
+		return
+	}
+	PrintResponse(sh.out, res, sh.palette)
+	fmt.Fprintln(sh.out, sh.palette.Comment(fmt.Sprintf(";; server %s in %d ms", sh.server, time.Since(start).Milliseconds())))
+}
+
+// completeShellLine completes the word before the cursor with a command, option or record type,
+// extending it to the longest prefix shared by all candidates
+func completeShellLine(line string, pos int) (string, int, bool) {
+	start := strings.LastIndexByte(line[:pos], ' ') + 1
+	prefix := line[start:pos]
+	before := strings.Fields(line[:start])
+
+	var candidates []string
+	switch {
+	case len(before) == 0:
+		candidates = shellCommands
+	case len(before) == 1 && strings.EqualFold(before[0], "set"):
+		candidates = shellSettings
+	case len(before) == 2 && strings.EqualFold(before[0], "set") && strings.EqualFold(before[1], "type"),
+		len(before) == 1 && !strings.EqualFold(before[0], "server"):
+		for _, name := range queryTypeNames {
+			candidates = append(candidates, name)
+		}
+		sort.Strings(candidates)
+	case len(before) == 2 && strings.EqualFold(before[0], "set") && strings.EqualFold(before[1], "color"):
+		candidates = []string{"off", "on"}
+	}
+
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(strings.ToLower(c), strings.ToLower(prefix)) {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+	common := matches[0]
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(strings.ToLower(m), strings.ToLower(common)) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(matches) == 1 {
+		common += " "
+	}
+	if len(common) <= len(prefix) {
+		return "", 0, false
+	}
+	newLine := line[:start] + common + line[pos:]
+	return newLine, start + len(common), true
+}
+
+const shellHelp = `Commands:
+  name [type]          look up a name, with the current type unless one is given
+  set                  show the current settings
+  set server addr      query addr: IP[:port], tls://host[:port] or an https:// URL
+  set type MX          change the default record type
+  set timeout 2s       change the time to wait for responses
+  set color on|off     turn colored output on or off
+  server addr          same as set server
+  help                 show this list
+  exit, quit           leave the shell (Ctrl-D also works)
+Tab completes commands, options and record types; the up and down arrows recall earlier lines.
+`
@@ -0,0 +1,642 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SPFResult is the outcome of an SPF evaluation (RFC 7208 section 2.6)
+type SPFResult string
+
+// SPF evaluation results
+const (
+	SPFNone      SPFResult = "none"
+	SPFNeutral   SPFResult = "neutral"
+	SPFPass      SPFResult = "pass"
+	SPFFail      SPFResult = "fail"
+	SPFSoftFail  SPFResult = "softfail"
+	SPFTempError SPFResult = "temperror"
+	SPFPermError SPFResult = "permerror"
+)
+
+// spfLookupLimit caps the DNS-querying terms of one evaluation (RFC 7208 section 4.6.4)
+const spfLookupLimit = 10
+
+// spfVoidLookupLimit caps lookups that return no records
+const spfVoidLookupLimit = 2
+
+// SPFMechanism is a single directive of an SPF record
+type SPFMechanism struct {
+	Qualifier byte   // One of '+', '-', '~' or '?'
+	Kind      string // all, include, a, mx, ptr, ip4, ip6 or exists
+	Domain    string // Target domain spec, possibly containing macros
+	Network   *net.IPNet
+	Prefix4   int // CIDR length applied to IPv4 addresses of a/mx
+	Prefix6   int // CIDR length applied to IPv6 addresses of a/mx
+}
+
+// String returns the mechanism in SPF record syntax
+func (m SPFMechanism) String() string {
+	s := m.Kind
+	if m.Qualifier != '+' {
+		s = string(m.Qualifier) + s
+	}
+	switch {
+	case m.Network != nil:
+		s += ":" + m.Network.String()
+	case m.Domain != "":
+		s += ":" + m.Domain
+	}
+	if (m.Kind == "a" || m.Kind == "mx") && m.Prefix4 != 32 {
+		s += "/" + strconv.Itoa(m.Prefix4)
+	}
+	if (m.Kind == "a" || m.Kind == "mx") && m.Prefix6 != 128 {
+		s += "//" + strconv.Itoa(m.Prefix6)
+	}
+	return s
+}
+
+// SPFRecord is a parsed SPF policy
+type SPFRecord struct {
+	Mechanisms []SPFMechanism
+	Redirect   string            // redirect= modifier
+	Exp        string            // exp= modifier
+	Modifiers  map[string]string // Unrecognized modifiers, kept for display
+}
+
+// ParseSPF parses the text of an SPF TXT record
+func ParseSPF(text string) (*SPFRecord, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "v=spf1") {
+		return nil, fmt.Errorf("not an SPF record")
+	}
+	rec := &SPFRecord{Modifiers: make(map[string]string)}
+
+	for _, term := range fields[1:] {
+		// Modifiers are name=value, where the name can't contain ':' or '/'
+		if eq := strings.IndexByte(term, '='); eq > 0 && !strings.ContainsAny(term[:eq], ":/") {
+			name, value := strings.ToLower(term[:eq]), term[eq+1:]
+			switch name {
+			case "redirect":
+				if rec.Redirect != "" {
+					return nil, fmt.Errorf("duplicate redirect modifier")
+				}
+				rec.Redirect = value
+			case "exp":
+				if rec.Exp != "" {
+					return nil, fmt.Errorf("duplicate exp modifier")
+				}
+				rec.Exp = value
+			default:
+				rec.Modifiers[name] = value
+			}
+			continue
+		}
+
+		mech := SPFMechanism{Qualifier: '+', Prefix4: 32, Prefix6: 128}
+		if strings.IndexByte("+-~?", term[0]) >= 0 {
+			mech.Qualifier = term[0]
+			term = term[1:]
+		}
+		name, arg := term, ""
+		if i := strings.IndexAny(term, ":/"); i >= 0 {
+			name, arg = term[:i], term[i:]
+		}
+		mech.Kind = strings.ToLower(name)
+
+		switch mech.Kind {
+		case "all":
+			if arg != "" {
+				return nil, fmt.Errorf("all takes no arguments")
+			}
+		case "include", "exists":
+			if !strings.HasPrefix(arg, ":") || len(arg) < 2 {
+				return nil, fmt.Errorf("%s requires a domain", mech.Kind)
+			}
+			mech.Domain = arg[1:]
+		case "ptr":
+			if strings.HasPrefix(arg, ":") {
+				mech.Domain = arg[1:]
+			} else if arg != "" {
+				return nil, fmt.Errorf("invalid ptr argument %q", arg)
+			}
+		case "a", "mx":
+			if strings.HasPrefix(arg, ":") {
+				arg = arg[1:]
+				if i := strings.IndexByte(arg, '/'); i >= 0 {
+					mech.Domain, arg = arg[:i], arg[i:]
+				} else {
+					mech.Domain, arg = arg, ""
+				}
+			}
+			if i := strings.Index(arg, "//"); i >= 0 {
+				n, err := strconv.Atoi(arg[i+2:])
+				if err != nil || n < 0 || n > 128 {
+					return nil, fmt.Errorf("invalid IPv6 prefix in %q", term)
+				}
+				mech.Prefix6, arg = n, arg[:i]
+			}
+			if strings.HasPrefix(arg, "/") {
+				n, err := strconv.Atoi(arg[1:])
+				if err != nil || n < 0 || n > 32 {
+					return nil, fmt.Errorf("invalid IPv4 prefix in %q", term)
+				}
+				mech.Prefix4 = n
+			} else if arg != "" {
+				return nil, fmt.Errorf("invalid %s argument %q", mech.Kind, arg)
+			}
+		case "ip4", "ip6":
+			if !strings.HasPrefix(arg, ":") {
+				return nil, fmt.Errorf("%s requires an address", mech.Kind)
+			}
+			network := arg[1:]
+			if !strings.Contains(network, "/") {
+				if mech.Kind == "ip4" {
+					network += "/32"
+				} else {
+					network += "/128"
+				}
+			}
+			ip, ipnet, err := net.ParseCIDR(network)
+			if err != nil || (ip.To4() != nil) != (mech.Kind == "ip4") {
+				return nil, fmt.Errorf("invalid %s network %q", mech.Kind, arg[1:])
+			}
+			mech.Network = ipnet
+		default:
+			return nil, fmt.Errorf("unknown mechanism %q", name)
+		}
+		rec.Mechanisms = append(rec.Mechanisms, mech)
+	}
+	return rec, nil
+}
+
+// SPFEvaluator resolves SPF policies and evaluates them for a connecting client
+type SPFEvaluator struct {
+	Client   *Client
+	Resolver string
+	lookups  int // DNS-querying terms used so far
+	voids    int // Lookups that returned no records
+}
+
+// NewSPFEvaluator initializes an SPFEvaluator using the given resolver
+func NewSPFEvaluator(client *Client, resolver string) *SPFEvaluator {
+	return &SPFEvaluator{Client: client, Resolver: resolver}
+}
+
+// spfError carries the result an evaluation failure maps to
+type spfError struct {
+	result SPFResult
+	msg    string
+}
+
+func (e *spfError) Error() string {
+	return string(e.result) + ": " + e.msg
+}
+
+// FetchSPF returns the single SPF record published at domain
+func (e *SPFEvaluator) FetchSPF(domain string) (*SPFRecord, error) {
+	res, err := e.Client.Lookup(domain, QTYPE_TXT, e.Resolver)
+	if err != nil {
+		return nil, &spfError{SPFTempError, err.Error()}
+	}
+	if res.Header.ResCode != NOERROR && res.Header.ResCode != NXDOMAIN {
+		return nil, &spfError{SPFTempError, fmt.Sprintf("%s: %s", domain, res.Header.ResCode)}
+	}
+	var texts []string
+	for _, rec := range res.Answers {
+		txt, ok := rec.Data.(*TXT)
+		if !ok {
+			continue
+		}
+		text := strings.Join(txt.Txt, "")
+		if strings.EqualFold(text, "v=spf1") || strings.HasPrefix(strings.ToLower(text), "v=spf1 ") {
+			texts = append(texts, text)
+		}
+	}
+	switch len(texts) {
+	case 0:
+		return nil, &spfError{SPFNone, fmt.Sprintf("no SPF record at %s", domain)}
+	case 1:
+	default:
+		return nil, &spfError{SPFPermError, fmt.Sprintf("multiple SPF records at %s", domain)}
+	}
+	rec, err := ParseSPF(texts[0])
+	if err != nil {
+		return nil, &spfError{SPFPermError, fmt.Sprintf("%s: %v", domain, err)}
+	}
+	return rec, nil
+}
+
+// countLookup charges one DNS-querying term against the limit
+func (e *SPFEvaluator) countLookup() error {
+	e.lookups++
+	if e.lookups > spfLookupLimit {
+		return &spfError{SPFPermError, fmt.Sprintf("more than %d DNS lookups", spfLookupLimit)}
+	}
+	return nil
+}
+
+// query performs a lookup for a mechanism, tracking void lookups
+func (e *SPFEvaluator) query(name string, qtype QueryType) ([]*DnsRecord, error) {
+	res, err := e.Client.Lookup(name, qtype, e.Resolver)
+	if err != nil {
+		return nil, &spfError{SPFTempError, err.Error()}
+	}
+	var records []*DnsRecord
+	for _, rec := range res.Answers {
+		if rec.Qtype == qtype {
+			records = append(records, rec)
+		}
+	}
+	if len(records) == 0 {
+		e.voids++
+		if e.voids > spfVoidLookupLimit {
+			return nil, &spfError{SPFPermError, fmt.Sprintf("more than %d void lookups", spfVoidLookupLimit)}
+		}
+	}
+	return records, nil
+}
+
+// CheckHost evaluates the SPF policy of domain for a message from ip with the given envelope sender
+func (e *SPFEvaluator) CheckHost(ip net.IP, domain, sender string) (SPFResult, error) {
+	e.lookups, e.voids = 0, 0
+	return e.checkHost(ip, domain, sender)
+}
+
+// checkHost is the recursive part of CheckHost shared by include and redirect
+func (e *SPFEvaluator) checkHost(ip net.IP, domain, sender string) (SPFResult, error) {
+	rec, err := e.FetchSPF(domain)
+	if err != nil {
+		return err.(*spfError).result, err
+	}
+
+	for _, mech := range rec.Mechanisms {
+		matched, err := e.matches(mech, ip, domain, sender)
+		if err != nil {
+			if serr, ok := err.(*spfError); ok {
+				return serr.result, err
+			}
+			return SPFPermError, err
+		}
+		if matched {
+			return qualifierResult(mech.Qualifier), nil
+		}
+	}
+
+	if rec.Redirect != "" {
+		if err := e.countLookup(); err != nil {
+			return SPFPermError, err
+		}
+		target := expandSPFMacros(rec.Redirect, ip, domain, sender)
+		result, err := e.checkHost(ip, target, sender)
+		if result == SPFNone {
+			return SPFPermError, err
+		}
+		return result, err
+	}
+	return SPFNeutral, nil
+}
+
+// matches reports whether a single mechanism matches the client
+func (e *SPFEvaluator) matches(mech SPFMechanism, ip net.IP, domain, sender string) (bool, error) {
+	target := domain
+	if mech.Domain != "" {
+		target = expandSPFMacros(mech.Domain, ip, domain, sender)
+	}
+
+	switch mech.Kind {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		return mech.Network.Contains(ip), nil
+	}
+
+	if err := e.countLookup(); err != nil {
+		return false, err
+	}
+	switch mech.Kind {
+	case "include":
+		result, err := e.checkHost(ip, target, sender)
+		switch result {
+		case SPFPass:
+			return true, nil
+		case SPFFail, SPFSoftFail, SPFNeutral:
+			return false, nil
+		case SPFNone:
+			return false, &spfError{SPFPermError, fmt.Sprintf("included domain %s has no SPF record", target)}
+		default:
+			return false, err
+		}
+
+	case "a":
+		return e.matchAddresses(target, ip, mech)
+
+	case "mx":
+		mxs, err := e.query(target, QTYPE_MX)
+		if err != nil {
+			return false, err
+		}
+		if len(mxs) > spfLookupLimit {
+			return false, &spfError{SPFPermError, fmt.Sprintf("%s has more than %d MX records", target, spfLookupLimit)}
+		}
+		for _, mx := range mxs {
+			host, _ := targetName(mx.Data)
+			ok, err := e.matchAddresses(host, ip, mech)
+			if ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+
+	case "ptr":
+		names, err := e.query(reverseName(ip), QTYPE_PTR)
+		if err != nil {
+			return false, nil
+		}
+		for _, ptr := range names {
+			host, _ := targetName(ptr.Data)
+			if !isSubdomain(host, target) {
+				continue
+			}
+			if ok, _ := e.matchAddresses(host, ip, SPFMechanism{Prefix4: 32, Prefix6: 128}); ok {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "exists":
+		addrs, err := e.query(target, QTYPE_A)
+		return len(addrs) > 0, err
+	}
+	return false, nil
+}
+
+// matchAddresses checks the client against the A or AAAA records of host using the mechanism's prefixes
+func (e *SPFEvaluator) matchAddresses(host string, ip net.IP, mech SPFMechanism) (bool, error) {
+	qtype, bits, prefix := QTYPE_AAAA, 128, mech.Prefix6
+	if ip.To4() != nil {
+		qtype, bits, prefix = QTYPE_A, 32, mech.Prefix4
+	}
+	addrs, err := e.query(host, qtype)
+	if err != nil {
+		return false, err
+	}
+	for _, rec := range addrs {
+		network := net.IPNet{IP: addrOf(rec.Data).Mask(net.CIDRMask(prefix, bits)), Mask: net.CIDRMask(prefix, bits)}
+		if network.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// qualifierResult maps a mechanism qualifier to its result
+func qualifierResult(q byte) SPFResult {
+	switch q {
+	case '-':
+		return SPFFail
+	case '~':
+		return SPFSoftFail
+	case '?':
+		return SPFNeutral
+	default:
+		return SPFPass
+	}
+}
+
+// reverseName builds the in-addr.arpa or ip6.arpa name for an address
+func reverseName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", v4[3], v4[2], v4[1], v4[0])
+	}
+	const hexDigits = "0123456789abcdef"
+	v6 := ip.To16()
+	labels := make([]string, 0, 34)
+	for i := len(v6) - 1; i >= 0; i-- {
+		labels = append(labels, string(hexDigits[v6[i]&0xF]), string(hexDigits[v6[i]>>4]))
+	}
+	return strings.Join(labels, ".") + ".ip6.arpa"
+}
+
+// expandSPFMacros expands the macro letters of RFC 7208 section 7 in a domain spec
+func expandSPFMacros(spec string, ip net.IP, domain, sender string) string {
+	if !strings.Contains(spec, "%") {
+		return spec
+	}
+	local, senderDomain := "postmaster", domain
+	if at := strings.LastIndexByte(sender, '@'); at >= 0 {
+		local, senderDomain = sender[:at], sender[at+1:]
+		if local == "" {
+			local = "postmaster"
+		}
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' || i+1 >= len(spec) {
+			sb.WriteByte(spec[i])
+			continue
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			sb.WriteByte('%')
+			continue
+		case '_':
+			sb.WriteByte(' ')
+			continue
+		case '-':
+			sb.WriteString("%20")
+			continue
+		case '{':
+		default:
+			sb.WriteByte('%')
+			sb.WriteByte(spec[i])
+			continue
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			sb.WriteString(spec[i-1:])
+			break
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		var value string
+		switch macro[0] | 0x20 {
+		case 's':
+			value = local + "@" + senderDomain
+		case 'l':
+			value = local
+		case 'o':
+			value = senderDomain
+		case 'd':
+			value = domain
+		case 'i':
+			if ip.To4() != nil {
+				value = ip.To4().String()
+			} else {
+				name := reverseName(ip)
+				labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+				for l, r := 0, len(labels)-1; l < r; l, r = l+1, r-1 {
+					labels[l], labels[r] = labels[r], labels[l]
+				}
+				value = strings.Join(labels, ".")
+			}
+		case 'v':
+			value = "in-addr"
+			if ip.To4() == nil {
+				value = "ip6"
+			}
+		case 'h':
+			value = domain
+		}
+
+		// Transformers: an optional digit count, an optional 'r' to reverse, then delimiters
+		rest := macro[1:]
+		digits := 0
+		for len(rest) > 0 && rest[0] >= '0' && rest[0] <= '9' {
+			digits = digits*10 + int(rest[0]-'0')
+			rest = rest[1:]
+		}
+		reverse := len(rest) > 0 && (rest[0]|0x20) == 'r'
+		if reverse {
+			rest = rest[1:]
+		}
+		delims := rest
+		if delims == "" {
+			delims = "."
+		}
+		parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delims, r) })
+		if reverse {
+			for l, r := 0, len(parts)-1; l < r; l, r = l+1, r-1 {
+				parts[l], parts[r] = parts[r], parts[l]
+			}
+		}
+		if digits > 0 && digits < len(parts) {
+			parts = parts[len(parts)-digits:]
+		}
+		sb.WriteString(strings.Join(parts, "."))
+	}
+	return sb.String()
+}
+
+// SPFLookupReport describes the lookup cost of a policy including its nested includes
+type SPFLookupReport struct {
+	Lookups  int      // DNS-querying terms across the whole include tree
+	Includes []string // Every domain reached through include or redirect
+	Errors   []string // Problems found while resolving the tree
+}
+
+// CountLookups resolves includes and redirects recursively and totals the DNS lookups a receiver would perform
+func (e *SPFEvaluator) CountLookups(domain string) *SPFLookupReport {
+	report := &SPFLookupReport{}
+	e.countTree(domain, report, map[string]bool{})
+	if report.Lookups > spfLookupLimit {
+		report.Errors = append(report.Errors, fmt.Sprintf("%d DNS lookups exceeds the limit of %d", report.Lookups, spfLookupLimit))
+	}
+	return report
+}
+
+// countTree walks one policy and the policies it includes
+func (e *SPFEvaluator) countTree(domain string, report *SPFLookupReport, seen map[string]bool) {
+	key := parseNameLoose(domain).Key()
+	if seen[key] {
+		report.Errors = append(report.Errors, fmt.Sprintf("include loop at %s", domain))
+		return
+	}
+	seen[key] = true
+	defer delete(seen, key)
+
+	rec, err := e.FetchSPF(domain)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return
+	}
+	for _, mech := range rec.Mechanisms {
+		switch mech.Kind {
+		case "include":
+			report.Lookups++
+			if strings.Contains(mech.Domain, "%") {
+				continue
+			}
+			report.Includes = append(report.Includes, mech.Domain)
+			e.countTree(mech.Domain, report, seen)
+		case "a", "mx", "ptr", "exists":
+			report.Lookups++
+		}
+	}
+	if rec.Redirect != "" {
+		report.Lookups++
+		if !strings.Contains(rec.Redirect, "%") {
+			report.Includes = append(report.Includes, rec.Redirect)
+			e.countTree(rec.Redirect, report, seen)
+		}
+	}
+}
+
+// runSPF implements the "spf" subcommand
+func runSPF(args []string) int {
+	fs := flag.NewFlagSet("spf", flag.ExitOnError)
+	resolver := fs.String("server", "1.1.1.1", "recursive resolver to query")
+	ipFlag := fs.String("ip", "", "evaluate the policy for a message from this client address")
+	sender := fs.String("sender", "", "envelope sender address used for macro expansion")
+	timeout := fs.Duration("timeout", 5*time.Second, "time to wait for each response")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gdns spf [-server 1.1.1.1] [-ip addr [-sender user@domain]] domain\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	domain := strings.TrimSuffix(fs.Arg(0), ".")
+
+	client := NewClient()
+	client.Timeout = *timeout
+	evaluator := NewSPFEvaluator(client, *resolver)
+
+	rec, err := evaluator.FetchSPF(domain)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	for _, mech := range rec.Mechanisms {
+		fmt.Printf("  %s\n", mech)
+	}
+	if rec.Redirect != "" {
+		fmt.Printf("  redirect=%s\n", rec.Redirect)
+	}
+
+	report := evaluator.CountLookups(domain)
+	fmt.Printf("DNS lookups: %d/%d\n", report.Lookups, spfLookupLimit)
+	for _, include := range report.Includes {
+		fmt.Printf("  includes %s\n", include)
+	}
+	status := 0
+	for _, problem := range report.Errors {
+		fmt.Printf("error: %s\n", problem)
+		status = 1
+	}
+
+	if *ipFlag != "" {
+		ip := net.ParseIP(*ipFlag)
+		if ip == nil {
+			fmt.Fprintf(os.Stderr, "invalid address %q\n", *ipFlag)
+			return 2
+		}
+		result, err := evaluator.CheckHost(ip, domain, *sender)
+		if err != nil {
+			fmt.Printf("result: %s (%v)\n", result, err)
+		} else {
+			fmt.Printf("result: %s\n", result)
+		}
+	}
+	return status
+}
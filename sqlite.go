@@ -0,0 +1,426 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sqliteSchema creates the zone tables. Triggers log every record change so servers sharing the
+// database, and edits made with other SQLite clients, are picked up without reloading whole zones.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS zones (
+	origin TEXT PRIMARY KEY
+);
+CREATE TABLE IF NOT EXISTS records (
+	id   INTEGER PRIMARY KEY AUTOINCREMENT,
+	zone TEXT NOT NULL,
+	name TEXT NOT NULL,
+	type TEXT NOT NULL,
+	ttl  INTEGER NOT NULL,
+	data TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS records_zone ON records (zone);
+CREATE TABLE IF NOT EXISTS changes (
+	seq  INTEGER PRIMARY KEY AUTOINCREMENT,
+	zone TEXT NOT NULL,
+	op   TEXT NOT NULL,
+	name TEXT,
+	type TEXT,
+	ttl  INTEGER,
+	data TEXT
+);
+CREATE TRIGGER IF NOT EXISTS records_insert AFTER INSERT ON records BEGIN
+	INSERT INTO changes (zone, op, name, type, ttl, data) VALUES (NEW.zone, 'add', NEW.name, NEW.type, NEW.ttl, NEW.data);
+END;
+CREATE TRIGGER IF NOT EXISTS records_delete AFTER DELETE ON records BEGIN
+	INSERT INTO changes (zone, op, name, type, ttl, data) VALUES (OLD.zone, 'delete', OLD.name, OLD.type, OLD.ttl, OLD.data);
+END;
+CREATE TRIGGER IF NOT EXISTS records_update AFTER UPDATE ON records BEGIN
+	INSERT INTO changes (zone, op, name, type, ttl, data) VALUES (OLD.zone, 'delete', OLD.name, OLD.type, OLD.ttl, OLD.data);
+	INSERT INTO changes (zone, op, name, type, ttl, data) VALUES (NEW.zone, 'add', NEW.name, NEW.type, NEW.ttl, NEW.data);
+END;
+CREATE TRIGGER IF NOT EXISTS zones_insert AFTER INSERT ON zones BEGIN
+	INSERT INTO changes (zone, op) VALUES (NEW.origin, 'zone');
+END;
+CREATE TRIGGER IF NOT EXISTS zones_delete AFTER DELETE ON zones BEGIN
+	INSERT INTO changes (zone, op) VALUES (OLD.origin, 'zone');
+END;
+`
+
+// ErrNotFound is returned when a zone or record doesn't exist in the store
+var ErrNotFound = errors.New("not found")
+
+// StoredRecord is a record as kept in the zone database, with its data in presentation format
+type StoredRecord struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"` // Owner, absolute or relative to the zone origin
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data string `json:"data"`
+}
+
+// SQLiteZoneStore keeps authoritative zones in an SQLite database
+type SQLiteZoneStore struct {
+	JournalDir string // Directory of the journals recording zone changes; empty to not journal them
+
+	db         *sql.DB
+	lastChange int64 // Sequence number of the last change applied by Sync
+	mu         sync.Mutex
+}
+
+// openSQLite opens the SQLite database at path, waiting out other writers' locks. Builds without the
+// sqlite tag have no driver and fail.
+func openSQLite(path string) (*sql.DB, error) {
+	if !slices.Contains(sql.Drivers(), "sqlite") {
+		return nil, fmt.Errorf("%s: SQLite support needs gdns built with -tags sqlite", path)
+	}
+	return sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+}
+
+// OpenSQLiteZoneStore opens the database at path, creating the tables if needed
+func OpenSQLiteZoneStore(path string) (*SQLiteZoneStore, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &SQLiteZoneStore{db: db}, nil
+}
+
+// Close closes the database
+func (s *SQLiteZoneStore) Close() error {
+	return s.db.Close()
+}
+
+// Zones lists the origins of the stored zones
+func (s *SQLiteZoneStore) Zones() ([]string, error) {
+	rows, err := s.db.Query("SELECT origin FROM zones ORDER BY origin")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var origins []string
+	for rows.Next() {
+		var origin string
+		if err := rows.Scan(&origin); err != nil {
+			return nil, err
+		}
+		origins = append(origins, origin)
+	}
+	return origins, rows.Err()
+}
+
+// CreateZone adds an empty zone
+func (s *SQLiteZoneStore) CreateZone(origin string) error {
+	if _, err := ParseName(origin); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("INSERT INTO zones (origin) VALUES (?)", zoneKey(origin))
+	return err
+}
+
+// DeleteZone removes a zone and all of its records
+func (s *SQLiteZoneStore) DeleteZone(origin string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("DELETE FROM zones WHERE origin = ?", zoneKey(origin))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM records WHERE zone = ?", zoneKey(origin)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Records lists the records of a zone
+func (s *SQLiteZoneStore) Records(origin string) ([]*StoredRecord, error) {
+	var exists int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM zones WHERE origin = ?", zoneKey(origin)).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, ErrNotFound
+	}
+	rows, err := s.db.Query("SELECT id, name, type, ttl, data FROM records WHERE zone = ? ORDER BY id", zoneKey(origin))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []*StoredRecord
+	for rows.Next() {
+		rec := &StoredRecord{}
+		if err := rows.Scan(&rec.ID, &rec.Name, &rec.Type, &rec.TTL, &rec.Data); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// AddRecord validates a record and adds it to a zone, setting its ID
+func (s *SQLiteZoneStore) AddRecord(origin string, rec *StoredRecord) error {
+	if _, err := rec.parse(zoneKey(origin)); err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`INSERT INTO records (zone, name, type, ttl, data)
+		SELECT origin, ?, ?, ?, ? FROM zones WHERE origin = ?`,
+		rec.Name, strings.ToUpper(rec.Type), rec.TTL, rec.Data, zoneKey(origin))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	rec.Type = strings.ToUpper(rec.Type)
+	rec.ID, err = res.LastInsertId()
+	return err
+}
+
+// DeleteRecord removes a record from a zone by ID
+func (s *SQLiteZoneStore) DeleteRecord(origin string, id int64) error {
+	res, err := s.db.Exec("DELETE FROM records WHERE zone = ? AND id = ?", zoneKey(origin), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// LoadZone reads a stored zone into a form that can be served
+func (s *SQLiteZoneStore) LoadZone(origin string) (*AuthZone, error) {
+	records, err := s.Records(origin)
+	if err != nil {
+		return nil, err
+	}
+	zone := &Zone{Origin: zoneKey(origin)}
+	for _, stored := range records {
+		rec, err := stored.parse(zone.Origin)
+		if err != nil {
+			return nil, fmt.Errorf("zone %s record %d: %w", zone.Origin, stored.ID, err)
+		}
+		zone.Records = append(zone.Records, rec)
+	}
+	return NewAuthZone(zone), nil
+}
+
+// Load serves every stored zone from auth and remembers the change log position for Sync
+func (s *SQLiteZoneStore) Load(auth *Authority) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Changes made while loading are applied again by the next Sync, which is harmless
+	if err := s.db.QueryRow("SELECT COALESCE(MAX(seq), 0) FROM changes").Scan(&s.lastChange); err != nil {
+		return err
+	}
+	origins, err := s.Zones()
+	if err != nil {
+		return err
+	}
+	for _, origin := range origins {
+		zone, err := s.LoadZone(origin)
+		if err != nil {
+			return err
+		}
+		if s.JournalDir != "" {
+			if err := zone.OpenJournal(s.JournalDir); err != nil {
+				return err
+			}
+		}
+		auth.SetZone(zone)
+	}
+	return nil
+}
+
+// Sync applies the changes logged since the last Load or Sync to the zones served by auth. Record
+// changes are applied one by one; zones that were created or deleted are reloaded.
+func (s *SQLiteZoneStore) Sync(auth *Authority) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows, err := s.db.Query(`SELECT seq, zone, op, COALESCE(name, ''), COALESCE(type, ''), COALESCE(ttl, 0), COALESCE(data, '')
+		FROM changes WHERE seq > ? ORDER BY seq`, s.lastChange)
+	if err != nil {
+		return err
+	}
+	type change struct {
+		zone, op string
+		rec      StoredRecord
+	}
+	var changes []change
+	for rows.Next() {
+		var c change
+		if err := rows.Scan(&s.lastChange, &c.zone, &c.op, &c.rec.Name, &c.rec.Type, &c.rec.TTL, &c.rec.Data); err != nil {
+			rows.Close()
+			return err
+		}
+		changes = append(changes, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	reload := make(map[string]bool)
+	before := make(map[string][]*DnsRecord) // Records of journaled zones before the changes
+	for _, c := range changes {
+		zone := auth.Zone(c.zone)
+		if c.op == "zone" || zone == nil {
+			reload[c.zone] = true
+		} else if _, ok := before[c.zone]; !ok && zone.Journal() != nil {
+			before[c.zone] = zone.Records()
+		}
+	}
+	for _, c := range changes {
+		if reload[c.zone] {
+			continue
+		}
+		rec, err := c.rec.parse(c.zone)
+		if err != nil {
+			log.Printf("zone %s: skipping change: %v", c.zone, err)
+			continue
+		}
+		if c.op == "add" {
+			auth.Zone(c.zone).Add(rec)
+		} else {
+			auth.Zone(c.zone).Remove(rec)
+		}
+	}
+	for origin, records := range before {
+		if reload[origin] {
+			continue
+		}
+		zone := auth.Zone(origin)
+		bumped, err := zone.Commit(records)
+		if err != nil {
+			log.Printf("zone %s: journal: %v", origin, err)
+		}
+		if bumped {
+			// Store the serial served, so the database and the journal agree
+			if err := s.setSerial(origin, zone.soa()); err != nil {
+				log.Printf("zone %s: %v", origin, err)
+			}
+		}
+	}
+	for origin := range reload {
+		zone, err := s.LoadZone(origin)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			auth.RemoveZone(origin)
+		case err != nil:
+			return err
+		default:
+			if s.JournalDir != "" && auth.Zone(origin) == nil {
+				if err := zone.OpenJournal(s.JournalDir); err != nil {
+					log.Printf("zone %s: journal: %v", origin, err)
+				}
+			}
+			auth.SetZone(zone)
+		}
+	}
+	return nil
+}
+
+// setSerial stores the SOA serial of a zone
+func (s *SQLiteZoneStore) setSerial(origin string, soa *DnsRecord) error {
+	if soa == nil {
+		return nil
+	}
+	_, err := s.db.Exec("UPDATE records SET data = ? WHERE zone = ? AND type = 'SOA'", soa.RdataString(), zoneKey(origin))
+	return err
+}
+
+// ReplaceRecords changes the records of a zone to the given ones in one transaction, deleting and
+// adding only the records that differ
+func (s *SQLiteZoneStore) ReplaceRecords(origin string, records []*DnsRecord) error {
+	stored, err := s.Records(origin)
+	if err != nil {
+		return err
+	}
+	want := make(map[string]*DnsRecord, len(records))
+	for _, rec := range records {
+		want[journalKey(rec)] = rec
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, st := range stored {
+		rec, err := st.parse(zoneKey(origin))
+		if err == nil {
+			if _, ok := want[journalKey(rec)]; ok {
+				delete(want, journalKey(rec))
+				continue
+			}
+		}
+		if _, err := tx.Exec("DELETE FROM records WHERE id = ?", st.ID); err != nil {
+			return err
+		}
+	}
+	for _, rec := range want {
+		if _, err := tx.Exec("INSERT INTO records (zone, name, type, ttl, data) VALUES (?, ?, ?, ?, ?)",
+			zoneKey(origin), parseNameLoose(rec.Name).FQDN(), rec.Qtype.String(), rec.TTL, rec.RdataString()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Watch calls Sync every interval until the database is closed
+func (s *SQLiteZoneStore) Watch(auth *Authority, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.Sync(auth); err != nil {
+			if errors.Is(err, sql.ErrConnDone) || strings.Contains(err.Error(), "database is closed") {
+				return
+			}
+			log.Printf("zone sync: %v", err)
+		}
+	}
+}
+
+// parse converts a stored record into a DnsRecord, resolving relative names against origin
+func (r *StoredRecord) parse(origin string) (*DnsRecord, error) {
+	if r.Name == "" || r.Type == "" || r.Data == "" {
+		return nil, fmt.Errorf("record needs a name, type and data")
+	}
+	line := fmt.Sprintf("%s %d IN %s %s\n", r.Name, r.TTL, r.Type, r.Data)
+	zone, err := ParseZone(strings.NewReader(line), origin)
+	if err != nil {
+		return nil, err
+	}
+	if len(zone.Records) != 1 {
+		return nil, fmt.Errorf("expected one record, got %d", len(zone.Records))
+	}
+	rec := zone.Records[0]
+	if !parseNameLoose(rec.Name).IsSubdomainOf(parseNameLoose(origin)) {
+		return nil, fmt.Errorf("%s is outside zone %s", rec.Name, origin)
+	}
+	return rec, nil
+}
+
+// zoneKey normalizes a zone origin to the form stored in the database
+func zoneKey(origin string) string {
+	name, err := ParseName(origin)
+	if err != nil {
+		return origin
+	}
+	return lowerASCII(name.String())
+}
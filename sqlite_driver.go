@@ -0,0 +1,7 @@
+//go:build sqlite
+
+package main
+
+// The SQLite driver is large and doesn't build for every platform gdns runs on, so only builds
+// tagged sqlite link it in, enabling -zone-db and -stats-db
+import _ "modernc.org/sqlite"
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How Forwarder orders the upstreams it tries
+const (
+	UpstreamOrdered = "ordered" // As given, so later upstreams are only backups
+	UpstreamFastest = "fastest" // Lowest smoothed round-trip time first
+)
+
+// srttExplore is the chance that a query first tries another upstream than the fastest, so the
+// estimates of the others follow when they speed up
+const srttExplore = 0.05
+
+// ParseUpstreamSelection checks the name of an upstream ordering
+func ParseUpstreamSelection(mode string) (string, error) {
+	switch mode {
+	case UpstreamOrdered, UpstreamFastest:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown upstream selection %q, expected %s or %s", mode, UpstreamOrdered, UpstreamFastest)
+}
+
+// SRTT keeps a smoothed round-trip time estimate per server, as unbound does for authoritative
+// servers: each new measurement moves the estimate an eighth of the way towards it (RFC 6298)
+type SRTT struct {
+	estimates map[string]time.Duration
+	mu        sync.Mutex
+}
+
+// Observe adds a measured round-trip time to the server's estimate. Timeouts count as the time
+// waited, so servers that stop answering sink to the back.
+func (s *SRTT) Observe(server string, rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.estimates == nil {
+		s.estimates = make(map[string]time.Duration)
+	}
+	if old, ok := s.estimates[server]; ok {
+		rtt = old + (rtt-old)/8
+	}
+	s.estimates[server] = rtt
+}
+
+// Estimate returns the server's smoothed round-trip time, false if it was never measured
+func (s *SRTT) Estimate(server string) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rtt, ok := s.estimates[server]
+	return rtt, ok
+}
+
+// Sort returns servers fastest first. Servers not measured yet come first so they get measured,
+// and now and then a random other server is moved to the front to keep its estimate current.
+func (s *SRTT) Sort(servers []string) []string {
+	sorted := append([]string(nil), servers...)
+	s.mu.Lock()
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, aok := s.estimates[sorted[i]]
+		b, bok := s.estimates[sorted[j]]
+		if aok != bok {
+			return !aok
+		}
+		return a < b
+	})
+	s.mu.Unlock()
+	if len(sorted) > 1 && rand.Float64() < srttExplore {
+		i := 1 + rand.Intn(len(sorted)-1)
+		sorted[0], sorted[i] = sorted[i], sorted[0]
+	}
+	return sorted
+}
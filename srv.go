@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ResolveService looks up the SRV records for a service using the system resolver
+func ResolveService(service, proto, name string) ([]string, error) {
+	return NewClient().ResolveService(service, proto, name, SystemResolver())
+}
+
+// ResolveService looks up _service._proto.name and returns host:port candidates in the order
+// they should be tried, sorted by priority with weighted shuffling per RFC 2782
+func (c *Client) ResolveService(service, proto, name, server string) ([]string, error) {
+	qname := "_" + service + "._" + proto + "." + strings.TrimSuffix(name, ".")
+	res, err := c.Lookup(qname, QTYPE_SRV, server)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRcode(res); err != nil {
+		return nil, err
+	}
+
+	var records []*SRV
+	for _, rec := range res.Answers {
+		if srv, ok := rec.Data.(*SRV); ok {
+			records = append(records, srv)
+		}
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s: no SRV records", qname)
+	}
+	// A single record with target "." means the service is decidedly not available
+	if len(records) == 1 && records[0].Target == "" {
+		return nil, fmt.Errorf("%s: service not available", qname)
+	}
+
+	var targets []string
+	for _, rec := range orderSRV(records) {
+		if rec.Target == "" {
+			continue
+		}
+		targets = append(targets, net.JoinHostPort(rec.Target, strconv.Itoa(int(rec.Port))))
+	}
+	return targets, nil
+}
+
+// orderSRV sorts SRV records by priority and shuffles each priority group by weight
+func orderSRV(records []*SRV) []*SRV {
+	sorted := append([]*SRV(nil), records...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority < sorted[j].Priority })
+
+	ordered := make([]*SRV, 0, len(sorted))
+	for start := 0; start < len(sorted); {
+		end := start
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			end++
+		}
+
+		// Zero-weight records go first so they have a small chance of being picked early
+		group := append([]*SRV(nil), sorted[start:end]...)
+		sort.SliceStable(group, func(i, j int) bool { return group[i].Weight == 0 && group[j].Weight != 0 })
+		for len(group) > 0 {
+			total := 0
+			for _, rec := range group {
+				total += int(rec.Weight)
+			}
+			pick := rand.Intn(total + 1)
+			running := 0
+			chosen := len(group) - 1
+			for i, rec := range group {
+				running += int(rec.Weight)
+				if running >= pick {
+					chosen = i
+					break
+				}
+			}
+			ordered = append(ordered, group[chosen])
+			group = append(group[:chosen], group[chosen+1:]...)
+		}
+		start = end
+	}
+	return ordered
+}
+
+// SystemResolver returns the first name server from /etc/resolv.conf, or the loopback address
+func SystemResolver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			// Strip IPv6 zone identifiers, which can't be dialed without an interface
+			return strings.SplitN(fields[1], "%", 2)[0]
+		}
+	}
+	return "127.0.0.1"
+}
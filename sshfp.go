@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SSHFP key algorithms (RFC 4255, RFC 6594, RFC 7479, RFC 8709)
+const (
+	SSHFP_RSA     = 1
+	SSHFP_DSA     = 2
+	SSHFP_ECDSA   = 3
+	SSHFP_ED25519 = 4
+	SSHFP_ED448   = 6
+)
+
+// SSHFP fingerprint types
+const (
+	SSHFP_SHA1   = 1
+	SSHFP_SHA256 = 2
+)
+
+// sshKeyAlgorithms maps SSH public key type names to SSHFP algorithm numbers
+var sshKeyAlgorithms = map[string]uint8{
+	"ssh-rsa":             SSHFP_RSA,
+	"ssh-dss":             SSHFP_DSA,
+	"ecdsa-sha2-nistp256": SSHFP_ECDSA,
+	"ecdsa-sha2-nistp384": SSHFP_ECDSA,
+	"ecdsa-sha2-nistp521": SSHFP_ECDSA,
+	"ssh-ed25519":         SSHFP_ED25519,
+	"ssh-ed448":           SSHFP_ED448,
+}
+
+// SSHFP is the data of an SSH host key fingerprint record (RFC 4255)
+type SSHFP struct {
+	Algorithm   uint8
+	Type        uint8 // Fingerprint hash
+	Fingerprint []byte
+}
+
+// RRType returns QTYPE_SSHFP
+func (s *SSHFP) RRType() QueryType {
+	return QTYPE_SSHFP
+}
+
+// Pack encodes the data in wire format
+func (s *SSHFP) Pack() ([]byte, error) {
+	return append([]byte{s.Algorithm, s.Type}, s.Fingerprint...), nil
+}
+
+// String formats the data in presentation format
+func (s *SSHFP) String() string {
+	return fmt.Sprintf("%d %d %x", s.Algorithm, s.Type, s.Fingerprint)
+}
+
+// decodeSSHFP parses wire format SSHFP data
+func decodeSSHFP(data []byte) (RData, error) {
+	r := rdataReader{data: data}
+	s := &SSHFP{Algorithm: r.u8(), Type: r.u8()}
+	s.Fingerprint = append([]byte(nil), r.rest()...)
+	return s, r.done()
+}
+
+// parseSSHFP parses presentation format SSHFP data
+func parseSSHFP(fields, names []string) (RData, error) {
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("expects algorithm, fingerprint type and fingerprint")
+	}
+	alg, err := strconv.ParseUint(fields[0], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid algorithm %q", fields[0])
+	}
+	typ, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fingerprint type %q", fields[1])
+	}
+	fp, err := hex.DecodeString(strings.Join(fields[2:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid fingerprint: %v", err)
+	}
+	return &SSHFP{Algorithm: uint8(alg), Type: uint8(typ), Fingerprint: fp}, nil
+}
+
+// SSHFP returns the record's SSHFP data, or nil if it isn't an SSHFP record
+func (r *DnsRecord) SSHFP() *SSHFP {
+	s, _ := r.Data.(*SSHFP)
+	return s
+}
+
+// SSHHostKey is an SSH public key in the wire encoding used by the SSH protocol and known_hosts files
+type SSHHostKey []byte
+
+// ParseSSHHostKey parses a public key in OpenSSH format, "type base64 [comment]", as found in
+// .pub files and authorized_keys
+func ParseSSHHostKey(line string) (SSHHostKey, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("expected key type and base64 key data")
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key data: %v", err)
+	}
+	key := SSHHostKey(blob)
+	if key.Type() != fields[0] {
+		return nil, fmt.Errorf("key type %q does not match the key data", fields[0])
+	}
+	return key, nil
+}
+
+// Type returns the key type name encoded at the start of the key, e.g. ssh-ed25519
+func (k SSHHostKey) Type() string {
+	if len(k) < 4 {
+		return ""
+	}
+	n := binary.BigEndian.Uint32(k)
+	if uint64(n)+4 > uint64(len(k)) {
+		return ""
+	}
+	return string(k[4 : 4+n])
+}
+
+// Fingerprints returns the SSHFP records describing the key, one per fingerprint type
+func (k SSHHostKey) Fingerprints() ([]*SSHFP, error) {
+	alg, ok := sshKeyAlgorithms[k.Type()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %q", k.Type())
+	}
+	sum1 := sha1.Sum(k)
+	sum256 := sha256.Sum256(k)
+	return []*SSHFP{
+		{Algorithm: alg, Type: SSHFP_SHA1, Fingerprint: sum1[:]},
+		{Algorithm: alg, Type: SSHFP_SHA256, Fingerprint: sum256[:]},
+	}, nil
+}
+
+// Matches reports whether the record describes the key
+func (s *SSHFP) Matches(key SSHHostKey) bool {
+	if sshKeyAlgorithms[key.Type()] != s.Algorithm {
+		return false
+	}
+	switch s.Type {
+	case SSHFP_SHA1:
+		sum := sha1.Sum(key)
+		return bytes.Equal(sum[:], s.Fingerprint)
+	case SSHFP_SHA256:
+		sum := sha256.Sum256(key)
+		return bytes.Equal(sum[:], s.Fingerprint)
+	}
+	return false
+}
+
+// VerifySSHFP reports whether any of the SSHFP records matches the host key. As in OpenSSH, the
+// answer is only trustworthy when the records came from a DNSSEC-validated response.
+func VerifySSHFP(records []*SSHFP, key SSHHostKey) bool {
+	for _, s := range records {
+		if s.Matches(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// LookupSSHFP fetches the SSHFP records of host from server
+func (c *Client) LookupSSHFP(host, server string) ([]*SSHFP, error) {
+	res, err := c.Lookup(host, QTYPE_SSHFP, server)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRcode(res); err != nil {
+		return nil, err
+	}
+	var records []*SSHFP
+	for _, rec := range res.Answers {
+		if s := rec.SSHFP(); s != nil {
+			records = append(records, s)
+		}
+	}
+	return records, nil
+}
+
+// KnownHostKeys returns the keys listed for host in a known_hosts file, including hashed entries
+func KnownHostKeys(path, host string) ([]SSHHostKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []SSHHostKey
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		// Skip @cert-authority and @revoked markers' entries; they aren't host keys
+		if strings.HasPrefix(fields[0], "@") {
+			continue
+		}
+		if !knownHostsMatch(fields[0], host) {
+			continue
+		}
+		key, err := ParseSSHHostKey(fields[1] + " " + fields[2])
+		if err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// knownHostsMatch reports whether a known_hosts host pattern list names host. Hashed entries are
+// |1|base64 salt|base64 HMAC-SHA1 of the host name.
+func knownHostsMatch(patterns, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.HasPrefix(patterns, "|1|") {
+		parts := strings.Split(patterns[3:], "|")
+		if len(parts) != 2 {
+			return false
+		}
+		salt, err1 := base64.StdEncoding.DecodeString(parts[0])
+		sum, err2 := base64.StdEncoding.DecodeString(parts[1])
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(host))
+		return hmac.Equal(mac.Sum(nil), sum)
+	}
+	for _, pattern := range strings.Split(patterns, ",") {
+		if strings.ToLower(pattern) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// runSSHFP implements the "sshfp" subcommand
+func runSSHFP(args []string) int {
+	fs := flag.NewFlagSet("sshfp", flag.ExitOnError)
+	resolver := fs.String("server", "1.1.1.1", "resolver to query; it should validate DNSSEC for the result to be trusted")
+	keyFile := fs.String("key", "", "verify this public key file against the published records, or print its records with -generate")
+	knownHosts := fs.String("known-hosts", "", "verify the host's keys in this known_hosts file against the published records")
+	generate := fs.Bool("generate", false, "print the records for -key instead of querying, like ssh-keygen -r")
+	timeout := fs.Duration("timeout", 5*time.Second, "time to wait for each response")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gdns sshfp [-server 1.1.1.1] [-key file.pub [-generate] | -known-hosts file] host\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || (*generate && *keyFile == "") || (*keyFile != "" && *knownHosts != "") {
+		fs.Usage()
+		return 2
+	}
+	host := strings.TrimSuffix(fs.Arg(0), ".")
+
+	var keys []SSHHostKey
+	if *keyFile != "" {
+		data, err := os.ReadFile(*keyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		key, err := ParseSSHHostKey(string(data))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *keyFile, err)
+			return 1
+		}
+		keys = append(keys, key)
+	}
+	if *generate {
+		fps, err := keys[0].Fingerprints()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, fp := range fps {
+			fmt.Printf("%s IN SSHFP %s\n", host, fp)
+		}
+		return 0
+	}
+	if *knownHosts != "" {
+		var err error
+		if keys, err = KnownHostKeys(*knownHosts, host); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(keys) == 0 {
+			fmt.Fprintf(os.Stderr, "%s: no keys for %s\n", *knownHosts, host)
+			return 1
+		}
+	}
+
+	client := NewClient()
+	client.Timeout = *timeout
+	records, err := client.LookupSSHFP(host, *resolver)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if len(keys) == 0 {
+		for _, s := range records {
+			fmt.Printf("%s IN SSHFP %s\n", host, s)
+		}
+		if len(records) == 0 {
+			fmt.Printf("%s: no SSHFP records\n", host)
+			return 1
+		}
+		return 0
+	}
+
+	// Report like OpenSSH's VerifyHostKeyDNS debug output
+	status := 0
+	for _, key := range keys {
+		if VerifySSHFP(records, key) {
+			fmt.Printf("%s: matching host key fingerprint found in DNS\n", key.Type())
+		} else {
+			fmt.Printf("%s: no matching host key fingerprint found in DNS\n", key.Type())
+			status = 1
+		}
+	}
+	return status
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsInterval is the length of the time buckets queries are counted in
+const statsInterval = time.Minute
+
+// statsHistory is how many buckets are kept, so aggregates cover at most the last hour
+const statsHistory = 60
+
+// maxStatsKeys bounds the distinct clients and names counted per bucket; later ones are counted
+// under "other"
+const maxStatsKeys = 10000
+
+// statsRecent is how many of the latest queries are kept
+const statsRecent = 100
+
+// statsBucket holds the counts of one interval
+type statsBucket struct {
+	start   time.Time
+	queries int
+	blocked int
+	clients map[string]int
+	names   map[string]int
+	domains map[string]int // Registered domains of the names
+	blocks  map[string]int // Blocked names
+	types   map[string]int
+}
+
+// StatsCount is a key and how often it was seen
+type StatsCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// StatsQuery is a query as the statistics record it
+type StatsQuery struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Rcode   string    `json:"rcode"`
+	Blocked bool      `json:"blocked"`
+}
+
+// StatsInterval is what was asked in one bucket of a StatsSummary's timeline
+type StatsInterval struct {
+	Start   time.Time      `json:"start"`
+	Queries int            `json:"queries"`
+	Blocked int            `json:"blocked"`
+	Types   map[string]int `json:"types"`
+}
+
+// StatsSummary aggregates the queries over a window
+type StatsSummary struct {
+	Since      time.Time       `json:"since"`
+	Queries    int             `json:"queries"`
+	Blocked    int             `json:"blocked"`
+	TopClients []StatsCount    `json:"top_clients"`
+	TopNames   []StatsCount    `json:"top_names"`
+	TopDomains []StatsCount    `json:"top_domains"` // Names grouped by registered domain
+	TopBlocked []StatsCount    `json:"top_blocked"`
+	Timeline   []StatsInterval `json:"timeline"` // Oldest first
+	Recent     []*StatsQuery   `json:"recent"`   // The latest queries, newest first
+}
+
+// QueryStats keeps per-minute counts of queries by client, name and type over the last hour, and the
+// latest queries, for dashboards of the busiest clients and most asked for and blocked names
+type QueryStats struct {
+	buckets [statsHistory]*statsBucket
+	recent  [statsRecent]*StatsQuery // Ring of the latest queries
+	next    int                      // Index in recent of the next query
+	mu      sync.Mutex
+}
+
+// Record counts a query
+func (s *QueryStats) Record(q *StatsQuery) {
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	start := q.Time.Truncate(statsInterval)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recent[s.next] = q
+	s.next = (s.next + 1) % statsRecent
+	i := int(start.Unix()/int64(statsInterval/time.Second)) % statsHistory
+	b := s.buckets[i]
+	if b == nil || !b.start.Equal(start) {
+		b = &statsBucket{
+			start:   start,
+			clients: make(map[string]int),
+			names:   make(map[string]int),
+			domains: make(map[string]int),
+			blocks:  make(map[string]int),
+			types:   make(map[string]int),
+		}
+		s.buckets[i] = b
+	}
+	b.queries++
+	countKey(b.clients, q.Client)
+	countKey(b.names, name)
+	if domain := RegisteredDomain(name); domain != "" {
+		countKey(b.domains, domain)
+	}
+	b.types[q.Type]++
+	if q.Blocked {
+		b.blocked++
+		countKey(b.blocks, name)
+	}
+}
+
+// countKey increments the count of key, or of "other" once the map is full
+func countKey(counts map[string]int, key string) {
+	if _, ok := counts[key]; !ok && len(counts) >= maxStatsKeys {
+		key = "other"
+	}
+	counts[key]++
+}
+
+// Summary aggregates the buckets of the window before now, listing the top n clients and names
+func (s *QueryStats) Summary(window time.Duration, n int, now time.Time) *StatsSummary {
+	since := now.Truncate(statsInterval).Add(statsInterval - window)
+	summary := &StatsSummary{Since: since, Timeline: []StatsInterval{}, Recent: []*StatsQuery{}}
+	clients, names, domains, blocks := make(map[string]int), make(map[string]int), make(map[string]int), make(map[string]int)
+	s.mu.Lock()
+	for _, b := range s.buckets {
+		if b == nil || b.start.Before(since) || b.start.After(now) {
+			continue
+		}
+		summary.Queries += b.queries
+		summary.Blocked += b.blocked
+		for key, count := range b.clients {
+			clients[key] += count
+		}
+		for key, count := range b.names {
+			names[key] += count
+		}
+		for key, count := range b.domains {
+			domains[key] += count
+		}
+		for key, count := range b.blocks {
+			blocks[key] += count
+		}
+		types := make(map[string]int, len(b.types))
+		for key, count := range b.types {
+			types[key] = count
+		}
+		summary.Timeline = append(summary.Timeline, StatsInterval{Start: b.start, Queries: b.queries, Blocked: b.blocked, Types: types})
+	}
+	for i := 1; i <= statsRecent; i++ {
+		if q := s.recent[(s.next-i+statsRecent)%statsRecent]; q != nil && !q.Time.Before(since) {
+			summary.Recent = append(summary.Recent, q)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(summary.Timeline, func(i, j int) bool { return summary.Timeline[i].Start.Before(summary.Timeline[j].Start) })
+	summary.TopClients = topCounts(clients, n)
+	summary.TopNames = topCounts(names, n)
+	summary.TopDomains = topCounts(domains, n)
+	summary.TopBlocked = topCounts(blocks, n)
+	return summary
+}
+
+// topCounts returns the n keys with the highest counts, highest first
+func topCounts(counts map[string]int, n int) []StatsCount {
+	top := make([]StatsCount, 0, len(counts))
+	for key, count := range counts {
+		top = append(top, StatsCount{key, count})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Key < top[j].Key
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// StatsHandler counts queries in Stats and records them in DB after Next answers them
+type StatsHandler struct {
+	Next  Handler
+	Stats *QueryStats // Nil if not kept
+	DB    *StatsDB    // Nil if not kept
+}
+
+// ServeDNS answers the query through Next and records it
+func (h *StatsHandler) ServeDNS(req *Request) *DnsPacket {
+	start := time.Now()
+	res := h.Next.ServeDNS(req)
+	if res == nil || len(req.Packet.Questions) == 0 {
+		return res
+	}
+	q := req.Packet.Questions[0]
+	record := &StatsQuery{
+		Time:    start,
+		Client:  "-",
+		Name:    q.Name,
+		Type:    QueryType(q.Qtype).String(),
+		Rcode:   res.Header.ResCode.String(),
+		Blocked: req.Blocked,
+	}
+	if ip := addrIP(req.RemoteAddr); ip != nil {
+		record.Client = ip.String()
+	}
+	if h.Stats != nil {
+		h.Stats.Record(record)
+	}
+	if h.DB != nil {
+		h.DB.Record(record)
+	}
+	return res
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+)
+
+// statsDBSchema creates the table of query summaries
+const statsDBSchema = `
+CREATE TABLE IF NOT EXISTS queries (
+	time     INTEGER NOT NULL, -- Unix milliseconds
+	client   TEXT NOT NULL,
+	name     TEXT NOT NULL,
+	type     TEXT NOT NULL,
+	rcode    TEXT NOT NULL,
+	blocked  INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS queries_time ON queries (time);
+`
+
+// statsDBDropped counts query summaries dropped because the database couldn't keep up
+var statsDBDropped = expvar.NewInt("stats_db_dropped")
+
+// statsDBBatch is the most summaries written in one transaction
+const statsDBBatch = 1000
+
+// StatsDB keeps a summary of every query in an SQLite database for historical reports, deleting
+// summaries older than Retention. Summaries are written in batches in the background; when writes
+// fall behind, new summaries are dropped rather than delaying answers.
+type StatsDB struct {
+	Retention time.Duration // How long summaries are kept
+
+	db    *sql.DB
+	queue chan *StatsQuery
+}
+
+// StatsPeriod is the number of queries in a day or an hour
+type StatsPeriod struct {
+	Start          time.Time `json:"start"`
+	Queries        int       `json:"queries"`
+	Blocked        int       `json:"blocked"`
+	BlockedPercent float64   `json:"blocked_percent"`
+}
+
+// OpenStatsDB opens the database at path, creating the table if needed, and starts writing to it
+func OpenStatsDB(path string, retention time.Duration) (*StatsDB, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(statsDBSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	s := &StatsDB{Retention: retention, db: db, queue: make(chan *StatsQuery, 10*statsDBBatch)}
+	go s.write()
+	go s.expire()
+	return s, nil
+}
+
+// Record queues a query summary to be written
+func (s *StatsDB) Record(q *StatsQuery) {
+	select {
+	case s.queue <- q:
+	default:
+		statsDBDropped.Add(1)
+	}
+}
+
+// write inserts queued summaries in batches until the process exits
+func (s *StatsDB) write() {
+	batch := make([]*StatsQuery, 0, statsDBBatch)
+	for q := range s.queue {
+		batch = append(batch[:0], q)
+	fill:
+		for len(batch) < statsDBBatch {
+			select {
+			case q := <-s.queue:
+				batch = append(batch, q)
+			default:
+				break fill
+			}
+		}
+		if err := s.insert(batch); err != nil {
+			log.Printf("stats db: %v", err)
+			statsDBDropped.Add(int64(len(batch)))
+		}
+		// Let summaries gather into larger batches
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// insert writes summaries in one transaction
+func (s *StatsDB) insert(batch []*StatsQuery) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("INSERT INTO queries (time, client, name, type, rcode, blocked) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, q := range batch {
+		if _, err := stmt.Exec(q.Time.UnixMilli(), q.Client, q.Name, q.Type, q.Rcode, q.Blocked); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// expire deletes summaries older than Retention every hour until the process exits
+func (s *StatsDB) expire() {
+	for {
+		cutoff := time.Now().Add(-s.Retention).UnixMilli()
+		if res, err := s.db.Exec("DELETE FROM queries WHERE time < ?", cutoff); err != nil {
+			log.Printf("stats db: %v", err)
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("stats db: deleted %d query summaries older than %s", n, s.Retention)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// History counts the queries and blocked queries per period since the given time, oldest first.
+// Periods start at UTC day or hour boundaries.
+func (s *StatsDB) History(since time.Time, period time.Duration) ([]*StatsPeriod, error) {
+	ms := period.Milliseconds()
+	rows, err := s.db.Query("SELECT time / ? * ?, COUNT(*), SUM(blocked) FROM queries WHERE time >= ? GROUP BY 1 ORDER BY 1",
+		ms, ms, since.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := []*StatsPeriod{}
+	for rows.Next() {
+		var start int64
+		p := &StatsPeriod{}
+		if err := rows.Scan(&start, &p.Queries, &p.Blocked); err != nil {
+			return nil, err
+		}
+		p.Start = time.UnixMilli(start).UTC()
+		if p.Queries > 0 {
+			p.BlockedPercent = 100 * float64(p.Blocked) / float64(p.Queries)
+		}
+		history = append(history, p)
+	}
+	return history, rows.Err()
+}
+
+// Close closes the database; summaries still queued are lost
+func (s *StatsDB) Close() error {
+	return s.db.Close()
+}
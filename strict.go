@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StrictCheck selects constraints enforced by strict parsing; checks combine with |
+type StrictCheck uint
+
+// Constraints strict parsing can enforce
+const (
+	CheckCounts      StrictCheck = 1 << iota // The header counts cover the whole message, with no bytes left over
+	CheckClass                               // Questions and records are class IN, except OPT and in UPDATE messages
+	CheckZ                                   // The reserved Z bit of the header is zero
+	CheckRdataLength                         // Each record's data decodes to exactly RDLENGTH bytes
+
+	CheckAll = CheckCounts | CheckClass | CheckZ | CheckRdataLength
+)
+
+// strictCheckNames maps checks to the names used by ParseStrictChecks and StrictError
+var strictCheckNames = []struct {
+	check StrictCheck
+	name  string
+}{
+	{CheckCounts, "counts"},
+	{CheckClass, "class"},
+	{CheckZ, "z"},
+	{CheckRdataLength, "rdlength"},
+}
+
+// opcodeUpdate is the DNS UPDATE opcode (RFC 2136), whose records use classes NONE and ANY
+const opcodeUpdate = 5
+
+// String returns the names of the checks, comma-separated
+func (c StrictCheck) String() string {
+	var names []string
+	for _, n := range strictCheckNames {
+		if c&n.check != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseStrictChecks parses a comma-separated list of check names, or "all"
+func ParseStrictChecks(s string) (StrictCheck, error) {
+	var checks StrictCheck
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "all" {
+			checks |= CheckAll
+			continue
+		}
+		found := false
+		for _, n := range strictCheckNames {
+			if n.name == name {
+				checks |= n.check
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown strict check %q, expected all, counts, class, z or rdlength", name)
+		}
+	}
+	return checks, nil
+}
+
+// StrictError reports the first constraint a message violates under strict parsing
+type StrictError struct {
+	Check   StrictCheck // The check that failed
+	Section string      // Where the violation is, one of the Section constants
+	Index   int         // Entry within the section, unused for the header
+	Detail  string
+}
+
+// Error implements the error interface
+func (e *StrictError) Error() string {
+	if e.Section == SectionHeader {
+		return fmt.Sprintf("strict check %s failed: %s", e.Check, e.Detail)
+	}
+	return fmt.Sprintf("strict check %s failed: %s %d: %s", e.Check, e.Section, e.Index, e.Detail)
+}
+
+// DnsPacketFromBufferStrict decodes a message like DnsPacketFromBuffer, then rejects it with a
+// *StrictError if it violates any of the selected checks
+func DnsPacketFromBufferStrict(buffer *BytePacketBuffer, checks StrictCheck) (*DnsPacket, error) {
+	packet := NewDnsPacket()
+	if err := packet.Header.Read(buffer); err != nil {
+		return nil, err
+	}
+	if checks&CheckZ != 0 && packet.Header.Z {
+		return nil, &StrictError{Check: CheckZ, Section: SectionHeader, Detail: "Z bit set"}
+	}
+	checkClass := checks&CheckClass != 0 && packet.Header.Opcode != opcodeUpdate
+
+	for i := 0; i < int(packet.Header.Questions); i++ {
+		var question DnsQuestion
+		if err := question.Read(buffer); err != nil {
+			return nil, err
+		}
+		if checkClass && question.Qclass != CLASS_IN {
+			return nil, &StrictError{CheckClass, SectionQuestion, i, fmt.Sprintf("class %s", question.Qclass)}
+		}
+		packet.Questions = append(packet.Questions, &question)
+	}
+
+	sections := []struct {
+		name  string
+		count uint16
+		dst   *[]*DnsRecord
+	}{
+		{SectionAnswer, packet.Header.Answers, &packet.Answers},
+		{SectionAuthority, packet.Header.AuthoritativeEntries, &packet.Authorities},
+		{SectionAdditional, packet.Header.ResourceEntries, &packet.Resources},
+	}
+	for _, section := range sections {
+		for i := 0; i < int(section.count); i++ {
+			record, consumed, err := readRecord(buffer)
+			if err != nil {
+				return nil, err
+			}
+			if checks&CheckRdataLength != 0 && consumed != int(record.DataLen) {
+				detail := fmt.Sprintf("%s data decodes to %d bytes, RDLENGTH is %d", record.Qtype, consumed, record.DataLen)
+				return nil, &StrictError{CheckRdataLength, section.name, i, detail}
+			}
+			if checkClass && record.Class != CLASS_IN && record.Qtype != QTYPE_OPT {
+				return nil, &StrictError{CheckClass, section.name, i, fmt.Sprintf("%s record of class %s", record.Qtype, record.Class)}
+			}
+			*section.dst = append(*section.dst, record)
+		}
+	}
+
+	if checks&CheckCounts != 0 && buffer.Pos() < len(buffer.buf) {
+		detail := fmt.Sprintf("%d bytes after the records counted in the header", len(buffer.buf)-buffer.Pos())
+		return nil, &StrictError{Check: CheckCounts, Section: SectionHeader, Detail: detail}
+	}
+	if err := checkOPT(packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestDnsPacketFromBufferStrict checks that each strict check rejects the malformed messages it
+// covers, pointing at the offending entry, and lets the rest through
+func TestDnsPacketFromBufferStrict(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     string
+		checks  StrictCheck
+		check   StrictCheck // The check that fails, or 0 when the message is accepted
+		section string
+		index   int
+		err     error // A decoding error wrapping this, rather than a *StrictError
+		broken  bool  // A decoding error of any kind
+	}{
+		{name: "well-formed", msg: "1234 8180 0001 0001 0000 0001" + testQuestion + testA + testOPT, checks: CheckAll},
+		{name: "Z bit set", msg: "1234 81c0 0001 0001 0000 0000" + testQuestion + testA, checks: CheckAll,
+			check: CheckZ, section: SectionHeader},
+		{name: "Z bit set, unchecked", msg: "1234 81c0 0001 0001 0000 0000" + testQuestion + testA,
+			checks: CheckAll &^ CheckZ},
+		{name: "question of class CH", msg: "1234 8180 0001 0000 0000 0000 07 6578616d706c65 03 636f6d 00 0001 0003",
+			checks: CheckAll, check: CheckClass, section: SectionQuestion},
+		{name: "record of class CH", msg: "1234 8180 0001 0001 0002 0000" + testQuestion + testA + testA + testAChaos,
+			checks: CheckAll, check: CheckClass, section: SectionAuthority, index: 1},
+		{name: "record of class CH, unchecked", msg: "1234 8180 0001 0001 0000 0000" + testQuestion + testAChaos,
+			checks: CheckAll &^ CheckClass},
+		// Opcode UPDATE, deleting an address with class NONE
+		{name: "UPDATE with class NONE", msg: "1234 2800 0001 0000 0001 0000 07 6578616d706c65 03 636f6d 00 0006 0001" +
+			"03 777777 c00c 0001 00fe 00000000 0004 c0000201", checks: CheckAll},
+		{name: "RDLENGTH longer than the data", msg: "1234 8180 0001 0002 0000 0000" + testQuestion + testA + testALong,
+			checks: CheckAll, check: CheckRdataLength, section: SectionAnswer, index: 1},
+		{name: "RDLENGTH longer than the data, unchecked", msg: "1234 8180 0001 0002 0000 0000" + testQuestion +
+			testA + testALong, checks: CheckAll &^ CheckRdataLength},
+		// Data running past RDLENGTH is a decoding error whatever the checks
+		{name: "RDLENGTH shorter than the data", msg: "1234 8180 0001 0002 0000 0000" + testQuestion + testAShort + testA,
+			broken: true},
+		{name: "trailing bytes", msg: "1234 8180 0001 0001 0000 0000" + testQuestion + testA + "0000",
+			checks: CheckAll, check: CheckCounts, section: SectionHeader},
+		{name: "trailing bytes, unchecked", msg: "1234 8180 0001 0001 0000 0000" + testQuestion + testA + "0000",
+			checks: CheckAll &^ CheckCounts},
+		{name: "counts past the records", msg: "1234 8180 0001 0002 0000 0000" + testQuestion + testA,
+			checks: CheckAll, err: ErrBufferOverrun},
+		{name: "two OPT records", msg: "1234 8180 0001 0000 0000 0002" + testQuestion + testOPT + testOPT,
+			err: ErrBadOPT},
+		{name: "OPT record in the answers", msg: "1234 8180 0001 0001 0000 0000" + testQuestion + testOPT,
+			err: ErrBadOPT},
+	}
+	for _, tt := range tests {
+		packet, err := DnsPacketFromBufferStrict(&BytePacketBuffer{buf: testHex(t, tt.msg)}, tt.checks)
+		var strictErr *StrictError
+		switch {
+		case tt.broken:
+			if err == nil || errors.As(err, &strictErr) {
+				t.Errorf("%s: got %v, want a decoding error", tt.name, err)
+			}
+		case tt.err != nil:
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+			}
+		case tt.check != 0:
+			if !errors.As(err, &strictErr) {
+				t.Errorf("%s: got %v, want a strict error", tt.name, err)
+				continue
+			}
+			if strictErr.Check != tt.check || strictErr.Section != tt.section || strictErr.Index != tt.index {
+				t.Errorf("%s: check %s failed at %s %d, want %s at %s %d", tt.name, strictErr.Check,
+					strictErr.Section, strictErr.Index, tt.check, tt.section, tt.index)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		default:
+			records := len(packet.Answers) + len(packet.Authorities) + len(packet.Resources)
+			counts := int(packet.Header.Answers) + int(packet.Header.AuthoritativeEntries) + int(packet.Header.ResourceEntries)
+			if records != counts {
+				t.Errorf("%s: decoded %d records, header counts %d", tt.name, records, counts)
+			}
+		}
+		if err != nil && packet != nil {
+			t.Errorf("%s: got a packet along with %v", tt.name, err)
+		}
+	}
+}
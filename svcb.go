@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SVCB service parameter keys (RFC 9460 section 14.3, RFC 9461)
+const (
+	SVCB_MANDATORY       uint16 = 0
+	SVCB_ALPN            uint16 = 1
+	SVCB_NO_DEFAULT_ALPN uint16 = 2
+	SVCB_PORT            uint16 = 3
+	SVCB_IPV4HINT        uint16 = 4
+	SVCB_ECH             uint16 = 5
+	SVCB_IPV6HINT        uint16 = 6
+	SVCB_DOHPATH         uint16 = 7
+)
+
+// svcbKeyNames maps service parameter keys to their presentation names
+var svcbKeyNames = map[uint16]string{
+	SVCB_MANDATORY:       "mandatory",
+	SVCB_ALPN:            "alpn",
+	SVCB_NO_DEFAULT_ALPN: "no-default-alpn",
+	SVCB_PORT:            "port",
+	SVCB_IPV4HINT:        "ipv4hint",
+	SVCB_ECH:             "ech",
+	SVCB_IPV6HINT:        "ipv6hint",
+	SVCB_DOHPATH:         "dohpath",
+}
+
+// SVCBParam is one key=value service parameter of an SVCB or HTTPS record
+type SVCBParam struct {
+	Key   uint16 // The parameter key
+	Value []byte // The parameter value in wire format
+}
+
+// svcbKeyName returns the presentation name of a key, keyNNNNN when it has none
+func svcbKeyName(key uint16) string {
+	if name, ok := svcbKeyNames[key]; ok {
+		return name
+	}
+	return fmt.Sprintf("key%d", key)
+}
+
+// parseSVCBKey converts a presentation key name into its number
+func parseSVCBKey(name string) (uint16, error) {
+	for key, known := range svcbKeyNames {
+		if known == name {
+			return key, nil
+		}
+	}
+	if strings.HasPrefix(name, "key") {
+		if n, err := strconv.ParseUint(name[3:], 10, 16); err == nil {
+			return uint16(n), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown service parameter %q", name)
+}
+
+// String returns the parameter in key=value presentation format
+func (p SVCBParam) String() string {
+	name := svcbKeyName(p.Key)
+	switch p.Key {
+	case SVCB_NO_DEFAULT_ALPN:
+		return name
+	case SVCB_MANDATORY:
+		var keys []string
+		for i := 0; i+1 < len(p.Value); i += 2 {
+			keys = append(keys, svcbKeyName(uint16(p.Value[i])<<8|uint16(p.Value[i+1])))
+		}
+		return name + "=" + strings.Join(keys, ",")
+	case SVCB_ALPN:
+		return name + "=" + strings.Join(splitCharStrings(p.Value), ",")
+	case SVCB_PORT:
+		if len(p.Value) == 2 {
+			return fmt.Sprintf("%s=%d", name, uint16(p.Value[0])<<8|uint16(p.Value[1]))
+		}
+	case SVCB_IPV4HINT, SVCB_IPV6HINT:
+		size := net.IPv4len
+		if p.Key == SVCB_IPV6HINT {
+			size = net.IPv6len
+		}
+		var addrs []string
+		for i := 0; i+size <= len(p.Value); i += size {
+			addrs = append(addrs, net.IP(p.Value[i:i+size]).String())
+		}
+		return name + "=" + strings.Join(addrs, ",")
+	case SVCB_ECH:
+		return name + "=" + base64.StdEncoding.EncodeToString(p.Value)
+	}
+	return name + "=" + quoteCharString(string(p.Value))
+}
+
+// ParseSVCBParam parses a key=value service parameter from presentation format
+func ParseSVCBParam(s string) (SVCBParam, error) {
+	name, value, hasValue := strings.Cut(s, "=")
+	key, err := parseSVCBKey(name)
+	if err != nil {
+		return SVCBParam{}, err
+	}
+	param := SVCBParam{Key: key}
+	value = strings.Trim(value, `"`)
+	if !hasValue && key != SVCB_NO_DEFAULT_ALPN {
+		return param, fmt.Errorf("%s requires a value", name)
+	}
+
+	switch key {
+	case SVCB_NO_DEFAULT_ALPN:
+		if hasValue {
+			return param, fmt.Errorf("%s takes no value", name)
+		}
+	case SVCB_MANDATORY:
+		for _, item := range strings.Split(value, ",") {
+			k, err := parseSVCBKey(item)
+			if err != nil {
+				return param, err
+			}
+			param.Value = append(param.Value, byte(k>>8), byte(k))
+		}
+	case SVCB_ALPN:
+		for _, id := range strings.Split(value, ",") {
+			if len(id) == 0 || len(id) > 255 {
+				return param, fmt.Errorf("invalid ALPN identifier %q", id)
+			}
+			param.Value = append(param.Value, byte(len(id)))
+			param.Value = append(param.Value, id...)
+		}
+	case SVCB_PORT:
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return param, fmt.Errorf("invalid port %q", value)
+		}
+		param.Value = []byte{byte(port >> 8), byte(port)}
+	case SVCB_IPV4HINT, SVCB_IPV6HINT:
+		for _, item := range strings.Split(value, ",") {
+			ip := net.ParseIP(item)
+			switch {
+			case ip == nil:
+				return param, fmt.Errorf("invalid address %q", item)
+			case key == SVCB_IPV4HINT && ip.To4() != nil:
+				param.Value = append(param.Value, ip.To4()...)
+			case key == SVCB_IPV6HINT && ip.To4() == nil:
+				param.Value = append(param.Value, ip.To16()...)
+			default:
+				return param, fmt.Errorf("wrong address family for %s: %s", name, item)
+			}
+		}
+	case SVCB_ECH:
+		if param.Value, err = base64.StdEncoding.DecodeString(value); err != nil {
+			return param, fmt.Errorf("invalid ech: %v", err)
+		}
+	default:
+		param.Value = []byte(value)
+	}
+	return param, nil
+}
+
+// splitCharStrings decodes a sequence of length-prefixed character strings
+func splitCharStrings(data []byte) []string {
+	var items []string
+	for len(data) > 0 {
+		n := int(data[0])
+		if n+1 > len(data) {
+			break
+		}
+		items = append(items, string(data[1:1+n]))
+		data = data[1+n:]
+	}
+	return items
+}
+
+// ServiceParam returns the value of the service parameter with the given key
+func (d *SVCB) ServiceParam(key uint16) ([]byte, bool) {
+	for _, p := range d.Params {
+		if p.Key == key {
+			return p.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ALPN returns the protocol identifiers advertised in the alpn parameter
+func (d *SVCB) ALPN() []string {
+	value, _ := d.ServiceParam(SVCB_ALPN)
+	return splitCharStrings(value)
+}
+
+// AddressHints returns the addresses from the ipv4hint and ipv6hint parameters
+func (d *SVCB) AddressHints() []net.IP {
+	var addrs []net.IP
+	if value, ok := d.ServiceParam(SVCB_IPV4HINT); ok {
+		for i := 0; i+net.IPv4len <= len(value); i += net.IPv4len {
+			addrs = append(addrs, net.IP(value[i:i+net.IPv4len]))
+		}
+	}
+	if value, ok := d.ServiceParam(SVCB_IPV6HINT); ok {
+		for i := 0; i+net.IPv6len <= len(value); i += net.IPv6len {
+			addrs = append(addrs, net.IP(value[i:i+net.IPv6len]))
+		}
+	}
+	return addrs
+}
+
+// readSVCBParams reads service parameters from the buffer up to end
+func readSVCBParams(buffer *BytePacketBuffer, end int) ([]SVCBParam, error) {
+	var params []SVCBParam
+	for buffer.Pos() < end {
+		key, err := buffer.ReadU16()
+		if err != nil {
+			return nil, err
+		}
+		length, err := buffer.ReadU16()
+		if err != nil {
+			return nil, err
+		}
+		if buffer.Pos()+int(length) > end {
+			return nil, fmt.Errorf("service parameter %s overruns record data", svcbKeyName(key))
+		}
+		value, err := buffer.GetRange(buffer.Pos(), int(length))
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, SVCBParam{Key: key, Value: append([]byte(nil), value...)})
+		buffer.Step(int(length))
+	}
+	return params, nil
+}
+
+// writeSVCBParams writes service parameters in ascending key order as the wire format requires
+func writeSVCBParams(buffer *BytePacketBuffer, params []SVCBParam) error {
+	sorted := append([]SVCBParam(nil), params...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	for _, p := range sorted {
+		if err := buffer.WriteU16(p.Key); err != nil {
+			return err
+		}
+		if err := buffer.WriteU16(uint16(len(p.Value))); err != nil {
+			return err
+		}
+		for _, b := range p.Value {
+			if err := buffer.Write(b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+// Crosscheck decodes the corpus messages with github.com/miekg/dns and compares the result with the
+// golden files, so the goldens aren't only checked against the decoder that wrote them. It is a
+// module of its own to keep miekg/dns out of gdns's dependencies:
+//
+//	cd testdata/corpus/crosscheck && go run . ..
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+func main() {
+	dir := ".."
+	if len(os.Args) > 1 {
+		dir = os.Args[1]
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.hex"))
+	if err != nil || len(paths) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: no .hex messages\n", dir)
+		os.Exit(2)
+	}
+	sort.Strings(paths)
+	failed := false
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".hex")
+		diffs, err := check(path, filepath.Join(dir, name+".golden"))
+		if err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		for _, d := range diffs {
+			fmt.Printf("%s: %s\n", name, d)
+		}
+		if len(diffs) > 0 {
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: ok\n", name)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// check decodes one message and returns how the golden file disagrees with it
+func check(hexPath, goldenPath string) ([]string, error) {
+	data, err := os.ReadFile(hexPath)
+	if err != nil {
+		return nil, err
+	}
+	var digits strings.Builder
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			digits.WriteString(strings.Join(strings.Fields(line), ""))
+		}
+	}
+	wire, err := hex.DecodeString(digits.String())
+	if err != nil {
+		return nil, err
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(wire); err != nil {
+		return nil, fmt.Errorf("miekg/dns can't decode it: %v", err)
+	}
+	golden, err := os.ReadFile(goldenPath)
+	if err != nil {
+		return nil, err
+	}
+	return compare(msg, string(golden)), nil
+}
+
+// compare lists the header fields, questions, records and EDNS data of msg that the golden text
+// describes differently, line by line
+func compare(msg *dns.Msg, golden string) []string {
+	want := []string{header(msg)}
+	for _, q := range msg.Question {
+		want = append(want, fields(q.String()))
+	}
+	sections := []struct {
+		name    string
+		records []dns.RR
+	}{
+		{"ANSWER", msg.Answer},
+		{"AUTHORITY", msg.Ns},
+		{"ADDITIONAL", msg.Extra},
+	}
+	for _, s := range sections {
+		var lines []string
+		for _, rr := range s.records {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				lines = append(lines, fields(rr.String()))
+			}
+		}
+		if len(lines) > 0 {
+			want = append(want, ";; "+s.name+" SECTION:")
+			want = append(want, lines...)
+		}
+	}
+	if opt := msg.IsEdns0(); opt != nil {
+		want = append(want, edns(opt)...)
+	}
+
+	var got []string
+	for _, line := range strings.Split(golden, "\n") {
+		if strings.TrimSpace(line) != "" {
+			got = append(got, fields(line))
+		}
+	}
+	var diffs []string
+	for i := 0; i < max(len(want), len(got)); i++ {
+		var w, g string
+		if i < len(want) {
+			w = want[i]
+		}
+		if i < len(got) {
+			g = got[i]
+		}
+		if w != g {
+			diffs = append(diffs, fmt.Sprintf("line %d\n\tmiekg/dns: %s\n\tgolden:    %s", i+1, w, g))
+		}
+	}
+	return diffs
+}
+
+// header renders the status line of the golden files from the message header
+func header(msg *dns.Msg) string {
+	var flags []string
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{msg.Response, "qr"},
+		{msg.Authoritative, "aa"},
+		{msg.Truncated, "tc"},
+		{msg.RecursionDesired, "rd"},
+		{msg.RecursionAvailable, "ra"},
+		{msg.AuthenticatedData, "ad"},
+		{msg.CheckingDisabled, "cd"},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	return fields(fmt.Sprintf(";; status: %s, id: %d, flags: %s", dns.RcodeToString[msg.Rcode], msg.Id, strings.Join(flags, " ")))
+}
+
+// edns renders the EDNS lines of the golden files from an OPT record
+func edns(opt *dns.OPT) []string {
+	flags := "none"
+	if opt.Do() {
+		flags = "do"
+	}
+	lines := []string{fields(fmt.Sprintf(";; EDNS: version %d, flags: %s, extended rcode %d, udp %d",
+		opt.Version(), flags, opt.ExtendedRcode()>>4, opt.UDPSize()))}
+	for _, option := range opt.Option {
+		packed, err := optionData(option)
+		if err != nil {
+			lines = append(lines, fmt.Sprintf(";; EDNS option %d: %v", option.Option(), err))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf(";; EDNS option %d: %x", option.Option(), packed))
+	}
+	return lines
+}
+
+// optionData returns the payload of an EDNS option as it was on the wire
+func optionData(option dns.EDNS0) ([]byte, error) {
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}, Option: []dns.EDNS0{option}}
+	buf := make([]byte, 512)
+	n, err := dns.PackRR(opt, buf, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	// Skip the root name, type, class, TTL, RDLENGTH and the option code and length
+	return buf[1+10+4 : n], nil
+}
+
+// fields collapses the whitespace of a line, since the two decoders align columns differently
+func fields(line string) string {
+	return strings.Join(strings.Fields(line), " ")
+}
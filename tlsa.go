@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TLSA certificate usages (RFC 7218 mnemonics)
+const (
+	DANE_PKIX_TA = 0 // CA constraint: a CA in a publicly trusted chain
+	DANE_PKIX_EE = 1 // Service certificate constraint, on top of public PKIX validation
+	DANE_TA      = 2 // Trust anchor assertion: a CA the chain must lead to, publicly trusted or not
+	DANE_EE      = 3 // Domain-issued certificate: the server's own certificate or key
+)
+
+// TLSA selectors and matching types
+const (
+	TLSA_SELECTOR_CERT = 0 // Full certificate
+	TLSA_SELECTOR_SPKI = 1 // SubjectPublicKeyInfo
+	TLSA_MATCH_FULL    = 0 // Exact match of the selected content
+	TLSA_MATCH_SHA256  = 1
+	TLSA_MATCH_SHA512  = 2
+)
+
+// ErrDANEMismatch is returned when no TLSA record matches the presented certificate chain
+var ErrDANEMismatch = errors.New("no TLSA record matches the certificate chain")
+
+// TLSA is the data of a TLS certificate association record (RFC 6698)
+type TLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Certificate  []byte // Certificate association data
+}
+
+// RRType returns QTYPE_TLSA
+func (t *TLSA) RRType() QueryType {
+	return QTYPE_TLSA
+}
+
+// Pack encodes the data in wire format
+func (t *TLSA) Pack() ([]byte, error) {
+	return append([]byte{t.Usage, t.Selector, t.MatchingType}, t.Certificate...), nil
+}
+
+// String formats the data in presentation format
+func (t *TLSA) String() string {
+	return fmt.Sprintf("%d %d %d %X", t.Usage, t.Selector, t.MatchingType, t.Certificate)
+}
+
+// decodeTLSA parses wire format TLSA data
+func decodeTLSA(data []byte) (RData, error) {
+	r := rdataReader{data: data}
+	t := &TLSA{Usage: r.u8(), Selector: r.u8(), MatchingType: r.u8()}
+	t.Certificate = append([]byte(nil), r.rest()...)
+	return t, r.done()
+}
+
+// parseTLSA parses presentation format TLSA data; the association data may be split into several fields
+func parseTLSA(fields, names []string) (RData, error) {
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("expects usage, selector, matching type and data")
+	}
+	var nums [3]uint8
+	for i := range nums {
+		n, err := strconv.ParseUint(fields[i], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", fields[i])
+		}
+		nums[i] = uint8(n)
+	}
+	data, err := hex.DecodeString(strings.Join(fields[3:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate association data: %v", err)
+	}
+	return &TLSA{Usage: nums[0], Selector: nums[1], MatchingType: nums[2], Certificate: data}, nil
+}
+
+// TLSA returns the record's TLSA data, or nil if it isn't a TLSA record
+func (r *DnsRecord) TLSA() *TLSA {
+	t, _ := r.Data.(*TLSA)
+	return t
+}
+
+// TLSAName returns the owner name of the TLSA records for a service, e.g. _443._tcp.www.example.com
+func TLSAName(port uint16, proto, host string) string {
+	return fmt.Sprintf("_%d._%s.%s", port, proto, strings.TrimSuffix(host, "."))
+}
+
+// NewTLSA builds the TLSA data matching a certificate
+func NewTLSA(cert *x509.Certificate, usage, selector, matchingType uint8) (*TLSA, error) {
+	t := &TLSA{Usage: usage, Selector: selector, MatchingType: matchingType}
+	data, err := t.associate(cert)
+	if err != nil {
+		return nil, err
+	}
+	t.Certificate = data
+	return t, nil
+}
+
+// Matches reports whether the certificate matches the record's selector and association data
+func (t *TLSA) Matches(cert *x509.Certificate) bool {
+	data, err := t.associate(cert)
+	return err == nil && bytes.Equal(data, t.Certificate)
+}
+
+// associate computes the association data of a certificate under the record's selector and matching type
+func (t *TLSA) associate(cert *x509.Certificate) ([]byte, error) {
+	var content []byte
+	switch t.Selector {
+	case TLSA_SELECTOR_CERT:
+		content = cert.Raw
+	case TLSA_SELECTOR_SPKI:
+		content = cert.RawSubjectPublicKeyInfo
+	default:
+		return nil, fmt.Errorf("unknown TLSA selector %d", t.Selector)
+	}
+	switch t.MatchingType {
+	case TLSA_MATCH_FULL:
+		return content, nil
+	case TLSA_MATCH_SHA256:
+		sum := sha256.Sum256(content)
+		return sum[:], nil
+	case TLSA_MATCH_SHA512:
+		sum := sha512.Sum512(content)
+		return sum[:], nil
+	default:
+		return nil, fmt.Errorf("unknown TLSA matching type %d", t.MatchingType)
+	}
+}
+
+// VerifyDANE checks a server's certificate chain, leaf first, against its TLSA RRset (RFC 6698,
+// RFC 7671). It succeeds if any usable record is satisfied:
+//
+//   - PKIX-TA and PKIX-EE need a publicly trusted chain for serverName, validated against roots
+//     (nil for the system pool), that contains the matching CA or leaf.
+//   - DANE-TA needs the chain to verify for serverName up to a matching certificate, which is
+//     trusted only for this connection.
+//   - DANE-EE needs only the leaf to match; names and expiry aren't checked (RFC 7671 section 5.1).
+//
+// The TLSA records must come from a DNSSEC-validated answer for DANE to be meaningful.
+func VerifyDANE(records []*TLSA, chain []*x509.Certificate, serverName string, roots *x509.CertPool) error {
+	if len(chain) == 0 {
+		return fmt.Errorf("no certificates presented")
+	}
+	leaf := chain[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	var pkixChains [][]*x509.Certificate
+	var pkixErr error
+	pkixVerified := false
+	pkix := func() ([][]*x509.Certificate, error) {
+		if !pkixVerified {
+			pkixChains, pkixErr = leaf.Verify(x509.VerifyOptions{DNSName: serverName, Roots: roots, Intermediates: intermediates})
+			pkixVerified = true
+		}
+		return pkixChains, pkixErr
+	}
+
+	var failures []error
+	for _, t := range records {
+		switch t.Usage {
+		case DANE_EE:
+			if t.Matches(leaf) {
+				return nil
+			}
+		case DANE_TA:
+			// The trust anchor may be sent in the chain or only published in DNS as a full certificate
+			anchors := chain[1:]
+			if t.Selector == TLSA_SELECTOR_CERT && t.MatchingType == TLSA_MATCH_FULL {
+				if cert, err := x509.ParseCertificate(t.Certificate); err == nil {
+					anchors = append(anchors, cert)
+				}
+			}
+			for _, anchor := range anchors {
+				if !t.Matches(anchor) {
+					continue
+				}
+				pool := x509.NewCertPool()
+				pool.AddCert(anchor)
+				if _, err := leaf.Verify(x509.VerifyOptions{DNSName: serverName, Roots: pool, Intermediates: intermediates}); err != nil {
+					failures = append(failures, fmt.Errorf("DANE-TA: %w", err))
+					continue
+				}
+				return nil
+			}
+		case DANE_PKIX_EE, DANE_PKIX_TA:
+			chains, err := pkix()
+			if err != nil {
+				failures = append(failures, fmt.Errorf("PKIX: %w", err))
+				continue
+			}
+			for _, verified := range chains {
+				candidates := verified[:1]
+				if t.Usage == DANE_PKIX_TA {
+					candidates = verified[1:]
+				}
+				for _, cert := range candidates {
+					if t.Matches(cert) {
+						return nil
+					}
+				}
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%w: %w", ErrDANEMismatch, errors.Join(failures...))
+	}
+	return ErrDANEMismatch
+}
+
+// DANEConfig returns a TLS configuration that authenticates the server with its TLSA records instead
+// of the usual certificate checks. The records must come from a DNSSEC-validated answer.
+func DANEConfig(records []*TLSA, serverName string) *tls.Config {
+	return &tls.Config{
+		ServerName: serverName,
+		// Verification happens in VerifyConnection, which also covers DANE-EE and DANE-TA chains
+		// that wouldn't pass PKIX validation
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return VerifyDANE(records, state.PeerCertificates, serverName, nil)
+		},
+	}
+}
+
+// LookupTLSA fetches the TLSA records for a service from server
+func (c *Client) LookupTLSA(port uint16, proto, host, server string) ([]*TLSA, error) {
+	res, err := c.Lookup(TLSAName(port, proto, host), QTYPE_TLSA, server)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRcode(res); err != nil {
+		return nil, err
+	}
+	var records []*TLSA
+	for _, rec := range res.Answers {
+		if t := rec.TLSA(); t != nil {
+			records = append(records, t)
+		}
+	}
+	return records, nil
+}
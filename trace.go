@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Span kinds as numbered by OTLP
+const (
+	SpanInternal = 1
+	SpanServer   = 2
+	SpanClient   = 3
+)
+
+// Tracer records spans of sampled requests and exports them in batches to an OpenTelemetry
+// collector using OTLP over HTTP with JSON encoding. A nil Tracer records nothing.
+type Tracer struct {
+	Endpoint    string        // OTLP traces URL, e.g. http://localhost:4318/v1/traces
+	ServiceName string        // Reported as the service.name resource attribute
+	SampleRate  float64       // Fraction of requests traced, between 0 and 1
+	Interval    time.Duration // How often finished spans are sent
+	BatchSize   int           // Spans sent per export, and the number buffered before spans are dropped
+
+	spans   chan *Span
+	client  *http.Client
+	started sync.Once
+}
+
+// NewTracer initializes a Tracer exporting every request's spans to endpoint
+func NewTracer(endpoint string) *Tracer {
+	return &Tracer{
+		Endpoint:    endpoint,
+		ServiceName: "gdns",
+		SampleRate:  1,
+		Interval:    5 * time.Second,
+		BatchSize:   512,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Span is one timed operation of a trace. Its methods do nothing on a nil Span, so code can be
+// instrumented unconditionally and costs nothing for requests that aren't sampled.
+type Span struct {
+	Name       string
+	Kind       int
+	TraceID    [16]byte
+	SpanID     [8]byte
+	ParentID   [8]byte // Zero for the root span
+	Start      time.Time
+	End        time.Time
+	Attributes []SpanAttribute
+	Err        error // Why the operation failed, if it did
+
+	tracer *Tracer
+}
+
+// SpanAttribute is a key and a string, integer or boolean value describing a span
+type SpanAttribute struct {
+	Key   string
+	Value any
+}
+
+// Start begins the root span of a new trace, or returns nil if the trace isn't sampled
+func (t *Tracer) Start(name string, kind int) *Span {
+	if t == nil || t.SampleRate <= 0 {
+		return nil
+	}
+	span := &Span{Name: name, Kind: kind, Start: time.Now(), tracer: t}
+	rand.Read(span.TraceID[:])
+	rand.Read(span.SpanID[:])
+	// The low 8 bytes of a random trace ID are uniform, so they decide sampling like OTel's ratio sampler
+	if t.SampleRate < 1 && float64(binary.BigEndian.Uint64(span.TraceID[8:])>>11) >= t.SampleRate*(1<<53) {
+		return nil
+	}
+	t.started.Do(func() {
+		t.spans = make(chan *Span, t.BatchSize)
+		go t.export()
+	})
+	return span
+}
+
+// Child begins a span for an operation that is part of s
+func (s *Span) Child(name string, kind int) *Span {
+	if s == nil {
+		return nil
+	}
+	child := &Span{Name: name, Kind: kind, TraceID: s.TraceID, ParentID: s.SpanID, Start: time.Now(), tracer: s.tracer}
+	rand.Read(child.SpanID[:])
+	return child
+}
+
+// SetAttr adds an attribute to the span
+func (s *Span) SetAttr(key string, value any) {
+	if s != nil {
+		s.Attributes = append(s.Attributes, SpanAttribute{key, value})
+	}
+}
+
+// SetError marks the span as failed, unless err is nil
+func (s *Span) SetError(err error) {
+	if s != nil && err != nil {
+		s.Err = err
+	}
+}
+
+// Finish ends the span and queues it for export, dropping it if the export queue is full
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	select {
+	case s.tracer.spans <- s:
+	default:
+	}
+}
+
+// export sends finished spans to the collector every Interval or whenever a batch fills up
+func (t *Tracer) export() {
+	ticker := time.NewTicker(t.Interval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case span := <-t.spans:
+			if batch = append(batch, span); len(batch) < t.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.send(batch); err != nil {
+			log.Printf("trace export: %v", err)
+		}
+		batch = nil
+	}
+}
+
+// send posts a batch of spans as an OTLP ExportTraceServiceRequest
+func (t *Tracer) send(batch []*Span) error {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = s.otlp()
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttribute{otlpAttr("service.name", t.ServiceName)},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "github.com/AvaterClasher/gdns"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: HTTP status %s", t.Endpoint, resp.Status)
+	}
+	return nil
+}
+
+// otlpSpan is a span in the OTLP JSON encoding, where IDs are hex and timestamps decimal strings
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 is STATUS_CODE_ERROR
+	Message string `json:"message"`
+}
+
+// otlp converts the span to its OTLP JSON form
+func (s *Span) otlp() otlpSpan {
+	o := otlpSpan{
+		TraceID: hex.EncodeToString(s.TraceID[:]),
+		SpanID:  hex.EncodeToString(s.SpanID[:]),
+		Name:    s.Name,
+		Kind:    s.Kind,
+		Start:   strconv.FormatInt(s.Start.UnixNano(), 10),
+		End:     strconv.FormatInt(s.End.UnixNano(), 10),
+	}
+	if s.ParentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.ParentID[:])
+	}
+	for _, a := range s.Attributes {
+		o.Attributes = append(o.Attributes, otlpAttr(a.Key, a.Value))
+	}
+	if s.Err != nil {
+		o.Status = &otlpStatus{Code: 2, Message: s.Err.Error()}
+	}
+	return o
+}
+
+// otlpAttr encodes an attribute value as an OTLP AnyValue
+func otlpAttr(key string, value any) otlpAttribute {
+	switch v := value.(type) {
+	case bool:
+		return otlpAttribute{key, map[string]any{"boolValue": v}}
+	case int:
+		return otlpAttribute{key, map[string]any{"intValue": strconv.Itoa(v)}}
+	}
+	return otlpAttribute{key, map[string]any{"stringValue": fmt.Sprint(value)}}
+}
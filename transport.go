@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// dohContentType is the media type of DNS messages carried over HTTPS (RFC 8484)
+const dohContentType = "application/dns-message"
+
+// ExchangeTLS sends a query over DNS over TLS (RFC 7858) to server, given as host or host:port,
+// reusing connections like ExchangeTCP
+func (c *Client) ExchangeTLS(query *DnsPacket, server string) (*DnsPacket, error) {
+	addr := server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		addr = net.JoinHostPort(server, "853")
+	}
+	host, _, _ := net.SplitHostPort(addr)
+
+	return c.exchangeStream("tls://"+addr, query, func() (net.Conn, error) {
+		raw, err := c.dial(context.Background(), "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return tls.Client(raw, c.tlsConfig(host, "dot")), nil
+	})
+}
+
+// ExchangeHTTPS sends a query to a DNS over HTTPS endpoint (RFC 8484) using POST
+func (c *Client) ExchangeHTTPS(query *DnsPacket, url string) (*DnsPacket, error) {
+	// The message ID is zero on the wire so responses stay cacheable by HTTP caches
+	wire := *query
+	header := *query.Header
+	header.ID = 0
+	wire.Header = &header
+	msg, err := wire.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: HTTP status %s", url, resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, dohContentType) {
+		return nil, fmt.Errorf("%s: unexpected content type %q", url, ct)
+	}
+	packet, err := ReadMessage(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	packet.Header.ID = query.Header.ID
+	if err := acceptResponse(query, packet, false); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// tlsConfig returns the client's TLS settings for a connection to serverName negotiating protos
+func (c *Client) tlsConfig(serverName string, protos ...string) *tls.Config {
+	config := &tls.Config{}
+	if c.TLSConfig != nil {
+		config = c.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = serverName
+	}
+	config.NextProtos = protos
+	return config
+}
+
+// httpClient returns the HTTP client used for DoH, created on first use so connections are reused
+func (c *Client) httpClient() *http.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.doh == nil {
+		c.doh = &http.Client{
+			Timeout: c.Timeout,
+			Transport: &http.Transport{
+				DialContext:       c.dial,
+				TLSClientConfig:   c.tlsConfig(""),
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   90 * time.Second,
+			},
+		}
+	}
+	return c.doh
+}
+
+// dial connects to addr, substituting the address pinned for it by DDR if there is one. Host names
+// are resolved to all their addresses, which are raced for the connection Happy Eyeballs style.
+func (c *Client) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	c.mu.Lock()
+	if pinned, ok := c.pinned[addr]; ok {
+		addr = pinned
+	}
+	c.mu.Unlock()
+	d := net.Dialer{Timeout: c.Timeout}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	SortAddrs(ips, c.AddrPreference)
+	return dialHappyEyeballs(ctx, &d, network, interleaveFamilies(ips), port)
+}
@@ -0,0 +1,30 @@
+package main
+
+import "expvar"
+
+// MaxTTL is the largest TTL a record may have. The field is 32 bits but only positive values of a
+// signed integer are meaningful (RFC 2181 section 8).
+const MaxTTL = 1<<31 - 1
+
+// ttlSanitized counts records whose TTL was over MaxTTL, zeroed when read off the wire and capped
+// when read from a zone file
+var ttlSanitized = expvar.NewInt("ttl_sanitized_records")
+
+// wireTTL returns the TTL of a record received from another server, 0 if its most significant bit
+// is set, so broken servers can't get answers cached for decades
+func wireTTL(ttl uint32) uint32 {
+	if ttl > MaxTTL {
+		ttlSanitized.Add(1)
+		return 0
+	}
+	return ttl
+}
+
+// capTTL returns a TTL given in a zone file, lowered to MaxTTL if it is over it
+func capTTL(ttl uint64) uint32 {
+	if ttl > MaxTTL {
+		ttlSanitized.Add(1)
+		return MaxTTL
+	}
+	return uint32(ttl)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What TunnelDetector does about clients it suspects of tunneling
+const (
+	TunnelAlert    = "alert"    // Log them
+	TunnelThrottle = "throttle" // Log them and refuse their queries under the domain for a while
+)
+
+// tunnelWindow is how long query counts are kept before they start over
+const tunnelWindow = time.Minute
+
+// maxTunnelKeys bounds the client and domain pairs counted per window
+const maxTunnelKeys = 100000
+
+// ParseTunnelMode checks the name of a tunnel detector mode
+func ParseTunnelMode(mode string) (string, error) {
+	switch mode {
+	case TunnelAlert, TunnelThrottle:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown tunnel detection mode %q, expected %s or %s", mode, TunnelAlert, TunnelThrottle)
+}
+
+// tunnelCounts is what a client asked under a domain in the current window
+type tunnelCounts struct {
+	names      map[string]struct{} // Distinct subdomains, up to one more than the limit
+	suspicious int                 // Queries for long or random looking names
+}
+
+// TunnelDetector watches for clients tunneling data through DNS, which shows as many queries for
+// long, random looking and never repeated names under one domain. Clients exceeding the limits
+// within a minute are logged and, in throttle mode, refused further queries under that domain
+// until Penalty has passed.
+type TunnelDetector struct {
+	Next          Handler
+	Mode          string        // TunnelAlert or TunnelThrottle
+	MaxUnique     int           // Distinct subdomains a client may ask for under a domain each minute
+	MaxSuspicious int           // Long or random looking names a client may ask for under a domain each minute
+	MaxLength     int           // Names longer than this are suspicious
+	MaxLabel      int           // Names with a longer label are suspicious
+	MinEntropy    float64       // Subdomains of at least 24 characters with more bits of entropy per character are suspicious
+	Penalty       time.Duration // How long a flagged client stays flagged
+
+	counts    map[string]*tunnelCounts // By client and domain
+	flagged   map[string]time.Time     // When flags on clients and domains expire
+	windowEnd time.Time
+	mu        sync.Mutex
+}
+
+// NewTunnelDetector initializes a TunnelDetector with default limits
+func NewTunnelDetector(next Handler, mode string) *TunnelDetector {
+	return &TunnelDetector{
+		Next:          next,
+		Mode:          mode,
+		MaxUnique:     100,
+		MaxSuspicious: 20,
+		MaxLength:     100,
+		MaxLabel:      40,
+		MinEntropy:    3.5,
+		Penalty:       10 * time.Minute,
+		counts:        make(map[string]*tunnelCounts),
+		flagged:       make(map[string]time.Time),
+	}
+}
+
+// ServeDNS counts the query against its client and domain, and refuses it if the client is being
+// throttled there
+func (h *TunnelDetector) ServeDNS(req *Request) *DnsPacket {
+	ip := addrIP(req.RemoteAddr)
+	if len(req.Packet.Questions) == 0 || ip == nil {
+		return h.Next.ServeDNS(req)
+	}
+	name := strings.ToLower(strings.TrimSuffix(req.Packet.Questions[0].Name, "."))
+	domain, sub := splitBaseDomain(name)
+	if sub == "" {
+		return h.Next.ServeDNS(req)
+	}
+	key := ip.String() + " " + domain
+	now := time.Now()
+
+	h.mu.Lock()
+	if now.After(h.windowEnd) || len(h.counts) >= maxTunnelKeys {
+		h.counts = make(map[string]*tunnelCounts)
+		h.windowEnd = now.Add(tunnelWindow)
+		for k, until := range h.flagged {
+			if now.After(until) {
+				delete(h.flagged, k)
+			}
+		}
+	}
+	if until, ok := h.flagged[key]; ok && now.Before(until) {
+		h.mu.Unlock()
+		if h.Mode == TunnelThrottle {
+			req.Blocked = true
+			return NewErrorResponse(req.Packet, REFUSED)
+		}
+		return h.Next.ServeDNS(req)
+	}
+	c := h.counts[key]
+	if c == nil {
+		c = &tunnelCounts{names: make(map[string]struct{})}
+		h.counts[key] = c
+	}
+	if len(c.names) <= h.MaxUnique {
+		c.names[sub] = struct{}{}
+	}
+	var reason string
+	if h.suspicious(name, sub) {
+		c.suspicious++
+		if c.suspicious > h.MaxSuspicious {
+			reason = fmt.Sprintf("more than %d long or random looking names a minute", h.MaxSuspicious)
+		}
+	}
+	if len(c.names) > h.MaxUnique {
+		reason = fmt.Sprintf("more than %d distinct names a minute", h.MaxUnique)
+	}
+	if reason != "" {
+		h.flagged[key] = now.Add(h.Penalty)
+		delete(h.counts, key)
+	}
+	h.mu.Unlock()
+
+	if reason != "" {
+		action := "flagged"
+		if h.Mode == TunnelThrottle {
+			action = "throttled for " + h.Penalty.String()
+		}
+		log.Printf("tunnel: client %s %s under %s: %s", ip, action, domain, reason)
+	}
+	return h.Next.ServeDNS(req)
+}
+
+// suspicious reports whether a name is long or random looking enough to carry tunneled data
+func (h *TunnelDetector) suspicious(name, sub string) bool {
+	if len(name) > h.MaxLength {
+		return true
+	}
+	for _, label := range strings.Split(sub, ".") {
+		if len(label) > h.MaxLabel {
+			return true
+		}
+	}
+	data := strings.ReplaceAll(sub, ".", "")
+	return len(data) >= 24 && shannonEntropy(data) > h.MinEntropy
+}
+
+// shannonEntropy returns the entropy of the characters of s in bits per character
+func shannonEntropy(s string) float64 {
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	entropy := 0.0
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(s))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
@@ -0,0 +1,42 @@
+package main
+
+import "net"
+
+// datagram is a single UDP message and its peer address
+type datagram struct {
+	buf  []byte       // Message storage; on read it must be allocated by the caller
+	n    int          // Length of the message in buf
+	addr *net.UDPAddr // Source address on read, destination on write
+}
+
+// batchConn reads and writes several datagrams per call. ReadBatch blocks until at least one
+// datagram arrives and returns how many of msgs were filled; WriteBatch returns how many were sent.
+type batchConn interface {
+	ReadBatch(msgs []datagram) (int, error)
+	WriteBatch(msgs []datagram) (int, error)
+}
+
+// singleConn is the portable batchConn that moves one datagram per system call
+type singleConn struct {
+	conn *net.UDPConn
+}
+
+// ReadBatch reads a single datagram into msgs[0]
+func (c *singleConn) ReadBatch(msgs []datagram) (int, error) {
+	n, addr, err := c.conn.ReadFromUDP(msgs[0].buf)
+	if err != nil {
+		return 0, err
+	}
+	msgs[0].n, msgs[0].addr = n, addr
+	return 1, nil
+}
+
+// WriteBatch sends the datagrams one at a time
+func (c *singleConn) WriteBatch(msgs []datagram) (int, error) {
+	for i, msg := range msgs {
+		if _, err := c.conn.WriteToUDP(msg.buf[:msg.n], msg.addr); err != nil {
+			return i, err
+		}
+	}
+	return len(msgs), nil
+}
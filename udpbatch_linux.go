@@ -0,0 +1,188 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr mirrors struct mmsghdr from <sys/socket.h>
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// mmsgConn moves batches of datagrams with recvmmsg(2) and sendmmsg(2). Reads and writes use
+// separate headers so one goroutine may read while another writes.
+type mmsgConn struct {
+	raw   syscall.RawConn
+	inet6 bool // Socket is AF_INET6, so IPv4 peers are addressed as v4-mapped
+	rd    mmsgBatch
+	wr    mmsgBatch
+}
+
+// mmsgBatch is the kernel-facing storage for one direction of batched I/O
+type mmsgBatch struct {
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrAny
+}
+
+// newMmsgBatch allocates storage for size datagrams
+func newMmsgBatch(size int) mmsgBatch {
+	return mmsgBatch{
+		hdrs:  make([]mmsghdr, size),
+		iovs:  make([]syscall.Iovec, size),
+		names: make([]syscall.RawSockaddrAny, size),
+	}
+}
+
+// newBatchConn returns a recvmmsg/sendmmsg based batchConn, or the portable one if the socket can't be used directly
+func newBatchConn(conn *net.UDPConn, size int) batchConn {
+	raw, err := conn.SyscallConn()
+	if err != nil || size == 1 {
+		return &singleConn{conn: conn}
+	}
+	inet6 := false
+	raw.Control(func(fd uintptr) {
+		if sa, err := syscall.Getsockname(int(fd)); err == nil {
+			_, inet6 = sa.(*syscall.SockaddrInet6)
+		}
+	})
+	return &mmsgConn{
+		raw:   raw,
+		inet6: inet6,
+		rd:    newMmsgBatch(size),
+		wr:    newMmsgBatch(size),
+	}
+}
+
+// ReadBatch receives up to len(msgs) datagrams in one system call
+func (c *mmsgConn) ReadBatch(msgs []datagram) (int, error) {
+	b := &c.rd
+	count := len(msgs)
+	if count > len(b.hdrs) {
+		count = len(b.hdrs)
+	}
+	for i := 0; i < count; i++ {
+		b.iovs[i].Base = &msgs[i].buf[0]
+		b.iovs[i].SetLen(len(msgs[i].buf))
+		b.hdrs[i] = mmsghdr{}
+		b.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&b.names[i]))
+		b.hdrs[i].hdr.Namelen = uint32(unsafe.Sizeof(b.names[i]))
+		b.hdrs[i].hdr.Iov = &b.iovs[i]
+		b.hdrs[i].hdr.Iovlen = 1
+	}
+
+	var n int
+	var errno syscall.Errno
+	err := c.raw.Read(func(fd uintptr) bool {
+		r, _, e := syscall.Syscall6(sysRecvmmsg, fd, uintptr(unsafe.Pointer(&b.hdrs[0])), uintptr(count), 0, 0, 0)
+		if e == syscall.EAGAIN {
+			return false
+		}
+		n, errno = int(r), e
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, &net.OpError{Op: "recvmmsg", Net: "udp", Err: errno}
+	}
+
+	for i := 0; i < n; i++ {
+		msgs[i].n = int(b.hdrs[i].len)
+		msgs[i].addr = sockaddrToUDP(&b.names[i])
+	}
+	return n, nil
+}
+
+// WriteBatch sends up to len(msgs) datagrams in one system call
+func (c *mmsgConn) WriteBatch(msgs []datagram) (int, error) {
+	b := &c.wr
+	count := len(msgs)
+	if count > len(b.hdrs) {
+		count = len(b.hdrs)
+	}
+	for i := 0; i < count; i++ {
+		namelen := udpToSockaddr(msgs[i].addr, &b.names[i], c.inet6)
+		b.iovs[i].Base = &msgs[i].buf[0]
+		b.iovs[i].SetLen(msgs[i].n)
+		b.hdrs[i] = mmsghdr{}
+		b.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&b.names[i]))
+		b.hdrs[i].hdr.Namelen = namelen
+		b.hdrs[i].hdr.Iov = &b.iovs[i]
+		b.hdrs[i].hdr.Iovlen = 1
+	}
+
+	var n int
+	var errno syscall.Errno
+	err := c.raw.Write(func(fd uintptr) bool {
+		r, _, e := syscall.Syscall6(sysSendmmsg, fd, uintptr(unsafe.Pointer(&b.hdrs[0])), uintptr(count), 0, 0, 0)
+		if e == syscall.EAGAIN {
+			return false
+		}
+		n, errno = int(r), e
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, &net.OpError{Op: "sendmmsg", Net: "udp", Err: errno}
+	}
+	return n, nil
+}
+
+// sockaddrToUDP converts a kernel socket address into a UDP address
+func sockaddrToUDP(sa *syscall.RawSockaddrAny) *net.UDPAddr {
+	switch sa.Addr.Family {
+	case syscall.AF_INET:
+		in := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		port := (*[2]byte)(unsafe.Pointer(&in.Port))
+		return &net.UDPAddr{
+			IP:   net.IPv4(in.Addr[0], in.Addr[1], in.Addr[2], in.Addr[3]),
+			Port: int(port[0])<<8 | int(port[1]),
+		}
+	case syscall.AF_INET6:
+		in := (*syscall.RawSockaddrInet6)(unsafe.Pointer(sa))
+		port := (*[2]byte)(unsafe.Pointer(&in.Port))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, in.Addr[:])
+		addr := &net.UDPAddr{IP: ip, Port: int(port[0])<<8 | int(port[1])}
+		if in.Scope_id != 0 {
+			if ifi, err := net.InterfaceByIndex(int(in.Scope_id)); err == nil {
+				addr.Zone = ifi.Name
+			}
+		}
+		return addr
+	}
+	return &net.UDPAddr{}
+}
+
+// udpToSockaddr fills sa with the kernel form of addr and returns its length
+func udpToSockaddr(addr *net.UDPAddr, sa *syscall.RawSockaddrAny, inet6 bool) uint32 {
+	*sa = syscall.RawSockaddrAny{}
+	if ip4 := addr.IP.To4(); ip4 != nil && !inet6 {
+		in := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		in.Family = syscall.AF_INET
+		port := (*[2]byte)(unsafe.Pointer(&in.Port))
+		port[0], port[1] = byte(addr.Port>>8), byte(addr.Port)
+		copy(in.Addr[:], ip4)
+		return syscall.SizeofSockaddrInet4
+	}
+	in := (*syscall.RawSockaddrInet6)(unsafe.Pointer(sa))
+	in.Family = syscall.AF_INET6
+	port := (*[2]byte)(unsafe.Pointer(&in.Port))
+	port[0], port[1] = byte(addr.Port>>8), byte(addr.Port)
+	copy(in.Addr[:], addr.IP.To16())
+	if addr.Zone != "" {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			in.Scope_id = uint32(ifi.Index)
+		}
+	}
+	return syscall.SizeofSockaddrInet6
+}
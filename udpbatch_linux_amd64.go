@@ -0,0 +1,7 @@
+package main
+
+// System call numbers for recvmmsg(2) and sendmmsg(2), which package syscall doesn't define on amd64
+const (
+	sysRecvmmsg = 299
+	sysSendmmsg = 307
+)
@@ -0,0 +1,9 @@
+package main
+
+import "syscall"
+
+// System call numbers for recvmmsg(2) and sendmmsg(2)
+const (
+	sysRecvmmsg = syscall.SYS_RECVMMSG
+	sysSendmmsg = syscall.SYS_SENDMMSG
+)
@@ -0,0 +1,10 @@
+//go:build !linux || !(amd64 || arm64)
+
+package main
+
+import "net"
+
+// newBatchConn returns the portable one-datagram-per-call implementation on this platform
+func newBatchConn(conn *net.UDPConn, size int) batchConn {
+	return &singleConn{conn: conn}
+}
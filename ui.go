@@ -0,0 +1,17 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// uiPage is the web UI, a single page drawing its data from the admin API
+//
+//go:embed ui/index.html
+var uiPage []byte
+
+// serveUI serves the web UI
+func serveUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(uiPage)
+}
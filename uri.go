@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// URI is the data of a uniform resource identifier record (RFC 7553)
+type URI struct {
+	Priority uint16 // Records with lower priority are tried first
+	Weight   uint16 // Relative selection weight between records of equal priority
+	Target   string // The URI, which fills the rest of the data without a length prefix
+}
+
+// RRType returns QTYPE_URI
+func (u *URI) RRType() QueryType {
+	return QTYPE_URI
+}
+
+// Pack encodes the data in wire format
+func (u *URI) Pack() ([]byte, error) {
+	if u.Target == "" {
+		return nil, fmt.Errorf("URI record has an empty target")
+	}
+	var w rdataWriter
+	w.u16(u.Priority)
+	w.u16(u.Weight)
+	w.buf = append(w.buf, u.Target...)
+	return w.bytes()
+}
+
+// String formats the data in presentation format
+func (u *URI) String() string {
+	return fmt.Sprintf("%d %d %s", u.Priority, u.Weight, quoteCharString(u.Target))
+}
+
+// decodeURI parses wire format URI data
+func decodeURI(data []byte) (RData, error) {
+	r := rdataReader{data: data}
+	u := &URI{Priority: r.u16(), Weight: r.u16(), Target: string(r.rest())}
+	if err := r.done(); err != nil {
+		return nil, err
+	}
+	if u.Target == "" {
+		return nil, fmt.Errorf("empty target")
+	}
+	return u, nil
+}
+
+// parseURI parses presentation format URI data; unlike a character string, the target may exceed 255 bytes
+func parseURI(fields, names []string) (RData, error) {
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("expects 3 fields, got %d", len(fields))
+	}
+	prio, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid priority %q", fields[0])
+	}
+	weight, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid weight %q", fields[1])
+	}
+	if fields[2] == "" {
+		return nil, fmt.Errorf("empty target")
+	}
+	return &URI{Priority: uint16(prio), Weight: uint16(weight), Target: fields[2]}, nil
+}
+
+// URI returns the record's URI data, or nil if it isn't a URI record
+func (r *DnsRecord) URI() *URI {
+	u, _ := r.Data.(*URI)
+	return u
+}
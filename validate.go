@@ -0,0 +1,732 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Security is the DNSSEC validation result of a response (RFC 4035 section 4.3)
+type Security uint8
+
+const (
+	SecurityInsecure Security = iota // Provably unsigned, or signed only with unsupported algorithms
+	SecuritySecure                   // Signatures chain up to a trust anchor
+	SecurityBogus                    // Signatures or proofs are missing or don't verify where they should
+)
+
+// String returns the RFC 4035 name of the result
+func (s Security) String() string {
+	switch s {
+	case SecuritySecure:
+		return "secure"
+	case SecurityBogus:
+		return "bogus"
+	}
+	return "insecure"
+}
+
+// RootAnchors are the DS records of the root zone's key signing keys, KSK-2017 and KSK-2024
+var RootAnchors = []string{
+	". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// Bounds on how long a Validator keeps what it learned about a zone's keys
+const (
+	validatorMinTTL = time.Minute
+	validatorMaxTTL = time.Hour
+)
+
+// bogusAnswers counts responses answered SERVFAIL because they failed validation
+var bogusAnswers = expvar.NewInt("dnssec_bogus_answers")
+
+// Validator checks the DNSSEC signatures of responses from a resolver, fetching the DS and DNSKEY
+// records that chain them up to a trust anchor from the same resolver. It acts as a validating
+// stub: the resolver may validate too, but only what the validator checks itself is trusted.
+type Validator struct {
+	Client    *Client
+	Upstreams []string                         // Resolvers queried for DS and DNSKEY records, tried in order
+	Anchors   []*DnsRecord                     // DS or DNSKEY records of the trusted keys, RootAnchors by default
+	Trace     func(format string, args ...any) // Called with each step of validation when set, to diagnose bogus results
+
+	zones map[string]*zoneTrust // Keyed by name, what its DS query showed
+	mu    sync.Mutex
+}
+
+// zoneTrust is what a Validator learned about a name from the DS records at it
+type zoneTrust struct {
+	cut      bool      // The name is the apex of a signed zone, whose keys are below
+	keys     []*DNSKEY // Verified keys of the zone
+	insecure bool      // The name is the apex of an unsigned zone, or one only signed with unsupported algorithms
+	missing  bool      // The name provably doesn't exist, so neither do names below it
+	err      error     // Why the DS or DNSKEY records failed validation
+	expires  time.Time
+}
+
+// NewValidator initializes a Validator trusting the root zone's keys
+func NewValidator(client *Client, upstreams []string) *Validator {
+	v := &Validator{Client: client, Upstreams: upstreams}
+	zone, err := ParseZone(strings.NewReader(strings.Join(RootAnchors, "\n")), "")
+	if err != nil {
+		panic(err)
+	}
+	v.Anchors = zone.Records
+	return v
+}
+
+// LoadTrustAnchors replaces the trust anchors with the DS and DNSKEY records in a master file
+func (v *Validator) LoadTrustAnchors(path string) error {
+	zone, err := LoadZoneFile(path, "")
+	if err != nil {
+		return err
+	}
+	var anchors []*DnsRecord
+	for _, rec := range zone.Records {
+		if rec.Qtype == QTYPE_DS || rec.Qtype == QTYPE_DNSKEY {
+			anchors = append(anchors, rec)
+		}
+	}
+	if len(anchors) == 0 {
+		return fmt.Errorf("%s: no DS or DNSKEY records", path)
+	}
+	v.Anchors = anchors
+	return nil
+}
+
+// tracef reports a step of validation to the Trace function, if any
+func (v *Validator) tracef(format string, args ...any) {
+	if v.Trace != nil {
+		v.Trace(format, args...)
+	}
+}
+
+// traceProof reports the outcome of a denial proof
+func (v *Validator) traceProof(what string, denial *Denial, err error) {
+	switch {
+	case err == nil:
+		v.tracef("%s: proven by %d NSEC and %d NSEC3 records", what, len(denial.nsec), len(denial.nsec3))
+	case errors.Is(err, ErrInsecureProof):
+		v.tracef("%s: insecure, %v", what, err)
+	default:
+		v.tracef("%s: not proven, %v", what, err)
+	}
+}
+
+// NewDNSSECQuery returns a query for a name's records of the type, with DO set to get their
+// signatures and CD set to get them even if the resolver finds them bogus
+func NewDNSSECQuery(name string, qtype QueryType) *DnsPacket {
+	query := NewDnsPacket()
+	query.Header.RecursionDesired = true
+	query.Header.CheckingDisabled = true
+	query.Questions = append(query.Questions, NewDnsQuestion(name, qtype))
+	query.SetEDNS(DefaultEDNSSize).TTL |= ednsDO
+	return query
+}
+
+// query asks the upstreams for a name's records of the type, with their signatures and without
+// the upstream's own validation getting in the way
+func (v *Validator) query(name Name, qtype QueryType) (*DnsPacket, error) {
+	query := NewDNSSECQuery(name.String(), qtype)
+	v.tracef("querying %s %s", name.FQDN(), qtype)
+	err := fmt.Errorf("no upstreams")
+	for _, upstream := range v.Upstreams {
+		var res *DnsPacket
+		res, err = v.Client.Exchange(query, upstream)
+		if err == nil && res.Header.TruncatedMessage {
+			res, err = v.Client.ExchangeTCP(query, upstream)
+		}
+		if err == nil && (res.Header.ResCode == NOERROR || res.Header.ResCode == NXDOMAIN) {
+			return res, nil
+		}
+		if err == nil {
+			err = checkRcode(res)
+		}
+	}
+	return nil, fmt.Errorf("%s %s: %w", name.FQDN(), qtype, err)
+}
+
+// signedSets groups records into RRsets and collects the signatures over each
+func signedSets(records []*DnsRecord) ([]*RRSet, map[rrsetKey][]*RRSIG) {
+	var data []*DnsRecord
+	sigs := make(map[rrsetKey][]*RRSIG)
+	for _, rec := range records {
+		if sig := rec.RRSIG(); sig != nil {
+			key := rrsetKey{Name: parseNameLoose(rec.Name).Key(), Qtype: sig.TypeCovered}
+			sigs[key] = append(sigs[key], sig)
+		} else if rec.Qtype != QTYPE_OPT {
+			data = append(data, rec)
+		}
+	}
+	sets, _ := GroupRRSets(data)
+	return sets, sigs
+}
+
+// setKey returns the key of an RRset's signatures in the map from signedSets
+func setKey(set *RRSet) rrsetKey {
+	return rrsetKey{Name: parseNameLoose(set.Name).Key(), Qtype: set.Qtype}
+}
+
+// verifySet checks that one of the signatures by zone verifies the RRset with one of the keys. It
+// returns the verifying signature.
+func (v *Validator) verifySet(set *RRSet, sigs []*RRSIG, zone Name, keys []*DNSKEY, now time.Time) (*RRSIG, error) {
+	err := fmt.Errorf("%w: %s %s has no signature by %s", ErrBogus, set.Name, set.Qtype, zone.FQDN())
+	for _, sig := range sigs {
+		if !parseNameLoose(sig.SignerName).Equal(zone) {
+			continue
+		}
+		found := false
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			found = true
+			if err = VerifyRRSIG(set, sig, key, now); err == nil {
+				v.tracef("%s %s: signature by %s key %d verifies", parseNameLoose(set.Name).FQDN(), set.Qtype, zone.FQDN(), sig.KeyTag)
+				return sig, nil
+			}
+			v.tracef("%s %s: %v", parseNameLoose(set.Name).FQDN(), set.Qtype, err)
+		}
+		if !found {
+			v.tracef("%s %s: signature by %s key %d, which isn't one of its verified keys", parseNameLoose(set.Name).FQDN(), set.Qtype, zone.FQDN(), sig.KeyTag)
+		}
+	}
+	return nil, err
+}
+
+// trustAnchor returns the trust anchors owned by name, if any
+func (v *Validator) trustAnchor(name Name) []*DnsRecord {
+	var anchors []*DnsRecord
+	for _, rec := range v.Anchors {
+		if parseNameLoose(rec.Name).Equal(name) {
+			anchors = append(anchors, rec)
+		}
+	}
+	return anchors
+}
+
+// zoneKeys fetches the DNSKEY RRset of a zone and returns its zone keys if one of the keys the DS
+// or DNSKEY records in trusted vouch for signed it. It reports insecure zones, whose trusted
+// records all use unsupported algorithms or digests, with ErrInsecureProof.
+func (v *Validator) zoneKeys(zone Name, trusted []*DnsRecord, now time.Time) ([]*DNSKEY, uint32, error) {
+	res, err := v.query(zone, QTYPE_DNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+	sets, sigs := signedSets(res.Answers)
+	var set *RRSet
+	for _, s := range sets {
+		if s.Qtype == QTYPE_DNSKEY && parseNameLoose(s.Name).Equal(zone) {
+			set = s
+		}
+	}
+	if set == nil {
+		return nil, 0, fmt.Errorf("%w: %s has no DNSKEY records", ErrBogus, zone.FQDN())
+	}
+	for _, rec := range set.Records {
+		if key := rec.DNSKEY(); key != nil {
+			v.tracef("%s DNSKEY: key %d, algorithm %d, flags %d", zone.FQDN(), key.KeyTag(), key.Algorithm, key.Flags)
+		}
+	}
+
+	var entry []*DNSKEY
+	supported := false
+	for _, rec := range set.Records {
+		key := rec.DNSKEY()
+		if key == nil || dnssecAlgorithmNames[key.Algorithm] == "" {
+			continue
+		}
+		tag := key.KeyTag()
+		for _, anchor := range trusted {
+			switch {
+			case anchor.DNSKEY() != nil:
+				if a := anchor.DNSKEY(); a.Algorithm == key.Algorithm {
+					supported = true
+					if string(a.PublicKey) == string(key.PublicKey) {
+						v.tracef("%s DNSKEY: key %d is a trust anchor", zone.FQDN(), tag)
+						entry = append(entry, key)
+					}
+				}
+			case anchor.DS() != nil:
+				if ds := anchor.DS(); ds.Algorithm == key.Algorithm && dsDigestNames[ds.DigestType] != "" {
+					supported = true
+					if ds.Matches(zone.String(), key) {
+						v.tracef("%s DNSKEY: key %d matches DS %d with %s digest", zone.FQDN(), tag, ds.KeyTag, dsDigestNames[ds.DigestType])
+						entry = append(entry, key)
+					} else if ds.KeyTag == tag {
+						v.tracef("%s DNSKEY: key %d doesn't match DS %d with %s digest", zone.FQDN(), tag, ds.KeyTag, dsDigestNames[ds.DigestType])
+					}
+				}
+			}
+		}
+	}
+	if !supported {
+		return nil, 0, fmt.Errorf("%w: %s is only signed with unsupported algorithms", ErrInsecureProof, zone.FQDN())
+	}
+	if len(entry) == 0 {
+		return nil, 0, fmt.Errorf("%w: no DNSKEY of %s matches its DS records", ErrBogus, zone.FQDN())
+	}
+	if _, err := v.verifySet(set, sigs[setKey(set)], zone, entry, now); err != nil {
+		return nil, 0, err
+	}
+	var keys []*DNSKEY
+	for _, rec := range set.Records {
+		if key := rec.DNSKEY(); key != nil && key.Flags&DNSKEY_ZONE != 0 && key.Protocol == dnskeyProtocol {
+			keys = append(keys, key)
+		}
+	}
+	return keys, set.TTL, nil
+}
+
+// trust finds out from its DS records whether name is the apex of a signed zone below parent,
+// whose keys are given, and fetches its keys if so
+func (v *Validator) trust(name, parent Name, parentKeys []*DNSKEY, now time.Time) *zoneTrust {
+	v.mu.Lock()
+	t := v.zones[name.Key()]
+	v.mu.Unlock()
+	if t != nil && now.Before(t.expires) {
+		return t
+	}
+
+	t = &zoneTrust{}
+	ttl := v.learn(t, name, parent, parentKeys, now)
+	if t.err != nil && !errors.Is(t.err, ErrBogus) {
+		// Network failures aren't remembered
+		return t
+	}
+	t.expires = now.Add(min(max(time.Duration(ttl)*time.Second, validatorMinTTL), validatorMaxTTL))
+	v.mu.Lock()
+	if v.zones == nil {
+		v.zones = make(map[string]*zoneTrust)
+	}
+	v.zones[name.Key()] = t
+	v.mu.Unlock()
+	return t
+}
+
+// learn fills in what the DS records at name say about it and returns the TTL to keep that for
+func (v *Validator) learn(t *zoneTrust, name, parent Name, parentKeys []*DNSKEY, now time.Time) uint32 {
+	res, err := v.query(name, QTYPE_DS)
+	if err != nil {
+		t.err = err
+		return 0
+	}
+	sets, sigs := signedSets(append(res.Answers, res.Authorities...))
+	var denial Denial
+	var ds *RRSet
+	for _, set := range sets {
+		if set.Qtype == QTYPE_NS && len(sigs[setKey(set)]) == 0 {
+			// Delegation NS records aren't signed by the parent
+			continue
+		}
+		if _, err := v.verifySet(set, sigs[setKey(set)], parent, parentKeys, now); err != nil {
+			t.err = err
+			return 0
+		}
+		switch {
+		case set.Qtype == QTYPE_DS && parseNameLoose(set.Name).Equal(name):
+			ds = set
+		case set.Qtype == QTYPE_NSEC || set.Qtype == QTYPE_NSEC3:
+			for _, rec := range set.Records {
+				denial.Add(rec)
+			}
+		}
+	}
+
+	if ds != nil {
+		keys, ttl, err := v.zoneKeys(name, ds.Records, now)
+		switch {
+		case errors.Is(err, ErrInsecureProof):
+			t.insecure = true
+		case err != nil:
+			t.err = err
+		default:
+			t.cut, t.keys = true, keys
+		}
+		return min(ds.TTL, ttl)
+	}
+	if res.Header.ResCode == NXDOMAIN {
+		t.err = denial.ProveNXDomain(name)
+		v.traceProof(fmt.Sprintf("%s doesn't exist", name.FQDN()), &denial, t.err)
+		if errors.Is(t.err, ErrInsecureProof) {
+			t.err, t.insecure = nil, true
+		}
+		t.missing = t.err == nil
+		return responseTTL(res)
+	}
+	err = denial.ProveNoData(name, QTYPE_DS)
+	v.traceProof(fmt.Sprintf("%s has no DS records", name.FQDN()), &denial, err)
+	switch {
+	case errors.Is(err, ErrInsecureProof):
+		t.insecure = true
+	case err != nil:
+		t.err = err
+	default:
+		// Without DS records, a delegation is to an unsigned zone; otherwise the name is in the parent
+		if n := denial.nsecMatching(name); n != nil && n.HasType(QTYPE_NS) {
+			t.insecure = true
+		} else if n := denial.nsec3Matching(name); n != nil && n.HasType(QTYPE_NS) {
+			t.insecure = true
+		}
+	}
+	return responseTTL(res)
+}
+
+// walk follows the chain of trust from the closest trust anchor down to name and returns the
+// closest zone above or at name with its verified keys. It returns ErrInsecureProof, wrapped, if
+// there is no trust anchor above name or the chain reaches an unsigned zone on the way.
+func (v *Validator) walk(name Name, now time.Time) (Name, []*DNSKEY, error) {
+	var zone Name
+	var keys []*DNSKEY
+	found := false
+	for i := name.CountLabels(); i >= 0 && !found; i-- {
+		zone = Name{labels: name.labels[name.CountLabels()-i:]}
+		anchors := v.trustAnchor(zone)
+		if len(anchors) == 0 {
+			continue
+		}
+		found = true
+		v.tracef("%s: trust anchor", zone.FQDN())
+		t := v.anchorTrust(zone, anchors, now)
+		if t.err != nil {
+			return zone, nil, t.err
+		}
+		if t.insecure {
+			return zone, nil, fmt.Errorf("%w: trust anchor for %s uses unsupported algorithms", ErrInsecureProof, zone.FQDN())
+		}
+		keys = t.keys
+	}
+	if !found {
+		return Name{}, nil, fmt.Errorf("%w: no trust anchor for %s", ErrInsecureProof, name.FQDN())
+	}
+
+	for i := zone.CountLabels() + 1; i <= name.CountLabels(); i++ {
+		child := Name{labels: name.labels[name.CountLabels()-i:]}
+		t := v.trust(child, zone, keys, now)
+		switch {
+		case t.err != nil:
+			v.tracef("%s: %v", child.FQDN(), t.err)
+			return zone, nil, t.err
+		case t.insecure:
+			v.tracef("%s: unsigned zone", child.FQDN())
+			return child, nil, fmt.Errorf("%w: %s is an unsigned zone", ErrInsecureProof, child.FQDN())
+		case t.missing:
+			v.tracef("%s: doesn't exist", child.FQDN())
+			return zone, keys, nil
+		case t.cut:
+			v.tracef("%s: signed zone with %d verified keys", child.FQDN(), len(t.keys))
+			zone, keys = child, t.keys
+		default:
+			v.tracef("%s: no zone cut, in %s", child.FQDN(), zone.FQDN())
+		}
+	}
+	return zone, keys, nil
+}
+
+// anchorTrust returns the keys of a zone with a trust anchor
+func (v *Validator) anchorTrust(zone Name, anchors []*DnsRecord, now time.Time) *zoneTrust {
+	key := "anchor/" + zone.Key()
+	v.mu.Lock()
+	t := v.zones[key]
+	v.mu.Unlock()
+	if t != nil && now.Before(t.expires) {
+		return t
+	}
+	t = &zoneTrust{cut: true}
+	keys, ttl, err := v.zoneKeys(zone, anchors, now)
+	switch {
+	case errors.Is(err, ErrInsecureProof):
+		t.insecure = true
+	case err != nil:
+		t.err = err
+		if !errors.Is(err, ErrBogus) {
+			return t
+		}
+	default:
+		t.keys = keys
+	}
+	t.expires = now.Add(min(max(time.Duration(ttl)*time.Second, validatorMinTTL), validatorMaxTTL))
+	v.mu.Lock()
+	if v.zones == nil {
+		v.zones = make(map[string]*zoneTrust)
+	}
+	v.zones[key] = t
+	v.mu.Unlock()
+	return t
+}
+
+// Validate checks the signatures of a response's answer and authority sections, and its proofs
+// that names or types don't exist. Errors explain bogus results, or failures to fetch the keys.
+func (v *Validator) Validate(res *DnsPacket) (Security, error) {
+	if len(res.Questions) != 1 || res.Header.ResCode != NOERROR && res.Header.ResCode != NXDOMAIN {
+		return SecurityInsecure, nil
+	}
+	now := time.Now()
+	q := res.Questions[0]
+	qtype := QueryType(q.Qtype)
+	insecure := false
+	type proof struct {
+		set  *RRSet
+		zone Name // The zone whose keys verified the set
+	}
+	var proofs []proof
+	type wildcard struct{ name, closest, zone Name }
+	var wildcards []wildcard
+
+	// check verifies an RRset with the keys of the zone that signed it, and returns that zone. It
+	// returns the root and sets insecure for RRsets from unsigned zones.
+	check := func(set *RRSet, sigs []*RRSIG) (Name, error) {
+		owner := parseNameLoose(set.Name)
+		if len(sigs) == 0 {
+			_, _, err := v.walk(owner, now)
+			if errors.Is(err, ErrInsecureProof) {
+				insecure = true
+				return Name{}, nil
+			}
+			if err != nil {
+				return Name{}, err
+			}
+			v.tracef("%s %s: not signed, but in signed zone", parseNameLoose(set.Name).FQDN(), set.Qtype)
+			return Name{}, fmt.Errorf("%w: %s %s is not signed", ErrBogus, set.Name, set.Qtype)
+		}
+		var err error
+		for _, sig := range sigs {
+			signer := parseNameLoose(sig.SignerName)
+			if !owner.IsSubdomainOf(signer) {
+				continue
+			}
+			var zone Name
+			var keys []*DNSKEY
+			zone, keys, err = v.walk(signer, now)
+			if errors.Is(err, ErrInsecureProof) {
+				insecure = true
+				return Name{}, nil
+			}
+			if err != nil {
+				return Name{}, err
+			}
+			if !zone.Equal(signer) {
+				err = fmt.Errorf("%w: %s signed by %s, which is not a signed zone", ErrBogus, set.Name, signer.FQDN())
+				continue
+			}
+			var verified *RRSIG
+			if verified, err = v.verifySet(set, []*RRSIG{sig}, zone, keys, now); err != nil {
+				continue
+			}
+			if int(verified.Labels) < SignatureLabels(owner) {
+				closest := Name{labels: owner.labels[owner.CountLabels()-int(verified.Labels):]}
+				v.tracef("%s %s: expanded from wildcard *.%s", parseNameLoose(set.Name).FQDN(), set.Qtype, closest.FQDN())
+				wildcards = append(wildcards, wildcard{owner, closest, zone})
+			}
+			return zone, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("%w: %s %s has no signature by a zone above it", ErrBogus, set.Name, set.Qtype)
+		}
+		return Name{}, err
+	}
+
+	answers, answerSigs := signedSets(res.Answers)
+	for _, set := range answers {
+		if _, err := check(set, answerSigs[setKey(set)]); err != nil {
+			return SecurityBogus, err
+		}
+	}
+	authority, authoritySigs := signedSets(res.Authorities)
+	for _, set := range authority {
+		sigs := authoritySigs[setKey(set)]
+		if set.Qtype == QTYPE_NS && len(sigs) == 0 {
+			continue
+		}
+		zone, err := check(set, sigs)
+		if err != nil {
+			return SecurityBogus, err
+		}
+		if len(sigs) > 0 && (set.Qtype == QTYPE_NSEC || set.Qtype == QTYPE_NSEC3) {
+			proofs = append(proofs, proof{set, zone})
+		}
+	}
+
+	// denialBy collects the proofs signed by a zone. A proof only counts for names in the zone that
+	// signed it, so records a parent signed can't deny names in a signed child (RFC 6840 section 4.1).
+	denialBy := func(zone Name) *Denial {
+		denial := &Denial{}
+		for _, p := range proofs {
+			if p.zone.Equal(zone) {
+				for _, rec := range p.set.Records {
+					denial.Add(rec)
+				}
+			}
+		}
+		return denial
+	}
+
+	// Follow the CNAME chain to the name the answer or denial is for
+	sname := parseNameLoose(q.Name)
+	positive := false
+	for range maxChainLength {
+		next := false
+		for _, set := range answers {
+			if !parseNameLoose(set.Name).Equal(sname) {
+				continue
+			}
+			if set.Qtype == qtype || qtype == QTYPE_ANY {
+				positive = true
+			} else if set.Qtype == QTYPE_CNAME && len(set.Records) == 1 {
+				sname, next = parseNameLoose(set.Records[0].Data.(*CNAME).Target), true
+			}
+		}
+		if !next || positive {
+			break
+		}
+	}
+
+	var err error
+	if !positive {
+		// The proof must come from the zone the name is in, or for DS from the zone above the cut
+		in := sname
+		if qtype == QTYPE_DS && !sname.IsRoot() {
+			in = sname.Parent()
+		}
+		var zone Name
+		zone, _, err = v.walk(in, now)
+		denial := denialBy(zone)
+		switch {
+		case errors.Is(err, ErrInsecureProof):
+			// Negative answers from unsigned zones carry no proof
+			insecure, err = true, nil
+		case err != nil:
+		case denial.Empty():
+			err = fmt.Errorf("%w: no proof by %s that %s %s doesn't exist", ErrBogus, zone.FQDN(), sname.FQDN(), qtype)
+		case res.Header.ResCode == NXDOMAIN:
+			err = denial.ProveNXDomain(sname)
+			v.traceProof(fmt.Sprintf("%s doesn't exist", sname.FQDN()), denial, err)
+		default:
+			err = denial.ProveNoData(sname, qtype)
+			v.traceProof(fmt.Sprintf("%s has no %s records", sname.FQDN(), qtype), denial, err)
+		}
+	}
+	for _, w := range wildcards {
+		if err == nil || errors.Is(err, ErrInsecureProof) {
+			denial := denialBy(w.zone)
+			werr := denial.ProveWildcard(w.name, w.closest)
+			v.traceProof(fmt.Sprintf("%s doesn't exist apart from the wildcard", w.name.FQDN()), denial, werr)
+			if werr != nil {
+				err = werr
+			}
+		}
+	}
+	switch {
+	case errors.Is(err, ErrInsecureProof):
+		return SecurityInsecure, nil
+	case err != nil:
+		return SecurityBogus, err
+	case insecure:
+		return SecurityInsecure, nil
+	}
+	return SecuritySecure, nil
+}
+
+// ValidatingHandler validates the answers of the next handler, normally a Forwarder, as a
+// validating stub resolver: it asks upstream for signatures with DO and for unvalidated answers
+// with CD, answers SERVFAIL to bogus ones and sets AD on secure ones. Queries with CD set are
+// passed on unvalidated, as the client validates itself (RFC 4035 section 3.2.2).
+type ValidatingHandler struct {
+	Next      Handler
+	Validator *Validator
+}
+
+// ServeDNS forwards the query with DO and CD set and validates the answer
+func (h *ValidatingHandler) ServeDNS(req *Request) *DnsPacket {
+	query := req.Packet
+	if query.Header.CheckingDisabled || query.Header.Opcode != 0 || len(query.Questions) != 1 {
+		res := h.Next.ServeDNS(req)
+		if res != nil {
+			res.Header.AuthedData = false
+		}
+		return res
+	}
+
+	upstream := *query
+	header := *query.Header
+	header.CheckingDisabled = true
+	upstream.Header = &header
+	upstream.Resources = nil
+	for _, rec := range query.Resources {
+		if rec.Qtype != QTYPE_OPT {
+			upstream.Resources = append(upstream.Resources, rec)
+		}
+	}
+	opt := upstream.SetEDNS(DefaultEDNSSize)
+	if old := query.OPT(); old != nil {
+		*opt = *old
+	}
+	opt.TTL |= ednsDO
+	forwarded := *req
+	forwarded.Packet = &upstream
+
+	res := h.Next.ServeDNS(&forwarded)
+	if res == nil {
+		return nil
+	}
+	res.Header.CheckingDisabled = false
+	security, err := h.Validator.Validate(res)
+	switch security {
+	case SecurityBogus:
+		bogusAnswers.Add(1)
+		log.Printf("dnssec: %s %s: %v", query.Questions[0].Name, QueryType(query.Questions[0].Qtype), err)
+		return NewErrorResponse(query, SERVFAIL)
+	case SecuritySecure:
+		res.Header.AuthedData = true
+	default:
+		res.Header.AuthedData = false
+	}
+	return res
+}
+
+// dnssecTypes are the types of the records that prove answers rather than answer queries
+var dnssecTypes = map[QueryType]bool{
+	QTYPE_RRSIG: true,
+	QTYPE_NSEC:  true,
+	QTYPE_NSEC3: true,
+}
+
+// DNSSECOKHandler fits the answers of a ValidatingHandler, possibly cached, to each client: it
+// leaves signatures and proofs out unless the client set DO (RFC 4035 section 3.2.1), and clears
+// AD unless the client set DO or AD, showing it understands the bit (RFC 6840 section 5.7)
+type DNSSECOKHandler struct {
+	Next Handler
+}
+
+// ServeDNS strips what the client didn't ask for from the answer
+func (h *DNSSECOKHandler) ServeDNS(req *Request) *DnsPacket {
+	query := req.Packet
+	res := h.Next.ServeDNS(req)
+	if res == nil || query.DNSSECOK() {
+		return res
+	}
+	if !query.Header.AuthedData {
+		res.Header.AuthedData = false
+	}
+	qtype := QueryType(0)
+	if len(query.Questions) > 0 {
+		qtype = QueryType(query.Questions[0].Qtype)
+	}
+	strip := func(records []*DnsRecord) []*DnsRecord {
+		kept := records[:0:0]
+		for _, rec := range records {
+			if !dnssecTypes[rec.Qtype] || rec.Qtype == qtype {
+				kept = append(kept, rec)
+			}
+		}
+		return kept
+	}
+	res.Answers = strip(res.Answers)
+	res.Authorities = strip(res.Authorities)
+	res.Resources = strip(res.Resources)
+	return res
+}
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testServe serves DNS with s over UDP and TCP on a free loopback port and returns the address
+func testServe(t *testing.T, s *Server) string {
+	t.Helper()
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		t.Fatal(err)
+	}
+	go s.ServeUDP(udp)
+	go s.ServeTCP(tcp)
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+	return udp.LocalAddr().String()
+}
+
+// testZone is a zone answered by testResolver: its RRsets, and if it has a key their signatures
+// and an NSEC or NSEC3 chain
+type testZone struct {
+	origin Name
+	key    *SigningKey // Nil for an unsigned zone
+	nsec3  bool        // Deny names with an NSEC3 chain without salt or extra iterations
+	optOut bool        // Leave unsigned delegations out of the NSEC3 chain
+	sets   []*RRSet
+	sigs   map[*RRSet]*DnsRecord
+	chain  []*RRSet // NSEC or NSEC3 RRsets in chain order
+	hashes [][]byte // Hashed owner of each NSEC3 RRset
+}
+
+// newTestZone builds a zone from master file lines, adding an SOA and NS record at the apex, and
+// signs it with key unless key is nil
+func newTestZone(t *testing.T, origin string, key *SigningKey, nsec3, optOut bool, lines ...string) *testZone {
+	t.Helper()
+	text := fmt.Sprintf("$ORIGIN %s.\n$TTL 300\n@ SOA ns.example. hostmaster.example. 1 3600 600 86400 300\n@ NS ns.example.\n%s\n",
+		origin, strings.Join(lines, "\n"))
+	parsed, err := ParseZone(strings.NewReader(text), origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := parsed.Records
+	if key != nil {
+		records = append(records, key.Record(300))
+	}
+	z := &testZone{origin: parseNameLoose(origin), key: key, nsec3: nsec3, optOut: optOut, sigs: make(map[*RRSet]*DnsRecord)}
+	if z.sets, err = GroupRRSets(records); err != nil {
+		t.Fatal(err)
+	}
+	if key == nil {
+		return z
+	}
+	for _, set := range z.sets {
+		if !z.delegation(parseNameLoose(set.Name)) || set.Qtype == QTYPE_DS {
+			z.sign(t, set)
+		}
+	}
+	if nsec3 {
+		z.buildNSEC3(t)
+	} else {
+		z.buildNSEC(t)
+	}
+	return z
+}
+
+// sign signs an RRset with the zone's key, valid for an hour either side of now
+func (z *testZone) sign(t *testing.T, set *RRSet) {
+	t.Helper()
+	now := time.Now()
+	sig, err := z.key.Sign(set, now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.sigs[set] = sig
+}
+
+// delegation reports whether name is a zone cut below the apex
+func (z *testZone) delegation(name Name) bool {
+	return !name.Equal(z.origin) && z.set(name, QTYPE_NS) != nil
+}
+
+// owners returns the names owning records in canonical order, with the types at each
+func (z *testZone) owners() ([]Name, map[string][]QueryType) {
+	var names []Name
+	types := make(map[string][]QueryType)
+	for _, set := range z.sets {
+		name := parseNameLoose(set.Name)
+		if types[name.Key()] == nil {
+			names = append(names, name)
+		}
+		types[name.Key()] = append(types[name.Key()], set.Qtype)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].Compare(names[j]) < 0 })
+	return names, types
+}
+
+// buildNSEC links the owner names into an NSEC chain
+func (z *testZone) buildNSEC(t *testing.T) {
+	names, types := z.owners()
+	for i, name := range names {
+		next := names[(i+1)%len(names)]
+		rec := NewRecord(name.String(), 300, &NSEC{NextName: next.String(), Types: append(types[name.Key()], QTYPE_RRSIG, QTYPE_NSEC)})
+		set := NewRRSet(rec)
+		set.Add(rec)
+		z.sign(t, set)
+		z.chain = append(z.chain, set)
+	}
+}
+
+// buildNSEC3 links the hashed owner names into an NSEC3 chain
+func (z *testZone) buildNSEC3(t *testing.T) {
+	names, types := z.owners()
+	type entry struct {
+		hash  []byte
+		types []QueryType
+	}
+	var entries []entry
+	for _, name := range names {
+		unsigned := z.delegation(name) && z.set(name, QTYPE_DS) == nil
+		if unsigned && z.optOut {
+			continue
+		}
+		hash, err := NSEC3Hash(name, NSEC3_SHA1, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := entry{hash, types[name.Key()]}
+		if !unsigned {
+			e.types = append(e.types, QTYPE_RRSIG)
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].hash, entries[j].hash) < 0 })
+	var flags uint8
+	if z.optOut {
+		flags = NSEC3_OPTOUT
+	}
+	for i, e := range entries {
+		owner := strings.ToLower(nsec3Encoding.EncodeToString(e.hash)) + "." + z.origin.String()
+		rec := NewRecord(owner, 300, &NSEC3{HashAlgorithm: NSEC3_SHA1, Flags: flags,
+			NextHashed: entries[(i+1)%len(entries)].hash, Types: e.types})
+		set := NewRRSet(rec)
+		set.Add(rec)
+		z.sign(t, set)
+		z.chain = append(z.chain, set)
+		z.hashes = append(z.hashes, e.hash)
+	}
+}
+
+// set returns the RRset of the type at name, including those of the NSEC chain
+func (z *testZone) set(name Name, qtype QueryType) *RRSet {
+	for _, set := range append(z.sets, z.chain...) {
+		if set.Qtype == qtype && parseNameLoose(set.Name).Equal(name) {
+			return set
+		}
+	}
+	return nil
+}
+
+// exists reports whether name owns records
+func (z *testZone) exists(name Name) bool {
+	for _, set := range z.sets {
+		if parseNameLoose(set.Name).Equal(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// signed returns an RRset's records followed by its signature, if any
+func (z *testZone) signed(set *RRSet) []*DnsRecord {
+	records := append([]*DnsRecord(nil), set.Records...)
+	if sig := z.sigs[set]; sig != nil {
+		records = append(records, sig)
+	}
+	return records
+}
+
+// matching returns the NSEC or NSEC3 RRset of name
+func (z *testZone) matching(name Name) *RRSet {
+	for i, set := range z.chain {
+		if z.nsec3 {
+			if hash, _ := NSEC3Hash(name, NSEC3_SHA1, 0, nil); bytes.Equal(hash, z.hashes[i]) {
+				return set
+			}
+		} else if parseNameLoose(set.Name).Equal(name) {
+			return set
+		}
+	}
+	return nil
+}
+
+// covering returns the NSEC or NSEC3 RRset whose span holds name: the last one before it in chain
+// order, or the last of all for names before the first
+func (z *testZone) covering(name Name) *RRSet {
+	hash, _ := NSEC3Hash(name, NSEC3_SHA1, 0, nil)
+	covering := z.chain[len(z.chain)-1]
+	for i, set := range z.chain {
+		if z.nsec3 && bytes.Compare(z.hashes[i], hash) < 0 || !z.nsec3 && parseNameLoose(set.Name).Compare(name) < 0 {
+			covering = set
+		}
+	}
+	return covering
+}
+
+// closestEncloser returns the closest ancestor of name that exists, in the NSEC3 chain if it has one
+func (z *testZone) closestEncloser(name Name) Name {
+	if name.Equal(z.origin) {
+		return name
+	}
+	ce := name.Parent()
+	for !ce.Equal(z.origin) && (!z.exists(ce) || z.nsec3 && z.matching(ce) == nil) {
+		ce = ce.Parent()
+	}
+	return ce
+}
+
+// nextCloser returns the ancestor of name one label below ce
+func nextCloser(name, ce Name) Name {
+	for name.CountLabels() > ce.CountLabels()+1 {
+		name = name.Parent()
+	}
+	return name
+}
+
+// answer fills in the response to a query for name and type: the answer with its signature, or
+// the SOA record with the NSEC or NSEC3 records proving there is none
+func (z *testZone) answer(res *DnsPacket, name Name, qtype QueryType) {
+	if set := z.set(name, qtype); set != nil {
+		res.Answers = z.signed(set)
+		return
+	}
+	var proofs []*RRSet
+	ce := z.closestEncloser(name)
+	wildcard := wildcardOf(ce)
+	// NSEC records cover the name itself, NSEC3 records the next closer name (RFC 5155 section 7.2.1)
+	denied := name
+	if z.nsec3 {
+		denied = nextCloser(name, ce)
+	}
+	switch {
+	case z.exists(name):
+		if match := z.matching(name); match != nil || !z.nsec3 {
+			proofs = append(proofs, match)
+		} else {
+			// Left out of an opt-out chain
+			proofs = append(proofs, z.matching(ce), z.covering(nextCloser(name, ce)))
+		}
+	case z.set(wildcard, qtype) != nil:
+		for _, rec := range z.signed(z.set(wildcard, qtype)) {
+			expanded := *rec
+			expanded.Name = name.String()
+			res.Answers = append(res.Answers, &expanded)
+		}
+		proofs = append(proofs, z.covering(denied))
+	case z.exists(wildcard):
+		proofs = append(proofs, z.covering(denied), z.matching(wildcard))
+		if z.nsec3 {
+			proofs = append(proofs, z.matching(ce))
+		}
+	default:
+		res.Header.ResCode = NXDOMAIN
+		proofs = append(proofs, z.covering(denied), z.covering(wildcard))
+		if z.nsec3 {
+			proofs = append(proofs, z.matching(ce))
+		}
+	}
+	res.Authorities = z.signed(z.set(z.origin, QTYPE_SOA))
+	seen := make(map[*RRSet]bool)
+	for _, set := range proofs {
+		if set != nil && !seen[set] {
+			seen[set] = true
+			res.Authorities = append(res.Authorities, z.signed(set)...)
+		}
+	}
+}
+
+// testResolver answers queries from its zones as a recursive resolver would, from the closest zone
+// holding the name, or for DS the closest zone above it
+type testResolver struct {
+	zones []*testZone
+}
+
+// ServeDNS answers a query
+func (r *testResolver) ServeDNS(req *Request) *DnsPacket {
+	res := NewResponse(req.Packet)
+	q := req.Packet.Questions[0]
+	name, qtype := parseNameLoose(q.Name), QueryType(q.Qtype)
+	var zone *testZone
+	for _, z := range r.zones {
+		if !name.IsSubdomainOf(z.origin) || qtype == QTYPE_DS && name.Equal(z.origin) {
+			continue
+		}
+		if zone == nil || z.origin.CountLabels() > zone.origin.CountLabels() {
+			zone = z
+		}
+	}
+	if zone == nil {
+		res.Header.ResCode = REFUSED
+		return res
+	}
+	zone.answer(res, name, qtype)
+	return res
+}
+
+// query asks the resolver directly for name and type, with DO set
+func (r *testResolver) query(name string, qtype QueryType) *DnsPacket {
+	return r.ServeDNS(&Request{Packet: NewDNSSECQuery(name, qtype)})
+}
+
+// dnssecFixture serves signed zones below a trust anchor for example.:
+//
+//	example.               NSEC, with a wildcard below wild.example.
+//	child.example.         signed delegation, NSEC3 with a wildcard below wild.child.example.
+//	optout.example.        signed delegation, opt-out NSEC3 leaving out sub.optout.example.
+//	sub.optout.example.    unsigned zone
+//	unsigned.example.      unsigned delegation and zone
+//	algo.example.          delegation signed with an algorithm the validator doesn't support
+type dnssecFixture struct {
+	resolver *testResolver
+	addr     string
+	anchor   *DnsRecord
+	example  *testZone
+}
+
+// newDNSSECFixture generates the keys, signs the zones and starts serving them
+func newDNSSECFixture(t *testing.T) *dnssecFixture {
+	t.Helper()
+	keys := make(map[string]*SigningKey)
+	ds := func(zone string) string {
+		key, err := GenerateSigningKey(zone, DNSSEC_ED25519, DNSKEY_ZONE|DNSKEY_SEP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if zone == "algo.example" {
+			key.DNSKEY.Algorithm = 253 // Private algorithm, which the validator can't verify
+		}
+		keys[zone] = key
+		ds, err := NewDS(zone, key.DNSKEY, DS_SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%s. DS %s", zone, ds)
+	}
+	f := &dnssecFixture{}
+	childDS, optOutDS, algoDS := ds("child.example"), ds("optout.example"), ds("algo.example")
+	ds("example")
+	f.anchor = NewRecord("example", 300, keys["example"].DNSKEY)
+	f.example = newTestZone(t, "example", keys["example"], false, false,
+		"ns A 192.0.2.53",
+		"www A 192.0.2.1",
+		"wild TXT parent",
+		"*.wild TXT wildcard",
+		"child NS ns.example.", childDS,
+		"optout NS ns.example.", optOutDS,
+		"unsigned NS ns.example.",
+		"algo NS ns.example.", algoDS)
+	f.resolver = &testResolver{zones: []*testZone{
+		f.example,
+		newTestZone(t, "child.example", keys["child.example"], true, false,
+			"www A 192.0.2.2",
+			"wild TXT parent",
+			"*.wild TXT wildcard"),
+		newTestZone(t, "optout.example", keys["optout.example"], true, true,
+			"www A 192.0.2.3",
+			"sub NS ns.example."),
+		newTestZone(t, "sub.optout.example", nil, false, false, "www A 192.0.2.4"),
+		newTestZone(t, "unsigned.example", nil, false, false, "www A 192.0.2.5"),
+		newTestZone(t, "algo.example", keys["algo.example"], false, false, "www A 192.0.2.6"),
+	}}
+	f.addr = testServe(t, NewServer("", f.resolver))
+	return f
+}
+
+// validator returns a fresh validator trusting the key of example.
+func (f *dnssecFixture) validator() *Validator {
+	client := NewClient()
+	client.Timeout = 2 * time.Second
+	return &Validator{Client: client, Upstreams: []string{f.addr}, Anchors: []*DnsRecord{f.anchor}}
+}
+
+func TestValidate(t *testing.T) {
+	f := newDNSSECFixture(t)
+	now := time.Now()
+
+	// resign replaces the signature over the answer with one made by the key of example.
+	resign := func(inception, expiration time.Time) func(*DnsPacket) {
+		return func(res *DnsPacket) {
+			sets, _ := signedSets(res.Answers)
+			sig, err := f.example.key.Sign(sets[0], inception, expiration)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Answers = append(withoutType(res.Answers, QTYPE_RRSIG), sig)
+		}
+	}
+	tests := []struct {
+		name  string
+		qname string
+		qtype QueryType
+		edit  func(res *DnsPacket)
+		rcode ResultCode
+		want  Security
+	}{
+		{"answer", "www.example", QTYPE_A, nil, NOERROR, SecuritySecure},
+		{"answer in child zone", "www.child.example", QTYPE_A, nil, NOERROR, SecuritySecure},
+		{"apex keys", "child.example", QTYPE_DNSKEY, nil, NOERROR, SecuritySecure},
+		{"unsigned delegation", "www.unsigned.example", QTYPE_A, nil, NOERROR, SecurityInsecure},
+		{"unsupported algorithm", "www.algo.example", QTYPE_A, nil, NOERROR, SecurityInsecure},
+		{"no DS at unsigned delegation", "unsigned.example", QTYPE_DS, nil, NOERROR, SecuritySecure},
+
+		{"NSEC NXDOMAIN", "nope.example", QTYPE_A, nil, NXDOMAIN, SecuritySecure},
+		{"NSEC NODATA", "www.example", QTYPE_MX, nil, NOERROR, SecuritySecure},
+		{"NSEC wildcard", "a.wild.example", QTYPE_TXT, nil, NOERROR, SecuritySecure},
+		{"NSEC wildcard NODATA", "a.wild.example", QTYPE_MX, nil, NOERROR, SecuritySecure},
+		{"NSEC3 NXDOMAIN", "nope.child.example", QTYPE_A, nil, NXDOMAIN, SecuritySecure},
+		{"NSEC3 NODATA", "www.child.example", QTYPE_MX, nil, NOERROR, SecuritySecure},
+		{"NSEC3 wildcard", "a.wild.child.example", QTYPE_TXT, nil, NOERROR, SecuritySecure},
+		{"NSEC3 wildcard NODATA", "a.wild.child.example", QTYPE_MX, nil, NOERROR, SecuritySecure},
+
+		{"answer in signed zone", "www.optout.example", QTYPE_A, nil, NOERROR, SecuritySecure},
+		{"opt-out delegation", "www.sub.optout.example", QTYPE_A, nil, NOERROR, SecurityInsecure},
+		{"opt-out NXDOMAIN", "nope.optout.example", QTYPE_A, nil, NXDOMAIN, SecurityInsecure},
+		{"opt-out no DS", "sub.optout.example", QTYPE_DS, nil, NOERROR, SecurityInsecure},
+
+		{"bad signature", "www.example", QTYPE_A, func(res *DnsPacket) {
+			sig := *res.Answers[1].RRSIG()
+			sig.Signature = append([]byte(nil), sig.Signature...)
+			sig.Signature[0] ^= 0xff
+			res.Answers = append(withoutType(res.Answers, QTYPE_RRSIG), NewRecord("www.example", 300, &sig))
+		}, NOERROR, SecurityBogus},
+		{"expired signature", "www.example", QTYPE_A, resign(now.Add(-2*time.Hour), now.Add(-time.Hour)), NOERROR, SecurityBogus},
+		{"future signature", "www.example", QTYPE_A, resign(now.Add(time.Hour), now.Add(2*time.Hour)), NOERROR, SecurityBogus},
+		{"missing signature", "www.example", QTYPE_A, func(res *DnsPacket) {
+			res.Answers = withoutType(res.Answers, QTYPE_RRSIG)
+		}, NOERROR, SecurityBogus},
+		{"missing signature in child zone", "www.child.example", QTYPE_A, func(res *DnsPacket) {
+			res.Answers = withoutType(res.Answers, QTYPE_RRSIG)
+		}, NOERROR, SecurityBogus},
+		{"missing NXDOMAIN proof", "nope.example", QTYPE_A, func(res *DnsPacket) {
+			res.Authorities = withoutType(withoutType(res.Authorities, QTYPE_NSEC), QTYPE_RRSIG)
+		}, NXDOMAIN, SecurityBogus},
+		{"missing wildcard proof", "a.wild.child.example", QTYPE_TXT, func(res *DnsPacket) {
+			res.Authorities = nil
+		}, NOERROR, SecurityBogus},
+		{"NODATA proof for another type", "www.example", QTYPE_A, func(res *DnsPacket) {
+			res.Answers, res.Authorities = nil, f.resolver.query("www.example", QTYPE_MX).Authorities
+		}, NOERROR, SecurityBogus},
+
+		// The parent's NSEC record at the delegation covers every name in the child zone, but it
+		// can't deny them
+		{"NXDOMAIN from above the zone cut", "www.child.example", QTYPE_A, func(res *DnsPacket) {
+			res.Header.ResCode = NXDOMAIN
+			res.Answers = nil
+			res.Authorities = append(f.example.signed(f.example.set(f.example.origin, QTYPE_SOA)),
+				f.example.signed(f.example.matching(parseNameLoose("child.example")))...)
+		}, NXDOMAIN, SecurityBogus},
+		{"NODATA from above the zone cut", "child.example", QTYPE_A, func(res *DnsPacket) {
+			res.Answers = nil
+			res.Authorities = append(f.example.signed(f.example.set(f.example.origin, QTYPE_SOA)),
+				f.example.signed(f.example.matching(parseNameLoose("child.example")))...)
+		}, NOERROR, SecurityBogus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := f.resolver.query(tt.qname, tt.qtype)
+			if tt.edit != nil {
+				tt.edit(res)
+			}
+			if res.Header.ResCode != tt.rcode {
+				t.Fatalf("fixture answered %s, want %s", res.Header.ResCode, tt.rcode)
+			}
+			got, err := f.validator().Validate(res)
+			if got != tt.want {
+				t.Errorf("got %s (%v), want %s", got, err, tt.want)
+			}
+			if (got == SecurityBogus) != (err != nil) {
+				t.Errorf("%s result with error %v", got, err)
+			}
+		})
+	}
+}
+
+// TestDenialAncestorDelegation checks that NSEC and NSEC3 records at a delegation or DNAME can't
+// deny names below them, though the same records at an apex can
+func TestDenialAncestorDelegation(t *testing.T) {
+	name := parseNameLoose("www.child.example")
+	for _, tt := range []struct {
+		types []QueryType
+		want  error
+	}{
+		{[]QueryType{QTYPE_NS, QTYPE_DS, QTYPE_RRSIG, QTYPE_NSEC}, ErrBogus},
+		{[]QueryType{QTYPE_DNAME, QTYPE_RRSIG, QTYPE_NSEC}, ErrBogus},
+		{[]QueryType{QTYPE_NS, QTYPE_SOA, QTYPE_RRSIG, QTYPE_NSEC}, nil},
+	} {
+		// The record's span holds every name below child.example, and the wildcard below it
+		var d Denial
+		d.Add(NewRecord("child.example", 300, &NSEC{NextName: "d.example", Types: tt.types}))
+		err := d.ProveNXDomain(name)
+		if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("NSEC with types %v: got %v, want %v", tt.types, err, tt.want)
+		}
+	}
+
+	cut := parseNameLoose("child.example")
+	hash, err := NSEC3Hash(cut, NSEC3_SHA1, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := append([]byte(nil), hash...)
+	after[len(after)-1]++
+	owner := func(hash []byte) string {
+		return strings.ToLower(nsec3Encoding.EncodeToString(hash)) + ".example"
+	}
+	// Two records make up the whole chain: the one at the cut and one covering every other hash
+	for _, tt := range []struct {
+		types []QueryType
+		want  error
+	}{
+		{[]QueryType{QTYPE_NS, QTYPE_DS, QTYPE_RRSIG}, ErrBogus},
+		{[]QueryType{QTYPE_DNAME, QTYPE_RRSIG}, ErrBogus},
+		{[]QueryType{QTYPE_NS, QTYPE_SOA, QTYPE_RRSIG}, nil},
+	} {
+		var d Denial
+		d.Add(NewRecord(owner(hash), 300, &NSEC3{HashAlgorithm: NSEC3_SHA1, NextHashed: after, Types: tt.types}))
+		d.Add(NewRecord(owner(after), 300, &NSEC3{HashAlgorithm: NSEC3_SHA1, NextHashed: hash, Types: []QueryType{QTYPE_A}}))
+		err := d.ProveNXDomain(name)
+		if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("NSEC3 with types %v: got %v, want %v", tt.types, err, tt.want)
+		}
+	}
+}
+
+func TestValidatingHandler(t *testing.T) {
+	f := newDNSSECFixture(t)
+	bogus := func(req *Request) *DnsPacket {
+		res := f.resolver.ServeDNS(req)
+		res.Answers = withoutType(res.Answers, QTYPE_RRSIG)
+		res.Header.AuthedData = true
+		return res
+	}
+	var forwarded *DnsPacket
+	tests := []struct {
+		name  string
+		next  HandlerFunc
+		cd    bool
+		rcode ResultCode
+		ad    bool
+	}{
+		{"secure", f.resolver.ServeDNS, false, NOERROR, true},
+		{"bogus", bogus, false, SERVFAIL, false},
+		{"checking disabled", bogus, true, NOERROR, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := func(req *Request) *DnsPacket {
+				forwarded = req.Packet
+				return tt.next(req)
+			}
+			h := &ValidatingHandler{Next: HandlerFunc(next), Validator: f.validator()}
+			query := NewDnsPacket()
+			query.Header.RecursionDesired = true
+			query.Header.CheckingDisabled = tt.cd
+			query.Questions = append(query.Questions, NewDnsQuestion("www.example", QTYPE_A))
+			res := h.ServeDNS(&Request{Packet: query})
+			if res.Header.ResCode != tt.rcode || res.Header.AuthedData != tt.ad {
+				t.Errorf("got %s with AD %t, want %s with AD %t", res.Header.ResCode, res.Header.AuthedData, tt.rcode, tt.ad)
+			}
+			// Queries with CD are passed on as they are; others get DO and CD
+			if forwarded.DNSSECOK() == tt.cd || !forwarded.Header.CheckingDisabled {
+				t.Errorf("forwarded query has DO %t and CD %t", forwarded.DNSSECOK(), forwarded.Header.CheckingDisabled)
+			}
+			if query.OPT() != nil || tt.cd != query.Header.CheckingDisabled {
+				t.Errorf("client's query was modified")
+			}
+		})
+	}
+}
+
+func TestDNSSECOKHandler(t *testing.T) {
+	f := newDNSSECFixture(t)
+	next := HandlerFunc(func(req *Request) *DnsPacket {
+		q := req.Packet.Questions[0]
+		res := f.resolver.query(q.Name, QueryType(q.Qtype))
+		res.Header.AuthedData = true
+		return res
+	})
+	tests := []struct {
+		name  string
+		qname string
+		qtype QueryType
+		do    bool
+		ad    bool
+		want  []QueryType // Types of the records left in the answer and authority sections
+		wantA bool        // Whether AD stays set
+	}{
+		{"DO", "www.example", QTYPE_A, true, false, []QueryType{QTYPE_A, QTYPE_RRSIG}, true},
+		{"no DO", "www.example", QTYPE_A, false, false, []QueryType{QTYPE_A}, false},
+		{"AD without DO", "www.example", QTYPE_A, false, true, []QueryType{QTYPE_A}, true},
+		{"no DO, NODATA", "www.example", QTYPE_MX, false, false, []QueryType{QTYPE_SOA}, false},
+		{"DO, NODATA", "www.example", QTYPE_MX, true, false, []QueryType{QTYPE_SOA, QTYPE_RRSIG, QTYPE_NSEC, QTYPE_RRSIG}, true},
+		{"no DO, query for NSEC", "www.example", QTYPE_NSEC, false, false, []QueryType{QTYPE_NSEC}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := NewDnsPacket()
+			query.Header.AuthedData = tt.ad
+			query.Questions = append(query.Questions, NewDnsQuestion(tt.qname, tt.qtype))
+			if tt.do {
+				query.SetEDNS(DefaultEDNSSize).TTL |= ednsDO
+			}
+			res := (&DNSSECOKHandler{Next: next}).ServeDNS(&Request{Packet: query})
+			var got []QueryType
+			for _, rec := range append(res.Answers, res.Authorities...) {
+				got = append(got, rec.Qtype)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) || res.Header.AuthedData != tt.wantA {
+				t.Errorf("got %v with AD %t, want %v with AD %t", got, res.Header.AuthedData, tt.want, tt.wantA)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WatchChange describes an answer that differs from the previous one, as sent to -webhook
+type WatchChange struct {
+	Name string    `json:"name"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Old  []string  `json:"old"` // Previous answer: the rcode if not NOERROR, else "TYPE rdata" lines
+	New  []string  `json:"new"`
+}
+
+// watchAnswer reduces a response to what a watch compares: the rcode, or the sorted record data of
+// the answer section. TTLs are left out because cached answers count them down.
+func watchAnswer(res *DnsPacket) []string {
+	if res.Header.ResCode != NOERROR {
+		return []string{res.Header.ResCode.String()}
+	}
+	lines := []string{}
+	for _, rec := range res.Answers {
+		lines = append(lines, rec.Qtype.String()+" "+rec.RdataString())
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// runWatch implements the "watch" subcommand, which re-queries a name periodically and reports
+// when the answer changes
+func runWatch(args []string) int {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	server := fs.String("server", SystemResolver(), "resolver to query: IP[:port], tls://host[:port] or an https:// URL")
+	qtypeName := fs.String("type", "A", "record type to query, also accepted as the argument after the name")
+	interval := fs.Duration("interval", 30*time.Second, "time between queries")
+	command := fs.String("exec", "", "shell command run on each change, with GDNS_NAME, GDNS_TYPE, GDNS_OLD and GDNS_NEW set")
+	webhook := fs.String("webhook", "", "URL sent a JSON description of each change in a POST request")
+	count := fs.Int("changes", 0, "exit after this many changes, 0 to watch until interrupted")
+	color := fs.String("color", "auto", "color output: auto (terminals only, unless NO_COLOR is set), always or never")
+	timeout := fs.Duration("timeout", 5*time.Second, "time to wait for each response")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gdns watch [-interval 30s] [-exec command] [-webhook url] name [type]\n")
+		fmt.Fprintf(fs.Output(), "Exit status: 0 after -changes changes, 4 usage error.\n")
+		fs.PrintDefaults()
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err == flag.ErrHelp {
+		return ExitOK
+	}
+	if err != nil {
+		return ExitUsage
+	}
+	if len(positional) < 1 || len(positional) > 2 || *interval <= 0 {
+		fs.Usage()
+		return ExitUsage
+	}
+	name := positional[0]
+	if len(positional) == 2 {
+		*qtypeName = positional[1]
+	}
+	qtype, err := QueryTypeFromString(*qtypeName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+	palette, err := NewPalette(*color, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitUsage
+	}
+
+	client := NewClient()
+	client.Timeout = *timeout
+	var previous []string
+	changes := 0
+	for first := true; ; first = false {
+		if !first {
+			time.Sleep(*interval)
+		}
+		stamp := palette.Comment(time.Now().Format("15:04:05"))
+		res, err := client.Lookup(name, qtype, *server)
+		if err != nil {
+			// A failed query says nothing about the records; keep comparing against the last answer
+			fmt.Printf("%s %s\n", stamp, palette.Removed(err.Error()))
+			continue
+		}
+		current := watchAnswer(res)
+		if previous == nil {
+			fmt.Printf("%s %s %s\n", stamp, palette.Name(name), palette.Type(qtype))
+			for _, line := range current {
+				fmt.Printf("  %s\n", line)
+			}
+			previous = current
+			continue
+		}
+		if strings.Join(current, "\n") == strings.Join(previous, "\n") {
+			continue
+		}
+
+		fmt.Printf("%s %s %s changed\n", stamp, palette.Name(name), palette.Type(qtype))
+		printWatchDiff(previous, current, palette)
+		change := &WatchChange{Name: name, Type: qtype.String(), Time: time.Now().UTC(), Old: previous, New: current}
+		if *command != "" {
+			if err := runWatchCommand(*command, change); err != nil {
+				fmt.Fprintf(os.Stderr, "exec: %v\n", err)
+			}
+		}
+		if *webhook != "" {
+			if err := postWatchChange(*webhook, change); err != nil {
+				fmt.Fprintf(os.Stderr, "webhook: %v\n", err)
+			}
+		}
+		previous = current
+		changes++
+		if *count > 0 && changes >= *count {
+			return ExitOK
+		}
+	}
+}
+
+// printWatchDiff prints the lines only in the old answer with - and those only in the new one with +
+func printWatchDiff(old, new []string, palette *Palette) {
+	inOld := make(map[string]bool)
+	for _, line := range old {
+		inOld[line] = true
+	}
+	inNew := make(map[string]bool)
+	for _, line := range new {
+		inNew[line] = true
+	}
+	for _, line := range old {
+		if !inNew[line] {
+			fmt.Println(palette.Removed("- " + line))
+		}
+	}
+	for _, line := range new {
+		if inOld[line] {
+			fmt.Printf("  %s\n", line)
+		} else {
+			fmt.Println(palette.Added("+ " + line))
+		}
+	}
+}
+
+// runWatchCommand runs the -exec command through the shell with the change in its environment
+func runWatchCommand(command string, change *WatchChange) error {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"GDNS_NAME="+change.Name,
+		"GDNS_TYPE="+change.Type,
+		"GDNS_OLD="+strings.Join(change.Old, "\n"),
+		"GDNS_NEW="+strings.Join(change.New, "\n"),
+	)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// postWatchChange sends the change to the -webhook URL as JSON
+func postWatchChange(url string, change *WatchChange) error {
+	body, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: HTTP status %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WeightedTarget is an address record offered in proportion to its weight while it is healthy
+type WeightedTarget struct {
+	Record *DnsRecord
+	Weight int
+	Check  *HealthCheck // Nil if the target is always considered healthy
+}
+
+// WeightedPools holds the weighted A and AAAA targets of load balanced names
+type WeightedPools struct {
+	targets map[poolKey][]*WeightedTarget
+}
+
+// LoadWeightedPools reads a pool file holding one "weight [check] record" entry per line, where check
+// is an optional tcp://, http:// or https:// health check URL and record is a master file entry for
+// an A or AAAA record with an absolute owner name, e.g.
+//
+//	3 http://192.0.2.1/healthz www.example.com. 30 IN A 192.0.2.1
+//	1 tcp://192.0.2.2:443      www.example.com. 30 IN A 192.0.2.2
+//
+// Lines starting with # are comments.
+func LoadWeightedPools(path string) (*WeightedPools, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &WeightedPools{targets: make(map[poolKey][]*WeightedTarget)}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: expected weight and record", path, line)
+		}
+		weight, err := strconv.Atoi(fields[0])
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("%s:%d: invalid weight %q", path, line, fields[0])
+		}
+		target := &WeightedTarget{Weight: weight}
+		fields = fields[1:]
+		if strings.Contains(fields[0], "://") {
+			if target.Check, err = NewHealthCheck(fields[0]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			fields = fields[1:]
+		}
+		zone, err := ParseZone(strings.NewReader(strings.Join(fields, " ")), "")
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if len(zone.Records) != 1 || (zone.Records[0].Qtype != QTYPE_A && zone.Records[0].Qtype != QTYPE_AAAA) {
+			return nil, fmt.Errorf("%s:%d: expected an A or AAAA record", path, line)
+		}
+		target.Record = zone.Records[0]
+		key := poolKey{parseNameLoose(target.Record.Name).Key(), target.Record.Qtype}
+		p.targets[key] = append(p.targets[key], target)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// StartChecks runs the health checks of every target in the background, as HealthCheck.Start
+func (p *WeightedPools) StartChecks(interval time.Duration, rise, fall int) {
+	for _, targets := range p.targets {
+		for _, target := range targets {
+			if target.Check != nil {
+				target.Check.Start(interval, rise, fall)
+			}
+		}
+	}
+}
+
+// Lookup returns the targets of a name and type
+func (p *WeightedPools) Lookup(name string, qtype QueryType) []*WeightedTarget {
+	n, err := ParseName(name)
+	if err != nil {
+		return nil
+	}
+	return p.targets[poolKey{n.Key(), qtype}]
+}
+
+// SampleTargets picks up to n healthy targets at random, each with a probability proportional to its
+// weight. When every target is down it samples all of them, since an answer that may work beats none.
+func SampleTargets(targets []*WeightedTarget, n int) []*WeightedTarget {
+	var candidates []*WeightedTarget
+	for _, target := range targets {
+		if target.Check == nil || target.Check.Healthy() {
+			candidates = append(candidates, target)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = append(candidates, targets...)
+	}
+
+	var picked []*WeightedTarget
+	for len(picked) < n && len(candidates) > 0 {
+		total := 0
+		for _, target := range candidates {
+			total += target.Weight
+		}
+		pick := rand.Intn(total)
+		chosen := len(candidates) - 1
+		for i, target := range candidates {
+			pick -= target.Weight
+			if pick < 0 {
+				chosen = i
+				break
+			}
+		}
+		picked = append(picked, candidates[chosen])
+		candidates = append(candidates[:chosen:chosen], candidates[chosen+1:]...)
+	}
+	return picked
+}
+
+// WeightedHandler answers A and AAAA queries for load balanced names with healthy targets sampled
+// by weight, overriding whatever Next would answer, and passes all other queries on to Next
+type WeightedHandler struct {
+	Next    Handler
+	Pools   *WeightedPools
+	Answers int // Number of addresses per answer; 0 means 1
+}
+
+// ServeDNS answers from the weighted targets of the queried name and type
+func (h *WeightedHandler) ServeDNS(req *Request) *DnsPacket {
+	query := req.Packet
+	if len(query.Questions) != 1 {
+		return h.Next.ServeDNS(req)
+	}
+	q := query.Questions[0]
+	targets := h.Pools.Lookup(q.Name, QueryType(q.Qtype))
+	if len(targets) == 0 {
+		return h.Next.ServeDNS(req)
+	}
+	res := NewResponse(query)
+	res.Header.AuthoritativeAnswer = true
+	for _, target := range SampleTargets(targets, max(h.Answers, 1)) {
+		answer := *target.Record
+		answer.Name = q.Name
+		res.Answers = append(res.Answers, &answer)
+	}
+	return res
+}
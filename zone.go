@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Zone holds the records of a DNS zone loaded from an RFC 1035 master file
+type Zone struct {
+	Origin  string       // The zone apex, without a trailing dot
+	Records []*DnsRecord // All records in file order
+}
+
+// zoneToken is a single field of a master file entry
+type zoneToken struct {
+	text   string // The field with escapes decoded
+	raw    string // The field as written in the file
+	quoted bool   // Whether the field was written as a quoted string
+}
+
+// zoneEntry is one logical master file entry, possibly spanning lines in parentheses
+type zoneEntry struct {
+	line   int         // Line number the entry starts on
+	blank  bool        // Entry started with whitespace, so the owner is inherited
+	tokens []zoneToken // The fields of the entry
+}
+
+// LoadZoneFile parses the master file at path
+func LoadZoneFile(path, origin string) (*Zone, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseZone(f, origin)
+}
+
+// ParseZone reads an RFC 1035 master file; origin applies until a $ORIGIN directive overrides it
+func ParseZone(r io.Reader, origin string) (*Zone, error) {
+	entries, err := tokenizeZone(r)
+	if err != nil {
+		return nil, err
+	}
+
+	origin = strings.TrimSuffix(origin, ".")
+	zone := &Zone{Origin: origin}
+	var owner string
+	var haveOwner bool
+	var defaultTTL, lastTTL uint32
+	var haveDefaultTTL, haveLastTTL bool
+
+	for _, entry := range entries {
+		tokens := entry.tokens
+		if !entry.blank && strings.HasPrefix(tokens[0].text, "$") {
+			switch strings.ToUpper(tokens[0].text) {
+			case "$ORIGIN":
+				if len(tokens) != 2 {
+					return nil, fmt.Errorf("line %d: $ORIGIN takes one argument", entry.line)
+				}
+				origin = absName(tokens[1].raw, origin)
+				if zone.Origin == "" {
+					zone.Origin = origin
+				}
+			case "$TTL":
+				if len(tokens) != 2 {
+					return nil, fmt.Errorf("line %d: $TTL takes one argument", entry.line)
+				}
+				ttl, err := parseTTL(tokens[1].text)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", entry.line, err)
+				}
+				defaultTTL, haveDefaultTTL = ttl, true
+			default:
+				return nil, fmt.Errorf("line %d: unsupported directive %s", entry.line, tokens[0].text)
+			}
+			continue
+		}
+
+		if !entry.blank {
+			owner = absName(tokens[0].raw, origin)
+			haveOwner = true
+			tokens = tokens[1:]
+		} else if !haveOwner {
+			return nil, fmt.Errorf("line %d: no owner name for record", entry.line)
+		}
+
+		rec := &DnsRecord{Name: owner, Class: CLASS_IN}
+		var haveTTL bool
+		for len(tokens) > 0 {
+			field := tokens[0].text
+			if class, ok := parseClass(field); ok {
+				rec.Class = class
+			} else if ttl, err := parseTTL(field); err == nil && field[0] >= '0' && field[0] <= '9' {
+				rec.TTL, haveTTL = ttl, true
+			} else {
+				break
+			}
+			tokens = tokens[1:]
+		}
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("line %d: missing record type", entry.line)
+		}
+		qtype, err := QueryTypeFromString(tokens[0].text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", entry.line, err)
+		}
+		rec.Qtype = qtype
+
+		if err := parseRdata(rec, tokens[1:], origin); err != nil {
+			return nil, fmt.Errorf("line %d: %s %v", entry.line, qtype, err)
+		}
+
+		switch {
+		case haveTTL:
+			lastTTL, haveLastTTL = rec.TTL, true
+		case haveDefaultTTL:
+			rec.TTL = defaultTTL
+		case haveLastTTL:
+			rec.TTL = lastTTL
+		case qtype == QTYPE_SOA:
+			rec.TTL = rec.Data.(*SOA).Minimum
+			lastTTL, haveLastTTL = rec.TTL, true
+		default:
+			return nil, fmt.Errorf("line %d: no TTL specified and no $TTL default", entry.line)
+		}
+
+		zone.Records = append(zone.Records, rec)
+	}
+
+	return zone, nil
+}
+
+// tokenizeZone splits a master file into entries, handling comments, quotes, escapes and parentheses
+func tokenizeZone(r io.Reader) ([]zoneEntry, error) {
+	var entries []zoneEntry
+	var current zoneEntry
+	var parens int
+	line := 0
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if parens == 0 {
+			current = zoneEntry{line: line, blank: len(text) > 0 && (text[0] == ' ' || text[0] == '\t')}
+		}
+
+		for i := 0; i < len(text); {
+			c := text[i]
+			switch {
+			case c == ';':
+				i = len(text)
+			case c == ' ' || c == '\t' || c == '\r':
+				i++
+			case c == '(':
+				parens++
+				i++
+			case c == ')':
+				if parens == 0 {
+					return nil, fmt.Errorf("line %d: unbalanced parenthesis", line)
+				}
+				parens--
+				i++
+			case c == '"':
+				var sb strings.Builder
+				i++
+				closed := false
+				for i < len(text) {
+					if text[i] == '"' {
+						closed = true
+						i++
+						break
+					}
+					n, err := decodeZoneEscape(text, i, &sb)
+					if err != nil {
+						return nil, fmt.Errorf("line %d: %v", line, err)
+					}
+					i += n
+				}
+				if !closed {
+					return nil, fmt.Errorf("line %d: unterminated quoted string", line)
+				}
+				current.tokens = append(current.tokens, zoneToken{text: sb.String(), quoted: true})
+			default:
+				var sb strings.Builder
+				start := i
+				for i < len(text) && !strings.ContainsRune(" \t\r;()\"", rune(text[i])) {
+					n, err := decodeZoneEscape(text, i, &sb)
+					if err != nil {
+						return nil, fmt.Errorf("line %d: %v", line, err)
+					}
+					i += n
+				}
+				current.tokens = append(current.tokens, zoneToken{text: sb.String(), raw: text[start:i]})
+			}
+		}
+
+		if parens == 0 && len(current.tokens) > 0 {
+			entries = append(entries, current)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if parens != 0 {
+		return nil, fmt.Errorf("line %d: unbalanced parenthesis at end of file", current.line)
+	}
+	return entries, nil
+}
+
+// decodeZoneEscape decodes one character (\X, \DDD or a literal byte) and returns how many bytes it consumed
+func decodeZoneEscape(text string, i int, sb *strings.Builder) (int, error) {
+	if text[i] != '\\' {
+		sb.WriteByte(text[i])
+		return 1, nil
+	}
+	if i+1 >= len(text) {
+		return 0, fmt.Errorf("dangling escape")
+	}
+	if i+3 < len(text) && isDigits(text[i+1:i+4]) {
+		n, _ := strconv.Atoi(text[i+1 : i+4])
+		if n > 255 {
+			return 0, fmt.Errorf("invalid escape \\%s", text[i+1:i+4])
+		}
+		sb.WriteByte(byte(n))
+		return 4, nil
+	}
+	sb.WriteByte(text[i+1])
+	return 2, nil
+}
+
+// isDigits reports whether s consists only of decimal digits
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+// absName resolves a master file name relative to the origin, returning it without a trailing dot
+func absName(name, origin string) string {
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return strings.TrimSuffix(name, ".")
+	case origin == "":
+		return name
+	default:
+		return name + "." + origin
+	}
+}
+
+// parseClass converts the class of a record in a zone file into its value; NONE and ANY only
+// appear in questions and dynamic updates
+func parseClass(s string) (Class, bool) {
+	class, err := ClassFromString(s)
+	if err != nil || class == CLASS_NONE || class == CLASS_ANY {
+		return 0, false
+	}
+	return class, true
+}
+
+// parseTTL parses a TTL in seconds or with BIND-style unit suffixes (1h30m, 2d, 1w)
+func parseTTL(s string) (uint32, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return capTTL(n), nil
+	}
+	var total, current uint64
+	var digits bool
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= '0' && c <= '9' {
+			current = current*10 + uint64(c-'0')
+			digits = true
+			continue
+		}
+		if !digits {
+			return 0, fmt.Errorf("invalid TTL %q", s)
+		}
+		switch c {
+		case 's', 'S':
+			total += current
+		case 'm', 'M':
+			total += current * 60
+		case 'h', 'H':
+			total += current * 3600
+		case 'd', 'D':
+			total += current * 86400
+		case 'w', 'W':
+			total += current * 604800
+		default:
+			return 0, fmt.Errorf("invalid TTL %q", s)
+		}
+		current, digits = 0, false
+	}
+	if digits || total > 0xFFFFFFFF || len(s) == 0 {
+		return 0, fmt.Errorf("invalid TTL %q", s)
+	}
+	return capTTL(total), nil
+}
+
+// parseRdata fills in the type-specific fields of a record from its master file fields
+func parseRdata(rec *DnsRecord, tokens []zoneToken, origin string) error {
+	fields := make([]string, len(tokens))
+	names := make([]string, len(tokens))
+	for i, token := range tokens {
+		fields[i] = token.text
+		names[i] = absName(token.raw, origin)
+	}
+	want := func(n int) error {
+		if len(fields) != n {
+			return fmt.Errorf("expects %d fields, got %d", n, len(fields))
+		}
+		return nil
+	}
+	u16 := func(s string) (uint16, error) {
+		n, err := strconv.ParseUint(s, 10, 16)
+		return uint16(n), err
+	}
+
+	if len(fields) > 0 && tokens[0].raw == `\#` {
+		return parseGenericRdata(rec, fields[1:])
+	}
+
+	var err error
+	switch rec.Qtype {
+	case QTYPE_A:
+		if err = want(1); err != nil {
+			return err
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid IPv4 address %q", fields[0])
+		}
+		rec.Data = &A{Addr: ip.To4()}
+
+	case QTYPE_AAAA:
+		if err = want(1); err != nil {
+			return err
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid IPv6 address %q", fields[0])
+		}
+		rec.Data = &AAAA{Addr: ip}
+
+	case QTYPE_NS:
+		if err = want(1); err != nil {
+			return err
+		}
+		rec.Data = &NS{Host: names[0]}
+
+	case QTYPE_CNAME:
+		if err = want(1); err != nil {
+			return err
+		}
+		rec.Data = &CNAME{Target: names[0]}
+
+	case QTYPE_PTR:
+		if err = want(1); err != nil {
+			return err
+		}
+		rec.Data = &PTR{Host: names[0]}
+
+	case QTYPE_MX:
+		if err = want(2); err != nil {
+			return err
+		}
+		mx := &MX{Host: names[1]}
+		if mx.Preference, err = u16(fields[0]); err != nil {
+			return fmt.Errorf("invalid preference %q", fields[0])
+		}
+		rec.Data = mx
+
+	case QTYPE_SOA:
+		if err = want(7); err != nil {
+			return err
+		}
+		soa := &SOA{MName: names[0], RName: names[1]}
+		serial, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid serial %q", fields[2])
+		}
+		soa.Serial = uint32(serial)
+		timers := []*uint32{&soa.Refresh, &soa.Retry, &soa.Expire, &soa.Minimum}
+		for i, field := range timers {
+			if *field, err = parseTTL(fields[3+i]); err != nil {
+				return err
+			}
+		}
+		rec.Data = soa
+
+	case QTYPE_RP:
+		if err = want(2); err != nil {
+			return err
+		}
+		rec.Data = &RP{Mbox: names[0], Txt: names[1]}
+
+	case QTYPE_TXT:
+		if len(fields) == 0 {
+			return fmt.Errorf("expects at least one string")
+		}
+		for _, text := range fields {
+			if len(text) > 255 {
+				return fmt.Errorf("string longer than 255 bytes")
+			}
+		}
+		rec.Data = &TXT{Txt: fields}
+
+	case QTYPE_SRV:
+		if err = want(4); err != nil {
+			return err
+		}
+		srv := &SRV{Target: names[3]}
+		for i, field := range []*uint16{&srv.Priority, &srv.Weight, &srv.Port} {
+			if *field, err = u16(fields[i]); err != nil {
+				return fmt.Errorf("invalid number %q", fields[i])
+			}
+		}
+		rec.Data = srv
+
+	case QTYPE_SVCB, QTYPE_HTTPS:
+		if len(fields) < 2 {
+			return fmt.Errorf("expects priority and target")
+		}
+		svcb := &SVCB{Target: names[1]}
+		if svcb.Priority, err = u16(fields[0]); err != nil {
+			return fmt.Errorf("invalid priority %q", fields[0])
+		}
+		for _, field := range fields[2:] {
+			param, err := ParseSVCBParam(field)
+			if err != nil {
+				return err
+			}
+			svcb.Params = append(svcb.Params, param)
+		}
+		if rec.Qtype == QTYPE_HTTPS {
+			rec.Data = &HTTPS{*svcb}
+		} else {
+			rec.Data = svcb
+		}
+
+	default:
+		if standard, ok := standardTypes[rec.Qtype]; ok {
+			rec.Data, err = standard.parse(fields, names)
+			return err
+		}
+		if codec := customCodec(rec.Qtype); codec != nil && codec.Parse != nil {
+			data, err := codec.Parse(fields)
+			if err != nil {
+				return err
+			}
+			rec.Data = &Registered{Qtype: rec.Qtype, Data: data}
+			return nil
+		}
+		return fmt.Errorf("unsupported in presentation format, use \\# generic encoding")
+	}
+	return nil
+}
+
+// parseGenericRdata decodes the RFC 3597 "\# length hex" form into the record
+func parseGenericRdata(rec *DnsRecord, fields []string) error {
+	if len(fields) == 0 {
+		return fmt.Errorf("generic encoding missing length")
+	}
+	length, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return fmt.Errorf("invalid generic length %q", fields[0])
+	}
+	data, err := hex.DecodeString(strings.Join(fields[1:], ""))
+	if err != nil {
+		return fmt.Errorf("invalid generic data: %v", err)
+	}
+	if len(data) != length {
+		return fmt.Errorf("generic data is %d bytes, expected %d", len(data), length)
+	}
+
+	// Known types are decoded into their structs via the wire parser
+	decoded, err := decodeRdata(rec.Qtype, data)
+	if err != nil {
+		return fmt.Errorf("invalid generic data: %v", err)
+	}
+	rec.Data = decoded
+	return nil
+}
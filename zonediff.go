@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// RRsetChange describes how one RRset differs between two versions of a zone
+type RRsetChange struct {
+	Change string   `json:"change"` // "added", "removed" or "changed"
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	OldTTL uint32   `json:"old_ttl,omitempty"`
+	NewTTL uint32   `json:"new_ttl,omitempty"`
+	Old    []string `json:"old,omitempty"` // Record data before the change
+	New    []string `json:"new,omitempty"` // Record data after the change
+}
+
+// DiffZones compares two sets of zone records RRset by RRset
+func DiffZones(oldRecords, newRecords []*DnsRecord) []RRsetChange {
+	oldSets, newSets := groupRRsets(oldRecords), groupRRsets(newRecords)
+	var changes []RRsetChange
+	for _, key := range sortedRRsetKeys(oldSets, newSets) {
+		a, b := oldSets[key], newSets[key]
+		change := RRsetChange{Name: key.Name + ".", Type: key.Qtype.String()}
+		switch {
+		case a == nil:
+			change.Change = "added"
+			change.NewTTL, change.New = b.TTL, b.Rdata
+		case b == nil:
+			change.Change = "removed"
+			change.OldTTL, change.Old = a.TTL, a.Rdata
+		case a.TTL != b.TTL || !equalStrings(a.Rdata, b.Rdata):
+			change.Change = "changed"
+			change.OldTTL, change.Old = a.TTL, a.Rdata
+			change.NewTTL, change.New = b.TTL, b.Rdata
+		default:
+			continue
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// equalStrings reports whether two string slices hold the same elements in the same order
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// runZoneDiff implements the "zonediff" subcommand
+func runZoneDiff(args []string) int {
+	fs := flag.NewFlagSet("zonediff", flag.ExitOnError)
+	origin := fs.String("origin", "", "zone origin, when the files have no $ORIGIN directive")
+	axfr := fs.String("axfr", "", "compare the zone file against a live AXFR from this server")
+	output := fs.String("output", "text", "output format: text or json")
+	color := fs.String("color", "auto", "color text output: auto (terminals only, unless NO_COLOR is set), always or never")
+	timeout := fs.Duration("timeout", 10*time.Second, "time to wait for transfer responses")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gdns zonediff [-origin zone] old.db new.db\n")
+		fmt.Fprintf(fs.Output(), "       gdns zonediff [-origin zone] -axfr server zone.db\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if (*axfr == "" && fs.NArg() != 2) || (*axfr != "" && fs.NArg() != 1) {
+		fs.Usage()
+		return 2
+	}
+
+	oldZone, err := LoadZoneFile(fs.Arg(0), *origin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(0), err)
+		return 2
+	}
+
+	var newRecords []*DnsRecord
+	if *axfr != "" {
+		client := NewClient()
+		client.Timeout = *timeout
+		newRecords, err = client.Transfer(oldZone.Origin, *axfr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	} else {
+		newZone, err := LoadZoneFile(fs.Arg(1), *origin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(1), err)
+			return 2
+		}
+		newRecords = newZone.Records
+	}
+
+	palette, err := NewPalette(*color, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	changes := DiffZones(oldZone.Records, newRecords)
+	switch *output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if changes == nil {
+			changes = []RRsetChange{}
+		}
+		enc.Encode(changes)
+	case "text":
+		for _, change := range changes {
+			fmt.Printf("%s %s %s\n", change.Change, palette.Name(change.Name), palette.paint(ansiCyan, change.Type))
+			for _, rdata := range change.Old {
+				fmt.Println(palette.Removed(fmt.Sprintf("- %s\t%d\t%s\t%s", change.Name, change.OldTTL, change.Type, rdata)))
+			}
+			for _, rdata := range change.New {
+				fmt.Println(palette.Added(fmt.Sprintf("+ %s\t%d\t%s\t%s", change.Name, change.NewTTL, change.Type, rdata)))
+			}
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *output)
+		return 2
+	}
+
+	if len(changes) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WriteZone writes records as an RFC 1035 master file for origin, the inverse of ParseZone. The
+// SOA comes first and the other records follow in canonical order (RFC 4034 section 6): by owner
+// name, then type, then data. Owners are written relative to the origin, and left blank when they
+// repeat the previous record's; names in record data are absolute.
+func WriteZone(w io.Writer, origin string, records []*DnsRecord) error {
+	apex := parseNameLoose(origin)
+	sorted, err := sortZone(apex, records)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "$ORIGIN %s\n", apex.FQDN())
+	previous := ""
+	for _, rec := range sorted {
+		owner := relativeName(parseNameLoose(rec.Name), apex)
+		if owner == previous {
+			owner = ""
+		} else {
+			previous = owner
+		}
+		fmt.Fprintf(bw, "%s\t%d\t%s\t%s\t%s\n", owner, rec.TTL, className(rec.Class), rec.Qtype, rec.RdataString())
+	}
+	return bw.Flush()
+}
+
+// sortZone returns the records with the SOA at the apex first and the others in canonical order
+func sortZone(apex Name, records []*DnsRecord) ([]*DnsRecord, error) {
+	type entry struct {
+		rec   *DnsRecord
+		name  Name
+		rdata []byte
+	}
+	entries := make([]entry, len(records))
+	for i, rec := range records {
+		rdata, err := CanonicalRdata(rec)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %v", rec.Name, rec.Qtype, err)
+		}
+		entries[i] = entry{rec, parseNameLoose(rec.Name), rdata}
+	}
+	isSOA := func(e entry) bool { return e.rec.Qtype == QTYPE_SOA && e.name.Equal(apex) }
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if isSOA(a) != isSOA(b) {
+			return isSOA(a)
+		}
+		if c := a.name.Compare(b.name); c != 0 {
+			return c < 0
+		}
+		if a.rec.Qtype != b.rec.Qtype {
+			return a.rec.Qtype < b.rec.Qtype
+		}
+		return bytes.Compare(a.rdata, b.rdata) < 0
+	})
+	sorted := make([]*DnsRecord, len(entries))
+	for i, e := range entries {
+		sorted[i] = e.rec
+	}
+	return sorted, nil
+}
+
+// relativeName writes name relative to origin: @ for the origin itself, the labels before it for
+// names below it, and the absolute name otherwise
+func relativeName(name, origin Name) string {
+	if name.Equal(origin) {
+		return "@"
+	}
+	if !name.IsSubdomainOf(origin) {
+		return name.FQDN()
+	}
+	labels := name.Labels()[:name.CountLabels()-origin.CountLabels()]
+	for i, label := range labels {
+		labels[i] = escapeLabel(label)
+	}
+	return strings.Join(labels, ".")
+}
+
+// className returns the mnemonic of a class, or CLASSn for classes without one (RFC 3597)
+func className(class Class) string {
+	if class == 0 {
+		return "IN"
+	}
+	return class.String()
+}
+
+// WriteTo writes the zone as a master file, as WriteZone does
+func (z *AuthZone) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	err := WriteZone(cw, z.Origin.String(), z.Records())
+	return cw.n, err
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// runTransfer implements the "transfer" subcommand, which fetches a zone with AXFR and writes it
+// as a master file
+func runTransfer(args []string) int {
+	fs := flag.NewFlagSet("transfer", flag.ExitOnError)
+	output := fs.String("o", "", "write the zone to this file instead of standard output")
+	timeout := fs.Duration("timeout", 10*time.Second, "time to wait for transfer responses")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gdns transfer [-o zone.db] zone server\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	client := NewClient()
+	client.Timeout = *timeout
+	records, err := client.Transfer(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := WriteZone(w, fs.Arg(0), records); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}